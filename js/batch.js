@@ -0,0 +1,36 @@
+document.addEventListener("DOMContentLoaded", function(){
+  const ws = new WS()
+
+  ws.onOpen (() => {
+    console.log("socket connected", ws.url)
+  })
+
+  if (!_complete) {
+    ws.subscribe({"batches": [_uuid]})
+  }
+
+  ws.onMessage ((msg) => {
+    switch (msg.type) {
+      case "batch":
+        if (msg.data.complete) {
+          // Reload to show the contact sheet and final statuses
+          window.location.reload()
+          break
+        }
+        updateProgress(msg.data)
+        break
+
+      case "ack":
+        break
+
+      default:
+        console.log("no handler for ws message", msg.type)
+    }
+  })
+})
+
+function updateProgress(p) {
+  const element = document.getElementById("batch-progress")
+  element.textContent = p.done + " done, " + p.running + " running, " +
+    p.pending + " pending, " + p.error + " failed, " + p.cancelled + " cancelled"
+}
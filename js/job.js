@@ -1,45 +1,74 @@
 document.addEventListener("DOMContentLoaded", function(){
   const ws = new WS()
 
+  updateQueue(_queue)
+
   ws.onOpen (() => {
     console.log("socket connected", ws.url)
-    if (!_jobArchived) {
-      ws.subscribe(_uuid)
-    }
   })
 
-  ws.onMessage ((event) => {
-    const wsJSON = JSON.parse(event.data)
-    const cmd = Object.keys(wsJSON)[0]
-    const arg = wsJSON[cmd]
+  // The server replies with the job's current state, so a job that started
+  // or finished since the page was rendered is still picked up
+  if (!_jobArchived) {
+    ws.subscribe({"jobs": [_uuid]})
+  }
 
-    switch (cmd) {
+  ws.onMessage ((msg) => {
+    switch (msg.type) {
       case "job":
 
-        switch (arg) {
+        switch (msg.data.status) {
           case "running":
-            updateStatus("creating image")
+            updateQueue(null)
             startTimer()
             break
 
+          case "pending":
+            break
+
           case "done":
+            updateQueue(null)
             stopTimer()
             showImage()
             updateStatus("done")
             break
 
+          case "cancelled":
+            updateQueue(null)
+            stopTimer()
+            updateStatus("cancelled")
+            break
+
+          case "error":
+            updateQueue(null)
+            stopTimer()
+            updateStatus("error")
+            break
+
           default:
-            throw new Error("invalid job command")
+            throw new Error("invalid job status")
         }
 
         break
 
-      case "subscribed":
+      case "ack":
         updateStatus("subscribed to updates")
         break
 
+      case "error":
+        updateStatus("failed to subscribe to updates")
+        break
+
+      case "queue":
+        updateQueue(msg.data)
+        break
+
+      case "progress":
+        progress = msg.data.percent + "%"
+        break
+
       default:
-        console.log("no command found for ws message", cmd)
+        console.log("no handler for ws message", msg.type)
     }
   })
 })
@@ -50,6 +79,28 @@ function showImage() {
   document.body.appendChild(img)
 }
 
+function updateQueue(queue) {
+  const element = document.getElementById("job-queue")
+  if (!element) {
+    return
+  }
+  if (!queue) {
+    element.textContent = ""
+  } else if (queue.position == 0) {
+    element.textContent = "about " + formatSecs(queue.finishIn) + " left"
+  } else {
+    element.textContent = "#" + queue.position + " in queue, starts in about " +
+      formatSecs(queue.startIn) + ", done in about " + formatSecs(queue.finishIn)
+  }
+}
+
+function formatSecs(secs) {
+  if (secs < 60) {
+    return secs + "s"
+  }
+  return Math.round(secs / 60) + "m"
+}
+
 function updateStatus(status) {
   const element = document.getElementById("job-status")
   element.innerHTML = status
@@ -57,16 +108,22 @@ function updateStatus(status) {
 
 let intervalID = 0
 
+let progress = ""
+
 function startTimer() {
+  if (intervalID) {
+    return
+  }
   console.log("start timer")
   const element = document.getElementById("job-status")
   let timer = 1
   intervalID = setInterval(() => {
-    element.textContent = "job is running (" + timer + "s)"
+    element.textContent = "job is running (" + timer + "s) " + progress
     timer++
   }, 1000)
 }
 
 function stopTimer() {
   clearInterval(intervalID)
+  intervalID = 0
 }
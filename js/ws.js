@@ -1,25 +1,89 @@
+const WS_PROTOCOL_VERSION = 1
+const WS_RECONNECT_MS = 2000
+
+// WS reconnects when the connection drops and subscribes again, asking for
+// the job events it missed in the meantime.
 class WS {
   constructor() {
     let url = document.location.origin+"/ws"
     url = url.replace("http", "ws")
-    console.log("ws connecting", url)
     this.url = url
-    this.socket = new WebSocket(url);
+    this.nextID = 1
+    this.subscriptions = {"jobs": [], "batches": [], "channels": []}
+    this.lastEventIDs = {}
+    this.openFn = () => {}
+    this.messageFn = () => {}
+    this.connect()
   }
 
-  subscribe(uuid) {
-    this.socket.send(JSON.stringify({
-      "subscribe": uuid,
-    }))
+  connect() {
+    console.log("ws connecting", this.url)
+    this.socket = new WebSocket(this.url)
+
+    this.socket.onopen = (event) => {
+      const topics = this.subscriptions
+      if (topics.jobs.length || topics.batches.length || topics.channels.length) {
+        this.send("subscribe", Object.assign({"since": this.lastEventIDs}, topics))
+      }
+      this.openFn(event)
+    }
+
+    this.socket.onmessage = (event) => {
+      const msg = JSON.parse(event.data)
+      if (msg.type == "error") {
+        console.log("ws error", msg.id, msg.error.code, msg.error.message)
+      }
+
+      // Messages that raced with a snapshot may be older than it
+      if (msg.job && msg.eventID) {
+        if (msg.eventID <= (this.lastEventIDs[msg.job] || 0)) {
+          return
+        }
+        this.lastEventIDs[msg.job] = msg.eventID
+      }
+
+      this.messageFn(msg)
+    }
+
+    this.socket.onclose = () => {
+      setTimeout(() => this.connect(), WS_RECONNECT_MS)
+    }
   }
 
-  onOpen(fn) {
-    this.socket.onopen = function(event) {
-      fn(event)
+  send(type, topics) {
+    const id = String(this.nextID++)
+    this.socket.send(JSON.stringify(Object.assign({
+      "v": WS_PROTOCOL_VERSION,
+      "id": id,
+      "type": type,
+    }, topics)))
+    return id
+  }
+
+  // Subscriptions made before the socket opens are sent once it does
+  subscribe(topics) {
+    for (const key in this.subscriptions) {
+      this.subscriptions[key] = this.subscriptions[key].concat(topics[key] || [])
+    }
+    if (this.socket.readyState == WebSocket.OPEN) {
+      this.send("subscribe", topics)
+    }
+  }
+
+  unsubscribe(topics) {
+    for (const key in this.subscriptions) {
+      this.subscriptions[key] = this.subscriptions[key].filter((t) => !(topics[key] || []).includes(t))
+    }
+    if (this.socket.readyState == WebSocket.OPEN) {
+      this.send("unsubscribe", topics)
     }
   }
 
+  onOpen(fn) {
+    this.openFn = fn
+  }
+
   onMessage(fn) {
-    this.socket.onmessage = (event) => fn(event)
+    this.messageFn = fn
   }
 }
@@ -1,29 +1,42 @@
 package api
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"image"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/juju/errors"
 	"github.com/wellsjo/ai-art/server/db"
+	"github.com/wellsjo/ai-art/server/events"
+	"github.com/wellsjo/ai-art/server/initimage"
 	"github.com/wellsjo/ai-art/server/job"
 	"github.com/wellsjo/ai-art/server/job_manager"
+	"github.com/wellsjo/ai-art/server/logging"
+	"github.com/wellsjo/ai-art/server/metrics"
+	"github.com/wellsjo/ai-art/server/quota"
+	"github.com/wellsjo/ai-art/server/webhook"
 	"github.com/wellsjo/ai-art/server/ws"
 )
 
 type API struct {
 	opts       Opts
-	db         *db.DB
+	db         db.Store
 	jobManager *job_manager.JobManager
 	wsManager  *ws.WSManager
+	webhooks   *webhook.Dispatcher
+	events     *events.Broker
 	router     *gin.Engine
-	timeout    time.Duration
 }
 
 type Opts struct {
@@ -31,20 +44,51 @@ type Opts struct {
 	MockJobs   bool
 	UseS3      bool
 	Port       int
+	UserLimits quota.Limits
+	IPLimits   quota.Limits
+	// Upscaler is used by upscale jobs that don't choose one.
+	Upscaler string
+	// TrustedProxies are the addresses or networks whose X-Forwarded-For
+	// headers are believed when working out client IPs for quotas and logs.
+	// Without any, the client IP is the address the request came from.
+	TrustedProxies []string
+	// SecureCookies marks session cookies as https only. They always are
+	// when the request came over TLS, but not behind a proxy that ends it.
+	SecureCookies bool
+}
+
+// ParseTrustedProxies checks that every proxy is an IP address or network.
+func ParseTrustedProxies(proxies []string) error {
+	for _, p := range proxies {
+		if _, err := netip.ParsePrefix(p); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddr(p); err != nil {
+			return errors.NotValidf("trusted proxy %q", p)
+		}
+	}
+	return nil
 }
 
 const DefaultPort = 8080
 const DefaultMaxMemory = 32 << 20
 
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
 func New(
 	opts Opts,
 	jobManager *job_manager.JobManager,
 	wsManager *ws.WSManager,
-	db *db.DB,
+	webhooks *webhook.Dispatcher,
+	broker *events.Broker,
+	db db.Store,
 ) *API {
-	r := gin.Default()
+	r := gin.New()
+	r.Use(logRequests, gin.Recovery())
 	r.LoadHTMLGlob("templates/*")
 	r.MaxMultipartMemory = DefaultMaxMemory // 32 MB
+	// Checked by ParseTrustedProxies
+	r.SetTrustedProxies(opts.TrustedProxies)
 
 	if opts.Port == 0 {
 		opts.Port = DefaultPort
@@ -52,13 +96,17 @@ func New(
 	if opts.UploadPath == "" {
 		opts.UploadPath = "/home/wells/src/ai-art/stable-diffusion-docker/input"
 	}
+	if opts.Upscaler == "" {
+		opts.Upscaler = job.DEFAULT_UPSCALER
+	}
 
 	a := &API{
 		router:     r,
 		jobManager: jobManager,
 		wsManager:  wsManager,
+		webhooks:   webhooks,
+		events:     broker,
 		db:         db,
-		timeout:    2 * time.Second,
 		opts:       opts,
 	}
 	a.setRoutes()
@@ -67,15 +115,34 @@ func New(
 }
 
 func (a *API) setRoutes() {
-
-	a.router.GET("/ws", func(c *gin.Context) {
-		if err := a.wsManager.AddConnection(c); err != nil {
-			log.Println(errors.ErrorStack(err))
+	a.router.Use(metrics.Middleware)
+	a.router.GET("/metrics", gin.WrapH(metrics.Handler()))
+	a.setHealthRoutes()
+
+	a.router.Use(a.authenticate)
+
+	a.setAuthRoutes()
+	a.setBatchRoutes()
+	a.setWebhookRoutes()
+	a.setModelRoutes()
+	a.setAssetRoutes()
+	a.setUpscaleRoutes()
+	a.setEventRoutes()
+
+	a.router.GET("/ws", requireUser, func(c *gin.Context) {
+		u, _ := currentUser(c)
+		if err := a.wsManager.AddConnection(c, a.wsHooks(u)); err != nil {
 			errorResponse(err, 500, c)
 		}
 	})
 
-	a.router.GET("/", func(c *gin.Context) {
+	a.router.GET("/", requireUser, func(c *gin.Context) {
+		u, _ := currentUser(c)
+		models, err := a.db.GetModels(c.Request.Context())
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
 		c.HTML(
 			// Set the HTTP status to 200 (OK)
 			http.StatusOK,
@@ -83,12 +150,16 @@ func (a *API) setRoutes() {
 			"index.html",
 			// Pass the data that the page uses (in this case, 'title')
 			gin.H{
-				"title": "AI ART - HOME",
+				"title":  "AI ART - HOME",
+				"user":   u,
+				"models": models,
 			},
 		)
 	})
 
-	a.router.POST("/job", func(c *gin.Context) {
+	a.router.POST("/job", requireUser, func(c *gin.Context) {
+		u, _ := currentUser(c)
+
 		err := c.Request.ParseMultipartForm(DefaultMaxMemory)
 		if err != nil {
 			errorResponse(err, 500, c)
@@ -97,9 +168,12 @@ func (a *API) setRoutes() {
 
 		var (
 			prompt, widthStr, heightStr, numIterStr string
+			stepsStr, scaleStr, seedStr             string
+			callbackURLStr, modelName               string
+			assets                                  []job.AssetRef
 		)
 
-		log.Println("POST FORM", c.Request.PostForm)
+		requestLogger(c).Debug("Create job", "form", c.Request.PostForm)
 		for key, value := range c.Request.PostForm {
 			if key == "prompt" && len(value) > 0 {
 				prompt = value[0]
@@ -113,6 +187,31 @@ func (a *API) setRoutes() {
 			if key == "num-iter" {
 				numIterStr = value[0]
 			}
+			if key == "steps" {
+				stepsStr = value[0]
+			}
+			if key == "scale" {
+				scaleStr = value[0]
+			}
+			if key == "seed" {
+				seedStr = value[0]
+			}
+			if key == "callback-url" {
+				callbackURLStr = value[0]
+			}
+			if key == "model" {
+				modelName = value[0]
+			}
+			if key == "asset" {
+				for _, v := range value {
+					ref, err := parseAssetRef(v)
+					if err != nil {
+						errorResponse(err, 400, c)
+						return
+					}
+					assets = append(assets, ref)
+				}
+			}
 		}
 
 		var numIter int64 = 0
@@ -145,53 +244,151 @@ func (a *API) setRoutes() {
 			}
 		}
 
-		j, err := job.New(job.Settings{
+		var steps int64 = 0
+		if stepsStr != "" {
+			var err error
+			steps, err = strconv.ParseInt(stepsStr, 10, 0)
+			if err != nil {
+				errorResponse(err, 400, c)
+				return
+			}
+		}
+
+		var scale float64 = 0
+		if scaleStr != "" {
+			var err error
+			scale, err = strconv.ParseFloat(scaleStr, 64)
+			if err != nil {
+				errorResponse(err, 400, c)
+				return
+			}
+		}
+
+		var seed int64 = 0
+		if seedStr != "" {
+			var err error
+			seed, err = strconv.ParseInt(seedStr, 10, 64)
+			if err != nil {
+				errorResponse(err, 400, c)
+				return
+			}
+		}
+
+		// Jobs given a parent refine its image once it is done, at its size
+		var parent job.Job
+		if parentStr := c.Request.PostForm.Get("parent"); parentStr != "" {
+			if _, err := c.FormFile("image"); err == nil {
+				errorResponse(errors.NotValidf("both image and parent"), 400, c)
+				return
+			}
+			parentUUID, err := uuid.Parse(parentStr)
+			if err != nil {
+				errorResponse(ErrJobNotFound, 404, c)
+				return
+			}
+			var ok bool
+			if parent, _, ok = a.getAuthorizedJobByUUID(c, parentUUID); !ok {
+				return
+			}
+			if width == 0 && height == 0 {
+				width, height = int64(parent.Settings.Width), int64(parent.Settings.Height)
+			} else if int(width) != parent.Settings.Width || int(height) != parent.Settings.Height {
+				err := errors.NotValidf("size %dx%d of a %dx%d parent", width, height, parent.Settings.Width, parent.Settings.Height)
+				errorResponse(err, 400, c)
+				return
+			}
+		}
+
+		fit, err := initimage.ParseFit(c.Request.PostForm.Get("fit"))
+		if err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+		initImage, hasImage, err := imageUpload(c)
+		if errors.IsNotValid(err) {
+			errorResponse(err, 400, c)
+			return
+		} else if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+
+		m, err := a.jobManager.Model(c.Request.Context(), modelName)
+		if errors.IsNotValid(err) {
+			errorResponse(err, 400, c)
+			return
+		} else if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+
+		j, err := job.New(m.ApplyDefaults(job.Settings{
 			Prompt:        prompt,
 			Width:         int(width),
 			Height:        int(height),
 			NumIterations: int(numIter),
-		})
+			Steps:         int(steps),
+			Scale:         scale,
+			Seed:          seed,
+			Assets:        assets,
+		}))
 		// TODO capture other types of errors
-		if err != nil {
+		if errors.IsNotValid(err) {
+			errorResponse(err, 400, c)
+			return
+		} else if err != nil {
 			errorResponse(err, 500, c)
 			return
 		}
+		j.OwnerID = u.ID
+		j.ClientIP = c.ClientIP()
+		j.CallbackURL, err = a.callbackURL(c, callbackURLStr)
+		if err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+
+		if !a.checkQuota(c, u, []job.Job{j}) {
+			return
+		}
 
 		jobMode := job.TextToImageMode
-		imageFile, err := c.FormFile("image")
-		if err == nil {
-			uploadPath := filepath.Join(a.opts.UploadPath, j.UUID.String())
-			if err = c.SaveUploadedFile(imageFile, uploadPath); err != nil {
+		uploadPath := filepath.Join(a.opts.UploadPath, j.UUID.String())
+		if hasImage {
+			// Runners expect the image at the job's size
+			img := initimage.Resize(initImage, j.Settings.Width, j.Settings.Height, fit)
+			if err := initimage.Save(uploadPath, img); err != nil {
 				errorResponse(err, 500, c)
 				return
 			}
 			jobMode = job.ImageToImageMode
 		}
+		if parent.UUID != uuid.Nil {
+			j.ParentUUID = parent.UUID
+			jobMode = job.ImageToImageMode
+		}
 
 		j.Settings.Mode = jobMode
 
-		// Adds job to queue
-		if err := a.db.AddJob(j); err != nil {
-			errorResponse(err, 500, c)
+		// The image has to be saved before the job is queued, in case it runs
+		// right away
+		if err := a.jobManager.AddJob(c.Request.Context(), j); err != nil {
+			if hasImage {
+				os.Remove(uploadPath)
+			}
+			addJobsErrorResponse(err, c)
 			return
 		}
+		requestLogger(c).Info("Added job", logging.KeyJob, j.UUID)
 
 		url := fmt.Sprintf("/job/%v", j.UUID)
 
 		c.Redirect(http.StatusFound, url)
 	})
 
-	a.router.GET("/job/:uuid", func(c *gin.Context) {
-		uuid_ := c.Param("uuid")
-		parsedUUID, err := uuid.Parse(uuid_)
-
-		j, found, _, err := a.jobManager.GetJobStatus(parsedUUID, a.timeout)
-		if !found {
-			errorResponse(ErrJobNotFound, 404, c)
-			return
-		}
-		if err != nil {
-			errorResponse(err, 500, c)
+	a.router.GET("/job/:uuid", requireUser, func(c *gin.Context) {
+		j, _, ok := a.getAuthorizedJob(c)
+		if !ok {
 			return
 		}
 
@@ -203,24 +400,37 @@ func (a *API) setRoutes() {
 			// finalJobDur = (*j.EndTime).Sub(*j.StartTime)
 		}
 
-		ar := ""
-		if j.ArchiveReason != nil {
-			ar = string(*j.ArchiveReason)
+		imgURL := a.jobImageURL(j.UUID)
+
+		var queue map[string]interface{}
+		if !j.Archived {
+			estimates, err := a.jobManager.GetQueueEstimates(c.Request.Context())
+			if err != nil {
+				errorResponse(err, 500, c)
+				return
+			}
+			if est, ok := estimates[j.UUID]; ok {
+				queue = job_manager.QueueMessage(est)
+			}
 		}
 
-		log.Println("Get", j)
-		log.Println("ArchiveReason", ar)
+		batchURL := ""
+		if j.BatchUUID != uuid.Nil {
+			batchURL = fmt.Sprintf("/batch/%v", j.BatchUUID)
+		}
+		parentURL := ""
+		if j.ParentUUID != uuid.Nil {
+			parentURL = fmt.Sprintf("/job/%v", j.ParentUUID)
+		}
 
-		imgURL := ""
-		if a.opts.MockJobs {
-			imgURL = fmt.Sprintf("/image/w/mock.png")
-		} else if a.opts.UseS3 {
-			// TODO put in config
-			imgURL = fmt.Sprintf("https://ai-art-1.s3.amazonaws.com/%v.png", j.UUID)
-		} else {
-			imgURL = fmt.Sprintf("/image/sd/%v.png", j.UUID)
+		children, err := a.childJobsView(c, j.UUID)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
 		}
 
+		u, _ := currentUser(c)
+
 		c.HTML(
 			http.StatusOK,
 			"job.html",
@@ -231,25 +441,277 @@ func (a *API) setRoutes() {
 				// "finalJobDur": finalJobDur,
 				"runningDurSecs": runningDurSecs,
 				"job":            j,
+				"queue":          queue,
+				"batchURL":       batchURL,
+				"parentURL":      parentURL,
+				"children":       children,
+				"upscale":        j.Settings.Mode == job.UpscaleMode,
+				// Jobs can start from this one's image unless it failed
+				"derivable": !j.Archived || j.Done(),
+				"upscaler":  a.opts.Upscaler,
+				"user":      u,
 			},
 		)
 	})
 
+	a.router.POST("/job/:uuid/cancel", requireUser, func(c *gin.Context) {
+		j, ok := a.cancelJob(c)
+		if !ok {
+			return
+		}
+		c.Redirect(http.StatusFound, fmt.Sprintf("/job/%v", j.UUID))
+	})
+
+	a.router.GET("/api/v1/jobs/:uuid", requireUser, func(c *gin.Context) {
+		j, pos, ok := a.getAuthorizedJob(c)
+		if !ok {
+			return
+		}
+
+		resp := gin.H{
+			"job":      j,
+			"status":   j.Status(),
+			"position": pos,
+		}
+		if !j.Archived {
+			estimates, err := a.jobManager.GetQueueEstimates(c.Request.Context())
+			if err != nil {
+				errorResponse(err, 500, c)
+				return
+			}
+			if est, ok := estimates[j.UUID]; ok {
+				resp["queue"] = job_manager.QueueMessage(est)
+			}
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	a.router.POST("/api/v1/jobs/:uuid/cancel", requireUser, func(c *gin.Context) {
+		j, ok := a.cancelJob(c)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"job":    j,
+			"status": j.Status(),
+		})
+	})
+
+	// Everything logged while the job ran, including the runner's output.
+	a.router.GET("/api/v1/jobs/:uuid/log", requireUser, func(c *gin.Context) {
+		j, _, ok := a.getAuthorizedJob(c)
+		if !ok {
+			return
+		}
+
+		output, found, err := a.jobManager.JobLog(c.Request.Context(), j.UUID)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		if !found {
+			errorResponse(ErrJobLogNotFound, 404, c)
+			return
+		}
+		c.String(http.StatusOK, output)
+	})
+
+	// Admins can bump or demote jobs that are still waiting in the queue.
+	a.router.POST("/api/v1/jobs/:uuid/priority", requireUser, requireAdmin, func(c *gin.Context) {
+		j, _, ok := a.getAuthorizedJob(c)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			Priority int `json:"priority"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+
+		found, err := a.db.SetJobPriority(c.Request.Context(), j.UUID, req.Priority)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		if !found {
+			errorResponse(ErrJobNotQueued, 409, c)
+			return
+		}
+		a.jobManager.QueueChanged()
+
+		j, _, pos, err := a.jobManager.GetJobStatus(c.Request.Context(), j.UUID)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"job":      j,
+			"status":   j.Status(),
+			"position": pos,
+		})
+	})
+
+	// Generated images are only served to the owner of the job that created
+	// them.
+	a.router.GET("/image/sd/:file", requireUser, func(c *gin.Context) {
+		fileName := filepath.Base(c.Param("file"))
+		parsedUUID, err := uuid.Parse(strings.TrimSuffix(fileName, filepath.Ext(fileName)))
+		if err != nil {
+			errorResponse(ErrJobNotFound, 404, c)
+			return
+		}
+
+		if _, _, ok := a.getAuthorizedJobByUUID(c, parsedUUID); !ok {
+			return
+		}
+		c.File(filepath.Join("./stable-diffusion-docker/output", fileName))
+	})
+
 	a.router.Static("/image/w", "./images")
-	a.router.Static("/image/sd", "./stable-diffusion-docker/output")
 	a.router.Static("/js", "./js")
 }
 
-var ErrJobNotFound = errors.New("job not found")
+func (a *API) jobImageURL(uuid_ uuid.UUID) string {
+	if a.opts.MockJobs {
+		return "/image/w/mock.png"
+	} else if a.opts.UseS3 {
+		// TODO put in config
+		return fmt.Sprintf("https://ai-art-1.s3.amazonaws.com/%v.png", uuid_)
+	}
+	return fmt.Sprintf("/image/sd/%v.png", uuid_)
+}
+
+// getAuthorizedJob loads the job named by the :uuid param and checks that the
+// current user may see it. If ok is false an error response has already been
+// written.
+func (a *API) getAuthorizedJob(c *gin.Context) (job.Job, int, bool) {
+	parsedUUID, err := uuid.Parse(c.Param("uuid"))
+	if err != nil {
+		errorResponse(ErrJobNotFound, 404, c)
+		return job.Job{}, 0, false
+	}
+	return a.getAuthorizedJobByUUID(c, parsedUUID)
+}
+
+func (a *API) getAuthorizedJobByUUID(c *gin.Context, uuid_ uuid.UUID) (job.Job, int, bool) {
+	j, found, pos, err := a.jobManager.GetJobStatus(c.Request.Context(), uuid_)
+	if err != nil {
+		errorResponse(err, 500, c)
+		return job.Job{}, 0, false
+	}
+
+	// Jobs owned by someone else are reported as missing so their existence
+	// isn't leaked.
+	u, _ := currentUser(c)
+	if !found || !u.CanAccess(j.OwnerID) {
+		errorResponse(ErrJobNotFound, 404, c)
+		return job.Job{}, 0, false
+	}
+
+	return j, pos, true
+}
+
+func (a *API) cancelJob(c *gin.Context) (job.Job, bool) {
+	j, _, ok := a.getAuthorizedJob(c)
+	if !ok {
+		return job.Job{}, false
+	}
+
+	if j.Archived {
+		errorResponse(ErrJobFinished, 409, c)
+		return job.Job{}, false
+	}
+
+	j, found, err := a.jobManager.CancelJob(c.Request.Context(), j)
+	if err != nil {
+		errorResponse(err, 500, c)
+		return job.Job{}, false
+	}
+	if !found {
+		errorResponse(ErrJobRunning, 409, c)
+		return job.Job{}, false
+	}
+
+	a.checkBatch(c.Request.Context(), j)
+	return j, true
+}
+
+var (
+	ErrJobNotFound    = errors.New("job not found")
+	ErrJobRunning     = errors.New("job is already running")
+	ErrJobFinished    = errors.New("job has already finished")
+	ErrJobNotQueued   = errors.New("job is not waiting in the queue")
+	ErrJobLogNotFound = errors.New("job has no log")
+)
+
+// addJobsErrorResponse reports why jobs couldn't be queued.
+func addJobsErrorResponse(err error, c *gin.Context) {
+	if errors.Is(err, job_manager.ErrQueueFull) {
+		c.Header("Retry-After", fmt.Sprintf("%d", int(job_manager.QUEUE_FULL_RETRY_AFTER.Seconds())))
+		errorResponse(err, 503, c)
+	} else if errors.IsNotValid(err) {
+		errorResponse(err, 400, c)
+	} else {
+		errorResponse(err, 500, c)
+	}
+}
 
 func errorResponse(err error, code int, c *gin.Context) {
-	log.Println("Error", errors.ErrorStack(err))
+	level := slog.LevelWarn
+	if code >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	requestLogger(c).Log(c.Request.Context(), level, "Error response", "status", code, logging.Err(err))
 	c.JSON(code, map[string]interface{}{
 		"error": err.Error(),
 	})
 }
 
-func (a *API) Run() {
-	log.Println("RUNNING", a.opts.Port)
-	a.router.Run(fmt.Sprintf(":%d", a.opts.Port))
+// Run serves the API until ctx is cancelled. Requests in flight are
+// cancelled along with it, and given SHUTDOWN_TIMEOUT to finish.
+func (a *API) Run(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", a.opts.Port),
+		Handler: a.router,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("Failed to shut down cleanly", logging.Err(err))
+		}
+	}()
+
+	slog.Info("Listening", "port", a.opts.Port)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// imageUpload decodes the image uploaded with a request. found is false if
+// there is none.
+func imageUpload(c *gin.Context) (img image.Image, found bool, err error) {
+	fh, err := c.FormFile("image")
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	defer f.Close()
+
+	img, err = initimage.Decode(f)
+	return img, true, errors.Trace(err)
 }
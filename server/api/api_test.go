@@ -0,0 +1,117 @@
+package api
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wellsjo/ai-art/server/quota"
+)
+
+func (a testAPI) postJob(t *testing.T, key string, fields map[string]string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		require.NoError(t, mw.WriteField(k, v))
+	}
+	fw, err := mw.CreateFormFile("image", "init.png")
+	require.NoError(t, err)
+	require.NoError(t, png.Encode(fw, image.NewGray(image.Rect(0, 0, 64, 48))))
+	require.NoError(t, mw.Close())
+
+	r := httptest.NewRequest("POST", "/job", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, r)
+	return w
+}
+
+func TestPostJobImage(t *testing.T) {
+	a := newTestAPI(t)
+	_, _, key := a.addUser(t, "alice", false)
+
+	// Rejected jobs don't leave their image behind
+	w := a.postJob(t, key, map[string]string{"prompt": "hello", "num-iter": "1000"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	files, err := os.ReadDir(a.opts.UploadPath)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	w = a.postJob(t, key, map[string]string{"prompt": "hello", "width": "128", "height": "128"})
+	require.Equal(t, http.StatusFound, w.Code)
+	files, err = os.ReadDir(a.opts.UploadPath)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	// Uploads are stored at the job's size
+	f, err := os.Open(filepath.Join(a.opts.UploadPath, files[0].Name()))
+	require.NoError(t, err)
+	defer f.Close()
+	cfg, err := png.DecodeConfig(f)
+	assert.NoError(t, err)
+	assert.Equal(t, 128, cfg.Width)
+	assert.Equal(t, 128, cfg.Height)
+}
+
+func (a testAPI) postPrompt(key, forwardedFor string) int {
+	return a.postForm(key, forwardedFor, map[string]string{"prompt": "hello"})
+}
+
+func (a testAPI) postForm(key, forwardedFor string, fields map[string]string) int {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	mw.Close()
+
+	r := httptest.NewRequest("POST", "/job", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+key)
+	r.Header.Set("X-Forwarded-For", forwardedFor)
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestIPQuotaForwardedFor(t *testing.T) {
+	limits := quota.Limits{MaxPendingJobs: 1}
+
+	// Clients can't reset their usage by claiming to be someone else
+	a := newTestAPIWithOpts(t, Opts{IPLimits: limits})
+	_, _, key := a.addUser(t, "alice", false)
+	assert.Equal(t, http.StatusFound, a.postPrompt(key, "10.0.0.1"))
+	assert.Equal(t, http.StatusTooManyRequests, a.postPrompt(key, "10.0.0.2"))
+
+	// Trusted proxies can
+	a = newTestAPIWithOpts(t, Opts{IPLimits: limits, TrustedProxies: []string{"192.0.2.0/24"}})
+	_, _, key = a.addUser(t, "alice", false)
+	assert.Equal(t, http.StatusFound, a.postPrompt(key, "10.0.0.1"))
+	assert.Equal(t, http.StatusFound, a.postPrompt(key, "10.0.0.2"))
+	assert.Equal(t, http.StatusTooManyRequests, a.postPrompt(key, "10.0.0.2"))
+
+	assert.Error(t, ParseTrustedProxies([]string{"proxy.internal"}))
+	assert.NoError(t, ParseTrustedProxies([]string{"10.0.0.1", "fd00::/8"}))
+}
+
+func TestPostJobNotValid(t *testing.T) {
+	a := newTestAPI(t)
+	_, _, key := a.addUser(t, "alice", false)
+
+	for _, fields := range []map[string]string{
+		{"prompt": "hello", "seed": "-1"},
+		{"prompt": ""},
+		{"prompt": "hello", "width": "500"},
+	} {
+		assert.Equal(t, http.StatusBadRequest, a.postForm(key, "", fields), "%v", fields)
+	}
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/asset"
+	"github.com/wellsjo/ai-art/server/job"
+)
+
+var ErrAssetNotFound = errors.New("asset not found")
+
+func (a *API) setAssetRoutes() {
+	v1 := a.router.Group("/api/v1", requireUser)
+
+	v1.GET("/assets", func(c *gin.Context) {
+		kind := asset.Kind(c.Query("kind"))
+		if kind != "" && !kind.Valid() {
+			errorResponse(errors.NotValidf("asset kind %q", kind), 400, c)
+			return
+		}
+
+		assets, err := a.db.GetAssets(c.Request.Context(), kind)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		c.JSON(http.StatusOK, assets)
+	})
+
+	v1.GET("/assets/:id", func(c *gin.Context) {
+		as, ok := a.getAsset(c)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, as)
+	})
+
+	// Takes a multipart form with the file, its kind and optionally a name.
+	v1.POST("/assets", func(c *gin.Context) {
+		u, _ := currentUser(c)
+
+		// Leave room for the other fields
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, asset.MAX_ASSET_SIZE+DefaultMaxMemory)
+		fh, err := c.FormFile("file")
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			errorResponse(err, 413, c)
+			return
+		} else if err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+
+		as, err := asset.New(asset.Kind(c.PostForm("kind")), c.PostForm("name"), fh.Filename, u.ID)
+		if err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+
+		f, err := fh.Open()
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		defer f.Close()
+
+		as, err = a.jobManager.AddAsset(c.Request.Context(), as, f)
+		if errors.IsNotValid(err) {
+			errorResponse(err, 400, c)
+			return
+		} else if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		requestLogger(c).Info("Added asset", "asset", as.ID, "kind", as.Kind, "size", as.Size)
+		c.JSON(http.StatusCreated, as)
+	})
+
+	// Only the owner or an admin can delete an asset. Jobs already queued
+	// with it will fail.
+	v1.DELETE("/assets/:id", func(c *gin.Context) {
+		u, _ := currentUser(c)
+		as, ok := a.getAsset(c)
+		if !ok {
+			return
+		}
+		if !u.CanAccess(as.OwnerID) {
+			errorResponse(ErrForbidden, 403, c)
+			return
+		}
+
+		if err := a.jobManager.DeleteAsset(c.Request.Context(), as); err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
+
+func (a *API) getAsset(c *gin.Context) (asset.Asset, bool) {
+	id, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		errorResponse(err, 400, c)
+		return asset.Asset{}, false
+	}
+	as, found, err := a.db.GetAsset(c.Request.Context(), id)
+	if err != nil {
+		errorResponse(err, 500, c)
+		return asset.Asset{}, false
+	}
+	if !found {
+		errorResponse(ErrAssetNotFound, 404, c)
+		return asset.Asset{}, false
+	}
+	return as, true
+}
+
+// parseAssetRef parses an asset form value, the asset's ID optionally
+// followed by a colon and its weight.
+func parseAssetRef(s string) (job.AssetRef, error) {
+	idStr, weightStr, hasWeight := strings.Cut(s, ":")
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		return job.AssetRef{}, errors.NotValidf("asset %q", s)
+	}
+	ref := job.AssetRef{ID: id}
+	if hasWeight {
+		if ref.Weight, err = strconv.ParseFloat(weightStr, 64); err != nil {
+			return job.AssetRef{}, errors.NotValidf("asset weight %q", weightStr)
+		}
+	}
+	return ref, nil
+}
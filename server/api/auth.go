@@ -0,0 +1,325 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/user"
+)
+
+const (
+	sessionCookie = "session"
+	userKey       = "user"
+	apiKeyKey     = "apiKey"
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+// authenticate resolves the caller from an API key (Authorization: Bearer or
+// X-API-Key) or a session cookie. It never rejects a request on its own; use
+// requireUser or requireAdmin for that.
+func (a *API) authenticate(c *gin.Context) {
+	var (
+		u     user.User
+		k     user.APIKey
+		found bool
+		err   error
+	)
+
+	if key := apiKeyFromRequest(c.Request); key != "" {
+		u, k, found, err = a.db.GetUserByAPIKey(c.Request.Context(), user.HashToken(key))
+		if found {
+			c.Set(apiKeyKey, k)
+		}
+	} else if token, cookieErr := c.Cookie(sessionCookie); cookieErr == nil && token != "" {
+		u, found, err = a.db.GetUserBySession(c.Request.Context(), user.HashToken(token))
+	}
+	if err != nil {
+		errorResponse(err, 500, c)
+		c.Abort()
+		return
+	}
+
+	if found {
+		c.Set(userKey, u)
+	}
+	c.Next()
+}
+
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return ""
+}
+
+// requireUser rejects anonymous requests. Browsers are sent to the login page,
+// everything else gets a 401.
+func requireUser(c *gin.Context) {
+	if _, ok := currentUser(c); ok {
+		c.Next()
+		return
+	}
+
+	if wantsHTML(c) {
+		c.Redirect(http.StatusFound, "/login")
+	} else {
+		errorResponse(ErrUnauthorized, 401, c)
+	}
+	c.Abort()
+}
+
+func requireAdmin(c *gin.Context) {
+	u, ok := currentUser(c)
+	if !ok {
+		errorResponse(ErrUnauthorized, 401, c)
+		c.Abort()
+		return
+	}
+	if !u.Admin {
+		errorResponse(ErrForbidden, 403, c)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+func currentUser(c *gin.Context) (user.User, bool) {
+	v, ok := c.Get(userKey)
+	if !ok {
+		return user.User{}, false
+	}
+	u, ok := v.(user.User)
+	return u, ok
+}
+
+// currentAPIKey is the key the request authenticated with, if any.
+func currentAPIKey(c *gin.Context) (user.APIKey, bool) {
+	v, ok := c.Get(apiKeyKey)
+	if !ok {
+		return user.APIKey{}, false
+	}
+	k, ok := v.(user.APIKey)
+	return k, ok
+}
+
+func wantsHTML(c *gin.Context) bool {
+	return apiKeyFromRequest(c.Request) == "" &&
+		!strings.HasPrefix(c.Request.URL.Path, "/api/") &&
+		strings.Contains(c.GetHeader("Accept"), "text/html")
+}
+
+// setSessionCookie sets the session cookie, or deletes it if maxAge is
+// negative. Lax same site cookies aren't sent with form posts from other
+// sites, so they can't submit jobs as the user.
+func (a *API) setSessionCookie(c *gin.Context, token string, maxAge int) {
+	secure := a.opts.SecureCookies || c.Request.TLS != nil
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, token, maxAge, "/", "", secure, true)
+}
+
+func (a *API) setAuthRoutes() {
+	a.router.GET("/login", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "login.html", gin.H{
+			"title": "AI ART - LOGIN",
+		})
+	})
+
+	a.router.POST("/login", func(c *gin.Context) {
+		username := c.PostForm("username")
+		password := c.PostForm("password")
+
+		u, passwordHash, found, err := a.db.GetUserByUsername(c.Request.Context(), username)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		if !found {
+			user.CheckNoPassword(password)
+		}
+		if !found || !user.CheckPassword(passwordHash, password) {
+			c.HTML(http.StatusUnauthorized, "login.html", gin.H{
+				"title": "AI ART - LOGIN",
+				"error": "invalid username or password",
+			})
+			return
+		}
+
+		token, tokenHash, err := user.NewToken("")
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		if err := a.db.AddSession(c.Request.Context(), u.ID, tokenHash, time.Now().Add(user.SessionDuration)); err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+
+		a.setSessionCookie(c, token, int(user.SessionDuration.Seconds()))
+		c.Redirect(http.StatusFound, "/")
+	})
+
+	a.router.POST("/logout", func(c *gin.Context) {
+		if token, err := c.Cookie(sessionCookie); err == nil {
+			if err := a.db.DeleteSession(c.Request.Context(), user.HashToken(token)); err != nil {
+				errorResponse(err, 500, c)
+				return
+			}
+		}
+		a.setSessionCookie(c, "", -1)
+		c.Redirect(http.StatusFound, "/login")
+	})
+
+	v1 := a.router.Group("/api/v1", requireUser)
+
+	v1.GET("/me", func(c *gin.Context) {
+		u, _ := currentUser(c)
+		c.JSON(http.StatusOK, u)
+	})
+
+	v1.POST("/users", requireAdmin, func(c *gin.Context) {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Admin    bool   `json:"admin"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+
+		u, err := user.New(req.Username, req.Admin)
+		if err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+		passwordHash, err := user.HashPassword(req.Password)
+		if err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+
+		u, err = a.db.AddUser(c.Request.Context(), u, passwordHash)
+		if errors.IsAlreadyExists(err) {
+			errorResponse(err, 409, c)
+			return
+		} else if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		c.JSON(http.StatusCreated, u)
+	})
+
+	v1.GET("/keys", func(c *gin.Context) {
+		u, _ := currentUser(c)
+		keys, err := a.db.GetAPIKeys(c.Request.Context(), u.ID)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		c.JSON(http.StatusOK, keys)
+	})
+
+	// Issues a key for the caller. Admins may issue keys for other users by
+	// passing userID.
+	v1.POST("/keys", func(c *gin.Context) {
+		u, _ := currentUser(c)
+
+		var req struct {
+			Name        string `json:"name"`
+			UserID      int64  `json:"userID"`
+			CallbackURL string `json:"callbackURL"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+		if err := a.validateCallbackURL(c.Request.Context(), req.CallbackURL); err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+
+		ownerID := u.ID
+		if req.UserID != 0 && req.UserID != u.ID {
+			if !u.Admin {
+				errorResponse(ErrForbidden, 403, c)
+				return
+			}
+			if _, found, err := a.db.GetUserByID(c.Request.Context(), req.UserID); err != nil {
+				errorResponse(err, 500, c)
+				return
+			} else if !found {
+				errorResponse(ErrUserNotFound, 404, c)
+				return
+			}
+			ownerID = req.UserID
+		}
+
+		token, tokenHash, err := user.NewToken(user.APIKeyPrefix)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+
+		k, err := a.db.AddAPIKey(c.Request.Context(), user.APIKey{
+			UserID:      ownerID,
+			Name:        req.Name,
+			Prefix:      token[:len(user.APIKeyPrefix)+6],
+			Created:     time.Now().Truncate(time.Microsecond).UTC(),
+			CallbackURL: req.CallbackURL,
+		}, tokenHash)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+
+		// This is the only time the full key is ever returned.
+		c.JSON(http.StatusCreated, gin.H{
+			"key":    token,
+			"apiKey": k,
+		})
+	})
+
+	v1.DELETE("/keys/:id", func(c *gin.Context) {
+		u, _ := currentUser(c)
+
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+
+		k, found, err := a.db.GetAPIKey(c.Request.Context(), id)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		if !found || !u.CanAccess(k.UserID) {
+			errorResponse(ErrAPIKeyNotFound, 404, c)
+			return
+		}
+
+		if err := a.db.RevokeAPIKey(c.Request.Context(), id, time.Now()); err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
+
+var (
+	ErrUserNotFound   = errors.New("user not found")
+	ErrAPIKeyNotFound = errors.New("api key not found")
+)
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wellsjo/ai-art/server/db/memory"
+	"github.com/wellsjo/ai-art/server/events"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/job_manager"
+	"github.com/wellsjo/ai-art/server/user"
+	"github.com/wellsjo/ai-art/server/ws"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	// Templates are loaded relative to the repository root, like the server
+	// is run
+	if err := os.Chdir("../.."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+type testAPI struct {
+	*API
+	store *memory.Store
+}
+
+func newTestAPI(t *testing.T) testAPI {
+	return newTestAPIWithOpts(t, Opts{})
+}
+
+func newTestAPIWithOpts(t *testing.T, opts Opts) testAPI {
+	store := memory.New()
+	broker := events.New(events.Opts{})
+	jm := job_manager.New(job_manager.Opts{MockJobs: true}, store, nil, ws.NewWSManager(), nil, broker)
+	opts.MockJobs = true
+	opts.UploadPath = t.TempDir()
+	a := New(opts, jm, ws.NewWSManager(), nil, broker, store)
+	return testAPI{API: a, store: store}
+}
+
+// addUser adds a user and returns an API key for them.
+func (a testAPI) addUser(t *testing.T, username string, admin bool) (user.User, user.APIKey, string) {
+	ctx := context.Background()
+	u, err := user.New(username, admin)
+	require.NoError(t, err)
+	u, err = a.store.AddUser(ctx, u, "")
+	require.NoError(t, err)
+
+	token, tokenHash, err := user.NewToken(user.APIKeyPrefix)
+	require.NoError(t, err)
+	k, err := a.store.AddAPIKey(ctx, user.APIKey{UserID: u.ID, Name: "test", Created: time.Now()}, tokenHash)
+	require.NoError(t, err)
+	return u, k, token
+}
+
+func (a testAPI) request(method, path, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader("{}"))
+	r.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		r.Header.Set("Authorization", "Bearer "+key)
+	}
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, r)
+	return w
+}
+
+func TestRequireUser(t *testing.T) {
+	a := newTestAPI(t)
+	_, _, key := a.addUser(t, "alice", false)
+
+	assert.Equal(t, http.StatusUnauthorized, a.request("GET", "/api/v1/me", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, a.request("GET", "/api/v1/me", "sds_unknown").Code)
+	assert.Equal(t, http.StatusOK, a.request("GET", "/api/v1/me", key).Code)
+
+	// Browsers are sent to log in instead
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/login", w.Header().Get("Location"))
+}
+
+func TestRevokedAPIKey(t *testing.T) {
+	a := newTestAPI(t)
+	_, k, key := a.addUser(t, "alice", false)
+	require.Equal(t, http.StatusOK, a.request("GET", "/api/v1/me", key).Code)
+
+	require.NoError(t, a.store.RevokeAPIKey(context.Background(), k.ID, time.Now()))
+	assert.Equal(t, http.StatusUnauthorized, a.request("GET", "/api/v1/me", key).Code)
+}
+
+func TestJobAccess(t *testing.T) {
+	a := newTestAPI(t)
+	owner, _, ownerKey := a.addUser(t, "alice", false)
+	_, _, otherKey := a.addUser(t, "bob", false)
+	_, _, adminKey := a.addUser(t, "admin", true)
+
+	j, err := job.New(job.Settings{Prompt: "hello"})
+	require.NoError(t, err)
+	j.OwnerID = owner.ID
+	require.NoError(t, a.store.AddJob(context.Background(), j))
+
+	path := "/job/" + j.UUID.String()
+	assert.Equal(t, http.StatusOK, a.request("GET", path, ownerKey).Code)
+	// Other users' jobs look missing
+	assert.Equal(t, http.StatusNotFound, a.request("GET", path, otherKey).Code)
+	assert.Equal(t, http.StatusOK, a.request("GET", path, adminKey).Code)
+	assert.Equal(t, http.StatusUnauthorized, a.request("GET", path, "").Code)
+	assert.Equal(t, http.StatusNotFound, a.request("POST", path+"/cancel", otherKey).Code)
+}
+
+func TestRequireAdmin(t *testing.T) {
+	a := newTestAPI(t)
+	_, _, key := a.addUser(t, "alice", false)
+	_, _, adminKey := a.addUser(t, "admin", true)
+
+	for _, path := range []string{"/api/v1/users", "/api/v1/models"} {
+		assert.Equal(t, http.StatusUnauthorized, a.request("POST", path, "").Code, path)
+		assert.Equal(t, http.StatusForbidden, a.request("POST", path, key).Code, path)
+		// Admins get as far as the empty body
+		assert.Equal(t, http.StatusBadRequest, a.request("POST", path, adminKey).Code, path)
+	}
+}
+
+func TestAddUser(t *testing.T) {
+	a := newTestAPI(t)
+	_, _, adminKey := a.addUser(t, "admin", true)
+
+	post := func(username string) int {
+		r := httptest.NewRequest("POST", "/api/v1/users", strings.NewReader(`{"username": "`+username+`", "password": "secret"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Authorization", "Bearer "+adminKey)
+		w := httptest.NewRecorder()
+		a.router.ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusCreated, post("alice"))
+	assert.Equal(t, http.StatusConflict, post("alice"))
+}
+
+func TestLogin(t *testing.T) {
+	a := newTestAPI(t)
+	hash, err := user.HashPassword("secret")
+	require.NoError(t, err)
+	u, _ := user.New("alice", false)
+	_, err = a.store.AddUser(context.Background(), u, hash)
+	require.NoError(t, err)
+
+	login := func(username, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/login", strings.NewReader("username="+username+"&password="+password))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		a.router.ServeHTTP(w, r)
+		return w
+	}
+	assert.Equal(t, http.StatusUnauthorized, login("alice", "wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, login("bob", "secret").Code)
+
+	w := login("alice", "secret")
+	assert.Equal(t, http.StatusFound, w.Code)
+	cookie := w.Result().Cookies()[0]
+	assert.Equal(t, sessionCookie, cookie.Name)
+	assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+	assert.True(t, cookie.HttpOnly)
+}
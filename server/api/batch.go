@@ -0,0 +1,205 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/batch"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/job_manager"
+	"github.com/wellsjo/ai-art/server/logging"
+)
+
+var ErrBatchNotFound = errors.New("batch not found")
+
+func (a *API) setBatchRoutes() {
+	a.router.POST("/api/v1/batches", requireUser, func(c *gin.Context) {
+		u, _ := currentUser(c)
+
+		var m batch.Matrix
+		if err := c.ShouldBindJSON(&m); err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+
+		mdl, err := a.jobManager.Model(c.Request.Context(), m.Model)
+		if errors.IsNotValid(err) {
+			errorResponse(err, 400, c)
+			return
+		} else if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		m.Model = mdl.Name
+		if len(m.Sizes) == 0 {
+			m.Sizes = []batch.Size{{Width: mdl.DefaultWidth, Height: mdl.DefaultHeight}}
+		}
+
+		b, jobs, err := batch.New(m, u.ID)
+		if err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+		callbackURL, _ := a.callbackURL(c, "")
+		for i := range jobs {
+			jobs[i].ClientIP = c.ClientIP()
+			jobs[i].CallbackURL = callbackURL
+		}
+
+		if !a.checkQuota(c, u, jobs) {
+			return
+		}
+
+		if err := a.jobManager.AddBatch(c.Request.Context(), b, jobs); err != nil {
+			addJobsErrorResponse(err, c)
+			return
+		}
+
+		jobUUIDs := make([]uuid.UUID, 0, len(jobs))
+		for _, j := range jobs {
+			jobUUIDs = append(jobUUIDs, j.UUID)
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"batch": b,
+			"jobs":  jobUUIDs,
+			"url":   fmt.Sprintf("/batch/%v", b.UUID),
+		})
+	})
+
+	a.router.GET("/api/v1/batches/:uuid", requireUser, func(c *gin.Context) {
+		b, jobs, ok := a.getAuthorizedBatch(c)
+		if !ok {
+			return
+		}
+
+		progress := batch.GetProgress(jobs)
+		resp := gin.H{
+			"batch":    b,
+			"progress": progress,
+			"jobs":     batchJobsView(b, jobs),
+		}
+		if progress.Complete {
+			resp["contactSheetURL"] = a.contactSheetURL(b)
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	a.router.GET("/batch/:uuid", requireUser, func(c *gin.Context) {
+		b, jobs, ok := a.getAuthorizedBatch(c)
+		if !ok {
+			return
+		}
+
+		u, _ := currentUser(c)
+		progress := batch.GetProgress(jobs)
+
+		c.HTML(
+			http.StatusOK,
+			"batch.html",
+			gin.H{
+				"title":           "AI ART - BATCH",
+				"batch":           b,
+				"progress":        progress,
+				"jobs":            batchJobsView(b, jobs),
+				"contactSheetURL": a.contactSheetURL(b),
+				"user":            u,
+			},
+		)
+	})
+
+	a.router.GET("/image/batch/:file", requireUser, func(c *gin.Context) {
+		fileName := filepath.Base(c.Param("file"))
+		parsedUUID, err := uuid.Parse(strings.TrimSuffix(strings.TrimPrefix(fileName, "batch-"), filepath.Ext(fileName)))
+		if err != nil {
+			errorResponse(ErrBatchNotFound, 404, c)
+			return
+		}
+
+		if _, _, ok := a.getAuthorizedBatchByUUID(c, parsedUUID); !ok {
+			return
+		}
+		c.File(filepath.Join("./stable-diffusion-docker/output", job_manager.GetBatchFileName(parsedUUID)))
+	})
+}
+
+func (a *API) getAuthorizedBatch(c *gin.Context) (batch.Batch, []job.Job, bool) {
+	parsedUUID, err := uuid.Parse(c.Param("uuid"))
+	if err != nil {
+		errorResponse(ErrBatchNotFound, 404, c)
+		return batch.Batch{}, nil, false
+	}
+	return a.getAuthorizedBatchByUUID(c, parsedUUID)
+}
+
+func (a *API) getAuthorizedBatchByUUID(c *gin.Context, uuid_ uuid.UUID) (batch.Batch, []job.Job, bool) {
+	b, found, err := a.db.GetBatch(c.Request.Context(), uuid_)
+	if err != nil {
+		errorResponse(err, 500, c)
+		return batch.Batch{}, nil, false
+	}
+
+	u, _ := currentUser(c)
+	if !found || !u.CanAccess(b.OwnerID) {
+		errorResponse(ErrBatchNotFound, 404, c)
+		return batch.Batch{}, nil, false
+	}
+
+	jobs, err := a.db.GetBatchJobs(c.Request.Context(), uuid_)
+	if err != nil {
+		errorResponse(err, 500, c)
+		return batch.Batch{}, nil, false
+	}
+
+	return b, jobs, true
+}
+
+// checkBatch refreshes a batch after one of its jobs changed outside of the
+// job loop, e.g. when a job was cancelled.
+func (a *API) checkBatch(ctx context.Context, j job.Job) {
+	if j.BatchUUID == uuid.Nil {
+		return
+	}
+
+	// The check outlives the request
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		if err := a.jobManager.CheckBatch(ctx, j.BatchUUID); err != nil {
+			slog.Error("Failed to check batch", logging.KeyBatch, j.BatchUUID, logging.Err(err))
+		}
+	}()
+}
+
+func (a *API) contactSheetURL(b batch.Batch) string {
+	fileName := job_manager.GetBatchFileName(b.UUID)
+	if a.opts.UseS3 {
+		// TODO put in config
+		return fmt.Sprintf("https://ai-art-1.s3.amazonaws.com/%v", fileName)
+	}
+	return fmt.Sprintf("/image/batch/%v", fileName)
+}
+
+type batchJobView struct {
+	UUID   uuid.UUID `json:"uuid"`
+	Label  string    `json:"label"`
+	Status string    `json:"status"`
+}
+
+func batchJobsView(b batch.Batch, jobs []job.Job) []batchJobView {
+	views := make([]batchJobView, 0, len(jobs))
+	for _, j := range jobs {
+		views = append(views, batchJobView{
+			UUID:   j.UUID,
+			Label:  b.Matrix.Label(j.Settings),
+			Status: j.Status(),
+		})
+	}
+	return views
+}
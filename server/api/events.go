@@ -0,0 +1,106 @@
+package api
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/wellsjo/ai-art/server/events"
+)
+
+// SSE_KEEPALIVE is how often a comment is sent on idle event streams so
+// proxies don't time them out.
+const SSE_KEEPALIVE = 15 * time.Second
+
+func (a *API) setEventRoutes() {
+	// Streams a job's status, progress and queue events until it completes.
+	// Clients that reconnect with Last-Event-ID get the events they missed,
+	// or a snapshot of the job if those are no longer available.
+	a.router.GET("/api/v1/jobs/:uuid/events", requireUser, func(c *gin.Context) {
+		j, _, ok := a.getAuthorizedJob(c)
+		if !ok {
+			return
+		}
+
+		lastID, _ := strconv.ParseInt(c.GetHeader("Last-Event-ID"), 10, 64)
+
+		sub := a.events.Subscribe(j.UUID, lastID)
+		defer sub.Close()
+
+		// Read the job again now that we're subscribed, so that nothing that
+		// happens in between is lost.
+		j, _, pos, err := a.jobManager.GetJobStatus(c.Request.Context(), j.UUID)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+
+		if lastID == 0 || sub.Missed {
+			data := a.jobManager.StatusMessage(j)
+			snapshot := events.Event{
+				ID:   sub.LastID,
+				Type: events.TypeStatus,
+				Data: data,
+			}
+			if j.Archived {
+				snapshot.Type = events.TypeComplete
+			} else {
+				data["position"] = pos
+			}
+
+			writeEvent(c, snapshot)
+			if j.Archived {
+				return
+			}
+		} else {
+			for _, e := range sub.Replay {
+				writeEvent(c, e)
+				if e.Type == events.TypeComplete {
+					return
+				}
+			}
+		}
+		c.Writer.Flush()
+
+		keepalive := time.NewTicker(SSE_KEEPALIVE)
+		defer keepalive.Stop()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case e, ok := <-sub.Events:
+				// A closed channel without a complete event means we fell
+				// behind. The client will reconnect and resume.
+				if !ok {
+					return false
+				}
+				writeEvent(c, e)
+				return e.Type != events.TypeComplete
+
+			case <-keepalive.C:
+				_, err := w.Write([]byte(":\n\n"))
+				return err == nil
+
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	})
+}
+
+func writeEvent(c *gin.Context, e events.Event) {
+	id := ""
+	if e.ID > 0 {
+		id = strconv.FormatInt(e.ID, 10)
+	}
+	c.Render(-1, sse.Event{
+		Id:    id,
+		Event: e.Type,
+		Data:  e.Data,
+	})
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wellsjo/ai-art/server/health"
+)
+
+// setHealthRoutes adds probes that don't require authentication. /healthz
+// only fails if the process needs restarting, while /readyz fails whenever
+// a dependency is unusable.
+func (a *API) setHealthRoutes() {
+	liveness := health.New(0)
+	liveness.Add("jobLoop", a.jobManager.CheckJobLoop)
+
+	readiness := health.New(0)
+	readiness.Add("postgres", a.checkPostgres)
+	readiness.Add("storage", a.jobManager.CheckStorage)
+	readiness.Add("runner", a.jobManager.CheckRunner)
+	readiness.Add("jobLoop", a.jobManager.CheckJobLoop)
+
+	a.router.GET("/healthz", healthHandler(liveness))
+	a.router.GET("/readyz", healthHandler(readiness))
+}
+
+func healthHandler(checker *health.Checker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := checker.Run(c.Request.Context())
+		code := http.StatusOK
+		if !report.OK() {
+			code = http.StatusServiceUnavailable
+		}
+		c.JSON(code, report)
+	}
+}
+
+func (a *API) checkPostgres(ctx context.Context) (interface{}, error) {
+	if err := a.db.Ping(ctx); err != nil {
+		return nil, err
+	}
+	version, err := a.db.CheckSchema(ctx)
+	return map[string]int{"schemaVersion": version}, err
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/wellsjo/ai-art/server/logging"
+)
+
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// MAX_REQUEST_ID_LENGTH bounds IDs accepted from proxies, so clients can't
+// stuff arbitrary data into the logs.
+const MAX_REQUEST_ID_LENGTH = 64
+
+// logRequests gives each request an ID, echoed in the response, and a logger
+// carrying it. The request is logged once it has been answered.
+func logRequests(c *gin.Context) {
+	requestID := c.GetHeader(REQUEST_ID_HEADER)
+	if requestID == "" || len(requestID) > MAX_REQUEST_ID_LENGTH {
+		requestID = uuid.NewString()
+	}
+	c.Header(REQUEST_ID_HEADER, requestID)
+
+	l := slog.Default().With(logging.KeyRequest, requestID)
+	c.Request = c.Request.WithContext(logging.WithLogger(c.Request.Context(), l))
+
+	start := time.Now()
+	c.Next()
+
+	level := slog.LevelInfo
+	if c.Writer.Status() >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	l.Log(c.Request.Context(), level, "Request",
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"duration", time.Since(start),
+		"ip", c.ClientIP(),
+	)
+}
+
+// requestLogger returns the logger for the current request.
+func requestLogger(c *gin.Context) *slog.Logger {
+	return logging.FromContext(c.Request.Context())
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/model"
+)
+
+var ErrModelNotFound = errors.New("model not found")
+
+func (a *API) setModelRoutes() {
+	v1 := a.router.Group("/api/v1", requireUser)
+
+	v1.GET("/models", func(c *gin.Context) {
+		models, err := a.db.GetModels(c.Request.Context())
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		c.JSON(http.StatusOK, models)
+	})
+
+	v1.GET("/models/:name", func(c *gin.Context) {
+		m, found, err := a.db.GetModel(c.Request.Context(), c.Param("name"))
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		if !found {
+			errorResponse(ErrModelNotFound, 404, c)
+			return
+		}
+		c.JSON(http.StatusOK, m)
+	})
+
+	v1.POST("/models", requireAdmin, func(c *gin.Context) {
+		var req model.Model
+		if err := c.ShouldBindJSON(&req); err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+
+		m, err := model.New(req)
+		if err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+
+		if err := a.db.AddModel(c.Request.Context(), m); errors.IsAlreadyExists(err) {
+			errorResponse(err, 409, c)
+			return
+		} else if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		c.JSON(http.StatusCreated, m)
+	})
+
+	// Replaces a model's settings. Jobs already queued keep their settings,
+	// but are rendered with the model as it is when they run.
+	v1.PUT("/models/:name", requireAdmin, func(c *gin.Context) {
+		var req model.Model
+		if err := c.ShouldBindJSON(&req); err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+		req.Name = c.Param("name")
+
+		m, err := model.New(req)
+		if err != nil {
+			errorResponse(err, 400, c)
+			return
+		}
+
+		updated, err := a.db.UpdateModel(c.Request.Context(), m)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		if !updated {
+			errorResponse(ErrModelNotFound, 404, c)
+			return
+		}
+
+		m, _, err = a.db.GetModel(c.Request.Context(), m.Name)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		c.JSON(http.StatusOK, m)
+	})
+
+	// Jobs already queued with the model will fail.
+	v1.DELETE("/models/:name", requireAdmin, func(c *gin.Context) {
+		deleted, err := a.db.DeleteModel(c.Request.Context(), c.Param("name"))
+		if errors.IsNotValid(err) {
+			errorResponse(err, 400, c)
+			return
+		} else if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		if !deleted {
+			errorResponse(ErrModelNotFound, 404, c)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/quota"
+	"github.com/wellsjo/ai-art/server/user"
+)
+
+// checkQuota enforces the per-user and per-IP submission limits for a set of
+// jobs submitted together. Admins are exempt. If ok is false an error
+// response has already been written.
+func (a *API) checkQuota(c *gin.Context, u user.User, jobs []job.Job) bool {
+	if u.Admin || len(jobs) == 0 {
+		return true
+	}
+
+	now := time.Now()
+	since := now.Add(-quota.Window)
+
+	var cost int64
+	for _, j := range jobs {
+		cost += j.Settings.Cost()
+	}
+
+	if !a.opts.UserLimits.Unlimited() {
+		usage, err := a.db.GetUserUsage(c.Request.Context(), u.ID, since)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return false
+		}
+		if err := a.opts.UserLimits.Check(usage, len(jobs), cost, now); err != nil {
+			quotaResponse(err, c)
+			return false
+		}
+	}
+
+	if !a.opts.IPLimits.Unlimited() {
+		usage, err := a.db.GetIPUsage(c.Request.Context(), jobs[0].ClientIP, since)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return false
+		}
+		if err := a.opts.IPLimits.Check(usage, len(jobs), cost, now); err != nil {
+			quotaResponse(err, c)
+			return false
+		}
+	}
+
+	return true
+}
+
+func quotaResponse(err error, c *gin.Context) {
+	var exceeded *quota.ExceededError
+	if errors.As(err, &exceeded) {
+		retryAfter := int(math.Ceil(exceeded.RetryAfter.Seconds()))
+		c.Header("Retry-After", fmt.Sprintf("%d", retryAfter))
+		errorResponse(err, 429, c)
+		return
+	}
+	errorResponse(err, 500, c)
+}
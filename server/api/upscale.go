@@ -0,0 +1,171 @@
+package api
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/initimage"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/logging"
+)
+
+func (a *API) setUpscaleRoutes() {
+	// Upscales a new upload, or the image of a finished job given as parent.
+	a.router.POST("/upscale", requireUser, func(c *gin.Context) {
+		j, ok := a.addUpscaleJob(c, c.PostForm("parent"))
+		if !ok {
+			return
+		}
+		c.Redirect(http.StatusFound, fmt.Sprintf("/job/%v", j.UUID))
+	})
+
+	a.router.POST("/api/v1/jobs/:uuid/upscale", requireUser, func(c *gin.Context) {
+		j, ok := a.addUpscaleJob(c, c.Param("uuid"))
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"job":    j,
+			"status": j.Status(),
+		})
+	})
+}
+
+// addUpscaleJob queues an upscale job from the request's form. It upscales
+// the image of the job named by parent, or the uploaded image if parent is
+// empty. If ok is false an error response has already been written.
+func (a *API) addUpscaleJob(c *gin.Context, parent string) (job.Job, bool) {
+	u, _ := currentUser(c)
+
+	settings := job.Settings{
+		Prompt:   c.PostForm("prompt"),
+		Upscaler: c.PostForm("upscaler"),
+	}
+	if settings.Upscaler == "" {
+		settings.Upscaler = a.opts.Upscaler
+	}
+	if s := c.PostForm("factor"); s != "" {
+		factor, err := strconv.Atoi(s)
+		if err != nil {
+			errorResponse(err, 400, c)
+			return job.Job{}, false
+		}
+		settings.UpscaleFactor = factor
+	}
+
+	var (
+		j     job.Job
+		input image.Image
+		err   error
+	)
+	if parent != "" {
+		parentUUID, err := uuid.Parse(parent)
+		if err != nil {
+			errorResponse(ErrJobNotFound, 404, c)
+			return job.Job{}, false
+		}
+		p, _, ok := a.getAuthorizedJobByUUID(c, parentUUID)
+		if !ok {
+			return job.Job{}, false
+		}
+		if j, err = job.NewUpscale(settings, p.Settings.Width, p.Settings.Height); err != nil {
+			errorResponse(err, 400, c)
+			return job.Job{}, false
+		}
+		j.ParentUUID = p.UUID
+	} else {
+		img, found, err := imageUpload(c)
+		if errors.IsNotValid(err) {
+			errorResponse(err, 400, c)
+			return job.Job{}, false
+		} else if err != nil {
+			errorResponse(err, 500, c)
+			return job.Job{}, false
+		} else if !found {
+			errorResponse(errors.NotValidf("missing image or parent"), 400, c)
+			return job.Job{}, false
+		}
+		input = img
+		size := img.Bounds().Size()
+		if j, err = job.NewUpscale(settings, size.X, size.Y); err != nil {
+			errorResponse(err, 400, c)
+			return job.Job{}, false
+		}
+	}
+
+	j.OwnerID = u.ID
+	j.ClientIP = c.ClientIP()
+	j.CallbackURL, err = a.callbackURL(c, c.PostForm("callback-url"))
+	if err != nil {
+		errorResponse(err, 400, c)
+		return job.Job{}, false
+	}
+
+	if !a.checkQuota(c, u, []job.Job{j}) {
+		return job.Job{}, false
+	}
+
+	uploadPath := filepath.Join(a.opts.UploadPath, j.UUID.String())
+	if input != nil {
+		if err := initimage.Save(uploadPath, input); err != nil {
+			errorResponse(err, 500, c)
+			return job.Job{}, false
+		}
+	}
+
+	// The image has to be saved before the job is queued, in case it runs
+	// right away
+	if err := a.jobManager.AddJob(c.Request.Context(), j); err != nil {
+		if input != nil {
+			os.Remove(uploadPath)
+		}
+		addJobsErrorResponse(err, c)
+		return job.Job{}, false
+	}
+	requestLogger(c).Info("Added upscale job", logging.KeyJob, j.UUID, "parent", j.ParentUUID)
+	return j, true
+}
+
+type childJobView struct {
+	UUID     uuid.UUID `json:"uuid"`
+	Label    string    `json:"label"`
+	Status   string    `json:"status"`
+	ImageURL string    `json:"imageURL,omitempty"`
+}
+
+// childJobsView describes the jobs derived from a job's image that the
+// current user can see.
+func (a *API) childJobsView(c *gin.Context, parent uuid.UUID) ([]childJobView, error) {
+	u, _ := currentUser(c)
+	children, err := a.db.GetChildJobs(c.Request.Context(), parent)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	views := []childJobView{}
+	for _, j := range children {
+		if !u.CanAccess(j.OwnerID) {
+			continue
+		}
+		v := childJobView{
+			UUID:   j.UUID,
+			Label:  fmt.Sprintf("%v %dx%d", j.Settings.Mode, j.Settings.Width, j.Settings.Height),
+			Status: j.Status(),
+		}
+		if j.Settings.Mode == job.UpscaleMode {
+			v.Label += " (" + j.Settings.Upscaler + ")"
+		}
+		if j.Done() {
+			v.ImageURL = a.jobImageURL(j.UUID)
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juju/errors"
+)
+
+var (
+	ErrDeliveryNotFound = errors.New("delivery not found")
+	ErrWebhooksDisabled = errors.New("webhooks are disabled")
+)
+
+func (a *API) setWebhookRoutes() {
+	a.router.GET("/api/v1/jobs/:uuid/deliveries", requireUser, func(c *gin.Context) {
+		j, _, ok := a.getAuthorizedJob(c)
+		if !ok {
+			return
+		}
+
+		deliveries, err := a.db.GetJobDeliveries(c.Request.Context(), j.UUID)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		c.JSON(http.StatusOK, deliveries)
+	})
+
+	a.router.POST("/api/v1/webhooks/deliveries/:id/redeliver", requireUser, func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			errorResponse(ErrDeliveryNotFound, 404, c)
+			return
+		}
+
+		d, found, err := a.db.GetDelivery(c.Request.Context(), id)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		if !found {
+			errorResponse(ErrDeliveryNotFound, 404, c)
+			return
+		}
+		if _, _, ok := a.getAuthorizedJobByUUID(c, d.JobUUID); !ok {
+			return
+		}
+
+		if a.webhooks == nil {
+			errorResponse(ErrWebhooksDisabled, 409, c)
+			return
+		}
+		d, err = a.webhooks.Redeliver(c.Request.Context(), id)
+		if err != nil {
+			errorResponse(err, 500, c)
+			return
+		}
+		c.JSON(http.StatusAccepted, d)
+	})
+}
+
+// callbackURL is where webhooks for a new job are sent. A URL given with the
+// job wins over the one registered on the caller's API key.
+func (a *API) callbackURL(c *gin.Context, requested string) (string, error) {
+	if requested != "" {
+		return requested, a.validateCallbackURL(c.Request.Context(), requested)
+	}
+	if k, ok := currentAPIKey(c); ok {
+		return k.CallbackURL, nil
+	}
+	return "", nil
+}
+
+// validateCallbackURL returns a NotValid error if webhooks can't be sent to
+// s, including when webhooks are disabled.
+func (a *API) validateCallbackURL(ctx context.Context, s string) error {
+	if s == "" {
+		return nil
+	}
+	if a.webhooks == nil {
+		return errors.NewNotValid(ErrWebhooksDisabled, "callback url")
+	}
+	return errors.Trace(a.webhooks.CheckURL(ctx, s))
+}
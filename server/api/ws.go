@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/batch"
+	"github.com/wellsjo/ai-art/server/events"
+	"github.com/wellsjo/ai-art/server/job_manager"
+	"github.com/wellsjo/ai-art/server/user"
+	"github.com/wellsjo/ai-art/server/ws"
+)
+
+func (a *API) wsHooks(u user.User) ws.Hooks {
+	return ws.Hooks{
+		Authorize: a.wsAuthorizer(u),
+		Snapshot:  a.wsSnapshot,
+	}
+}
+
+// wsAuthorizer only lets a websocket subscribe to jobs and batches its user
+// can access.
+func (a *API) wsAuthorizer(u user.User) ws.Authorizer {
+	return func(ctx context.Context, t ws.Topic) (bool, error) {
+		switch t.Kind {
+		case ws.TopicJob:
+			j, found, _, err := a.db.GetJobByUUID(ctx, t.UUID)
+			if err != nil {
+				return false, errors.Trace(err)
+			}
+			return found && u.CanAccess(j.OwnerID), nil
+
+		case ws.TopicBatch:
+			b, found, err := a.db.GetBatch(ctx, t.UUID)
+			if err != nil {
+				return false, errors.Trace(err)
+			}
+			return found && u.CanAccess(b.OwnerID), nil
+		}
+		return false, nil
+	}
+}
+
+// wsSnapshot catches up a new subscriber. Jobs replay the events the client
+// missed if they are still logged, otherwise they send the latest progress or
+// queue position followed by the job's current status.
+func (a *API) wsSnapshot(ctx context.Context, t ws.Topic, lastEventID int64) ([]ws.Message, error) {
+	switch t.Kind {
+	case ws.TopicJob:
+		replay, missed, latestID := a.events.Since(t.UUID, lastEventID)
+		if lastEventID > 0 && !missed {
+			msgs := make([]ws.Message, 0, len(replay))
+			for _, e := range replay {
+				msgs = append(msgs, job_manager.WSMessage(e))
+			}
+			return msgs, nil
+		}
+
+		j, found, pos, err := a.db.GetJobByUUID(ctx, t.UUID)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if !found {
+			return nil, nil
+		}
+
+		var msgs []ws.Message
+		if j.Running {
+			if e, ok := a.events.Latest(j.UUID, events.TypeProgress); ok {
+				msgs = append(msgs, job_manager.WSMessage(e))
+			}
+		} else if j.Pending() {
+			if e, ok := a.events.Latest(j.UUID, events.TypeQueue); ok {
+				msgs = append(msgs, job_manager.WSMessage(e))
+			}
+		}
+
+		status := a.jobManager.StatusMessage(j)
+		if !j.Archived {
+			status["position"] = pos
+		}
+		msg := ws.JobMessage(ws.TypeJob, j.UUID, status)
+		msg.EventID = latestID
+
+		return append(msgs, msg), nil
+
+	case ws.TopicBatch:
+		jobs, err := a.db.GetBatchJobs(ctx, t.UUID)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return []ws.Message{ws.BatchMessage(t.UUID, batch.GetProgress(jobs))}, nil
+	}
+	return nil, nil
+}
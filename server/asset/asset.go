@@ -0,0 +1,108 @@
+package asset
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+)
+
+// MAX_ASSET_SIZE is the largest file that can be uploaded. LoRAs and
+// embeddings are much smaller, but full VAEs are a few hundred MB.
+const MAX_ASSET_SIZE = 1 << 30
+
+// Kind is what an asset does to a job.
+type Kind string
+
+const (
+	KindLoRA      Kind = "lora"
+	KindEmbedding Kind = "embedding"
+	KindVAE       Kind = "vae"
+)
+
+// Extensions are the weight formats the entrypoint can load.
+var Extensions = []string{".safetensors", ".pt", ".bin", ".ckpt"}
+
+// Asset is an uploaded file that jobs can render with.
+type Asset struct {
+	ID   uuid.UUID `json:"id"`
+	Kind Kind      `json:"kind"`
+	Name string    `json:"name"`
+	// FileName is the stored file's name: the ID and the uploaded file's
+	// extension.
+	FileName string    `json:"fileName"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	OwnerID  int64     `json:"ownerID"`
+	Created  time.Time `json:"created"`
+}
+
+func (a Asset) String() string {
+	return fmt.Sprintf("%v %v (%v)", a.Kind, a.Name, a.ID)
+}
+
+func (k Kind) Valid() bool {
+	return k == KindLoRA || k == KindEmbedding || k == KindVAE
+}
+
+// New catalogs a file uploaded as uploadName. The size and checksum are
+// filled in as the file is stored.
+func New(kind Kind, name, uploadName string, ownerID int64) (Asset, error) {
+	if !kind.Valid() {
+		return Asset{}, errors.NotValidf("asset kind %q", kind)
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(uploadName), filepath.Ext(uploadName))
+	}
+	if name == "" {
+		return Asset{}, errors.NotValidf("empty asset name")
+	}
+
+	ext := strings.ToLower(filepath.Ext(uploadName))
+	if !validExtension(ext) {
+		return Asset{}, errors.NotValidf("file extension %q", ext)
+	}
+
+	id := uuid.New()
+	return Asset{
+		ID:       id,
+		Kind:     kind,
+		Name:     name,
+		FileName: id.String() + ext,
+		OwnerID:  ownerID,
+		Created:  time.Now().Truncate(time.Microsecond).UTC(),
+	}, nil
+}
+
+// Key is where the asset is kept in the S3 bucket.
+func (a Asset) Key() string {
+	return path.Join("assets", string(a.Kind), a.FileName)
+}
+
+// Checksum copies r to w, returning the hex SHA-256 of what was copied and
+// its size.
+func Checksum(w io.Writer, r io.Reader) (string, int64, error) {
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		return "", n, errors.Trace(err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func validExtension(ext string) bool {
+	for _, e := range Extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package asset
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	a, err := New(KindLoRA, " ", "styles/Watercolor.SafeTensors", 3)
+	assert.NoError(t, err)
+	assert.Equal(t, "Watercolor", a.Name)
+	assert.Equal(t, a.ID.String()+".safetensors", a.FileName)
+	assert.Equal(t, "assets/lora/"+a.FileName, a.Key())
+	assert.Equal(t, int64(3), a.OwnerID)
+
+	for _, tc := range []struct {
+		kind       Kind
+		name, file string
+	}{
+		{"checkpoint", "x", "x.safetensors"},
+		{KindVAE, "x", "x.zip"},
+		{KindEmbedding, "", ".pt"},
+	} {
+		_, err := New(tc.kind, tc.name, tc.file, 1)
+		assert.True(t, errors.IsNotValid(err), "%v: %v", tc, err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	var buf bytes.Buffer
+	sum, n, err := Checksum(&buf, strings.NewReader("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", sum)
+	assert.Equal(t, int64(5), n)
+	assert.Equal(t, "hello", buf.String())
+}
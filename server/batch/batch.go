@@ -0,0 +1,210 @@
+package batch
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/job"
+)
+
+// MAX_BATCH_SIZE limits how many jobs a single matrix can expand into.
+const MAX_BATCH_SIZE = 100
+
+type Size struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Matrix describes a grid of jobs. Every combination of the listed values
+// becomes one job. Empty lists use the job defaults.
+type Matrix struct {
+	Prompts       []string  `json:"prompts"`
+	Seeds         []int64   `json:"seeds"`
+	Scales        []float64 `json:"scales"`
+	Steps         []int     `json:"steps"`
+	Sizes         []Size    `json:"sizes"`
+	NumIterations int       `json:"numIterations"`
+	// Model is used by every job. Empty is the default model.
+	Model string `json:"model,omitempty"`
+	// Assets are used by every job.
+	Assets []job.AssetRef `json:"assets,omitempty"`
+}
+
+func (m Matrix) Value() (driver.Value, error) {
+	return json.Marshal(m)
+}
+
+func (m *Matrix) Scan(value interface{}) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+
+	return json.Unmarshal(b, &m)
+}
+
+// Size is the number of jobs the matrix expands into.
+func (m Matrix) Size() int {
+	return len(m.Prompts) * atLeastOne(len(m.Seeds)) * atLeastOne(len(m.Scales)) *
+		atLeastOne(len(m.Steps)) * atLeastOne(len(m.Sizes))
+}
+
+// Expand returns the settings for every job in the matrix, ordered by prompt,
+// then size, steps, scale and seed.
+func (m Matrix) Expand() ([]job.Settings, error) {
+	if len(m.Prompts) == 0 {
+		return nil, errors.New("missing prompts")
+	}
+	if n := m.Size(); n > MAX_BATCH_SIZE {
+		return nil, errors.Errorf("batch has %d jobs (max %d)", n, MAX_BATCH_SIZE)
+	}
+
+	var (
+		seeds  = m.Seeds
+		scales = m.Scales
+		steps  = m.Steps
+		sizes  = m.Sizes
+	)
+	if len(seeds) == 0 {
+		seeds = []int64{0}
+	}
+	if len(scales) == 0 {
+		scales = []float64{0}
+	}
+	if len(steps) == 0 {
+		steps = []int{0}
+	}
+	if len(sizes) == 0 {
+		sizes = []Size{{}}
+	}
+
+	settings := []job.Settings{}
+	for _, prompt := range m.Prompts {
+		for _, size := range sizes {
+			for _, st := range steps {
+				for _, scale := range scales {
+					for _, seed := range seeds {
+						settings = append(settings, job.Settings{
+							Prompt:        prompt,
+							Width:         size.Width,
+							Height:        size.Height,
+							NumIterations: m.NumIterations,
+							Steps:         st,
+							Scale:         scale,
+							Seed:          seed,
+							Model:         m.Model,
+							Assets:        m.Assets,
+						})
+					}
+				}
+			}
+		}
+	}
+
+	return settings, nil
+}
+
+// Label describes a job by the settings that vary across the matrix.
+func (m Matrix) Label(s job.Settings) string {
+	parts := []string{}
+	if len(m.Prompts) > 1 {
+		parts = append(parts, s.Prompt)
+	}
+	if len(m.Sizes) > 1 {
+		parts = append(parts, fmt.Sprintf("%dx%d", s.Width, s.Height))
+	}
+	if len(m.Steps) > 1 {
+		parts = append(parts, fmt.Sprintf("steps %d", s.Steps))
+	}
+	if len(m.Scales) > 1 {
+		parts = append(parts, fmt.Sprintf("scale %g", s.Scale))
+	}
+	if len(m.Seeds) > 1 {
+		parts = append(parts, fmt.Sprintf("seed %d", s.Seed))
+	}
+	if len(parts) == 0 {
+		return s.Prompt
+	}
+	return strings.Join(parts, ", ")
+}
+
+func atLeastOne(n int) int {
+	if n == 0 {
+		return 1
+	}
+	return n
+}
+
+type Batch struct {
+	UUID    uuid.UUID `json:"uuid"`
+	OwnerID int64     `json:"ownerID"`
+	Created time.Time `json:"created"`
+	Matrix  Matrix    `json:"matrix"`
+}
+
+// New expands the matrix into jobs that all belong to the new batch.
+func New(m Matrix, ownerID int64) (Batch, []job.Job, error) {
+	settings, err := m.Expand()
+	if err != nil {
+		return Batch{}, nil, errors.Trace(err)
+	}
+
+	b := Batch{
+		UUID:    uuid.New(),
+		OwnerID: ownerID,
+		Created: time.Now().Truncate(time.Microsecond).UTC(),
+		Matrix:  m,
+	}
+
+	jobs := make([]job.Job, 0, len(settings))
+	for i, s := range settings {
+		j, err := job.New(s)
+		if err != nil {
+			return Batch{}, nil, errors.Annotatef(err, "batch job %q", m.Label(s))
+		}
+		j.OwnerID = ownerID
+		j.BatchUUID = b.UUID
+		// Keep creation order identical to matrix order, which the contact
+		// sheet relies on.
+		j.Created = b.Created.Add(time.Duration(i) * time.Microsecond)
+		jobs = append(jobs, j)
+	}
+
+	return b, jobs, nil
+}
+
+// Progress summarizes the jobs in a batch.
+type Progress struct {
+	Total     int  `json:"total"`
+	Pending   int  `json:"pending"`
+	Running   int  `json:"running"`
+	Done      int  `json:"done"`
+	Error     int  `json:"error"`
+	Cancelled int  `json:"cancelled"`
+	Complete  bool `json:"complete"`
+}
+
+func GetProgress(jobs []job.Job) Progress {
+	p := Progress{Total: len(jobs)}
+	for _, j := range jobs {
+		switch j.Status() {
+		case "pending":
+			p.Pending++
+		case "running":
+			p.Running++
+		case string(job.ArchiveReasonDone):
+			p.Done++
+		case string(job.ArchiveReasonError):
+			p.Error++
+		case string(job.ArchiveReasonCancelled):
+			p.Cancelled++
+		}
+	}
+	p.Complete = p.Pending == 0 && p.Running == 0
+	return p
+}
@@ -0,0 +1,67 @@
+package batch
+
+import (
+	"image"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wellsjo/ai-art/server/job"
+)
+
+func TestExpand(t *testing.T) {
+	m := Matrix{
+		Prompts: []string{"cat", "dog"},
+		Seeds:   []int64{1, 2, 3},
+		Scales:  []float64{7.5},
+	}
+	assert.Equal(t, 6, m.Size())
+
+	settings, err := m.Expand()
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(settings))
+	assert.Equal(t, job.Settings{Prompt: "cat", Seed: 1, Scale: 7.5}, settings[0])
+	assert.Equal(t, job.Settings{Prompt: "dog", Seed: 3, Scale: 7.5}, settings[5])
+
+	assert.Equal(t, "dog, seed 3", m.Label(settings[5]))
+
+	_, err = Matrix{}.Expand()
+	assert.NotNil(t, err)
+
+	_, err = Matrix{Prompts: []string{"a"}, Seeds: make([]int64, MAX_BATCH_SIZE+1)}.Expand()
+	assert.NotNil(t, err)
+}
+
+func TestNew(t *testing.T) {
+	b, jobs, err := New(Matrix{
+		Prompts: []string{"cat"},
+		Sizes:   []Size{{Width: 256, Height: 256}, {Width: 512, Height: 256}},
+	}, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(jobs))
+
+	for i, j := range jobs {
+		assert.Equal(t, b.UUID, j.BatchUUID)
+		assert.Equal(t, int64(7), j.OwnerID)
+		if i > 0 {
+			assert.True(t, j.Created.After(jobs[i-1].Created))
+		}
+	}
+
+	_, _, err = New(Matrix{
+		Prompts: []string{"cat"},
+		Sizes:   []Size{{Width: 250, Height: 256}},
+	}, 7)
+	assert.NotNil(t, err)
+}
+
+func TestRenderContactSheet(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 512, 256))
+	sheet := RenderContactSheet([]Cell{
+		{Label: "one", Image: img},
+		{Label: "two"},
+		{Label: "three", Image: img},
+	}, 2)
+
+	assert.Equal(t, image.Rect(0, 0, 2*(thumbSize+padding)+padding, 2*(thumbSize+labelHeight+padding)+padding), sheet.Bounds())
+	assert.Equal(t, image.Rect(10, 20, 110, 70), fit(img.Bounds(), image.Rect(10, 10, 110, 80)))
+}
@@ -0,0 +1,93 @@
+package batch
+
+import (
+	"image"
+	"image/color"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	thumbSize   = 256
+	labelHeight = 20
+	padding     = 8
+)
+
+// Cell is one labeled image on a contact sheet. A nil Image is drawn as an
+// empty placeholder, e.g. for jobs that failed.
+type Cell struct {
+	Label string
+	Image image.Image
+}
+
+// RenderContactSheet lays cells out in a grid with the given number of
+// columns, scaling each image to fit a thumbnail and writing its label below.
+func RenderContactSheet(cells []Cell, columns int) image.Image {
+	if columns <= 0 {
+		columns = 1
+	}
+	rows := (len(cells) + columns - 1) / columns
+
+	cellW := thumbSize + padding
+	cellH := thumbSize + labelHeight + padding
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*cellW+padding, rows*cellH+padding))
+	draw.Draw(sheet, sheet.Bounds(), image.White, image.Point{}, draw.Src)
+
+	face := basicfont.Face7x13
+	placeholder := image.NewUniform(color.Gray{Y: 0xdd})
+
+	for i, cell := range cells {
+		x := padding + (i%columns)*cellW
+		y := padding + (i/columns)*cellH
+		thumb := image.Rect(x, y, x+thumbSize, y+thumbSize)
+
+		if cell.Image == nil {
+			draw.Draw(sheet, thumb, placeholder, image.Point{}, draw.Src)
+		} else {
+			draw.CatmullRom.Scale(sheet, fit(cell.Image.Bounds(), thumb), cell.Image, cell.Image.Bounds(), draw.Over, nil)
+		}
+
+		d := font.Drawer{
+			Dst:  sheet,
+			Src:  image.Black,
+			Face: face,
+			Dot:  fixed.P(x, y+thumbSize+labelHeight-5),
+		}
+		d.DrawString(truncate(cell.Label, face, thumbSize))
+	}
+
+	return sheet
+}
+
+// fit centers a rectangle with the aspect ratio of src inside dst.
+func fit(src, dst image.Rectangle) image.Rectangle {
+	sw, sh := src.Dx(), src.Dy()
+	dw, dh := dst.Dx(), dst.Dy()
+	if sw == 0 || sh == 0 {
+		return dst
+	}
+
+	w, h := dw, sh*dw/sw
+	if h > dh {
+		w, h = sw*dh/sh, dh
+	}
+
+	x := dst.Min.X + (dw-w)/2
+	y := dst.Min.Y + (dh-h)/2
+	return image.Rect(x, y, x+w, y+h)
+}
+
+func truncate(s string, face font.Face, width int) string {
+	if font.MeasureString(face, s).Ceil() <= width {
+		return s
+	}
+
+	r := []rune(s)
+	for len(r) > 0 && font.MeasureString(face, string(r)+"...").Ceil() > width {
+		r = r[:len(r)-1]
+	}
+	return string(r) + "..."
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/asset"
+)
+
+const assetColumns = `id, kind, name, file_name, size, sha256, owner_id, created`
+
+func (db *DB) AddAsset(ctx context.Context, a asset.Asset) error {
+	_, err := db.db.ExecContext(ctx, `
+	INSERT INTO assets (`+assetColumns+`)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, a.ID, a.Kind, a.Name, a.FileName, a.Size, a.SHA256, nullOwner(a.OwnerID), a.Created)
+	return errors.Annotate(err, "AddAsset")
+}
+
+func (db *DB) GetAsset(ctx context.Context, id uuid.UUID) (asset.Asset, bool, error) {
+	row := db.db.QueryRowContext(ctx, `SELECT `+assetColumns+` FROM assets WHERE id=$1`, id)
+
+	a, err := scanAsset(row)
+	if err == sql.ErrNoRows {
+		return asset.Asset{}, false, nil
+	} else if err != nil {
+		return asset.Asset{}, false, errors.Annotate(err, "GetAsset")
+	}
+	return a, true, nil
+}
+
+// GetAssets returns the assets of a kind, or of every kind if it is empty,
+// oldest first.
+func (db *DB) GetAssets(ctx context.Context, kind asset.Kind) ([]asset.Asset, error) {
+	rows, err := db.db.QueryContext(ctx, `
+	SELECT `+assetColumns+` FROM assets
+	WHERE $1='' OR kind=$1
+	ORDER BY created ASC
+	`, kind)
+	if err != nil {
+		return nil, errors.Annotate(err, "GetAssets")
+	}
+	defer rows.Close()
+
+	assets := []asset.Asset{}
+	for rows.Next() {
+		a, err := scanAsset(rows)
+		if err != nil {
+			return nil, errors.Annotate(err, "GetAssets Scan")
+		}
+		assets = append(assets, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return assets, nil
+}
+
+func (db *DB) DeleteAsset(ctx context.Context, id uuid.UUID) (bool, error) {
+	res, err := db.db.ExecContext(ctx, `DELETE FROM assets WHERE id=$1`, id)
+	if err != nil {
+		return false, errors.Annotate(err, "DeleteAsset")
+	}
+	n, err := res.RowsAffected()
+	return n > 0, errors.Trace(err)
+}
+
+func scanAsset(row scanner) (asset.Asset, error) {
+	var (
+		a       asset.Asset
+		ownerID sql.NullInt64
+	)
+	if err := row.Scan(&a.ID, &a.Kind, &a.Name, &a.FileName, &a.Size, &a.SHA256, &ownerID, &a.Created); err != nil {
+		return asset.Asset{}, err
+	}
+	a.OwnerID = ownerID.Int64
+	a.Created = a.Created.UTC()
+	return a, nil
+}
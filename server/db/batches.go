@@ -0,0 +1,115 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/batch"
+	"github.com/wellsjo/ai-art/server/job"
+)
+
+// AddBatch queues all of a batch's jobs at once, so a batch is never left
+// half submitted.
+func (db *DB) AddBatch(ctx context.Context, b batch.Batch, jobs []job.Job) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO batches (uuid, owner_id, created, matrix) VALUES ($1, $2, $3, $4)`,
+		b.UUID, nullOwner(b.OwnerID), b.Created, b.Matrix,
+	)
+	if err != nil {
+		return errors.Annotate(err, "AddBatch")
+	}
+
+	for _, j := range jobs {
+		if _, err := insertJob(ctx, tx, j); err != nil {
+			return errors.Annotate(err, "AddBatch job")
+		}
+	}
+
+	return errors.Trace(tx.Commit())
+}
+
+func (db *DB) GetBatch(ctx context.Context, uuid_ uuid.UUID) (batch.Batch, bool, error) {
+	row := db.db.QueryRowContext(ctx,
+		`SELECT uuid, owner_id, created, matrix FROM batches WHERE uuid=$1`,
+		uuid_,
+	)
+
+	var (
+		b       batch.Batch
+		ownerID sql.NullInt64
+	)
+	if err := row.Scan(&b.UUID, &ownerID, &b.Created, &b.Matrix); err == sql.ErrNoRows {
+		return batch.Batch{}, false, nil
+	} else if err != nil {
+		return batch.Batch{}, false, errors.Annotate(err, "GetBatch")
+	}
+	b.OwnerID = ownerID.Int64
+	b.Created = b.Created.UTC()
+
+	return b, true, nil
+}
+
+// GetBatchJobs returns every job in a batch, queued or archived, in the order
+// they were created.
+func (db *DB) GetBatchJobs(ctx context.Context, uuid_ uuid.UUID) ([]job.Job, error) {
+	jobs, err := db.selectJobsWhere(ctx, "batch_id=$1", uuid_)
+	return jobs, errors.Annotate(err, "GetBatchJobs")
+}
+
+// selectJobsWhere returns the queued and archived jobs matching a condition,
+// in the order they were created.
+func (db *DB) selectJobsWhere(ctx context.Context, where string, args ...interface{}) ([]job.Job, error) {
+	jobs := []job.Job{}
+
+	rows, err := db.db.QueryContext(ctx, `SELECT `+jobColumns+` FROM jobs WHERE `+where, args...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	archiveRows, err := db.db.QueryContext(ctx, `SELECT `+archiveColumns+` FROM jobs_archive WHERE `+where, args...)
+	if err != nil {
+		return nil, errors.Annotate(err, "archive")
+	}
+	defer archiveRows.Close()
+
+	for archiveRows.Next() {
+		j, err := scanArchivedJob(archiveRows)
+		if err != nil {
+			return nil, errors.Annotate(err, "archive")
+		}
+		jobs = append(jobs, j)
+	}
+	if err := archiveRows.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	sortByCreated(jobs)
+	return jobs, nil
+}
+
+func sortByCreated(jobs []job.Job) {
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].Created.Before(jobs[k].Created)
+	})
+}
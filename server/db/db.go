@@ -4,11 +4,13 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/eta"
 	"github.com/wellsjo/ai-art/server/job"
 
 	_ "github.com/lib/pq"
@@ -18,6 +20,35 @@ type DB struct {
 	db *sql.DB
 }
 
+// Columns selected by every query that returns rows from jobs or
+// jobs_archive. They must stay in the order that scanJob and
+// scanArchivedJob expect.
+const (
+	jobColumns        = `uuid, owner_id, client_ip, batch_id, parent_id, callback_url, created, settings, start_time, end_time, hardware, running, priority`
+	archiveColumns    = `uuid, owner_id, client_ip, batch_id, parent_id, callback_url, created, settings, start_time, end_time, hardware, archive_reason`
+	archiveMoveInsert = `INSERT INTO jobs_archive (id, uuid, owner_id, client_ip, batch_id, parent_id, callback_url, cost, created, settings, start_time, hardware, end_time, archive_reason)`
+	archiveMoveSelect = `a.id, a.uuid, a.owner_id, a.client_ip, a.batch_id, a.parent_id, a.callback_url, a.cost, a.created, a.settings, a.start_time, a.hardware`
+)
+
+// queueOrder ranks pending jobs in the order they will be run. Higher
+// priorities go first. Within a priority, owners take turns so one user's
+// large batch can't starve everyone else: each owner's oldest job comes
+// before anyone's second oldest, and so on.
+const queueOrder = `
+	SELECT uuid, row_number() OVER (ORDER BY priority DESC, owner_rank ASC, created ASC) AS position
+	FROM (
+		SELECT uuid, priority, created,
+			row_number() OVER (PARTITION BY owner_id, priority ORDER BY created ASC) AS owner_rank
+		FROM jobs
+		WHERE running=false
+	) ranked
+`
+
+// jobReady holds for jobs, as r, that have no parent or whose parent
+// finished. Jobs waiting on their parent keep their place in the queue, but
+// the jobs behind them are run first.
+const jobReady = `(r.parent_id IS NULL OR EXISTS (SELECT 1 FROM jobs_archive p WHERE p.uuid=r.parent_id AND p.archive_reason='done'))`
+
 func Connect(host string, port int, user string, password string, dbname string) (*DB, error) {
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+
 		"password=%s dbname=%s sslmode=disable",
@@ -33,11 +64,14 @@ func Connect(host string, port int, user string, password string, dbname string)
 	}, nil
 }
 
-func (db *DB) AddJob(j job.Job) error {
-	result, err := db.db.Exec(
-		`INSERT INTO jobs (uuid, created, settings) VALUES ($1, $2, $3)`,
-		j.UUID, j.Created, j.Settings,
-	)
+// Ping fails if the database can't be reached. Connect doesn't open a
+// connection, so this is the first point at which bad settings show up.
+func (db *DB) Ping(ctx context.Context) error {
+	return errors.Trace(db.db.PingContext(ctx))
+}
+
+func (db *DB) AddJob(ctx context.Context, j job.Job) error {
+	result, err := insertJob(ctx, db.db, j)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -47,22 +81,23 @@ func (db *DB) AddJob(j job.Job) error {
 		return errors.Trace(err)
 	}
 
-	log.Println(rowsAffected, "rows affected")
+	slog.Debug("Added job", "job", j.UUID, "rowsAffected", rowsAffected)
 	return nil
 }
 
-// Position is -1 if job is done, 0 if job is running.
-func (db *DB) GetJobByUUID(uuid_ uuid.UUID) (job.Job, bool, int, error) {
-	j, found, err := db.selectJobByUUID(uuid_)
+// Position is -1 if job is done, 0 if job is running, and otherwise the
+// job's place among pending jobs starting from 1.
+func (db *DB) GetJobByUUID(ctx context.Context, uuid_ uuid.UUID) (job.Job, bool, int, error) {
+	j, found, err := db.selectJobByUUID(ctx, uuid_)
 	if err != nil {
 		return job.Job{}, false, 0, errors.Trace(err)
 	}
 	if found {
-		pos, err := db.getJobQueuePosition(j)
+		pos, err := db.getJobQueuePosition(ctx, j)
 		return j, true, pos, errors.Trace(err)
 	}
 
-	j, found, err = db.selectJobArchiveByUUID(uuid_)
+	j, found, err = db.selectJobArchiveByUUID(ctx, uuid_)
 	if err != nil {
 		return job.Job{}, false, 0, errors.Trace(err)
 	}
@@ -73,139 +108,120 @@ func (db *DB) GetJobByUUID(uuid_ uuid.UUID) (job.Job, bool, int, error) {
 	return j, true, -1, nil
 }
 
-func (db *DB) getJobQueuePosition(j job.Job) (int, error) {
-	rows, err := db.db.Query(`
-	SELECT count(*) FROM jobs WHERE created < $1
-	`, j.Created)
-	if err != nil {
-		return 0, errors.Annotate(err, "getJobQueuePosition")
+func (db *DB) getJobQueuePosition(ctx context.Context, j job.Job) (int, error) {
+	if j.Running {
+		return 0, nil
 	}
-	defer rows.Close()
 
-	rows.Next()
+	row := db.db.QueryRowContext(ctx, `
+	SELECT q.position FROM (`+queueOrder+`) q WHERE q.uuid=$1
+	`, j.UUID)
+
 	var position int
-	rows.Scan(&position)
+	if err := row.Scan(&position); err != nil {
+		return 0, errors.Annotate(err, "getJobQueuePosition")
+	}
 
 	return position, nil
 }
 
-func (db *DB) selectJobByUUID(uuid_ uuid.UUID) (job.Job, bool, error) {
-	row := db.db.QueryRow(`
-	SELECT created, settings, running, start_time, end_time FROM jobs WHERE uuid=$1
-	`, uuid_)
+func (db *DB) selectJobByUUID(ctx context.Context, uuid_ uuid.UUID) (job.Job, bool, error) {
+	row := db.db.QueryRowContext(ctx, `SELECT `+jobColumns+` FROM jobs WHERE uuid=$1`, uuid_)
 	if err := row.Err(); err != nil {
 		return job.Job{}, false, errors.Annotate(err, "GetJobByUUID")
 	}
 
-	var (
-		created   time.Time
-		settings  job.Settings
-		running   bool
-		startTime *time.Time
-		endTime   *time.Time
-	)
-	if err := row.Scan(
-		&created, &settings, &running, &startTime, &endTime,
-	); err == sql.ErrNoRows {
+	j, err := scanJob(row)
+	if err == sql.ErrNoRows {
 		return job.Job{}, false, nil
 	} else if err != nil {
 		return job.Job{}, false, errors.Annotate(err, "GetJobByUUID")
 	}
 
-	log.Println("GET JOB", created.UTC())
-
-	return job.Job{
-		UUID:      uuid_,
-		Created:   created.UTC(),
-		Settings:  settings,
-		Running:   running,
-		StartTime: startTime,
-		EndTime:   endTime,
-	}, true, nil
+	return j, true, nil
 }
 
-func (db *DB) selectJobArchiveByUUID(uuid_ uuid.UUID) (job.Job, bool, error) {
-	row := db.db.QueryRow(
-		`SELECT created, settings, start_time, end_time, archive_reason FROM jobs_archive WHERE uuid=$1`,
-		uuid_,
-	)
+func (db *DB) selectJobArchiveByUUID(ctx context.Context, uuid_ uuid.UUID) (job.Job, bool, error) {
+	row := db.db.QueryRowContext(ctx, `SELECT `+archiveColumns+` FROM jobs_archive WHERE uuid=$1`, uuid_)
 	if err := row.Err(); err != nil {
 		return job.Job{}, false, errors.Annotate(err, "GetJobByUUID")
 	}
 
-	var (
-		created       time.Time
-		settings      job.Settings
-		startTime     *time.Time
-		endTime       *time.Time
-		archiveReason job.ArchiveReason
-	)
-	if err := row.Scan(&created, &settings, &startTime, &endTime, &archiveReason); err == sql.ErrNoRows {
+	j, err := scanArchivedJob(row)
+	if err == sql.ErrNoRows {
 		return job.Job{}, false, nil
 	} else if err != nil {
 		return job.Job{}, false, errors.Annotate(err, "GetJobByUUID")
 	}
 
-	return job.Job{
-		UUID:          uuid_,
-		Created:       created.UTC(),
-		Settings:      settings,
-		StartTime:     startTime,
-		EndTime:       endTime,
-		Archived:      true,
-		ArchiveReason: &archiveReason,
-	}, true, nil
+	return j, true, nil
 }
 
-func (db *DB) GetNextJob() (job.Job, bool, error) {
-	// TODO pass context from caller
-	tx, err := db.db.BeginTx(context.Background(), nil)
-	if err != nil {
+// GetNextJob claims the job at the front of the queue. hardware is recorded
+// on the job so durations can be compared like for like, and worker so the
+// job can be found again if the worker stops while running it.
+func (db *DB) GetNextJob(ctx context.Context, hardware, worker string) (job.Job, bool, error) {
+	// Take the first job in the queue that isn't waiting on its parent, and
+	// update it to running=true
+	row := db.db.QueryRowContext(ctx, `
+		UPDATE jobs
+			SET running=true, start_time=$1, hardware=$2, worker=$3
+		FROM (
+			SELECT `+jobColumns+`
+			FROM jobs
+			WHERE uuid=(
+				SELECT q.uuid FROM (`+queueOrder+`) q
+				JOIN jobs r ON r.uuid=q.uuid
+				WHERE `+jobReady+`
+				ORDER BY q.position LIMIT 1
+			)
+			FOR UPDATE
+		) a
+		WHERE jobs.uuid=a.uuid
+		RETURNING a.*
+	`, time.Now().UTC(), hardware, worker)
+
+	j, found, err := scanJobRow(row)
+	if err != nil || !found {
 		return job.Job{}, false, errors.Trace(err)
 	}
-	defer tx.Rollback()
+	return j, true, nil
+}
 
-	// First look for running jobs, in case we crashed
-	row := db.db.QueryRow(`
-	SELECT uuid, created, settings, start_time, end_time
-	FROM jobs WHERE running=true
-	ORDER BY created ASC
-	LIMIT 1
-	`)
+// GetRunningJobs returns the jobs a worker claimed and didn't archive, oldest
+// first.
+func (db *DB) GetRunningJobs(ctx context.Context, worker string) ([]job.Job, error) {
+	jobs, err := db.selectJobsWhere(ctx, "running=true AND worker=$1 ORDER BY created ASC", worker)
+	return jobs, errors.Annotate(err, "GetRunningJobs")
+}
 
-	j, found, err := scanJobRow(row)
+// SetJobPriority changes the priority of a queued job. found is false if the
+// job isn't waiting in the queue.
+func (db *DB) SetJobPriority(ctx context.Context, uuid_ uuid.UUID, priority int) (bool, error) {
+	result, err := db.db.ExecContext(ctx,
+		`UPDATE jobs SET priority=$2 WHERE uuid=$1 AND running=false`,
+		uuid_, priority,
+	)
 	if err != nil {
-		return job.Job{}, false, errors.Trace(err)
-	}
-	if found {
-		return j, true, nil
+		return false, errors.Annotate(err, "SetJobPriority")
 	}
 
-	// Next look for the most recently created job and update it to running=true
-	row = db.db.QueryRow(`
-		UPDATE jobs
-			SET running=true, start_time=$1
-		FROM (
-			SELECT uuid, created, settings, start_time, end_time
-			FROM jobs
-			WHERE running=false
-			ORDER BY created ASC
-			LIMIT 1
-		) a
-		RETURNING a.*
-	`, time.Now().UTC())
+	ra, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Annotate(err, "SetJobPriority RowsAffected")
+	}
 
-	return scanJobRow(row)
+	return ra == 1, nil
 }
 
-func (db *DB) ArchiveJob(ar job.ArchiveReason, uuid_ uuid.UUID, endTime time.Time) error {
-	result, err := db.db.Exec(`
+func (db *DB) ArchiveJob(ctx context.Context, ar job.ArchiveReason, uuid_ uuid.UUID, endTime time.Time) error {
+	result, err := db.db.ExecContext(ctx, `
 	WITH moved_row AS (
     DELETE FROM jobs a
 		WHERE a.uuid=$1
-		RETURNING a.id, a.uuid, a.created, a.settings, a.start_time, $2::timestamptz, $3::archive_reason
+		RETURNING `+archiveMoveSelect+`, $2::timestamptz, $3::archive_reason
 	)
-	INSERT INTO jobs_archive (id, uuid, created, settings, start_time, end_time, archive_reason)
+	`+archiveMoveInsert+`
 		SELECT * FROM moved_row
 	`, uuid_, endTime, ar)
 	if err != nil {
@@ -223,9 +239,146 @@ func (db *DB) ArchiveJob(ar job.ArchiveReason, uuid_ uuid.UUID, endTime time.Tim
 	return nil
 }
 
-func (db *DB) GetAllJobs() ([]job.Job, error) {
-	rows, err := db.db.Query(`
-	SELECT uuid, created, settings, start_time, end_time FROM jobs
+// SetJobOutput stores the log of an archived job.
+func (db *DB) SetJobOutput(ctx context.Context, uuid_ uuid.UUID, output string) error {
+	_, err := db.db.ExecContext(ctx, `UPDATE jobs_archive SET job_output=$2 WHERE uuid=$1`, uuid_, output)
+	return errors.Annotate(err, "SetJobOutput")
+}
+
+// GetJobOutput returns the log of an archived job. found is false if the job
+// isn't archived or never ran.
+func (db *DB) GetJobOutput(ctx context.Context, uuid_ uuid.UUID) (string, bool, error) {
+	var output sql.NullString
+	err := db.db.QueryRowContext(ctx, `SELECT job_output FROM jobs_archive WHERE uuid=$1`, uuid_).Scan(&output)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, errors.Annotate(err, "GetJobOutput")
+	}
+	return output.String, output.Valid, nil
+}
+
+// CancelJob archives a job as cancelled, but only if it has not started
+// running yet. found is false if the job is not in the queue.
+func (db *DB) CancelJob(ctx context.Context, uuid_ uuid.UUID, endTime time.Time) (bool, error) {
+	result, err := db.db.ExecContext(ctx, `
+	WITH moved_row AS (
+		DELETE FROM jobs a
+		WHERE a.uuid=$1 AND a.running=false
+		RETURNING `+archiveMoveSelect+`, $2::timestamptz, $3::archive_reason
+	)
+	`+archiveMoveInsert+`
+		SELECT * FROM moved_row
+	`, uuid_, endTime, job.ArchiveReasonCancelled)
+	if err != nil {
+		return false, errors.Annotate(err, "CancelJob Query")
+	}
+
+	ra, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Annotate(err, "CancelJob RowsAffected")
+	}
+
+	return ra == 1, nil
+}
+
+// GetChildJobs returns the jobs that start from a job's image, queued or
+// archived, in the order they were created.
+func (db *DB) GetChildJobs(ctx context.Context, parent uuid.UUID) ([]job.Job, error) {
+	jobs, err := db.selectJobsWhere(ctx, "parent_id=$1", parent)
+	return jobs, errors.Annotate(err, "GetChildJobs")
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertJob(ctx context.Context, e execer, j job.Job) (sql.Result, error) {
+	return e.ExecContext(ctx, `
+	INSERT INTO jobs (uuid, owner_id, client_ip, batch_id, parent_id, callback_url, cost, created, settings, priority)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`, j.UUID, nullOwner(j.OwnerID), j.ClientIP, nullUUID(j.BatchUUID), nullUUID(j.ParentUUID), j.CallbackURL, j.Settings.Cost(), j.Created, j.Settings, j.Priority)
+}
+
+// GetQueuedJobs returns the running jobs, and the pending jobs in the order
+// they will run.
+func (db *DB) GetQueuedJobs(ctx context.Context) ([]job.Job, []job.Job, error) {
+	rows, err := db.db.QueryContext(ctx, `
+	SELECT `+prefixColumns("j", jobColumns)+`
+	FROM jobs j
+	LEFT JOIN (`+queueOrder+`) q ON q.uuid=j.uuid
+	ORDER BY j.running DESC, q.position ASC
+	`)
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "GetQueuedJobs")
+	}
+	defer rows.Close()
+
+	running, pending := []job.Job{}, []job.Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, nil, errors.Annotate(err, "GetQueuedJobs")
+		}
+		if j.Running {
+			running = append(running, j)
+		} else {
+			pending = append(pending, j)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	return running, pending, nil
+}
+
+// CountPendingJobs returns how many jobs are waiting to run.
+func (db *DB) CountPendingJobs(ctx context.Context) (int, error) {
+	var n int
+	err := db.db.QueryRowContext(ctx, `SELECT count(*) FROM jobs WHERE running=false`).Scan(&n)
+	return n, errors.Annotate(err, "CountPendingJobs")
+}
+
+// GetDurationSamples returns how long the most recent successful jobs took
+// on the given hardware.
+func (db *DB) GetDurationSamples(ctx context.Context, hardware string, limit int) ([]eta.Sample, error) {
+	rows, err := db.db.QueryContext(ctx, `
+	SELECT settings, extract(epoch FROM end_time - start_time) FROM jobs_archive
+	WHERE archive_reason='done' AND hardware=$1 AND start_time IS NOT NULL AND end_time IS NOT NULL
+	ORDER BY end_time DESC
+	LIMIT $2
+	`, hardware, limit)
+	if err != nil {
+		return nil, errors.Annotate(err, "GetDurationSamples")
+	}
+	defer rows.Close()
+
+	samples := []eta.Sample{}
+	for rows.Next() {
+		var (
+			s       eta.Sample
+			seconds float64
+		)
+		if err := rows.Scan(&s.Settings, &seconds); err != nil {
+			return nil, errors.Annotate(err, "GetDurationSamples Scan")
+		}
+		s.Duration = time.Duration(seconds * float64(time.Second))
+		samples = append(samples, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return samples, nil
+}
+
+func (db *DB) GetAllJobs(ctx context.Context) ([]job.Job, error) {
+	rows, err := db.db.QueryContext(ctx, `
+	SELECT `+jobColumns+` FROM jobs
 	ORDER BY created ASC
 	`)
 	if err != nil {
@@ -235,21 +388,11 @@ func (db *DB) GetAllJobs() ([]job.Job, error) {
 
 	jobs := []job.Job{}
 	for rows.Next() {
-		var (
-			uuid_     uuid.UUID
-			created   time.Time
-			settings  job.Settings
-			startTime *time.Time
-			endTime   *time.Time
-		)
-		rows.Scan(&uuid_, &created, &settings, &startTime, &endTime)
-		jobs = append(jobs, job.Job{
-			UUID:      uuid_,
-			Created:   created.UTC(),
-			Settings:  settings,
-			StartTime: startTime,
-			EndTime:   endTime,
-		})
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, errors.Annotate(err, "GetAllJobs")
+		}
+		jobs = append(jobs, j)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -260,31 +403,98 @@ func (db *DB) GetAllJobs() ([]job.Job, error) {
 }
 
 func scanJobRow(row *sql.Row) (job.Job, bool, error) {
-	var (
-		uuid_     uuid.UUID
-		created   time.Time
-		settings  job.Settings
-		startTime *time.Time
-		endTime   *time.Time
-	)
-
 	if err := row.Err(); err != nil {
 		return job.Job{}, false, errors.Annotate(err, "GetNextJob")
 	}
 
-	if err := row.Scan(&uuid_, &created, &settings, &startTime, &endTime); err == sql.ErrNoRows {
+	j, err := scanJob(row)
+	if err == sql.ErrNoRows {
 		return job.Job{}, false, nil
 	} else if err != nil {
 		return job.Job{}, false, errors.Annotate(err, "scanJobRow")
 	}
 
-	return job.Job{
-		UUID:      uuid_,
-		Created:   created.UTC(),
-		Settings:  settings,
-		StartTime: startTime,
-		EndTime:   endTime,
-	}, true, nil
+	return j, true, nil
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanJob reads a row selected with jobColumns.
+func scanJob(row scanner) (job.Job, error) {
+	var (
+		j           job.Job
+		ownerID     sql.NullInt64
+		clientIP    sql.NullString
+		batchUUID   uuid.NullUUID
+		parentUUID  uuid.NullUUID
+		callbackURL sql.NullString
+		hardware    sql.NullString
+	)
+	if err := row.Scan(
+		&j.UUID, &ownerID, &clientIP, &batchUUID, &parentUUID, &callbackURL, &j.Created, &j.Settings, &j.StartTime, &j.EndTime, &hardware, &j.Running, &j.Priority,
+	); err != nil {
+		return job.Job{}, err
+	}
+
+	j.BatchUUID = batchUUID.UUID
+	j.ParentUUID = parentUUID.UUID
+	j.CallbackURL = callbackURL.String
+	j.OwnerID = ownerID.Int64
+	j.ClientIP = clientIP.String
+	j.Hardware = hardware.String
+	j.Created = j.Created.UTC()
+	return j, nil
+}
+
+// scanArchivedJob reads a row selected with archiveColumns.
+func scanArchivedJob(row scanner) (job.Job, error) {
+	var (
+		j             job.Job
+		ownerID       sql.NullInt64
+		clientIP      sql.NullString
+		batchUUID     uuid.NullUUID
+		parentUUID    uuid.NullUUID
+		callbackURL   sql.NullString
+		hardware      sql.NullString
+		archiveReason job.ArchiveReason
+	)
+	if err := row.Scan(
+		&j.UUID, &ownerID, &clientIP, &batchUUID, &parentUUID, &callbackURL, &j.Created, &j.Settings, &j.StartTime, &j.EndTime, &hardware, &archiveReason,
+	); err != nil {
+		return job.Job{}, err
+	}
+
+	j.BatchUUID = batchUUID.UUID
+	j.ParentUUID = parentUUID.UUID
+	j.CallbackURL = callbackURL.String
+	j.OwnerID = ownerID.Int64
+	j.ClientIP = clientIP.String
+	j.Hardware = hardware.String
+	j.Created = j.Created.UTC()
+	j.Archived = true
+	j.ArchiveReason = &archiveReason
+	return j, nil
+}
+
+// prefixColumns qualifies a column list with a table alias.
+func prefixColumns(alias, columns string) string {
+	cols := strings.Split(columns, ", ")
+	for i, c := range cols {
+		cols[i] = alias + "." + c
+	}
+	return strings.Join(cols, ", ")
+}
+
+// Jobs created before user accounts existed have no owner.
+func nullOwner(ownerID int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: ownerID, Valid: ownerID != 0}
+}
+
+func nullUUID(uuid_ uuid.UUID) uuid.NullUUID {
+	return uuid.NullUUID{UUID: uuid_, Valid: uuid_ != uuid.Nil}
 }
 
 func GetTestConnection() (*DB, error) {
@@ -293,7 +503,7 @@ func GetTestConnection() (*DB, error) {
 		return nil, errors.Trace(err)
 	}
 
-	err = db.Reset()
+	err = db.Reset(context.Background())
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"log"
 	"testing"
 	"time"
@@ -9,15 +10,24 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/user"
 )
 
-func TestDB(t *testing.T) {
+// testConnection skips tests that need Postgres when it can't be reached,
+// like the Store suite does.
+func testConnection(t *testing.T) *DB {
 	db, err := GetTestConnection()
 	if err != nil {
-		FatalError(err)
+		t.Skipf("postgres unavailable: %v", err)
 	}
+	return db
+}
+
+func TestDB(t *testing.T) {
+	ctx := context.Background()
+	db := testConnection(t)
 
-	jobs, err := db.GetAllJobs()
+	jobs, err := db.GetAllJobs(ctx)
 	if err != nil {
 		FatalError(err)
 	}
@@ -28,25 +38,25 @@ func TestDB(t *testing.T) {
 
 	j1 := NewTestJob("hello")
 	assert.Nil(t, err)
-	err = db.AddJob(j1)
+	err = db.AddJob(ctx, j1)
 	if err != nil {
 		FatalError(err)
 	}
 	log.Println("Added Job", j1)
 
-	j1Get, found, _, err := db.GetJobByUUID(j1.UUID)
+	j1Get, found, _, err := db.GetJobByUUID(ctx, j1.UUID)
 	assert.Nil(t, err)
 	assert.Equal(t, true, found)
 	assert.Equal(t, j1, j1Get)
 
 	j2 := NewTestJob("hello2")
-	err = db.AddJob(j2)
+	err = db.AddJob(ctx, j2)
 	if err != nil {
 		FatalError(err)
 	}
 	log.Println("Added Job", j2)
 
-	jobs, err = db.GetAllJobs()
+	jobs, err = db.GetAllJobs(ctx)
 	if err != nil {
 		FatalError(err)
 	}
@@ -56,7 +66,7 @@ func TestDB(t *testing.T) {
 	assert.Equal(t, jobs[0], j1)
 	assert.Equal(t, jobs[1], j2)
 
-	nextJob, found, err := db.GetNextJob()
+	nextJob, found, err := db.GetNextJob(ctx, "", "")
 	if err != nil {
 		FatalError(err)
 	}
@@ -66,13 +76,13 @@ func TestDB(t *testing.T) {
 	assert.Equal(t, j1, nextJob)
 
 	log.Println("Archiving", nextJob.UUID)
-	err = db.ArchiveJob(job.ArchiveReasonDone, nextJob.UUID, time.Now())
+	err = db.ArchiveJob(ctx, job.ArchiveReasonDone, nextJob.UUID, time.Now())
 	if err != nil {
 		FatalError(err)
 	}
 
 	log.Println("GET", nextJob.UUID)
-	j, found, _, err := db.GetJobByUUID(nextJob.UUID)
+	j, found, _, err := db.GetJobByUUID(ctx, nextJob.UUID)
 	log.Println("Job", j)
 
 	assert.True(t, j.Archived)
@@ -81,24 +91,22 @@ func TestDB(t *testing.T) {
 }
 
 func TestGetNextJob(t *testing.T) {
-	db, err := GetTestConnection()
-	if err != nil {
-		FatalError(err)
-	}
+	ctx := context.Background()
+	db := testConnection(t)
 
 	j1 := NewTestJob("hello")
-	err = db.AddJob(j1)
+	err := db.AddJob(ctx, j1)
 	if err != nil {
 		FatalError(err)
 	}
 
 	j2 := NewTestJob("hello2")
-	err = db.AddJob(j2)
+	err = db.AddJob(ctx, j2)
 	if err != nil {
 		FatalError(err)
 	}
 
-	j, found, err := db.GetNextJob()
+	j, found, err := db.GetNextJob(ctx, "", "")
 	if err != nil {
 		FatalError(err)
 	}
@@ -107,10 +115,10 @@ func TestGetNextJob(t *testing.T) {
 	assert.Equal(t, j1, j)
 	assert.Nil(t, err)
 
-	err = db.ArchiveJob(job.ArchiveReasonDone, j.UUID, time.Now())
+	err = db.ArchiveJob(ctx, job.ArchiveReasonDone, j.UUID, time.Now())
 	assert.Nil(t, err)
 
-	j, found, err = db.GetNextJob()
+	j, found, err = db.GetNextJob(ctx, "", "")
 	if err != nil {
 		FatalError(err)
 	}
@@ -122,32 +130,30 @@ func TestGetNextJob(t *testing.T) {
 	assert.Equal(t, j2, j)
 	assert.Nil(t, err)
 
-	err = db.ArchiveJob(job.ArchiveReasonDone, j.UUID, time.Now())
+	err = db.ArchiveJob(ctx, job.ArchiveReasonDone, j.UUID, time.Now())
 	assert.Nil(t, err)
 
-	_, found, err = db.GetNextJob()
+	_, found, err = db.GetNextJob(ctx, "", "")
 	assert.False(t, found)
 	assert.Nil(t, err)
 }
 
 func TestArchive(t *testing.T) {
-	db, err := GetTestConnection()
-	if err != nil {
-		FatalError(err)
-	}
+	ctx := context.Background()
+	db := testConnection(t)
 
 	j := NewTestJob("hello")
-	err = db.AddJob(j)
+	err := db.AddJob(ctx, j)
 	if err != nil {
 		FatalError(err)
 	}
 
-	err = db.ArchiveJob(job.ArchiveReasonDone, j.UUID, time.Now())
+	err = db.ArchiveJob(ctx, job.ArchiveReasonDone, j.UUID, time.Now())
 	if err != nil {
 		FatalError(err)
 	}
 
-	jobs, err := db.GetAllJobs()
+	jobs, err := db.GetAllJobs(ctx)
 	if err != nil {
 		FatalError(err)
 	}
@@ -155,41 +161,135 @@ func TestArchive(t *testing.T) {
 	assert.Equal(t, 0, len(jobs))
 }
 
-func TestPending(t *testing.T) {
-	db, err := GetTestConnection()
+func TestJobOutput(t *testing.T) {
+	ctx := context.Background()
+	db := testConnection(t)
+
+	j := NewTestJob("hello")
+	err := db.AddJob(ctx, j)
+	if err != nil {
+		FatalError(err)
+	}
+
+	_, found, err := db.GetJobOutput(ctx, j.UUID)
+	assert.Nil(t, err)
+	assert.False(t, found)
+
+	err = db.ArchiveJob(ctx, job.ArchiveReasonDone, j.UUID, time.Now())
 	if err != nil {
 		FatalError(err)
 	}
 
+	err = db.SetJobOutput(ctx, j.UUID, "step 1\nstep 2\n")
+	assert.Nil(t, err)
+
+	output, found, err := db.GetJobOutput(ctx, j.UUID)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "step 1\nstep 2\n", output)
+}
+
+func TestPending(t *testing.T) {
+	ctx := context.Background()
+	db := testConnection(t)
+
 	j := NewTestJob("hello")
-	err = db.AddJob(j)
+	err := db.AddJob(ctx, j)
 	if err != nil {
 		FatalError(err)
 	}
 
 	j2 := NewTestJob("hello2")
-	err = db.AddJob(j2)
+	err = db.AddJob(ctx, j2)
 	if err != nil {
 		FatalError(err)
 	}
 
 	j3 := NewTestJob("hello3")
-	err = db.AddJob(j3)
+	err = db.AddJob(ctx, j3)
 	if err != nil {
 		FatalError(err)
 	}
 
-	pos, err := db.getJobQueuePosition(j)
+	pos, err := db.getJobQueuePosition(ctx, j)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pos)
+
+	pos, err = db.getJobQueuePosition(ctx, j2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, pos)
+
+	pos, err = db.getJobQueuePosition(ctx, j3)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, pos)
+
+	// The running job is no longer counted ahead of pending jobs
+	_, _, err = db.GetNextJob(ctx, "", "")
+	assert.Nil(t, err)
+
+	_, _, pos, err = db.GetJobByUUID(ctx, j.UUID)
 	assert.Nil(t, err)
 	assert.Equal(t, 0, pos)
 
-	pos, err = db.getJobQueuePosition(j2)
+	_, _, pos, err = db.GetJobByUUID(ctx, j3.UUID)
 	assert.Nil(t, err)
-	assert.Equal(t, 1, pos)
+	assert.Equal(t, 2, pos)
+}
+
+func TestFairShare(t *testing.T) {
+	ctx := context.Background()
+	db := testConnection(t)
+
+	alice := NewTestUser(db, "alice")
+	bob := NewTestUser(db, "bob")
+
+	// Alice queues a batch before Bob submits anything
+	a1 := NewTestJobFor("a1", alice.ID)
+	a2 := NewTestJobFor("a2", alice.ID)
+	a3 := NewTestJobFor("a3", alice.ID)
+	b1 := NewTestJobFor("b1", bob.ID)
+	b2 := NewTestJobFor("b2", bob.ID)
+	for _, j := range []job.Job{a1, a2, a3, b1, b2} {
+		if err := db.AddJob(ctx, j); err != nil {
+			FatalError(err)
+		}
+	}
 
-	pos, err = db.getJobQueuePosition(j3)
+	_, _, pos, err := db.GetJobByUUID(ctx, b1.UUID)
 	assert.Nil(t, err)
 	assert.Equal(t, 2, pos)
+
+	// Bumping a job moves it to the front
+	found, err := db.SetJobPriority(ctx, b2.UUID, 1)
+	assert.Nil(t, err)
+	assert.True(t, found)
+
+	expected := []job.Job{b2, a1, b1, a2, a3}
+	for _, e := range expected {
+		j, found, err := db.GetNextJob(ctx, "", "")
+		assert.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, e.UUID, j.UUID)
+
+		err = db.ArchiveJob(ctx, job.ArchiveReasonDone, j.UUID, time.Now())
+		assert.Nil(t, err)
+	}
+}
+
+func NewTestUser(db *DB, username string) user.User {
+	ctx := context.Background()
+	u, _ := user.New(username, false)
+	u, err := db.AddUser(ctx, u, "")
+	if err != nil {
+		FatalError(err)
+	}
+	return u
+}
+
+func NewTestJobFor(prompt string, ownerID int64) job.Job {
+	j := NewTestJob(prompt)
+	j.OwnerID = ownerID
+	return j
 }
 
 func NewTestJob(prompt string) job.Job {
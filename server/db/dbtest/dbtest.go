@@ -0,0 +1,797 @@
+// Package dbtest checks that a db.Store behaves as the server expects. Every
+// implementation should run TestStore from its own tests.
+package dbtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wellsjo/ai-art/server/asset"
+	"github.com/wellsjo/ai-art/server/batch"
+	"github.com/wellsjo/ai-art/server/db"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/model"
+	"github.com/wellsjo/ai-art/server/user"
+	"github.com/wellsjo/ai-art/server/webhook"
+)
+
+// NewStore returns an empty store. It is called once per test.
+type NewStore func(t *testing.T) db.Store
+
+// TestStore runs the conformance suite against stores made by newStore.
+func TestStore(t *testing.T, newStore NewStore) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s db.Store)
+	}{
+		{"Jobs", testJobs},
+		{"Queue", testQueue},
+		{"FairShare", testFairShare},
+		{"Recovery", testRecovery},
+		{"Cancel", testCancel},
+		{"Output", testOutput},
+		{"DurationSamples", testDurationSamples},
+		{"Usage", testUsage},
+		{"Batches", testBatches},
+		{"ChildJobs", testChildJobs},
+		{"Dependencies", testDependencies},
+		{"Users", testUsers},
+		{"APIKeys", testAPIKeys},
+		{"Sessions", testSessions},
+		{"Deliveries", testDeliveries},
+		{"Models", testModels},
+		{"Assets", testAssets},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, newStore(t))
+		})
+	}
+}
+
+func newJob(t *testing.T, prompt string) job.Job {
+	j, err := job.New(job.Settings{Prompt: prompt})
+	require.NoError(t, err)
+	return j
+}
+
+func newJobFor(t *testing.T, prompt string, ownerID int64) job.Job {
+	j := newJob(t, prompt)
+	j.OwnerID = ownerID
+	return j
+}
+
+func addJobs(t *testing.T, s db.Store, jobs ...job.Job) {
+	ctx := context.Background()
+	for _, j := range jobs {
+		require.NoError(t, s.AddJob(ctx, j))
+	}
+}
+
+func addUser(t *testing.T, s db.Store, username string) user.User {
+	ctx := context.Background()
+	u, err := user.New(username, false)
+	require.NoError(t, err)
+	u, err = s.AddUser(ctx, u, "hash-"+username)
+	require.NoError(t, err)
+	return u
+}
+
+func uuids(jobs []job.Job) []uuid.UUID {
+	ids := make([]uuid.UUID, len(jobs))
+	for i, j := range jobs {
+		ids[i] = j.UUID
+	}
+	return ids
+}
+
+func assertTime(t *testing.T, expected time.Time, actual *time.Time) {
+	if assert.NotNil(t, actual) {
+		assert.True(t, expected.Equal(*actual), "expected %v, got %v", expected, *actual)
+	}
+}
+
+func testJobs(t *testing.T, s db.Store) {
+	ctx := context.Background()
+	jobs, err := s.GetAllJobs(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, jobs)
+
+	_, found, _, err := s.GetJobByUUID(ctx, uuid.New())
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	j1 := newJob(t, "hello")
+	j1.ClientIP = "10.0.0.1"
+	j1.CallbackURL = "https://example.com/hook"
+	j2 := newJob(t, "hello2")
+	addJobs(t, s, j1, j2)
+
+	assert.Error(t, s.AddJob(ctx, j1))
+
+	got, found, pos, err := s.GetJobByUUID(ctx, j1.UUID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 1, pos)
+	assert.Equal(t, j1, got)
+
+	jobs, err = s.GetAllJobs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []job.Job{j1, j2}, jobs)
+
+	next, found, err := s.GetNextJob(ctx, "gpu", "")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, j1.UUID, next.UUID)
+
+	got, _, pos, err = s.GetJobByUUID(ctx, j1.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, pos)
+	assert.True(t, got.Running)
+	assert.NotNil(t, got.StartTime)
+	assert.Equal(t, "gpu", got.Hardware)
+
+	// Running jobs can't be reprioritized
+	found, err = s.SetJobPriority(ctx, j1.UUID, 5)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	endTime := time.Now()
+	assert.NoError(t, s.ArchiveJob(ctx, job.ArchiveReasonDone, j1.UUID, endTime))
+	assert.Error(t, s.ArchiveJob(ctx, job.ArchiveReasonDone, j1.UUID, endTime))
+
+	got, found, pos, err = s.GetJobByUUID(ctx, j1.UUID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, -1, pos)
+	assert.True(t, got.Archived)
+	assert.False(t, got.Running)
+	assert.True(t, got.Done())
+	assert.Equal(t, j1.Settings, got.Settings)
+	assert.Equal(t, j1.ClientIP, got.ClientIP)
+	assert.Equal(t, j1.CallbackURL, got.CallbackURL)
+	assert.Equal(t, "gpu", got.Hardware)
+	assert.NotNil(t, got.StartTime)
+	assertTime(t, endTime.Truncate(time.Microsecond), got.EndTime)
+
+	jobs, err = s.GetAllJobs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{j2.UUID}, uuids(jobs))
+}
+
+func testQueue(t *testing.T, s db.Store) {
+	ctx := context.Background()
+	j1, j2, j3 := newJob(t, "1"), newJob(t, "2"), newJob(t, "3")
+	addJobs(t, s, j1, j2, j3)
+
+	for i, j := range []job.Job{j1, j2, j3} {
+		_, _, pos, err := s.GetJobByUUID(ctx, j.UUID)
+		assert.NoError(t, err)
+		assert.Equal(t, i+1, pos)
+	}
+
+	// The running job is no longer counted ahead of pending jobs
+	_, _, err := s.GetNextJob(ctx, "", "")
+	assert.NoError(t, err)
+	_, _, pos, err := s.GetJobByUUID(ctx, j3.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, pos)
+
+	found, err := s.SetJobPriority(ctx, j3.UUID, 1)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	_, _, pos, err = s.GetJobByUUID(ctx, j3.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pos)
+
+	running, pending, err := s.GetQueuedJobs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{j1.UUID}, uuids(running))
+	assert.Equal(t, []uuid.UUID{j3.UUID, j2.UUID}, uuids(pending))
+
+	n, err := s.CountPendingJobs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func testFairShare(t *testing.T, s db.Store) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	bob := addUser(t, s, "bob")
+
+	// Alice queues a batch before Bob submits anything
+	a1 := newJobFor(t, "a1", alice.ID)
+	a2 := newJobFor(t, "a2", alice.ID)
+	a3 := newJobFor(t, "a3", alice.ID)
+	b1 := newJobFor(t, "b1", bob.ID)
+	b2 := newJobFor(t, "b2", bob.ID)
+	addJobs(t, s, a1, a2, a3, b1, b2)
+
+	_, _, pos, err := s.GetJobByUUID(ctx, b1.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, pos)
+
+	// Bumping a job moves it to the front
+	found, err := s.SetJobPriority(ctx, b2.UUID, 1)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	_, pending, err := s.GetQueuedJobs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{b2.UUID, a1.UUID, b1.UUID, a2.UUID, a3.UUID}, uuids(pending))
+
+	for i := 0; i < 5; i++ {
+		j, found, err := s.GetNextJob(ctx, "", "")
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.NoError(t, s.ArchiveJob(ctx, job.ArchiveReasonDone, j.UUID, time.Now()))
+	}
+
+	_, found, err = s.GetNextJob(ctx, "", "")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+// A job left running by a crash is found again by the worker that claimed
+// it, and isn't handed out to anyone else.
+func testRecovery(t *testing.T, s db.Store) {
+	ctx := context.Background()
+	j1, j2 := newJob(t, "1"), newJob(t, "2")
+	addJobs(t, s, j1, j2)
+
+	first, _, err := s.GetNextJob(ctx, "cpu", "worker-1")
+	assert.NoError(t, err)
+	next, found, err := s.GetNextJob(ctx, "cpu", "worker-2")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, j2.UUID, next.UUID)
+
+	running, err := s.GetRunningJobs(ctx, "worker-1")
+	assert.NoError(t, err)
+	if assert.Len(t, running, 1) {
+		assert.Equal(t, first.UUID, running[0].UUID)
+		assert.True(t, running[0].Running)
+	}
+
+	assert.NoError(t, s.ArchiveJob(ctx, job.ArchiveReasonDone, first.UUID, time.Now()))
+	running, err = s.GetRunningJobs(ctx, "worker-1")
+	assert.NoError(t, err)
+	assert.Empty(t, running)
+}
+
+func testCancel(t *testing.T, s db.Store) {
+	ctx := context.Background()
+	j1, j2 := newJob(t, "1"), newJob(t, "2")
+	addJobs(t, s, j1, j2)
+
+	_, _, err := s.GetNextJob(ctx, "", "")
+	assert.NoError(t, err)
+
+	found, err := s.CancelJob(ctx, j1.UUID, time.Now())
+	assert.NoError(t, err)
+	assert.False(t, found, "running jobs can't be cancelled")
+
+	found, err = s.CancelJob(ctx, j2.UUID, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	got, _, pos, err := s.GetJobByUUID(ctx, j2.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, -1, pos)
+	assert.Equal(t, job.ArchiveReasonCancelled, *got.ArchiveReason)
+
+	found, err = s.CancelJob(ctx, j2.UUID, time.Now())
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	found, err = s.SetJobPriority(ctx, j2.UUID, 1)
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func testOutput(t *testing.T, s db.Store) {
+	ctx := context.Background()
+	j := newJob(t, "hello")
+	addJobs(t, s, j)
+
+	_, found, err := s.GetJobOutput(ctx, j.UUID)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	assert.NoError(t, s.ArchiveJob(ctx, job.ArchiveReasonDone, j.UUID, time.Now()))
+	_, found, err = s.GetJobOutput(ctx, j.UUID)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	assert.NoError(t, s.SetJobOutput(ctx, j.UUID, "step 1\nstep 2\n"))
+	output, found, err := s.GetJobOutput(ctx, j.UUID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "step 1\nstep 2\n", output)
+}
+
+func testDurationSamples(t *testing.T, s db.Store) {
+	ctx := context.Background()
+	jobs := []job.Job{newJob(t, "1"), newJob(t, "2"), newJob(t, "3"), newJob(t, "4")}
+	addJobs(t, s, jobs...)
+
+	reasons := []job.ArchiveReason{job.ArchiveReasonDone, job.ArchiveReasonError, job.ArchiveReasonDone, job.ArchiveReasonDone}
+	hardware := []string{"gpu", "gpu", "cpu", "gpu"}
+	for i := range jobs {
+		j, _, err := s.GetNextJob(ctx, hardware[i], "")
+		require.NoError(t, err)
+		got, _, _, err := s.GetJobByUUID(ctx, j.UUID)
+		require.NoError(t, err)
+		endTime := got.StartTime.Add(time.Duration(i+1) * time.Second)
+		require.NoError(t, s.ArchiveJob(ctx, reasons[i], j.UUID, endTime))
+	}
+
+	samples, err := s.GetDurationSamples(ctx, "gpu", 10)
+	assert.NoError(t, err)
+	if assert.Len(t, samples, 2) {
+		// Most recent first
+		assert.Equal(t, 4*time.Second, samples[0].Duration)
+		assert.Equal(t, jobs[3].Settings, samples[0].Settings)
+		assert.Equal(t, 1*time.Second, samples[1].Duration)
+	}
+
+	samples, err = s.GetDurationSamples(ctx, "gpu", 1)
+	assert.NoError(t, err)
+	assert.Len(t, samples, 1)
+
+	samples, err = s.GetDurationSamples(ctx, "mocked", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, samples)
+}
+
+func testUsage(t *testing.T, s db.Store) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	since := time.Now().Add(-time.Hour)
+
+	old := newJobFor(t, "old", alice.ID)
+	old.Created = since.Add(-time.Minute).Truncate(time.Microsecond).UTC()
+	old.ClientIP = "10.0.0.1"
+	j1 := newJobFor(t, "1", alice.ID)
+	j1.ClientIP = "10.0.0.1"
+	j2 := newJobFor(t, "2", alice.ID)
+	j2.ClientIP = "10.0.0.2"
+	addJobs(t, s, old, j1, j2)
+
+	// old runs and finishes; archived jobs still count against the window
+	_, _, err := s.GetNextJob(ctx, "", "")
+	require.NoError(t, err)
+	require.NoError(t, s.ArchiveJob(ctx, job.ArchiveReasonDone, old.UUID, time.Now()))
+
+	u, err := s.GetUserUsage(ctx, alice.ID, since)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, u.PendingJobs)
+	assert.Equal(t, 2, u.JobsInWindow)
+	assert.Equal(t, j1.Settings.Cost()+j2.Settings.Cost(), u.CostInWindow)
+	assertTime(t, j1.Created, u.OldestInWindow)
+
+	u, err = s.GetIPUsage(ctx, "10.0.0.1", since)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, u.PendingJobs)
+	assert.Equal(t, 1, u.JobsInWindow)
+
+	u, err = s.GetUserUsage(ctx, alice.ID+1, since)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, u.JobsInWindow)
+	assert.Nil(t, u.OldestInWindow)
+}
+
+func testBatches(t *testing.T, s db.Store) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+
+	b, jobs, err := batch.New(batch.Matrix{
+		Prompts: []string{"cat", "dog"},
+		Seeds:   []int64{1, 2},
+	}, alice.ID)
+	require.NoError(t, err)
+
+	_, found, err := s.GetBatch(ctx, b.UUID)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	assert.NoError(t, s.AddBatch(ctx, b, jobs))
+
+	got, found, err := s.GetBatch(ctx, b.UUID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, b, got)
+
+	assert.NoError(t, s.ArchiveJob(ctx, job.ArchiveReasonError, jobs[1].UUID, time.Now()))
+
+	batchJobs, err := s.GetBatchJobs(ctx, b.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, uuids(jobs), uuids(batchJobs))
+	assert.True(t, batchJobs[1].Archived)
+	assert.Equal(t, b.UUID, batchJobs[1].BatchUUID)
+	assert.Equal(t, alice.ID, batchJobs[0].OwnerID)
+
+	batchJobs, err = s.GetBatchJobs(ctx, uuid.New())
+	assert.NoError(t, err)
+	assert.Empty(t, batchJobs)
+}
+
+func testChildJobs(t *testing.T, s db.Store) {
+	ctx := context.Background()
+	parent := newJob(t, "hello")
+	addJobs(t, s, parent)
+	assert.NoError(t, s.ArchiveJob(ctx, job.ArchiveReasonDone, parent.UUID, time.Now()))
+
+	upscaled, err := job.NewUpscale(job.Settings{}, parent.Settings.Width, parent.Settings.Height)
+	require.NoError(t, err)
+	upscaled.ParentUUID = parent.UUID
+	refined := newJob(t, "hello again")
+	refined.ParentUUID = parent.UUID
+	addJobs(t, s, upscaled, refined, newJob(t, "unrelated"))
+	assert.NoError(t, s.ArchiveJob(ctx, job.ArchiveReasonDone, upscaled.UUID, time.Now()))
+
+	children, err := s.GetChildJobs(ctx, parent.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{upscaled.UUID, refined.UUID}, uuids(children))
+	assert.True(t, children[0].Archived)
+	assert.Equal(t, parent.UUID, children[0].ParentUUID)
+	assert.Equal(t, job.UpscaleMode, children[0].Settings.Mode)
+	assert.Equal(t, 2*parent.Settings.Width, children[0].Settings.Width)
+	assert.Equal(t, parent.UUID, children[1].ParentUUID)
+
+	got, _, _, err := s.GetJobByUUID(ctx, refined.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, parent.UUID, got.ParentUUID)
+
+	children, err = s.GetChildJobs(ctx, refined.UUID)
+	assert.NoError(t, err)
+	assert.Empty(t, children)
+}
+
+func testDependencies(t *testing.T, s db.Store) {
+	ctx := context.Background()
+	parent, other := newJob(t, "parent"), newJob(t, "other")
+	parent.Priority = -1
+	child := newJob(t, "child")
+	child.ParentUUID = parent.UUID
+	// At the front of the queue, but waiting on its parent
+	child.Priority = 1
+	addJobs(t, s, parent, child, other)
+
+	_, _, pos, err := s.GetJobByUUID(ctx, child.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pos)
+
+	for _, want := range []job.Job{other, parent, child} {
+		next, found, err := s.GetNextJob(ctx, "gpu", "")
+		assert.NoError(t, err)
+		assert.True(t, found)
+		assert.Equal(t, want.UUID, next.UUID)
+		assert.NoError(t, s.ArchiveJob(ctx, job.ArchiveReasonDone, next.UUID, time.Now()))
+	}
+
+	// Children of failed jobs are never claimed
+	failed := newJob(t, "failed")
+	orphan := newJob(t, "orphan")
+	orphan.ParentUUID = failed.UUID
+	addJobs(t, s, failed, orphan)
+	assert.NoError(t, s.ArchiveJob(ctx, job.ArchiveReasonError, failed.UUID, time.Now()))
+
+	_, found, err := s.GetNextJob(ctx, "gpu", "")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func testUsers(t *testing.T, s db.Store) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	bob := addUser(t, s, "bob")
+	assert.NotZero(t, alice.ID)
+	assert.NotEqual(t, alice.ID, bob.ID)
+
+	dup, _ := user.New("alice", true)
+	_, err := s.AddUser(ctx, dup, "")
+	assert.True(t, errors.IsAlreadyExists(err), "%v", err)
+
+	got, hash, found, err := s.GetUserByUsername(ctx, "alice")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "hash-alice", hash)
+	assert.Equal(t, alice, got)
+
+	_, _, found, err = s.GetUserByUsername(ctx, "carol")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	got, found, err = s.GetUserByID(ctx, bob.ID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, bob, got)
+
+	_, found, err = s.GetUserByID(ctx, bob.ID+100)
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func testAPIKeys(t *testing.T, s db.Store) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	bob := addUser(t, s, "bob")
+
+	newKey := func(u user.User, name string) user.APIKey {
+		return user.APIKey{
+			UserID:      u.ID,
+			Name:        name,
+			Prefix:      "aa_" + name,
+			Created:     time.Now().Truncate(time.Microsecond).UTC(),
+			CallbackURL: "https://example.com/" + name,
+		}
+	}
+
+	k1, err := s.AddAPIKey(ctx, newKey(alice, "one"), "hash1")
+	assert.NoError(t, err)
+	assert.NotZero(t, k1.ID)
+	k2, err := s.AddAPIKey(ctx, newKey(alice, "two"), "hash2")
+	assert.NoError(t, err)
+	_, err = s.AddAPIKey(ctx, newKey(bob, "three"), "hash3")
+	assert.NoError(t, err)
+
+	_, err = s.AddAPIKey(ctx, newKey(bob, "dup"), "hash1")
+	assert.Error(t, err)
+
+	got, found, err := s.GetAPIKey(ctx, k1.ID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, k1, got)
+
+	keys, err := s.GetAPIKeys(ctx, alice.ID)
+	assert.NoError(t, err)
+	if assert.Len(t, keys, 2) {
+		assert.Equal(t, k1.ID, keys[0].ID)
+		assert.Equal(t, k2.ID, keys[1].ID)
+	}
+
+	u, k, found, err := s.GetUserByAPIKey(ctx, "hash2")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, alice, u)
+	assert.Equal(t, k2, k)
+
+	revoked := time.Now()
+	assert.NoError(t, s.RevokeAPIKey(ctx, k2.ID, revoked))
+	assert.NoError(t, s.RevokeAPIKey(ctx, k2.ID, revoked.Add(time.Hour)))
+
+	_, _, found, err = s.GetUserByAPIKey(ctx, "hash2")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	got, _, err = s.GetAPIKey(ctx, k2.ID)
+	assert.NoError(t, err)
+	assert.False(t, got.Active())
+	assertTime(t, revoked.Truncate(time.Microsecond), got.Revoked)
+}
+
+func testSessions(t *testing.T, s db.Store) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+
+	assert.NoError(t, s.AddSession(ctx, alice.ID, "live", time.Now().Add(time.Hour)))
+	assert.NoError(t, s.AddSession(ctx, alice.ID, "expired", time.Now().Add(-time.Hour)))
+
+	u, found, err := s.GetUserBySession(ctx, "live")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, alice, u)
+
+	_, found, err = s.GetUserBySession(ctx, "expired")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	assert.NoError(t, s.DeleteSession(ctx, "live"))
+	_, found, err = s.GetUserBySession(ctx, "live")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func testDeliveries(t *testing.T, s db.Store) {
+	ctx := context.Background()
+	jobUUID := uuid.New()
+	now := time.Now().Truncate(time.Microsecond).UTC()
+	later := now.Add(time.Minute)
+
+	d1, err := s.AddDelivery(ctx, webhook.Delivery{
+		JobUUID:     jobUUID,
+		URL:         "https://example.com/hook",
+		Event:       "job.running",
+		Payload:     []byte(`{"a":1}`),
+		Status:      webhook.StatusPending,
+		Created:     now,
+		NextAttempt: &now,
+	})
+	assert.NoError(t, err)
+	assert.NotZero(t, d1.ID)
+
+	d2, err := s.AddDelivery(ctx, webhook.Delivery{
+		JobUUID:     jobUUID,
+		URL:         "https://example.com/hook",
+		Event:       "job.done",
+		Payload:     []byte(`{"a":2}`),
+		Status:      webhook.StatusPending,
+		Created:     now.Add(time.Microsecond),
+		NextAttempt: &later,
+	})
+	assert.NoError(t, err)
+
+	lease := now.Add(time.Minute)
+	due, err := s.ClaimDueDeliveries(ctx, now, lease, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, d1.ID, due[0].ID)
+		assert.JSONEq(t, `{"a":1}`, string(due[0].Payload))
+	}
+
+	// Claimed deliveries aren't handed out again until the lease runs out
+	due, err = s.ClaimDueDeliveries(ctx, now, lease, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+	got, _, err := s.GetDelivery(ctx, d1.ID)
+	assert.NoError(t, err)
+	assertTime(t, lease, got.NextAttempt)
+
+	d1.Status = webhook.StatusDelivered
+	d1.Attempts = 1
+	d1.ResponseCode = 200
+	d1.NextAttempt = nil
+	d1.DeliveredAt = &now
+	assert.NoError(t, s.UpdateDelivery(ctx, d1))
+
+	got, found, err := s.GetDelivery(ctx, d1.ID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, webhook.StatusDelivered, got.Status)
+	assert.Equal(t, 1, got.Attempts)
+	assert.Equal(t, 200, got.ResponseCode)
+	assert.Nil(t, got.NextAttempt)
+	assertTime(t, now, got.DeliveredAt)
+
+	_, found, err = s.GetDelivery(ctx, d2.ID+100)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	due, err = s.ClaimDueDeliveries(ctx, later, later.Add(time.Minute), 10)
+	assert.NoError(t, err)
+	assert.Len(t, due, 1)
+
+	deliveries, err := s.GetJobDeliveries(ctx, jobUUID)
+	assert.NoError(t, err)
+	if assert.Len(t, deliveries, 2) {
+		assert.Equal(t, d1.ID, deliveries[0].ID)
+		assert.Equal(t, d2.ID, deliveries[1].ID)
+	}
+
+	deliveries, err = s.GetJobDeliveries(ctx, uuid.New())
+	assert.NoError(t, err)
+	assert.Empty(t, deliveries)
+}
+
+func testModels(t *testing.T, s db.Store) {
+	ctx := context.Background()
+
+	// Every store starts with the default model
+	def, found, err := s.GetDefaultModel(ctx)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, model.DEFAULT_MODEL, def.Name)
+	assert.Equal(t, model.DEFAULT_MODEL_SOURCE, def.Source)
+	assert.Equal(t, model.Default().Modes, def.Modes)
+
+	m, err := model.New(model.Model{
+		Name:     "sd-xl",
+		Source:   "/models/sd-xl",
+		Modes:    []job.Mode{job.TextToImageMode},
+		MaxWidth: 2048,
+	})
+	require.NoError(t, err)
+	assert.NoError(t, s.AddModel(ctx, m))
+	assert.True(t, errors.IsAlreadyExists(s.AddModel(ctx, m)))
+
+	got, found, err := s.GetModel(ctx, "sd-xl")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, m, got)
+
+	_, found, err = s.GetModel(ctx, "missing")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	// Making it the default takes over from the old one
+	m.Default = true
+	m.AllowCPU = true
+	updated, err := s.UpdateModel(ctx, m)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+
+	models, err := s.GetModels(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, models, 2) {
+		assert.Equal(t, "sd-xl", models[0].Name)
+		assert.True(t, models[0].Default)
+		assert.True(t, models[0].AllowCPU)
+		assert.Equal(t, model.DEFAULT_MODEL, models[1].Name)
+		assert.False(t, models[1].Default)
+	}
+
+	// The default can't be removed, or stop being the default by itself
+	m.Default = false
+	_, err = s.UpdateModel(ctx, m)
+	assert.NoError(t, err)
+	def, _, err = s.GetDefaultModel(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "sd-xl", def.Name)
+
+	_, err = s.DeleteModel(ctx, "sd-xl")
+	assert.True(t, errors.IsNotValid(err))
+
+	deleted, err := s.DeleteModel(ctx, model.DEFAULT_MODEL)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+
+	deleted, err = s.DeleteModel(ctx, model.DEFAULT_MODEL)
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+
+	updated, err = s.UpdateModel(ctx, model.Default())
+	assert.NoError(t, err)
+	assert.False(t, updated)
+}
+
+func testAssets(t *testing.T, s db.Store) {
+	ctx := context.Background()
+
+	lora, err := asset.New(asset.KindLoRA, "watercolor", "watercolor.safetensors", 0)
+	require.NoError(t, err)
+	lora.Size = 1234
+	lora.SHA256 = "abc"
+	assert.NoError(t, s.AddAsset(ctx, lora))
+
+	vae, err := asset.New(asset.KindVAE, "", "sharp.pt", 0)
+	require.NoError(t, err)
+	vae.Created = lora.Created.Add(time.Second)
+	assert.NoError(t, s.AddAsset(ctx, vae))
+
+	got, found, err := s.GetAsset(ctx, lora.ID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, lora, got)
+
+	_, found, err = s.GetAsset(ctx, uuid.New())
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	assets, err := s.GetAssets(ctx, "")
+	assert.NoError(t, err)
+	if assert.Len(t, assets, 2) {
+		assert.Equal(t, lora.ID, assets[0].ID)
+		assert.Equal(t, vae.ID, assets[1].ID)
+		assert.Equal(t, "sharp", assets[1].Name)
+	}
+
+	assets, err = s.GetAssets(ctx, asset.KindVAE)
+	assert.NoError(t, err)
+	if assert.Len(t, assets, 1) {
+		assert.Equal(t, vae.ID, assets[0].ID)
+	}
+
+	deleted, err := s.DeleteAsset(ctx, lora.ID)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+
+	deleted, err = s.DeleteAsset(ctx, lora.ID)
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+}
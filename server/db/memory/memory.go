@@ -0,0 +1,918 @@
+package memory
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/asset"
+	"github.com/wellsjo/ai-art/server/batch"
+	"github.com/wellsjo/ai-art/server/db"
+	"github.com/wellsjo/ai-art/server/eta"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/model"
+	"github.com/wellsjo/ai-art/server/quota"
+	"github.com/wellsjo/ai-art/server/user"
+	"github.com/wellsjo/ai-art/server/webhook"
+)
+
+// Store keeps everything in memory, behaving as *db.DB does against
+// Postgres. It is meant for tests and for trying the server out without a
+// database; nothing survives a restart.
+type Store struct {
+	mtx sync.Mutex
+
+	jobs      map[uuid.UUID]*jobRecord
+	seq       int64
+	batches   map[uuid.UUID]batch.Batch
+	users     []userRecord
+	keys      []keyRecord
+	sessions  map[string]sessionRecord
+	delivered []webhook.Delivery
+	models    map[string]model.Model
+	assets    []asset.Asset
+}
+
+type jobRecord struct {
+	job      job.Job
+	seq      int64
+	cost     int64
+	archived bool
+	output   *string
+	worker   string
+}
+
+type userRecord struct {
+	user         user.User
+	passwordHash string
+}
+
+type keyRecord struct {
+	key     user.APIKey
+	keyHash string
+}
+
+type sessionRecord struct {
+	userID  int64
+	expires time.Time
+}
+
+var _ db.Store = (*Store)(nil)
+
+// New returns an empty store, apart from the default model that the
+// migrations add.
+func New() *Store {
+	m := model.Default()
+	m.Created = normTime(time.Now())
+
+	return &Store{
+		jobs:     map[uuid.UUID]*jobRecord{},
+		batches:  map[uuid.UUID]batch.Batch{},
+		sessions: map[string]sessionRecord{},
+		models:   map[string]model.Model{m.Name: m},
+	}
+}
+
+func (s *Store) Ping(ctx context.Context) error {
+	return nil
+}
+
+// CheckSchema always reports the latest version, as there is no schema to
+// migrate.
+func (s *Store) CheckSchema(ctx context.Context) (int, error) {
+	return db.LatestVersion()
+}
+
+// Postgres keeps microseconds, so times are rounded the same way here.
+func normTime(t time.Time) time.Time {
+	return t.Truncate(time.Microsecond).UTC()
+}
+
+func normTimePtr(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	n := normTime(*t)
+	return &n
+}
+
+// copyJob returns j without any pointers shared with the store.
+func copyJob(j job.Job) job.Job {
+	j.StartTime = normTimePtr(j.StartTime)
+	j.EndTime = normTimePtr(j.EndTime)
+	if j.ArchiveReason != nil {
+		ar := *j.ArchiveReason
+		j.ArchiveReason = &ar
+	}
+	return j
+}
+
+func (s *Store) AddJob(ctx context.Context, j job.Job) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return errors.Annotate(s.insertJob(j), "AddJob")
+}
+
+func (s *Store) insertJob(j job.Job) error {
+	if _, ok := s.jobs[j.UUID]; ok {
+		return errors.AlreadyExistsf("job %v", j.UUID)
+	}
+
+	s.seq++
+	j = copyJob(j)
+	j.Created = normTime(j.Created)
+	j.Running = false
+	j.Archived = false
+	j.ArchiveReason = nil
+	s.jobs[j.UUID] = &jobRecord{
+		job:  j,
+		seq:  s.seq,
+		cost: j.Settings.Cost(),
+	}
+	return nil
+}
+
+// queue returns the pending jobs in the order they will run: highest
+// priority first, then each owner's oldest job before anyone's second
+// oldest, then oldest first.
+func (s *Store) queue() []*jobRecord {
+	var pending []*jobRecord
+	for _, r := range s.jobs {
+		if !r.archived && !r.job.Running {
+			pending = append(pending, r)
+		}
+	}
+	sort.Slice(pending, func(i, k int) bool {
+		return pending[i].seq < pending[k].seq
+	})
+
+	// Rank within each owner and priority, by age
+	type partition struct {
+		ownerID  int64
+		priority int
+	}
+	ranks := map[*jobRecord]int{}
+	byCreated := append([]*jobRecord{}, pending...)
+	sort.SliceStable(byCreated, func(i, k int) bool {
+		return byCreated[i].job.Created.Before(byCreated[k].job.Created)
+	})
+	counts := map[partition]int{}
+	for _, r := range byCreated {
+		p := partition{r.job.OwnerID, r.job.Priority}
+		counts[p]++
+		ranks[r] = counts[p]
+	}
+
+	sort.SliceStable(pending, func(i, k int) bool {
+		a, b := pending[i], pending[k]
+		if a.job.Priority != b.job.Priority {
+			return a.job.Priority > b.job.Priority
+		}
+		if ranks[a] != ranks[b] {
+			return ranks[a] < ranks[b]
+		}
+		return a.job.Created.Before(b.job.Created)
+	})
+	return pending
+}
+
+// archivedJob is a record as read back from the archive, which doesn't keep
+// the priority.
+func archivedJob(r *jobRecord) job.Job {
+	j := copyJob(r.job)
+	j.Priority = 0
+	j.Running = false
+	return j
+}
+
+func (s *Store) GetJobByUUID(ctx context.Context, uuid_ uuid.UUID) (job.Job, bool, int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	r, ok := s.jobs[uuid_]
+	if !ok {
+		return job.Job{}, false, 0, nil
+	}
+	if r.archived {
+		return archivedJob(r), true, -1, nil
+	}
+	if r.job.Running {
+		return copyJob(r.job), true, 0, nil
+	}
+
+	for i, q := range s.queue() {
+		if q == r {
+			return copyJob(r.job), true, i + 1, nil
+		}
+	}
+	return job.Job{}, false, 0, errors.Errorf("job %v missing from queue", uuid_)
+}
+
+// GetNextJob returns the job as it was before it was claimed, like the
+// Postgres implementation.
+func (s *Store) GetNextJob(ctx context.Context, hardware, worker string) (job.Job, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var r *jobRecord
+	for _, q := range s.queue() {
+		if s.ready(q) {
+			r = q
+			break
+		}
+	}
+	if r == nil {
+		return job.Job{}, false, nil
+	}
+	j := copyJob(r.job)
+
+	startTime := normTime(time.Now())
+	r.job.Running = true
+	r.job.StartTime = &startTime
+	r.job.Hardware = hardware
+	r.worker = worker
+
+	return j, true, nil
+}
+
+func (s *Store) GetRunningJobs(ctx context.Context, worker string) ([]job.Job, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var running []*jobRecord
+	for _, r := range s.jobs {
+		if !r.archived && r.job.Running && r.worker == worker {
+			running = append(running, r)
+		}
+	}
+	sort.Slice(running, func(i, k int) bool {
+		return running[i].job.Created.Before(running[k].job.Created)
+	})
+
+	jobs := []job.Job{}
+	for _, r := range running {
+		jobs = append(jobs, copyJob(r.job))
+	}
+	return jobs, nil
+}
+
+// ready is true if a job has no parent or its parent finished.
+func (s *Store) ready(r *jobRecord) bool {
+	if r.job.ParentUUID == uuid.Nil {
+		return true
+	}
+	parent, ok := s.jobs[r.job.ParentUUID]
+	return ok && parent.archived && *parent.job.ArchiveReason == job.ArchiveReasonDone
+}
+
+func (s *Store) SetJobPriority(ctx context.Context, uuid_ uuid.UUID, priority int) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	r, ok := s.jobs[uuid_]
+	if !ok || r.archived || r.job.Running {
+		return false, nil
+	}
+	r.job.Priority = priority
+	return true, nil
+}
+
+func (s *Store) archive(r *jobRecord, ar job.ArchiveReason, endTime time.Time) {
+	end := normTime(endTime)
+	r.archived = true
+	r.job.Archived = true
+	r.job.ArchiveReason = &ar
+	r.job.EndTime = &end
+}
+
+func (s *Store) ArchiveJob(ctx context.Context, ar job.ArchiveReason, uuid_ uuid.UUID, endTime time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	r, ok := s.jobs[uuid_]
+	if !ok || r.archived {
+		return errors.New("ArchieJob affected a wrong number of rows (0)")
+	}
+	s.archive(r, ar, endTime)
+	return nil
+}
+
+func (s *Store) CancelJob(ctx context.Context, uuid_ uuid.UUID, endTime time.Time) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	r, ok := s.jobs[uuid_]
+	if !ok || r.archived || r.job.Running {
+		return false, nil
+	}
+	s.archive(r, job.ArchiveReasonCancelled, endTime)
+	return true, nil
+}
+
+func (s *Store) SetJobOutput(ctx context.Context, uuid_ uuid.UUID, output string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if r, ok := s.jobs[uuid_]; ok && r.archived {
+		r.output = &output
+	}
+	return nil
+}
+
+func (s *Store) GetJobOutput(ctx context.Context, uuid_ uuid.UUID) (string, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	r, ok := s.jobs[uuid_]
+	if !ok || !r.archived || r.output == nil {
+		return "", false, nil
+	}
+	return *r.output, true, nil
+}
+
+func (s *Store) GetQueuedJobs(ctx context.Context) ([]job.Job, []job.Job, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	running, pending := []job.Job{}, []job.Job{}
+	for _, r := range s.sortedJobs() {
+		if !r.archived && r.job.Running {
+			running = append(running, copyJob(r.job))
+		}
+	}
+	for _, r := range s.queue() {
+		pending = append(pending, copyJob(r.job))
+	}
+	return running, pending, nil
+}
+
+func (s *Store) CountPendingJobs(ctx context.Context) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.queue()), nil
+}
+
+// sortedJobs returns every record, oldest first.
+func (s *Store) sortedJobs() []*jobRecord {
+	records := make([]*jobRecord, 0, len(s.jobs))
+	for _, r := range s.jobs {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, k int) bool {
+		if !records[i].job.Created.Equal(records[k].job.Created) {
+			return records[i].job.Created.Before(records[k].job.Created)
+		}
+		return records[i].seq < records[k].seq
+	})
+	return records
+}
+
+func (s *Store) GetAllJobs(ctx context.Context) ([]job.Job, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	jobs := []job.Job{}
+	for _, r := range s.sortedJobs() {
+		if !r.archived {
+			jobs = append(jobs, copyJob(r.job))
+		}
+	}
+	return jobs, nil
+}
+
+func (s *Store) GetDurationSamples(ctx context.Context, hardware string, limit int) ([]eta.Sample, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var done []*jobRecord
+	for _, r := range s.jobs {
+		j := r.job
+		if r.archived && *j.ArchiveReason == job.ArchiveReasonDone && j.Hardware == hardware &&
+			j.StartTime != nil && j.EndTime != nil {
+			done = append(done, r)
+		}
+	}
+	sort.Slice(done, func(i, k int) bool {
+		return done[i].job.EndTime.After(*done[k].job.EndTime)
+	})
+	if len(done) > limit {
+		done = done[:limit]
+	}
+
+	samples := []eta.Sample{}
+	for _, r := range done {
+		samples = append(samples, eta.Sample{
+			Settings: r.job.Settings,
+			Duration: r.job.EndTime.Sub(*r.job.StartTime),
+		})
+	}
+	return samples, nil
+}
+
+func (s *Store) GetUserUsage(ctx context.Context, ownerID int64, since time.Time) (quota.Usage, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// Jobs without an owner are stored as NULL, which matches nothing
+	return s.usage(func(j job.Job) bool {
+		return ownerID != 0 && j.OwnerID == ownerID
+	}, since), nil
+}
+
+func (s *Store) GetIPUsage(ctx context.Context, clientIP string, since time.Time) (quota.Usage, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.usage(func(j job.Job) bool {
+		return j.ClientIP == clientIP
+	}, since), nil
+}
+
+func (s *Store) usage(match func(j job.Job) bool, since time.Time) quota.Usage {
+	var u quota.Usage
+	for _, r := range s.jobs {
+		if !match(r.job) {
+			continue
+		}
+		if !r.archived && !r.job.Running {
+			u.PendingJobs++
+		}
+		if r.job.Created.Before(since) {
+			continue
+		}
+		u.JobsInWindow++
+		u.CostInWindow += r.cost
+		if u.OldestInWindow == nil || r.job.Created.Before(*u.OldestInWindow) {
+			oldest := r.job.Created
+			u.OldestInWindow = &oldest
+		}
+	}
+	return u
+}
+
+func (s *Store) AddBatch(ctx context.Context, b batch.Batch, jobs []job.Job) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.batches[b.UUID]; ok {
+		return errors.AlreadyExistsf("batch %v", b.UUID)
+	}
+	for _, j := range jobs {
+		if _, ok := s.jobs[j.UUID]; ok {
+			return errors.AlreadyExistsf("job %v", j.UUID)
+		}
+	}
+
+	b.Created = normTime(b.Created)
+	s.batches[b.UUID] = b
+	for _, j := range jobs {
+		if err := s.insertJob(j); err != nil {
+			return errors.Annotate(err, "AddBatch job")
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetBatch(ctx context.Context, uuid_ uuid.UUID) (batch.Batch, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	b, ok := s.batches[uuid_]
+	return b, ok, nil
+}
+
+func (s *Store) GetBatchJobs(ctx context.Context, uuid_ uuid.UUID) ([]job.Job, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.jobsWhere(func(j job.Job) bool { return j.BatchUUID == uuid_ }), nil
+}
+
+func (s *Store) GetChildJobs(ctx context.Context, parent uuid.UUID) ([]job.Job, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.jobsWhere(func(j job.Job) bool { return j.ParentUUID == parent }), nil
+}
+
+// jobsWhere returns the queued and archived jobs that match, oldest first.
+func (s *Store) jobsWhere(match func(j job.Job) bool) []job.Job {
+	jobs := []job.Job{}
+	for _, r := range s.sortedJobs() {
+		if !match(r.job) {
+			continue
+		}
+		if r.archived {
+			jobs = append(jobs, archivedJob(r))
+		} else {
+			jobs = append(jobs, copyJob(r.job))
+		}
+	}
+	return jobs
+}
+
+func (s *Store) AddUser(ctx context.Context, u user.User, passwordHash string) (user.User, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, r := range s.users {
+		if r.user.Username == u.Username {
+			return user.User{}, errors.AlreadyExistsf("user %q", u.Username)
+		}
+	}
+
+	u.ID = int64(len(s.users) + 1)
+	u.Created = normTime(u.Created)
+	s.users = append(s.users, userRecord{user: u, passwordHash: passwordHash})
+	return u, nil
+}
+
+func (s *Store) GetUserByUsername(ctx context.Context, username string) (user.User, string, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, r := range s.users {
+		if r.user.Username == username {
+			return r.user, r.passwordHash, true, nil
+		}
+	}
+	return user.User{}, "", false, nil
+}
+
+func (s *Store) GetUserByID(ctx context.Context, id int64) (user.User, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	u, ok := s.userByID(id)
+	return u, ok, nil
+}
+
+func (s *Store) userByID(id int64) (user.User, bool) {
+	if id < 1 || id > int64(len(s.users)) {
+		return user.User{}, false
+	}
+	return s.users[id-1].user, true
+}
+
+func copyKey(k user.APIKey) user.APIKey {
+	k.Revoked = normTimePtr(k.Revoked)
+	return k
+}
+
+func (s *Store) GetUserByAPIKey(ctx context.Context, keyHash string) (user.User, user.APIKey, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, r := range s.keys {
+		if r.keyHash != keyHash || r.key.Revoked != nil {
+			continue
+		}
+		u, ok := s.userByID(r.key.UserID)
+		if !ok {
+			break
+		}
+		return u, copyKey(r.key), true, nil
+	}
+	return user.User{}, user.APIKey{}, false, nil
+}
+
+func (s *Store) AddAPIKey(ctx context.Context, k user.APIKey, keyHash string) (user.APIKey, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.userByID(k.UserID); !ok {
+		return user.APIKey{}, errors.NotFoundf("user %d", k.UserID)
+	}
+	for _, r := range s.keys {
+		if r.keyHash == keyHash {
+			return user.APIKey{}, errors.AlreadyExistsf("api key")
+		}
+	}
+
+	k.ID = int64(len(s.keys) + 1)
+	k.Created = normTime(k.Created)
+	k = copyKey(k)
+	s.keys = append(s.keys, keyRecord{key: k, keyHash: keyHash})
+	return copyKey(k), nil
+}
+
+func (s *Store) GetAPIKey(ctx context.Context, id int64) (user.APIKey, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if id < 1 || id > int64(len(s.keys)) {
+		return user.APIKey{}, false, nil
+	}
+	return copyKey(s.keys[id-1].key), true, nil
+}
+
+func (s *Store) GetAPIKeys(ctx context.Context, userID int64) ([]user.APIKey, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	keys := []user.APIKey{}
+	for _, r := range s.keys {
+		if r.key.UserID == userID {
+			keys = append(keys, copyKey(r.key))
+		}
+	}
+	sort.SliceStable(keys, func(i, k int) bool {
+		return keys[i].Created.Before(keys[k].Created)
+	})
+	return keys, nil
+}
+
+func (s *Store) RevokeAPIKey(ctx context.Context, id int64, revoked time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if id < 1 || id > int64(len(s.keys)) {
+		return nil
+	}
+	if k := &s.keys[id-1].key; k.Revoked == nil {
+		k.Revoked = normTimePtr(&revoked)
+	}
+	return nil
+}
+
+func (s *Store) AddSession(ctx context.Context, userID int64, tokenHash string, expires time.Time) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.userByID(userID); !ok {
+		return errors.NotFoundf("user %d", userID)
+	}
+	if _, ok := s.sessions[tokenHash]; ok {
+		return errors.AlreadyExistsf("session")
+	}
+	s.sessions[tokenHash] = sessionRecord{userID: userID, expires: expires}
+	return nil
+}
+
+func (s *Store) GetUserBySession(ctx context.Context, tokenHash string) (user.User, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	sess, ok := s.sessions[tokenHash]
+	if !ok || !sess.expires.After(time.Now()) {
+		return user.User{}, false, nil
+	}
+	u, ok := s.userByID(sess.userID)
+	return u, ok, nil
+}
+
+func (s *Store) DeleteSession(ctx context.Context, tokenHash string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.sessions, tokenHash)
+	return nil
+}
+
+func copyDelivery(d webhook.Delivery) webhook.Delivery {
+	d.Payload = append([]byte(nil), d.Payload...)
+	d.NextAttempt = normTimePtr(d.NextAttempt)
+	d.DeliveredAt = normTimePtr(d.DeliveredAt)
+	return d
+}
+
+func (s *Store) AddDelivery(ctx context.Context, d webhook.Delivery) (webhook.Delivery, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	d.ID = int64(len(s.delivered) + 1)
+	d.Created = normTime(d.Created)
+	d = copyDelivery(d)
+	s.delivered = append(s.delivered, d)
+	return copyDelivery(d), nil
+}
+
+// UpdateDelivery only changes the fields that record the outcome of an
+// attempt.
+func (s *Store) UpdateDelivery(ctx context.Context, d webhook.Delivery) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if d.ID < 1 || d.ID > int64(len(s.delivered)) {
+		return nil
+	}
+	stored := &s.delivered[d.ID-1]
+	stored.Status = d.Status
+	stored.Attempts = d.Attempts
+	stored.ResponseCode = d.ResponseCode
+	stored.LastError = d.LastError
+	stored.NextAttempt = normTimePtr(d.NextAttempt)
+	stored.DeliveredAt = normTimePtr(d.DeliveredAt)
+	return nil
+}
+
+func (s *Store) GetDelivery(ctx context.Context, id int64) (webhook.Delivery, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if id < 1 || id > int64(len(s.delivered)) {
+		return webhook.Delivery{}, false, nil
+	}
+	return copyDelivery(s.delivered[id-1]), true, nil
+}
+
+func (s *Store) ClaimDueDeliveries(ctx context.Context, now, leaseUntil time.Time, limit int) ([]webhook.Delivery, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var due []*webhook.Delivery
+	for i := range s.delivered {
+		d := &s.delivered[i]
+		if d.Status == webhook.StatusPending && d.NextAttempt != nil && !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.SliceStable(due, func(i, k int) bool {
+		return due[i].NextAttempt.Before(*due[k].NextAttempt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := []webhook.Delivery{}
+	for _, d := range due {
+		lease := normTime(leaseUntil)
+		d.NextAttempt = &lease
+		claimed = append(claimed, copyDelivery(*d))
+	}
+	return claimed, nil
+}
+
+func (s *Store) GetJobDeliveries(ctx context.Context, jobUUID uuid.UUID) ([]webhook.Delivery, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	deliveries := []webhook.Delivery{}
+	for _, d := range s.delivered {
+		if d.JobUUID == jobUUID {
+			deliveries = append(deliveries, copyDelivery(d))
+		}
+	}
+	sort.SliceStable(deliveries, func(i, k int) bool {
+		return deliveries[i].Created.Before(deliveries[k].Created)
+	})
+	return deliveries, nil
+}
+
+func copyModel(m model.Model) model.Model {
+	m.Modes = append([]job.Mode(nil), m.Modes...)
+	m.Created = normTime(m.Created)
+	return m
+}
+
+// clearDefault makes no model the default, apart from keep.
+func (s *Store) clearDefault(keep string) {
+	for name, m := range s.models {
+		if name != keep {
+			m.Default = false
+			s.models[name] = m
+		}
+	}
+}
+
+func (s *Store) AddModel(ctx context.Context, m model.Model) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, ok := s.models[m.Name]; ok {
+		return errors.AlreadyExistsf("model %s", m.Name)
+	}
+	if m.Default {
+		s.clearDefault(m.Name)
+	}
+	s.models[m.Name] = copyModel(m)
+	return nil
+}
+
+func (s *Store) UpdateModel(ctx context.Context, m model.Model) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	stored, ok := s.models[m.Name]
+	if !ok {
+		return false, nil
+	}
+	if m.Default {
+		s.clearDefault(m.Name)
+	}
+	m.Default = m.Default || stored.Default
+	m.Created = stored.Created
+	s.models[m.Name] = copyModel(m)
+	return true, nil
+}
+
+func (s *Store) DeleteModel(ctx context.Context, name string) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	m, ok := s.models[name]
+	if !ok {
+		return false, nil
+	}
+	if m.Default {
+		return false, errors.NotValidf("deleting default model %s", name)
+	}
+	delete(s.models, name)
+	return true, nil
+}
+
+func (s *Store) GetModel(ctx context.Context, name string) (model.Model, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	m, ok := s.models[name]
+	if !ok {
+		return model.Model{}, false, nil
+	}
+	return copyModel(m), true, nil
+}
+
+func (s *Store) GetDefaultModel(ctx context.Context) (model.Model, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, m := range s.models {
+		if m.Default {
+			return copyModel(m), true, nil
+		}
+	}
+	return model.Model{}, false, nil
+}
+
+func (s *Store) GetModels(ctx context.Context) ([]model.Model, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	models := make([]model.Model, 0, len(s.models))
+	for _, m := range s.models {
+		models = append(models, copyModel(m))
+	}
+	sort.Slice(models, func(i, k int) bool {
+		return models[i].Name < models[k].Name
+	})
+	return models, nil
+}
+
+func (s *Store) AddAsset(ctx context.Context, a asset.Asset) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, stored := range s.assets {
+		if stored.ID == a.ID {
+			return errors.Errorf("asset %v already exists", a.ID)
+		}
+	}
+	a.Created = normTime(a.Created)
+	s.assets = append(s.assets, a)
+	return nil
+}
+
+func (s *Store) GetAsset(ctx context.Context, id uuid.UUID) (asset.Asset, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, a := range s.assets {
+		if a.ID == id {
+			return a, true, nil
+		}
+	}
+	return asset.Asset{}, false, nil
+}
+
+func (s *Store) GetAssets(ctx context.Context, kind asset.Kind) ([]asset.Asset, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	assets := []asset.Asset{}
+	for _, a := range s.assets {
+		if kind == "" || a.Kind == kind {
+			assets = append(assets, a)
+		}
+	}
+	sort.SliceStable(assets, func(i, k int) bool {
+		return assets[i].Created.Before(assets[k].Created)
+	})
+	return assets, nil
+}
+
+func (s *Store) DeleteAsset(ctx context.Context, id uuid.UUID) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for i, a := range s.assets {
+		if a.ID == id {
+			s.assets = append(s.assets[:i], s.assets[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
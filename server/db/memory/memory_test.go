@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/wellsjo/ai-art/server/db"
+	"github.com/wellsjo/ai-art/server/db/dbtest"
+)
+
+func TestStore(t *testing.T) {
+	dbtest.TestStore(t, func(t *testing.T) db.Store {
+		return New()
+	})
+}
@@ -1,56 +1,276 @@
 package db
 
 import (
+	"context"
+	"database/sql"
+	"embed"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
 	"github.com/juju/errors"
 )
 
-func (db *DB) Reset() error {
-	_, err := db.db.Exec("DROP TABLE IF EXISTS jobs")
+// Migrations are SQL files named <version>_<name>.up.sql and
+// <version>_<name>.down.sql. Versions must be consecutive from 1, and every
+// migration needs both files.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// MIGRATION_LOCK_ID is the advisory lock held while migrating, so servers
+// starting at the same time don't both apply the same migration.
+const MIGRATION_LOCK_ID = 7283461
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this server")
+
+// Migrations returns every embedded migration in version order.
+func Migrations() ([]Migration, error) {
+	return loadMigrations(migrationFiles, "migrations")
+}
+
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		m := migrationFileName.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, errors.Errorf("bad migration file name %q", e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+
+		b, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, errors.Errorf("migration %d is named both %q and %q", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(b)
+		} else {
+			mig.Down = string(b)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	for i, mig := range migrations {
+		if mig.Version != i+1 {
+			return nil, errors.Errorf("missing migration %d", i+1)
+		}
+		if mig.Up == "" || mig.Down == "" {
+			return nil, errors.Errorf("migration %d needs both up and down files", mig.Version)
+		}
+	}
+	return migrations, nil
+}
+
+// LatestVersion is the version the embedded migrations bring the schema to.
+func LatestVersion() (int, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return len(migrations), nil
+}
+
+// MigrateUp applies every migration that hasn't been applied yet.
+func (db *DB) MigrateUp(ctx context.Context) error {
+	latest, err := LatestVersion()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(db.MigrateTo(ctx, latest))
+}
+
+// MigrateDown reverts the last n migrations.
+func (db *DB) MigrateDown(ctx context.Context, n int) error {
+	version, err := db.SchemaVersion(ctx)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	target := version - n
+	if target < 0 {
+		target = 0
+	}
+	return errors.Trace(db.MigrateTo(ctx, target))
+}
 
-	_, err = db.db.Exec("DROP TABLE IF EXISTS jobs_archive")
+// MigrateTo applies or reverts migrations until the schema is at version.
+// Each migration runs in its own transaction, so a failure leaves the schema
+// at the last version that succeeded.
+func (db *DB) MigrateTo(ctx context.Context, version int) error {
+	migrations, err := Migrations()
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if version < 0 || version > len(migrations) {
+		return errors.Errorf("unknown schema version %d", version)
+	}
 
-	_, err = db.db.Exec("DROP TYPE IF EXISTS archive_reason")
+	conn, err := db.db.Conn(ctx)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	defer conn.Close()
+
+	// Advisory locks belong to the session, so the lock, the migrations and
+	// the unlock must all use the same connection.
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, MIGRATION_LOCK_ID); err != nil {
+		return errors.Annotate(err, "MigrateTo lock")
+	}
+	// Unlock even if ctx was cancelled, since the connection goes back to
+	// the pool still holding the lock otherwise.
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, MIGRATION_LOCK_ID)
 
-	err = db.MigrateUp()
-	return errors.Trace(err)
+	if _, err := conn.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations
+	(
+		version integer PRIMARY KEY,
+		name text NOT NULL,
+		applied timestamp with time zone NOT NULL DEFAULT now()
+	)`); err != nil {
+		return errors.Annotate(err, "MigrateTo schema_migrations")
+	}
+
+	current, err := schemaVersion(ctx, conn)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if current > len(migrations) {
+		return errors.Annotatef(ErrSchemaTooNew, "version %d, latest known %d", current, len(migrations))
+	}
+
+	for current < version {
+		mig := migrations[current]
+		slog.Info("Applying migration", "version", mig.Version, "name", mig.Name)
+		err := runMigration(ctx, conn, mig.Up,
+			`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, mig.Version, mig.Name)
+		if err != nil {
+			return errors.Annotatef(err, "migration %d_%s up", mig.Version, mig.Name)
+		}
+		current++
+	}
+
+	for current > version {
+		mig := migrations[current-1]
+		slog.Info("Reverting migration", "version", mig.Version, "name", mig.Name)
+		err := runMigration(ctx, conn, mig.Down,
+			`DELETE FROM schema_migrations WHERE version=$1`, mig.Version)
+		if err != nil {
+			return errors.Annotatef(err, "migration %d_%s down", mig.Version, mig.Name)
+		}
+		current--
+	}
+
+	return nil
+}
+
+// runMigration runs script and records that it ran in one transaction.
+func runMigration(ctx context.Context, conn *sql.Conn, script, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(tx.Commit())
 }
 
-func (db *DB) MigrateUp() error {
-	_, err := db.db.Exec(`
-CREATE TABLE IF NOT EXISTS jobs
-(
-  id serial PRIMARY KEY,
-  uuid uuid UNIQUE NOT NULL,
-  created timestamp with time zone NOT NULL DEFAULT now(),
-  running boolean NOT NULL DEFAULT false,
-  settings jsonb NOT NULL,
-	start_time timestamp with time zone,
-	end_time timestamp with time zone
-);
+// queryRower is satisfied by *sql.DB, *sql.Conn and *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
 
-CREATE TYPE archive_reason AS ENUM ('done', 'cancelled', 'error');
+func schemaVersion(ctx context.Context, q queryRower) (int, error) {
+	var version int
+	err := q.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, errors.Annotate(err, "schemaVersion")
+}
 
-CREATE TABLE IF NOT EXISTS jobs_archive
-(
-  id bigserial PRIMARY KEY,
-  uuid uuid NOT NULL,
-  created timestamp with time zone NOT NULL,
-  settings jsonb NOT NULL,
-	start_time timestamp with time zone,
-  end_time timestamp with time zone,
-	archive_reason archive_reason NOT NULL,
-	job_output text
-);
-`)
+// SchemaVersion returns the version of the last migration applied, or 0 if
+// none have been.
+func (db *DB) SchemaVersion(ctx context.Context) (int, error) {
+	var exists bool
+	err := db.db.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists)
+	if err != nil {
+		return 0, errors.Annotate(err, "SchemaVersion")
+	}
+	if !exists {
+		return 0, nil
+	}
+	return schemaVersion(ctx, db.db)
+}
+
+// CheckSchema fails unless the schema is at the latest version this server
+// knows about. It returns the version the database is at.
+func (db *DB) CheckSchema(ctx context.Context) (int, error) {
+	latest, err := LatestVersion()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	version, err := db.SchemaVersion(ctx)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	if version < latest {
+		return version, errors.Errorf("%d pending migrations", latest-version)
+	} else if version > latest {
+		return version, errors.Annotatef(ErrSchemaTooNew, "version %d, latest known %d", version, latest)
+	}
+	return version, nil
+}
+
+// Reset reverts every migration and applies them again, leaving an empty
+// database. Tables left by servers that predate versioned migrations are
+// dropped too.
+func (db *DB) Reset(ctx context.Context) error {
+	if err := db.MigrateTo(ctx, 0); err != nil {
+		return errors.Trace(err)
+	}
+
+	migrations, err := Migrations()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := db.db.ExecContext(ctx, migrations[0].Down); err != nil {
+		return errors.Trace(err)
+	}
 
-	return errors.Trace(err)
+	return errors.Trace(db.MigrateUp(ctx))
 }
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS jobs_archive;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS jobs;
+DROP TABLE IF EXISTS batches;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS users;
+DROP TYPE IF EXISTS archive_reason;
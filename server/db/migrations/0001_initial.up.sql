@@ -0,0 +1,130 @@
+-- The schema as it was before migrations were versioned. Everything is
+-- guarded so that existing databases can be brought under version control.
+
+CREATE TABLE IF NOT EXISTS users
+(
+  id bigserial PRIMARY KEY,
+  username text UNIQUE NOT NULL,
+  password_hash text NOT NULL,
+  admin boolean NOT NULL DEFAULT false,
+  created timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS api_keys
+(
+  id bigserial PRIMARY KEY,
+  user_id bigint NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  name text NOT NULL,
+  prefix text NOT NULL,
+  key_hash text UNIQUE NOT NULL,
+  callback_url text,
+  created timestamp with time zone NOT NULL DEFAULT now(),
+  revoked timestamp with time zone
+);
+
+CREATE TABLE IF NOT EXISTS sessions
+(
+  token_hash text PRIMARY KEY,
+  user_id bigint NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+  created timestamp with time zone NOT NULL DEFAULT now(),
+  expires timestamp with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS batches
+(
+  id bigserial PRIMARY KEY,
+  uuid uuid UNIQUE NOT NULL,
+  owner_id bigint REFERENCES users(id),
+  created timestamp with time zone NOT NULL DEFAULT now(),
+  matrix jsonb NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS jobs
+(
+  id serial PRIMARY KEY,
+  uuid uuid UNIQUE NOT NULL,
+  owner_id bigint REFERENCES users(id),
+  client_ip text,
+  batch_id uuid,
+  callback_url text,
+  cost bigint NOT NULL DEFAULT 0,
+  created timestamp with time zone NOT NULL DEFAULT now(),
+  running boolean NOT NULL DEFAULT false,
+  priority integer NOT NULL DEFAULT 0,
+  settings jsonb NOT NULL,
+	start_time timestamp with time zone,
+	end_time timestamp with time zone,
+  hardware text
+);
+
+-- Servers that predate migrations created the type without a guard
+DO $$ BEGIN
+  CREATE TYPE archive_reason AS ENUM ('done', 'cancelled', 'error');
+EXCEPTION
+  WHEN duplicate_object THEN NULL;
+END $$;
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+  id bigserial PRIMARY KEY,
+  job_uuid uuid NOT NULL,
+  url text NOT NULL,
+  event text NOT NULL,
+  payload jsonb NOT NULL,
+  status text NOT NULL,
+  attempts integer NOT NULL DEFAULT 0,
+  response_code integer,
+  last_error text,
+  created timestamp with time zone NOT NULL DEFAULT now(),
+  next_attempt timestamp with time zone,
+  delivered_at timestamp with time zone
+);
+
+CREATE TABLE IF NOT EXISTS jobs_archive
+(
+  id bigserial PRIMARY KEY,
+  uuid uuid NOT NULL,
+  owner_id bigint REFERENCES users(id),
+  client_ip text,
+  batch_id uuid,
+  callback_url text,
+  cost bigint NOT NULL DEFAULT 0,
+  created timestamp with time zone NOT NULL,
+  settings jsonb NOT NULL,
+	start_time timestamp with time zone,
+  end_time timestamp with time zone,
+  hardware text,
+	archive_reason archive_reason NOT NULL,
+	job_output text
+);
+
+-- Databases created before migrations have the original jobs tables, which
+-- CREATE TABLE IF NOT EXISTS leaves alone
+ALTER TABLE jobs
+  ADD COLUMN IF NOT EXISTS owner_id bigint REFERENCES users(id),
+  ADD COLUMN IF NOT EXISTS client_ip text,
+  ADD COLUMN IF NOT EXISTS batch_id uuid,
+  ADD COLUMN IF NOT EXISTS callback_url text,
+  ADD COLUMN IF NOT EXISTS cost bigint NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS priority integer NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS hardware text;
+
+ALTER TABLE jobs_archive
+  ADD COLUMN IF NOT EXISTS owner_id bigint REFERENCES users(id),
+  ADD COLUMN IF NOT EXISTS client_ip text,
+  ADD COLUMN IF NOT EXISTS batch_id uuid,
+  ADD COLUMN IF NOT EXISTS callback_url text,
+  ADD COLUMN IF NOT EXISTS cost bigint NOT NULL DEFAULT 0,
+  ADD COLUMN IF NOT EXISTS hardware text;
+
+-- Quota checks count recent jobs per owner and per address, ETAs sample
+-- recent jobs by hardware, and batches and deliveries are looked up by job.
+CREATE INDEX IF NOT EXISTS jobs_owner_id_idx ON jobs (owner_id);
+CREATE INDEX IF NOT EXISTS jobs_client_ip_idx ON jobs (client_ip);
+CREATE INDEX IF NOT EXISTS jobs_archive_owner_id_created_idx ON jobs_archive (owner_id, created);
+CREATE INDEX IF NOT EXISTS jobs_archive_client_ip_created_idx ON jobs_archive (client_ip, created);
+CREATE INDEX IF NOT EXISTS jobs_archive_hardware_end_time_idx ON jobs_archive (hardware, end_time);
+CREATE INDEX IF NOT EXISTS jobs_batch_id_idx ON jobs (batch_id);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_job_uuid_idx ON webhook_deliveries (job_uuid);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt) WHERE status='pending';
+CREATE INDEX IF NOT EXISTS jobs_archive_batch_id_idx ON jobs_archive (batch_id);
@@ -0,0 +1,21 @@
+-- The model registry. The default model is the one the docker entrypoint
+-- used before jobs could choose, and must match model.Default.
+
+CREATE TABLE models
+(
+  name text PRIMARY KEY,
+  source text NOT NULL,
+  modes jsonb NOT NULL,
+  default_width integer NOT NULL,
+  default_height integer NOT NULL,
+  max_width integer NOT NULL DEFAULT 0,
+  max_height integer NOT NULL DEFAULT 0,
+  allow_cpu boolean NOT NULL DEFAULT false,
+  is_default boolean NOT NULL DEFAULT false,
+  created timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX models_default ON models (is_default) WHERE is_default;
+
+INSERT INTO models (name, source, modes, default_width, default_height, max_width, max_height, allow_cpu, is_default)
+VALUES ('stable-diffusion-v1-4', 'CompVis/stable-diffusion-v1-4', '[0, 1]', 512, 512, 1024, 1024, true, true);
@@ -0,0 +1,13 @@
+CREATE TABLE assets
+(
+  id uuid PRIMARY KEY,
+  kind text NOT NULL,
+  name text NOT NULL,
+  file_name text NOT NULL,
+  size bigint NOT NULL,
+  sha256 text NOT NULL,
+  owner_id bigint REFERENCES users(id),
+  created timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX assets_kind ON assets (kind, created);
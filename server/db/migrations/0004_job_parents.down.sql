@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS jobs_archive_uuid_idx;
+DROP INDEX IF EXISTS jobs_archive_parent_id_idx;
+DROP INDEX IF EXISTS jobs_parent_id_idx;
+
+ALTER TABLE jobs_archive DROP COLUMN IF EXISTS parent_id;
+ALTER TABLE jobs DROP COLUMN IF EXISTS parent_id;
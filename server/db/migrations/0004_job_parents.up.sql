@@ -0,0 +1,8 @@
+ALTER TABLE jobs ADD COLUMN parent_id uuid;
+ALTER TABLE jobs_archive ADD COLUMN parent_id uuid;
+
+CREATE INDEX jobs_parent_id_idx ON jobs (parent_id);
+CREATE INDEX jobs_archive_parent_id_idx ON jobs_archive (parent_id);
+
+-- Jobs are only claimed once their parent is archived as done
+CREATE INDEX jobs_archive_uuid_idx ON jobs_archive (uuid);
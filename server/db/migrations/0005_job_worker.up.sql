@@ -0,0 +1,3 @@
+-- The worker that claimed a running job, so only it runs the job again
+-- after a restart
+ALTER TABLE jobs ADD COLUMN worker text;
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := Migrations()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, migrations)
+
+	latest, err := LatestVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, len(migrations), latest)
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/0002_add_things.up.sql":   {Data: []byte("CREATE TABLE things ();")},
+		"m/0002_add_things.down.sql": {Data: []byte("DROP TABLE things;")},
+		"m/0001_initial.up.sql":      {Data: []byte("CREATE TABLE jobs ();")},
+		"m/0001_initial.down.sql":    {Data: []byte("DROP TABLE jobs;")},
+	}
+	migrations, err := loadMigrations(fsys, "m")
+	assert.Nil(t, err)
+	if assert.Len(t, migrations, 2) {
+		assert.Equal(t, 1, migrations[0].Version)
+		assert.Equal(t, "add_things", migrations[1].Name)
+		assert.Equal(t, "DROP TABLE things;", migrations[1].Down)
+	}
+
+	delete(fsys, "m/0002_add_things.down.sql")
+	_, err = loadMigrations(fsys, "m")
+	assert.Error(t, err)
+
+	delete(fsys, "m/0002_add_things.up.sql")
+	delete(fsys, "m/0001_initial.up.sql")
+	delete(fsys, "m/0001_initial.down.sql")
+	fsys["m/0003_skipped.up.sql"] = &fstest.MapFile{Data: []byte("SELECT 1;")}
+	fsys["m/0003_skipped.down.sql"] = &fstest.MapFile{Data: []byte("SELECT 1;")}
+	_, err = loadMigrations(fsys, "m")
+	assert.Error(t, err)
+
+	fsys["m/notes.txt"] = &fstest.MapFile{}
+	_, err = loadMigrations(fsys, "m")
+	assert.Error(t, err)
+}
+
+func TestMigrateDownUp(t *testing.T) {
+	ctx := context.Background()
+	db := testConnection(t)
+
+	latest, err := LatestVersion()
+	assert.Nil(t, err)
+
+	version, err := db.CheckSchema(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, latest, version)
+
+	assert.Nil(t, db.MigrateDown(ctx, latest))
+	version, err = db.SchemaVersion(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, version)
+	_, err = db.CheckSchema(ctx)
+	assert.Error(t, err)
+
+	// Migrating up twice is a no-op
+	assert.Nil(t, db.MigrateUp(ctx))
+	assert.Nil(t, db.MigrateUp(ctx))
+	version, err = db.CheckSchema(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, latest, version)
+}
+
+// baselineSchema is what db/reset created before migrations were versioned.
+const baselineSchema = `
+CREATE TABLE jobs
+(
+  id serial PRIMARY KEY,
+  uuid uuid UNIQUE NOT NULL,
+  created timestamp with time zone NOT NULL DEFAULT now(),
+  running boolean NOT NULL DEFAULT false,
+  settings jsonb NOT NULL,
+  start_time timestamp with time zone,
+  end_time timestamp with time zone
+);
+
+CREATE TYPE archive_reason AS ENUM ('done', 'cancelled', 'error');
+
+CREATE TABLE jobs_archive
+(
+  id bigserial PRIMARY KEY,
+  uuid uuid NOT NULL,
+  created timestamp with time zone NOT NULL,
+  settings jsonb NOT NULL,
+  start_time timestamp with time zone,
+  end_time timestamp with time zone,
+  archive_reason archive_reason NOT NULL,
+  job_output text
+);
+
+INSERT INTO jobs (uuid, settings) VALUES ('7c2d2f1e-3b4a-4c5d-9e6f-7a8b9c0d1e2f', '{"prompt": "old"}');
+`
+
+func TestMigrateFromBaseline(t *testing.T) {
+	ctx := context.Background()
+	db := testConnection(t)
+	latest, err := LatestVersion()
+	assert.Nil(t, err)
+	defer db.Reset(ctx)
+
+	assert.Nil(t, db.MigrateTo(ctx, 0))
+	_, err = db.db.ExecContext(ctx, baselineSchema)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.MigrateUp(ctx))
+	version, err := db.CheckSchema(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, latest, version)
+
+	// Jobs queued before the upgrade are kept
+	n, err := db.CountPendingJobs(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+}
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/model"
+)
+
+const modelColumns = `name, source, modes, default_width, default_height, max_width, max_height, allow_cpu, is_default, created`
+
+// AddModel returns an AlreadyExists error if the name is taken. A new default
+// model takes over from the old one.
+func (db *DB) AddModel(ctx context.Context, m model.Model) error {
+	modes, err := json.Marshal(m.Modes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer tx.Rollback()
+
+	if m.Default {
+		if _, err := tx.ExecContext(ctx, `UPDATE models SET is_default=false WHERE is_default`); err != nil {
+			return errors.Annotate(err, "AddModel")
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, `
+	INSERT INTO models (`+modelColumns+`)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	ON CONFLICT (name) DO NOTHING
+	`, m.Name, m.Source, modes, m.DefaultWidth, m.DefaultHeight, m.MaxWidth, m.MaxHeight, m.AllowCPU, m.Default, m.Created)
+	if err != nil {
+		return errors.Annotate(err, "AddModel")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Trace(err)
+	} else if n == 0 {
+		return errors.AlreadyExistsf("model %s", m.Name)
+	}
+
+	return errors.Trace(tx.Commit())
+}
+
+// UpdateModel replaces everything but the name and created time. The default
+// model can only be changed by making another model the default.
+func (db *DB) UpdateModel(ctx context.Context, m model.Model) (bool, error) {
+	modes, err := json.Marshal(m.Modes)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	defer tx.Rollback()
+
+	if m.Default {
+		if _, err := tx.ExecContext(ctx, `UPDATE models SET is_default=false WHERE is_default AND name<>$1`, m.Name); err != nil {
+			return false, errors.Annotate(err, "UpdateModel")
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, `
+	UPDATE models
+	SET source=$2, modes=$3, default_width=$4, default_height=$5, max_width=$6, max_height=$7, allow_cpu=$8, is_default=(is_default OR $9)
+	WHERE name=$1
+	`, m.Name, m.Source, modes, m.DefaultWidth, m.DefaultHeight, m.MaxWidth, m.MaxHeight, m.AllowCPU, m.Default)
+	if err != nil {
+		return false, errors.Annotate(err, "UpdateModel")
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, errors.Trace(err)
+	}
+
+	return true, errors.Trace(tx.Commit())
+}
+
+// DeleteModel refuses to delete the default model with a NotValid error.
+func (db *DB) DeleteModel(ctx context.Context, name string) (bool, error) {
+	m, found, err := db.GetModel(ctx, name)
+	if err != nil || !found {
+		return false, errors.Trace(err)
+	}
+	if m.Default {
+		return false, errors.NotValidf("deleting default model %s", name)
+	}
+
+	res, err := db.db.ExecContext(ctx, `DELETE FROM models WHERE name=$1 AND NOT is_default`, name)
+	if err != nil {
+		return false, errors.Annotate(err, "DeleteModel")
+	}
+	n, err := res.RowsAffected()
+	return n > 0, errors.Trace(err)
+}
+
+func (db *DB) GetModel(ctx context.Context, name string) (model.Model, bool, error) {
+	row := db.db.QueryRowContext(ctx, `SELECT `+modelColumns+` FROM models WHERE name=$1`, name)
+
+	m, err := scanModel(row)
+	if err == sql.ErrNoRows {
+		return model.Model{}, false, nil
+	} else if err != nil {
+		return model.Model{}, false, errors.Annotate(err, "GetModel")
+	}
+	return m, true, nil
+}
+
+func (db *DB) GetDefaultModel(ctx context.Context) (model.Model, bool, error) {
+	row := db.db.QueryRowContext(ctx, `SELECT `+modelColumns+` FROM models WHERE is_default`)
+
+	m, err := scanModel(row)
+	if err == sql.ErrNoRows {
+		return model.Model{}, false, nil
+	} else if err != nil {
+		return model.Model{}, false, errors.Annotate(err, "GetDefaultModel")
+	}
+	return m, true, nil
+}
+
+// GetModels returns every model ordered by name.
+func (db *DB) GetModels(ctx context.Context) ([]model.Model, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT `+modelColumns+` FROM models ORDER BY name ASC`)
+	if err != nil {
+		return nil, errors.Annotate(err, "GetModels")
+	}
+	defer rows.Close()
+
+	models := []model.Model{}
+	for rows.Next() {
+		m, err := scanModel(rows)
+		if err != nil {
+			return nil, errors.Annotate(err, "GetModels Scan")
+		}
+		models = append(models, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return models, nil
+}
+
+func scanModel(row scanner) (model.Model, error) {
+	var (
+		m     model.Model
+		modes []byte
+	)
+	err := row.Scan(&m.Name, &m.Source, &modes, &m.DefaultWidth, &m.DefaultHeight, &m.MaxWidth, &m.MaxHeight, &m.AllowCPU, &m.Default, &m.Created)
+	if err != nil {
+		return model.Model{}, err
+	}
+	if err := json.Unmarshal(modes, &m.Modes); err != nil {
+		return model.Model{}, errors.Trace(err)
+	}
+	m.Created = m.Created.UTC()
+	return m, nil
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/quota"
+)
+
+// GetUserUsage counts the jobs an owner has queued, and everything they
+// submitted since the given time, whether or not it has finished.
+func (db *DB) GetUserUsage(ctx context.Context, ownerID int64, since time.Time) (quota.Usage, error) {
+	u, err := db.getUsage(ctx, "owner_id", ownerID, since)
+	return u, errors.Annotate(err, "GetUserUsage")
+}
+
+// GetIPUsage is GetUserUsage for jobs submitted from a client address.
+func (db *DB) GetIPUsage(ctx context.Context, clientIP string, since time.Time) (quota.Usage, error) {
+	u, err := db.getUsage(ctx, "client_ip", clientIP, since)
+	return u, errors.Annotate(err, "GetIPUsage")
+}
+
+// column is never user input.
+func (db *DB) getUsage(ctx context.Context, column string, value interface{}, since time.Time) (quota.Usage, error) {
+	var u quota.Usage
+
+	row := db.db.QueryRowContext(ctx, `
+	SELECT count(*) FROM jobs WHERE `+column+`=$1 AND running=false
+	`, value)
+	if err := row.Scan(&u.PendingJobs); err != nil {
+		return quota.Usage{}, errors.Trace(err)
+	}
+
+	row = db.db.QueryRowContext(ctx, `
+	SELECT count(*), coalesce(sum(cost), 0), min(created) FROM (
+		SELECT cost, created FROM jobs WHERE `+column+`=$1 AND created >= $2
+		UNION ALL
+		SELECT cost, created FROM jobs_archive WHERE `+column+`=$1 AND created >= $2
+	) a
+	`, value, since)
+	if err := row.Scan(&u.JobsInWindow, &u.CostInWindow, &u.OldestInWindow); err != nil {
+		return quota.Usage{}, errors.Trace(err)
+	}
+
+	return u, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 
@@ -16,7 +17,7 @@ func main() {
 	if err != nil {
 		log.Fatal(errors.ErrorStack(err))
 	}
-	err = db.Reset()
+	err = db.Reset(context.Background())
 	if err != nil {
 		log.Fatal(errors.ErrorStack(err))
 	}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wellsjo/ai-art/server/asset"
+	"github.com/wellsjo/ai-art/server/batch"
+	"github.com/wellsjo/ai-art/server/eta"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/model"
+	"github.com/wellsjo/ai-art/server/quota"
+	"github.com/wellsjo/ai-art/server/user"
+	"github.com/wellsjo/ai-art/server/webhook"
+)
+
+// Store is everything the server keeps between requests. *DB stores it in
+// Postgres, and the memory package keeps it in process for tests. Both must
+// pass the suite in dbtest.
+type Store interface {
+	JobStore
+	BatchStore
+	UserStore
+	DeliveryStore
+	ModelStore
+	AssetStore
+
+	Ping(ctx context.Context) error
+	CheckSchema(ctx context.Context) (int, error)
+}
+
+type JobStore interface {
+	AddJob(ctx context.Context, j job.Job) error
+	GetJobByUUID(ctx context.Context, uuid_ uuid.UUID) (job.Job, bool, int, error)
+	GetNextJob(ctx context.Context, hardware, worker string) (job.Job, bool, error)
+	GetRunningJobs(ctx context.Context, worker string) ([]job.Job, error)
+	SetJobPriority(ctx context.Context, uuid_ uuid.UUID, priority int) (bool, error)
+	ArchiveJob(ctx context.Context, ar job.ArchiveReason, uuid_ uuid.UUID, endTime time.Time) error
+	CancelJob(ctx context.Context, uuid_ uuid.UUID, endTime time.Time) (bool, error)
+	SetJobOutput(ctx context.Context, uuid_ uuid.UUID, output string) error
+	GetJobOutput(ctx context.Context, uuid_ uuid.UUID) (string, bool, error)
+	GetQueuedJobs(ctx context.Context) ([]job.Job, []job.Job, error)
+	CountPendingJobs(ctx context.Context) (int, error)
+	GetAllJobs(ctx context.Context) ([]job.Job, error)
+	GetChildJobs(ctx context.Context, parent uuid.UUID) ([]job.Job, error)
+	GetDurationSamples(ctx context.Context, hardware string, limit int) ([]eta.Sample, error)
+	GetUserUsage(ctx context.Context, ownerID int64, since time.Time) (quota.Usage, error)
+	GetIPUsage(ctx context.Context, clientIP string, since time.Time) (quota.Usage, error)
+}
+
+type BatchStore interface {
+	AddBatch(ctx context.Context, b batch.Batch, jobs []job.Job) error
+	GetBatch(ctx context.Context, uuid_ uuid.UUID) (batch.Batch, bool, error)
+	GetBatchJobs(ctx context.Context, uuid_ uuid.UUID) ([]job.Job, error)
+}
+
+type UserStore interface {
+	AddUser(ctx context.Context, u user.User, passwordHash string) (user.User, error)
+	GetUserByUsername(ctx context.Context, username string) (user.User, string, bool, error)
+	GetUserByID(ctx context.Context, id int64) (user.User, bool, error)
+	GetUserByAPIKey(ctx context.Context, keyHash string) (user.User, user.APIKey, bool, error)
+	AddAPIKey(ctx context.Context, k user.APIKey, keyHash string) (user.APIKey, error)
+	GetAPIKey(ctx context.Context, id int64) (user.APIKey, bool, error)
+	GetAPIKeys(ctx context.Context, userID int64) ([]user.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id int64, revoked time.Time) error
+	AddSession(ctx context.Context, userID int64, tokenHash string, expires time.Time) error
+	GetUserBySession(ctx context.Context, tokenHash string) (user.User, bool, error)
+	DeleteSession(ctx context.Context, tokenHash string) error
+}
+
+type ModelStore interface {
+	AddModel(ctx context.Context, m model.Model) error
+	UpdateModel(ctx context.Context, m model.Model) (bool, error)
+	DeleteModel(ctx context.Context, name string) (bool, error)
+	GetModel(ctx context.Context, name string) (model.Model, bool, error)
+	GetDefaultModel(ctx context.Context) (model.Model, bool, error)
+	GetModels(ctx context.Context) ([]model.Model, error)
+}
+
+type AssetStore interface {
+	AddAsset(ctx context.Context, a asset.Asset) error
+	GetAsset(ctx context.Context, id uuid.UUID) (asset.Asset, bool, error)
+	GetAssets(ctx context.Context, kind asset.Kind) ([]asset.Asset, error)
+	DeleteAsset(ctx context.Context, id uuid.UUID) (bool, error)
+}
+
+type DeliveryStore interface {
+	webhook.Store
+	GetJobDeliveries(ctx context.Context, jobUUID uuid.UUID) ([]webhook.Delivery, error)
+}
+
+var _ Store = (*DB)(nil)
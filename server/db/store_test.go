@@ -0,0 +1,18 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/wellsjo/ai-art/server/db"
+	"github.com/wellsjo/ai-art/server/db/dbtest"
+)
+
+func TestStore(t *testing.T) {
+	dbtest.TestStore(t, func(t *testing.T) db.Store {
+		database, err := db.GetTestConnection()
+		if err != nil {
+			t.Skipf("postgres unavailable: %v", err)
+		}
+		return database
+	})
+}
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/lib/pq"
+	"github.com/wellsjo/ai-art/server/user"
+)
+
+// AddUser returns an AlreadyExists error if the username is taken.
+func (db *DB) AddUser(ctx context.Context, u user.User, passwordHash string) (user.User, error) {
+	row := db.db.QueryRowContext(ctx,
+		`INSERT INTO users (username, password_hash, admin, created) VALUES ($1, $2, $3, $4) RETURNING id`,
+		u.Username, passwordHash, u.Admin, u.Created,
+	)
+	var pqErr *pq.Error
+	if err := row.Scan(&u.ID); errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return user.User{}, errors.AlreadyExistsf("user %q", u.Username)
+	} else if err != nil {
+		return user.User{}, errors.Annotate(err, "AddUser")
+	}
+
+	return u, nil
+}
+
+// uniqueViolation is the Postgres error code for a duplicate key.
+const uniqueViolation = "23505"
+
+// GetUserByUsername also returns the password hash so callers can verify a
+// login.
+func (db *DB) GetUserByUsername(ctx context.Context, username string) (user.User, string, bool, error) {
+	row := db.db.QueryRowContext(ctx,
+		`SELECT id, username, admin, created, password_hash FROM users WHERE username=$1`,
+		username,
+	)
+
+	var passwordHash string
+	u, found, err := scanUserRow(row, &passwordHash)
+	if err != nil {
+		return user.User{}, "", false, errors.Annotate(err, "GetUserByUsername")
+	}
+
+	return u, passwordHash, found, nil
+}
+
+func (db *DB) GetUserByID(ctx context.Context, id int64) (user.User, bool, error) {
+	row := db.db.QueryRowContext(ctx,
+		`SELECT id, username, admin, created FROM users WHERE id=$1`,
+		id,
+	)
+
+	u, found, err := scanUserRow(row)
+	return u, found, errors.Annotate(err, "GetUserByID")
+}
+
+// GetUserByAPIKey looks up an unrevoked API key and its owner by the key's
+// hash.
+func (db *DB) GetUserByAPIKey(ctx context.Context, keyHash string) (user.User, user.APIKey, bool, error) {
+	row := db.db.QueryRowContext(ctx, `
+	SELECT u.id, u.username, u.admin, u.created, `+prefixColumns("k", apiKeyColumns)+`
+	FROM api_keys k JOIN users u ON u.id=k.user_id
+	WHERE k.key_hash=$1 AND k.revoked IS NULL
+	`, keyHash)
+
+	var (
+		k           user.APIKey
+		callbackURL sql.NullString
+	)
+	u, found, err := scanUserRow(row, &k.ID, &k.UserID, &k.Name, &k.Prefix, &k.Created, &k.Revoked, &callbackURL)
+	if err != nil || !found {
+		return user.User{}, user.APIKey{}, false, errors.Annotate(err, "GetUserByAPIKey")
+	}
+	k.Created = k.Created.UTC()
+	k.CallbackURL = callbackURL.String
+
+	return u, k, true, nil
+}
+
+func (db *DB) AddAPIKey(ctx context.Context, k user.APIKey, keyHash string) (user.APIKey, error) {
+	row := db.db.QueryRowContext(ctx, `
+	INSERT INTO api_keys (user_id, name, prefix, key_hash, created, callback_url)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id
+	`, k.UserID, k.Name, k.Prefix, keyHash, k.Created, k.CallbackURL)
+	if err := row.Scan(&k.ID); err != nil {
+		return user.APIKey{}, errors.Annotate(err, "AddAPIKey")
+	}
+
+	return k, nil
+}
+
+func (db *DB) GetAPIKey(ctx context.Context, id int64) (user.APIKey, bool, error) {
+	row := db.db.QueryRowContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys WHERE id=$1`, id)
+
+	k, err := scanAPIKey(row)
+	if err == sql.ErrNoRows {
+		return user.APIKey{}, false, nil
+	} else if err != nil {
+		return user.APIKey{}, false, errors.Annotate(err, "GetAPIKey")
+	}
+
+	return k, true, nil
+}
+
+func (db *DB) GetAPIKeys(ctx context.Context, userID int64) ([]user.APIKey, error) {
+	rows, err := db.db.QueryContext(ctx, `
+	SELECT `+apiKeyColumns+` FROM api_keys
+	WHERE user_id=$1
+	ORDER BY created ASC
+	`, userID)
+	if err != nil {
+		return nil, errors.Annotate(err, "GetAPIKeys")
+	}
+	defer rows.Close()
+
+	keys := []user.APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, errors.Annotate(err, "GetAPIKeys Scan")
+		}
+		keys = append(keys, k)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return keys, nil
+}
+
+func (db *DB) RevokeAPIKey(ctx context.Context, id int64, revoked time.Time) error {
+	_, err := db.db.ExecContext(ctx,
+		`UPDATE api_keys SET revoked=$2 WHERE id=$1 AND revoked IS NULL`,
+		id, revoked,
+	)
+	return errors.Annotate(err, "RevokeAPIKey")
+}
+
+func (db *DB) AddSession(ctx context.Context, userID int64, tokenHash string, expires time.Time) error {
+	_, err := db.db.ExecContext(ctx,
+		`INSERT INTO sessions (token_hash, user_id, expires) VALUES ($1, $2, $3)`,
+		tokenHash, userID, expires,
+	)
+	return errors.Annotate(err, "AddSession")
+}
+
+func (db *DB) GetUserBySession(ctx context.Context, tokenHash string) (user.User, bool, error) {
+	row := db.db.QueryRowContext(ctx, `
+	SELECT u.id, u.username, u.admin, u.created
+	FROM sessions s JOIN users u ON u.id=s.user_id
+	WHERE s.token_hash=$1 AND s.expires > now()
+	`, tokenHash)
+
+	u, found, err := scanUserRow(row)
+	return u, found, errors.Annotate(err, "GetUserBySession")
+}
+
+func (db *DB) DeleteSession(ctx context.Context, tokenHash string) error {
+	_, err := db.db.ExecContext(ctx, `DELETE FROM sessions WHERE token_hash=$1`, tokenHash)
+	return errors.Annotate(err, "DeleteSession")
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, created, revoked, callback_url`
+
+func scanAPIKey(row scanner) (user.APIKey, error) {
+	var (
+		k           user.APIKey
+		callbackURL sql.NullString
+	)
+	if err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.Prefix, &k.Created, &k.Revoked, &callbackURL); err != nil {
+		return user.APIKey{}, err
+	}
+	k.Created = k.Created.UTC()
+	k.CallbackURL = callbackURL.String
+
+	return k, nil
+}
+
+func scanUserRow(row *sql.Row, extra ...interface{}) (user.User, bool, error) {
+	var u user.User
+	dest := append([]interface{}{&u.ID, &u.Username, &u.Admin, &u.Created}, extra...)
+	if err := row.Scan(dest...); err == sql.ErrNoRows {
+		return user.User{}, false, nil
+	} else if err != nil {
+		return user.User{}, false, errors.Trace(err)
+	}
+	u.Created = u.Created.UTC()
+
+	return u, true, nil
+}
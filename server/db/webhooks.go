@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/webhook"
+)
+
+const deliveryColumns = `id, job_uuid, url, event, payload, status, attempts, response_code, last_error, created, next_attempt, delivered_at`
+
+func (db *DB) AddDelivery(ctx context.Context, d webhook.Delivery) (webhook.Delivery, error) {
+	row := db.db.QueryRowContext(ctx, `
+	INSERT INTO webhook_deliveries (job_uuid, url, event, payload, status, attempts, created, next_attempt)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	RETURNING id
+	`, d.JobUUID, d.URL, d.Event, string(d.Payload), d.Status, d.Attempts, d.Created, d.NextAttempt)
+	if err := row.Scan(&d.ID); err != nil {
+		return webhook.Delivery{}, errors.Annotate(err, "AddDelivery")
+	}
+
+	return d, nil
+}
+
+func (db *DB) UpdateDelivery(ctx context.Context, d webhook.Delivery) error {
+	_, err := db.db.ExecContext(ctx, `
+	UPDATE webhook_deliveries
+		SET status=$2, attempts=$3, response_code=$4, last_error=$5, next_attempt=$6, delivered_at=$7
+	WHERE id=$1
+	`, d.ID, d.Status, d.Attempts, nullInt(d.ResponseCode), d.LastError, d.NextAttempt, d.DeliveredAt)
+	return errors.Annotate(err, "UpdateDelivery")
+}
+
+func (db *DB) GetDelivery(ctx context.Context, id int64) (webhook.Delivery, bool, error) {
+	row := db.db.QueryRowContext(ctx, `SELECT `+deliveryColumns+` FROM webhook_deliveries WHERE id=$1`, id)
+
+	d, err := scanDelivery(row)
+	if err == sql.ErrNoRows {
+		return webhook.Delivery{}, false, nil
+	} else if err != nil {
+		return webhook.Delivery{}, false, errors.Annotate(err, "GetDelivery")
+	}
+
+	return d, true, nil
+}
+
+// ClaimDueDeliveries skips rows being claimed by another server, so each
+// delivery is only handed to one.
+func (db *DB) ClaimDueDeliveries(ctx context.Context, now, leaseUntil time.Time, limit int) ([]webhook.Delivery, error) {
+	rows, err := db.db.QueryContext(ctx, `
+	UPDATE webhook_deliveries SET next_attempt=$3
+	WHERE id IN (
+		SELECT id FROM webhook_deliveries
+		WHERE status=$1 AND next_attempt <= $2
+		ORDER BY next_attempt ASC
+		LIMIT $4
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING `+deliveryColumns+`
+	`, webhook.StatusPending, now, leaseUntil, limit)
+	if err != nil {
+		return nil, errors.Annotate(err, "ClaimDueDeliveries")
+	}
+
+	return scanDeliveries(rows)
+}
+
+// GetJobDeliveries returns the delivery log for a job, oldest first.
+func (db *DB) GetJobDeliveries(ctx context.Context, jobUUID uuid.UUID) ([]webhook.Delivery, error) {
+	rows, err := db.db.QueryContext(ctx, `
+	SELECT `+deliveryColumns+` FROM webhook_deliveries
+	WHERE job_uuid=$1
+	ORDER BY created ASC, id ASC
+	`, jobUUID)
+	if err != nil {
+		return nil, errors.Annotate(err, "GetJobDeliveries")
+	}
+
+	return scanDeliveries(rows)
+}
+
+func scanDeliveries(rows *sql.Rows) ([]webhook.Delivery, error) {
+	defer rows.Close()
+
+	deliveries := []webhook.Delivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, errors.Annotate(err, "scanDeliveries")
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return deliveries, nil
+}
+
+func scanDelivery(row scanner) (webhook.Delivery, error) {
+	var (
+		d            webhook.Delivery
+		payload      string
+		responseCode sql.NullInt64
+		lastError    sql.NullString
+	)
+	if err := row.Scan(
+		&d.ID, &d.JobUUID, &d.URL, &d.Event, &payload, &d.Status, &d.Attempts,
+		&responseCode, &lastError, &d.Created, &d.NextAttempt, &d.DeliveredAt,
+	); err != nil {
+		return webhook.Delivery{}, err
+	}
+
+	d.Payload = []byte(payload)
+	d.ResponseCode = int(responseCode.Int64)
+	d.LastError = lastError.String
+	d.Created = d.Created.UTC()
+	return d, nil
+}
+
+func nullInt(i int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(i), Valid: i != 0}
+}
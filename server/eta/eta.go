@@ -0,0 +1,116 @@
+package eta
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wellsjo/ai-art/server/job"
+)
+
+// DefaultDuration is assumed for jobs when there is no history to go on.
+const DefaultDuration = 30 * time.Second
+
+// Sample is how long a finished job took.
+type Sample struct {
+	Settings job.Settings
+	Duration time.Duration
+}
+
+type key struct {
+	width, height, numIterations, steps int
+}
+
+func keyFor(s job.Settings) key {
+	steps := s.Steps
+	if steps <= 0 {
+		steps = job.DEFAULT_NUM_STEPS
+	}
+	return key{s.Width, s.Height, s.NumIterations, steps}
+}
+
+// Estimator predicts job durations from jobs that already ran on the same
+// hardware. Jobs with the same size, iterations and steps as a previous job are
+// estimated from their average; anything else is scaled by compute cost.
+type Estimator struct {
+	byKey   map[key]time.Duration
+	perCost float64
+}
+
+func NewEstimator(samples []Sample) *Estimator {
+	var (
+		sums      = map[key]time.Duration{}
+		counts    = map[key]int{}
+		totalDur  time.Duration
+		totalCost int64
+	)
+	for _, s := range samples {
+		k := keyFor(s.Settings)
+		sums[k] += s.Duration
+		counts[k]++
+		totalDur += s.Duration
+		totalCost += s.Settings.Cost()
+	}
+
+	e := &Estimator{
+		byKey: map[key]time.Duration{},
+	}
+	for k, sum := range sums {
+		e.byKey[k] = sum / time.Duration(counts[k])
+	}
+	if totalCost > 0 {
+		e.perCost = float64(totalDur) / float64(totalCost)
+	}
+	return e
+}
+
+func (e *Estimator) Estimate(s job.Settings) time.Duration {
+	if d, ok := e.byKey[keyFor(s)]; ok {
+		return d
+	}
+	if e.perCost > 0 {
+		return time.Duration(e.perCost * float64(s.Cost()))
+	}
+	return DefaultDuration
+}
+
+// Estimate is where a job stands in the queue. Position is 0 for the running
+// job and counts up from 1 for pending jobs.
+type Estimate struct {
+	Position int           `json:"position"`
+	StartIn  time.Duration `json:"startIn"`
+	FinishIn time.Duration `json:"finishIn"`
+}
+
+// Queue estimates every job in the queue. running are the jobs currently
+// being worked on, and pending must be in the order they will be run.
+func (e *Estimator) Queue(running, pending []job.Job, now time.Time) map[uuid.UUID]Estimate {
+	estimates := map[uuid.UUID]Estimate{}
+
+	var ahead time.Duration
+	for _, j := range running {
+		remaining := e.Estimate(j.Settings)
+		if j.StartTime != nil {
+			remaining -= now.Sub(*j.StartTime)
+		}
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		estimates[j.UUID] = Estimate{
+			FinishIn: remaining.Round(time.Second),
+		}
+		ahead += remaining
+	}
+
+	for i, j := range pending {
+		d := e.Estimate(j.Settings)
+		estimates[j.UUID] = Estimate{
+			Position: i + 1,
+			StartIn:  ahead.Round(time.Second),
+			FinishIn: (ahead + d).Round(time.Second),
+		}
+		ahead += d
+	}
+
+	return estimates
+}
@@ -0,0 +1,45 @@
+package eta
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wellsjo/ai-art/server/job"
+)
+
+func TestEstimate(t *testing.T) {
+	small := job.Settings{Width: 256, Height: 256, NumIterations: 1}
+	large := job.Settings{Width: 512, Height: 512, NumIterations: 1}
+
+	e := NewEstimator(nil)
+	assert.Equal(t, DefaultDuration, e.Estimate(small))
+
+	e = NewEstimator([]Sample{
+		{Settings: small, Duration: 10 * time.Second},
+		{Settings: small, Duration: 20 * time.Second},
+	})
+	assert.Equal(t, 15*time.Second, e.Estimate(small))
+
+	// 4x the pixels of anything seen so far
+	assert.Equal(t, 60*time.Second, e.Estimate(large))
+}
+
+func TestQueue(t *testing.T) {
+	s := job.Settings{Width: 512, Height: 512, NumIterations: 1}
+	e := NewEstimator([]Sample{{Settings: s, Duration: 10 * time.Second}})
+
+	now := time.Now()
+	started := now.Add(-4 * time.Second)
+
+	running, _ := job.New(job.Settings{Prompt: "running"})
+	running.StartTime = &started
+	p1, _ := job.New(job.Settings{Prompt: "p1"})
+	p2, _ := job.New(job.Settings{Prompt: "p2"})
+
+	estimates := e.Queue([]job.Job{running}, []job.Job{p1, p2}, now)
+
+	assert.Equal(t, Estimate{Position: 0, FinishIn: 6 * time.Second}, estimates[running.UUID])
+	assert.Equal(t, Estimate{Position: 1, StartIn: 6 * time.Second, FinishIn: 16 * time.Second}, estimates[p1.UUID])
+	assert.Equal(t, Estimate{Position: 2, StartIn: 16 * time.Second, FinishIn: 26 * time.Second}, estimates[p2.UUID])
+}
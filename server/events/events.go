@@ -0,0 +1,249 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DEFAULT_LOG_SIZE is how many recent events are kept per job for
+	// clients that reconnect.
+	DEFAULT_LOG_SIZE = 100
+	// DEFAULT_RETENTION is how long the log of a finished job is kept.
+	DEFAULT_RETENTION = 10 * time.Minute
+	SUBSCRIBER_BUFFER = 64
+)
+
+const (
+	TypeStatus   = "status"
+	TypeProgress = "progress"
+	TypeQueue    = "queue"
+	// TypeComplete is the last event of a job. Its data has the final status.
+	TypeComplete = "complete"
+)
+
+// Event is something that happened to a job. IDs increase by one with every
+// event published for the same job, starting at 1.
+type Event struct {
+	ID      int64       `json:"id"`
+	JobUUID uuid.UUID   `json:"jobUUID"`
+	Type    string      `json:"type"`
+	Data    interface{} `json:"data"`
+	Time    time.Time   `json:"time"`
+}
+
+type Progress struct {
+	Step    int `json:"step"`
+	Total   int `json:"total"`
+	Percent int `json:"percent"`
+}
+
+func NewProgress(step, total int) Progress {
+	p := Progress{Step: step, Total: total}
+	if total > 0 {
+		p.Percent = step * 100 / total
+	}
+	return p
+}
+
+type Opts struct {
+	LogSize   int
+	Retention time.Duration
+}
+
+type jobLog struct {
+	events   []Event
+	lastID   int64
+	subs     map[chan Event]struct{}
+	finished *time.Time
+}
+
+// Broker keeps a short log of recent events per job and fans new events out
+// to subscribers.
+type Broker struct {
+	opts Opts
+	mtx  sync.Mutex
+	logs map[uuid.UUID]*jobLog
+}
+
+func New(opts Opts) *Broker {
+	if opts.LogSize == 0 {
+		opts.LogSize = DEFAULT_LOG_SIZE
+	}
+	if opts.Retention == 0 {
+		opts.Retention = DEFAULT_RETENTION
+	}
+
+	return &Broker{
+		opts: opts,
+		logs: map[uuid.UUID]*jobLog{},
+	}
+}
+
+// Publish records an event for a job and sends it to its subscribers.
+// Subscribers that have fallen too far behind are dropped; they are expected
+// to reconnect and resume from the last ID they saw.
+func (b *Broker) Publish(jobUUID uuid.UUID, typ string, data interface{}) Event {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	now := time.Now()
+	b.expire(now)
+
+	l := b.getLog(jobUUID)
+	l.lastID++
+	e := Event{
+		ID:      l.lastID,
+		JobUUID: jobUUID,
+		Type:    typ,
+		Data:    data,
+		Time:    now.UTC(),
+	}
+
+	l.events = append(l.events, e)
+	if len(l.events) > b.opts.LogSize {
+		l.events = l.events[len(l.events)-b.opts.LogSize:]
+	}
+
+	for ch := range l.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(l.subs, ch)
+			close(ch)
+		}
+	}
+
+	if typ == TypeComplete {
+		l.finished = &now
+		for ch := range l.subs {
+			delete(l.subs, ch)
+			close(ch)
+		}
+	}
+
+	return e
+}
+
+// Subscription receives the events of one job.
+type Subscription struct {
+	// Replay holds logged events published after the ID given to Subscribe.
+	Replay []Event
+	// Missed is true if some of those events were already dropped from the
+	// log (or the ID is from before a restart), so the subscriber should be
+	// sent a fresh snapshot of the job.
+	Missed bool
+	// LastID is the ID of the latest event published before subscribing.
+	LastID int64
+	// Events is closed once the job completes or the subscriber falls
+	// behind.
+	Events <-chan Event
+
+	close func()
+}
+
+func (s *Subscription) Close() {
+	s.close()
+}
+
+func (b *Broker) Subscribe(jobUUID uuid.UUID, lastID int64) *Subscription {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	l := b.getLog(jobUUID)
+	replay, missed := l.since(lastID)
+
+	ch := make(chan Event, SUBSCRIBER_BUFFER)
+	sub := &Subscription{
+		Replay: replay,
+		Missed: missed,
+		LastID: l.lastID,
+		Events: ch,
+		close:  func() {},
+	}
+	if l.finished != nil {
+		close(ch)
+		return sub
+	}
+
+	l.subs[ch] = struct{}{}
+	sub.close = func() {
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+
+		if _, ok := l.subs[ch]; ok {
+			delete(l.subs, ch)
+			close(ch)
+		}
+		// Don't keep empty logs around for jobs that finished before the
+		// server started.
+		if l.lastID == 0 && len(l.subs) == 0 && b.logs[jobUUID] == l {
+			delete(b.logs, jobUUID)
+		}
+	}
+	return sub
+}
+
+// Since returns the logged events after lastID without subscribing. See
+// Subscription for the meaning of the other values.
+func (b *Broker) Since(jobUUID uuid.UUID, lastID int64) (replay []Event, missed bool, latestID int64) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	l, ok := b.logs[jobUUID]
+	if !ok {
+		return nil, lastID > 0, 0
+	}
+	replay, missed = l.since(lastID)
+	return replay, missed, l.lastID
+}
+
+// Latest returns the most recent logged event of a type.
+func (b *Broker) Latest(jobUUID uuid.UUID, typ string) (Event, bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	l, ok := b.logs[jobUUID]
+	if !ok {
+		return Event{}, false
+	}
+	for i := len(l.events) - 1; i >= 0; i-- {
+		if l.events[i].Type == typ {
+			return l.events[i], true
+		}
+	}
+	return Event{}, false
+}
+
+func (b *Broker) getLog(jobUUID uuid.UUID) *jobLog {
+	l, ok := b.logs[jobUUID]
+	if !ok {
+		l = &jobLog{subs: map[chan Event]struct{}{}}
+		b.logs[jobUUID] = l
+	}
+	return l
+}
+
+// expire forgets finished jobs that nobody is listening to anymore.
+func (b *Broker) expire(now time.Time) {
+	for jobUUID, l := range b.logs {
+		if l.finished != nil && now.Sub(*l.finished) > b.opts.Retention {
+			delete(b.logs, jobUUID)
+		}
+	}
+}
+
+// since returns the events after lastID and whether any were missed.
+func (l *jobLog) since(lastID int64) ([]Event, bool) {
+	if lastID >= l.lastID {
+		return nil, lastID > l.lastID
+	}
+	if len(l.events) == 0 || l.events[0].ID > lastID+1 {
+		return append([]Event{}, l.events...), true
+	}
+
+	i := int(lastID - l.events[0].ID + 1)
+	return append([]Event{}, l.events[i:]...), false
+}
@@ -0,0 +1,125 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	b := New(Opts{})
+	jobUUID := uuid.New()
+
+	sub := b.Subscribe(jobUUID, 0)
+	defer sub.Close()
+	assert.Empty(t, sub.Replay)
+	assert.False(t, sub.Missed)
+
+	b.Publish(jobUUID, TypeStatus, "running")
+	b.Publish(jobUUID, TypeProgress, NewProgress(5, 50))
+	b.Publish(jobUUID, TypeComplete, "done")
+
+	var got []Event
+	for e := range sub.Events {
+		got = append(got, e)
+	}
+	assert.Len(t, got, 3)
+	assert.Equal(t, int64(1), got[0].ID)
+	assert.Equal(t, NewProgress(5, 50), got[1].Data)
+	assert.Equal(t, 10, got[1].Data.(Progress).Percent)
+	assert.Equal(t, TypeComplete, got[2].Type)
+}
+
+func TestResume(t *testing.T) {
+	b := New(Opts{LogSize: 3})
+	jobUUID := uuid.New()
+
+	for i := 0; i < 5; i++ {
+		b.Publish(jobUUID, TypeProgress, NewProgress(i, 5))
+	}
+
+	sub := b.Subscribe(jobUUID, 3)
+	assert.False(t, sub.Missed)
+	assert.Equal(t, int64(5), sub.LastID)
+	if assert.Len(t, sub.Replay, 2) {
+		assert.Equal(t, int64(4), sub.Replay[0].ID)
+		assert.Equal(t, int64(5), sub.Replay[1].ID)
+	}
+	sub.Close()
+
+	// Event 2 has been dropped from the log
+	sub = b.Subscribe(jobUUID, 1)
+	assert.True(t, sub.Missed)
+	assert.Len(t, sub.Replay, 3)
+	sub.Close()
+
+	// IDs from before a restart are newer than anything in the log
+	sub = b.Subscribe(jobUUID, 9)
+	assert.True(t, sub.Missed)
+	assert.Empty(t, sub.Replay)
+	sub.Close()
+
+	sub = b.Subscribe(jobUUID, 5)
+	assert.False(t, sub.Missed)
+	assert.Empty(t, sub.Replay)
+	sub.Close()
+}
+
+func TestCompletedJob(t *testing.T) {
+	b := New(Opts{Retention: time.Hour})
+	jobUUID := uuid.New()
+	b.Publish(jobUUID, TypeComplete, "cancelled")
+
+	sub := b.Subscribe(jobUUID, 0)
+	defer sub.Close()
+	assert.Len(t, sub.Replay, 1)
+
+	_, ok := <-sub.Events
+	assert.False(t, ok)
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	b := New(Opts{LogSize: 1000})
+	jobUUID := uuid.New()
+
+	sub := b.Subscribe(jobUUID, 0)
+	defer sub.Close()
+
+	for i := 0; i <= SUBSCRIBER_BUFFER; i++ {
+		b.Publish(jobUUID, TypeProgress, NewProgress(i, 100))
+	}
+
+	n := 0
+	for range sub.Events {
+		n++
+	}
+	assert.Equal(t, SUBSCRIBER_BUFFER, n)
+}
+
+func TestSinceLatest(t *testing.T) {
+	b := New(Opts{})
+	jobUUID := uuid.New()
+
+	replay, missed, latestID := b.Since(jobUUID, 0)
+	assert.Empty(t, replay)
+	assert.False(t, missed)
+	assert.Equal(t, int64(0), latestID)
+
+	_, ok := b.Latest(jobUUID, TypeProgress)
+	assert.False(t, ok)
+
+	b.Publish(jobUUID, TypeStatus, "running")
+	b.Publish(jobUUID, TypeProgress, NewProgress(1, 10))
+	b.Publish(jobUUID, TypeProgress, NewProgress(2, 10))
+
+	replay, missed, latestID = b.Since(jobUUID, 1)
+	assert.Len(t, replay, 2)
+	assert.False(t, missed)
+	assert.Equal(t, int64(3), latestID)
+
+	e, ok := b.Latest(jobUUID, TypeProgress)
+	assert.True(t, ok)
+	assert.Equal(t, NewProgress(2, 10), e.Data)
+}
@@ -0,0 +1,124 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const DEFAULT_TIMEOUT = 5 * time.Second
+
+type Status string
+
+var (
+	StatusOK   Status = "ok"
+	StatusFail Status = "fail"
+)
+
+// CheckFunc returns nil if a dependency is usable. Details, if any, are
+// reported alongside the status.
+type CheckFunc func(ctx context.Context) (details interface{}, err error)
+
+type Result struct {
+	Status   Status      `json:"status"`
+	Error    string      `json:"error,omitempty"`
+	Details  interface{} `json:"details,omitempty"`
+	Duration string      `json:"duration"`
+}
+
+type Report struct {
+	Status Status            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+func (r Report) OK() bool {
+	return r.Status == StatusOK
+}
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// Checker runs a set of named checks concurrently, each with a timeout.
+type Checker struct {
+	timeout time.Duration
+	checks  []check
+}
+
+func New(timeout time.Duration) *Checker {
+	if timeout == 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	return &Checker{timeout: timeout}
+}
+
+func (c *Checker) Add(name string, fn CheckFunc) {
+	c.checks = append(c.checks, check{name: name, fn: fn})
+}
+
+// Run fails the report if any check fails or times out.
+func (c *Checker) Run(ctx context.Context) Report {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var (
+		mtx    sync.Mutex
+		wg     sync.WaitGroup
+		report = Report{
+			Status: StatusOK,
+			Checks: map[string]Result{},
+		}
+	)
+
+	for _, ch := range c.checks {
+		wg.Add(1)
+		go func(ch check) {
+			defer wg.Done()
+
+			res := c.run(ctx, ch)
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			report.Checks[ch.name] = res
+			if res.Status != StatusOK {
+				report.Status = StatusFail
+			}
+		}(ch)
+	}
+	wg.Wait()
+
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, ch check) Result {
+	start := time.Now()
+
+	type outcome struct {
+		details interface{}
+		err     error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		details, err := ch.fn(ctx)
+		done <- outcome{details, err}
+	}()
+
+	var o outcome
+	select {
+	case o = <-done:
+	case <-ctx.Done():
+		o.err = ctx.Err()
+	}
+
+	res := Result{
+		Status:   StatusOK,
+		Details:  o.details,
+		Duration: time.Since(start).Round(time.Microsecond).String(),
+	}
+	if o.err != nil {
+		res.Status = StatusFail
+		res.Error = o.err.Error()
+	}
+	return res
+}
@@ -0,0 +1,46 @@
+package health
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker(t *testing.T) {
+	c := New(time.Second)
+	c.Add("ok", func(ctx context.Context) (interface{}, error) {
+		return "v1", nil
+	})
+
+	report := c.Run(context.Background())
+	assert.True(t, report.OK())
+	assert.Equal(t, StatusOK, report.Checks["ok"].Status)
+	assert.Equal(t, "v1", report.Checks["ok"].Details)
+
+	c.Add("broken", func(ctx context.Context) (interface{}, error) {
+		return nil, errors.New("connection refused")
+	})
+
+	report = c.Run(context.Background())
+	assert.False(t, report.OK())
+	assert.Equal(t, StatusOK, report.Checks["ok"].Status)
+	assert.Equal(t, StatusFail, report.Checks["broken"].Status)
+	assert.Equal(t, "connection refused", report.Checks["broken"].Error)
+}
+
+func TestTimeout(t *testing.T) {
+	c := New(50 * time.Millisecond)
+	c.Add("hangs", func(ctx context.Context) (interface{}, error) {
+		time.Sleep(time.Second)
+		return nil, nil
+	})
+
+	start := time.Now()
+	report := c.Run(context.Background())
+	assert.Less(t, time.Since(start), time.Second)
+	assert.False(t, report.OK())
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks["hangs"].Error)
+}
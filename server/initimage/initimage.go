@@ -0,0 +1,132 @@
+// Package initimage checks the images uploaded for jobs to start from, and
+// prepares them for the runners: upright, without metadata, at the size of
+// the job and saved as PNG.
+package initimage
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"os"
+
+	"github.com/juju/errors"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// MAX_UPLOAD_SIZE is the largest image file that can be uploaded.
+const MAX_UPLOAD_SIZE = 20 << 20
+
+// MAX_PIXELS limits the size of uploaded images once decoded, so small files
+// that decode to huge images are turned away before they are decoded.
+const MAX_PIXELS = 4096 * 4096
+
+// Fit is how an image is made to fit the size of a job whose aspect ratio
+// differs from the image's.
+type Fit string
+
+const (
+	// FitCrop scales the image to cover the job and crops what sticks out
+	// evenly from both sides.
+	FitCrop Fit = "crop"
+	// FitContain scales the image to fit inside the job and pads the rest
+	// with black.
+	FitContain Fit = "contain"
+	// FitStretch scales the image to the job's size, distorting it.
+	FitStretch Fit = "stretch"
+)
+
+const DEFAULT_FIT = FitCrop
+
+// ParseFit returns the fit named s, or DEFAULT_FIT if s is empty.
+func ParseFit(s string) (Fit, error) {
+	switch f := Fit(s); f {
+	case "":
+		return DEFAULT_FIT, nil
+	case FitCrop, FitContain, FitStretch:
+		return f, nil
+	}
+	return "", errors.NotValidf("fit %q", s)
+}
+
+// Decode reads an uploaded PNG, JPEG, GIF or WebP image and turns it upright
+// if its EXIF data says it was taken rotated. Anything else, and images over
+// MAX_UPLOAD_SIZE or MAX_PIXELS, get a NotValid error.
+func Decode(r io.Reader) (image.Image, error) {
+	b, err := io.ReadAll(io.LimitReader(r, MAX_UPLOAD_SIZE+1))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(b) > MAX_UPLOAD_SIZE {
+		return nil, errors.NotValidf("image over %d bytes", MAX_UPLOAD_SIZE)
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.NewNotValid(err, "image")
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > MAX_PIXELS {
+		return nil, errors.NotValidf("image size %dx%d (max %d pixels)", cfg.Width, cfg.Height, MAX_PIXELS)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.NewNotValid(err, "image")
+	}
+	if format == "jpeg" {
+		img = orient(img, exifOrientation(b))
+	}
+	return img, nil
+}
+
+// Resize scales img to width by height, using fit if their aspect ratios
+// differ.
+func Resize(img image.Image, width, height int, fit Fit) image.Image {
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	src := img.Bounds()
+	sw, sh := src.Dx(), src.Dy()
+
+	switch fit {
+	case FitCrop:
+		// The largest part of the image with the job's aspect ratio
+		w, h := sw, sw*height/width
+		if h > sh {
+			w, h = sh*width/height, sh
+		}
+		x := src.Min.X + (sw-w)/2
+		y := src.Min.Y + (sh-h)/2
+		src = image.Rect(x, y, x+w, y+h)
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	case FitContain:
+		draw.Draw(dst, dst.Bounds(), image.Black, image.Point{}, draw.Src)
+		w, h := width, sh*width/sw
+		if h > height {
+			w, h = sw*height/sh, height
+		}
+		x := (width - w) / 2
+		y := (height - h) / 2
+		draw.CatmullRom.Scale(dst, image.Rect(x, y, x+w, y+h), img, src, draw.Src, nil)
+	default:
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	}
+	return dst
+}
+
+// Save writes img to path as a PNG. Nothing from the uploaded file besides
+// its pixels is kept.
+func Save(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, img); err != nil {
+		os.Remove(path)
+		return errors.Trace(err)
+	}
+	return errors.Trace(f.Close())
+}
@@ -0,0 +1,121 @@
+package initimage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testImage is red on the left half and blue on the right.
+func testImage(w, h int) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{R: 255, A: 255}
+			if x >= w/2 {
+				c = color.NRGBA{B: 255, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// withOrientation adds an EXIF segment with an orientation to a JPEG.
+func withOrientation(t *testing.T, jpg []byte, orientation uint16) []byte {
+	var exif bytes.Buffer
+	exif.WriteString("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08")
+	for _, v := range []interface{}{
+		uint16(1), uint16(exifOrientationTag), uint16(3), uint32(1), orientation, uint16(0), uint32(0),
+	} {
+		require.NoError(t, binary.Write(&exif, binary.BigEndian, v))
+	}
+
+	var b bytes.Buffer
+	b.Write(jpg[:2])
+	b.Write([]byte{0xff, 0xe1})
+	require.NoError(t, binary.Write(&b, binary.BigEndian, uint16(exif.Len()+2)))
+	b.Write(exif.Bytes())
+	b.Write(jpg[2:])
+	return b.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	var jpg bytes.Buffer
+	require.NoError(t, jpeg.Encode(&jpg, testImage(64, 32), nil))
+
+	img, err := Decode(bytes.NewReader(jpg.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 64, 32), img.Bounds())
+
+	// Rotated 90 degrees clockwise, so the red half ends up on top
+	img, err = Decode(bytes.NewReader(withOrientation(t, jpg.Bytes(), 6)))
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 32, 64), img.Bounds())
+	r, _, b, _ := img.At(16, 8).RGBA()
+	assert.Greater(t, r, b)
+	r, _, b, _ = img.At(16, 56).RGBA()
+	assert.Greater(t, b, r)
+
+	_, err = Decode(strings.NewReader("not an image"))
+	assert.True(t, errors.IsNotValid(err), "%v", err)
+
+	// A tiny file claiming to be a huge image isn't decoded
+	var bomb bytes.Buffer
+	require.NoError(t, png.Encode(&bomb, image.NewGray(image.Rect(0, 0, 1, 1))))
+	b2 := bomb.Bytes()
+	binary.BigEndian.PutUint32(b2[16:], 100000)
+	binary.BigEndian.PutUint32(b2[20:], 100000)
+	binary.BigEndian.PutUint32(b2[29:], crc32.ChecksumIEEE(b2[12:29]))
+	_, err = Decode(bytes.NewReader(b2))
+	assert.ErrorContains(t, err, "pixels")
+}
+
+func TestResize(t *testing.T) {
+	src := testImage(200, 100)
+
+	// Cropping keeps the middle, half red and half blue
+	img := Resize(src, 64, 64, FitCrop)
+	assert.Equal(t, image.Rect(0, 0, 64, 64), img.Bounds())
+	assert.Equal(t, color.NRGBA{R: 255, A: 255}, img.At(8, 32))
+	assert.Equal(t, color.NRGBA{B: 255, A: 255}, img.At(56, 32))
+
+	// Containing pads above and below
+	img = Resize(src, 64, 64, FitContain)
+	assert.Equal(t, color.NRGBA{A: 255}, img.At(32, 4))
+	assert.Equal(t, color.NRGBA{R: 255, A: 255}, img.At(4, 32))
+
+	img = Resize(src, 64, 128, FitStretch)
+	assert.Equal(t, image.Rect(0, 0, 64, 128), img.Bounds())
+	assert.Equal(t, color.NRGBA{R: 255, A: 255}, img.At(4, 4))
+
+	_, err := ParseFit("zoom")
+	assert.True(t, errors.IsNotValid(err))
+	fit, err := ParseFit("")
+	assert.NoError(t, err)
+	assert.Equal(t, DEFAULT_FIT, fit)
+}
+
+func TestSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image")
+	require.NoError(t, Save(path, testImage(16, 8)))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	_, format, err := image.DecodeConfig(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "png", format)
+}
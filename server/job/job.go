@@ -4,7 +4,7 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,19 +15,70 @@ const DEFAULT_WIDTH = 512
 const DEFAULT_HEIGHT = 512
 const DEFAULT_NUM_ITERATIONS = 1
 
+// DEFAULT_NUM_STEPS and DEFAULT_SCALE match the --ddim_steps and --scale
+// defaults of the docker entrypoint.
+const DEFAULT_NUM_STEPS = 50
+const DEFAULT_SCALE = 7.5
+
 type Mode int
 
 const (
 	TextToImageMode Mode = iota
 	ImageToImageMode
+	// UpscaleMode enlarges an existing image instead of rendering one.
+	UpscaleMode
 )
 
+// DEFAULT_UPSCALER is understood by the entrypoint and by AUTOMATIC1111.
+const DEFAULT_UPSCALER = "Lanczos"
+const DEFAULT_UPSCALE_FACTOR = 2
+const MAX_UPSCALE_FACTOR = 4
+
+// MAX_UPSCALE_SIZE limits the width and height of upscaled images.
+const MAX_UPSCALE_SIZE = 4096
+
+func (m Mode) String() string {
+	switch m {
+	case TextToImageMode:
+		return "text-to-image"
+	case ImageToImageMode:
+		return "image-to-image"
+	case UpscaleMode:
+		return "upscale"
+	}
+	return fmt.Sprintf("mode %d", int(m))
+}
+
 type Settings struct {
-	Prompt        string `json:"prompt"`
-	Width         int    `json:"width"`
-	Height        int    `json:"height"`
-	NumIterations int    `json:"numIterations"`
-	Mode          Mode   `json:"mode"`
+	Prompt        string  `json:"prompt"`
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	NumIterations int     `json:"numIterations"`
+	Mode          Mode    `json:"mode"`
+	Steps         int     `json:"steps,omitempty"`
+	Scale         float64 `json:"scale,omitempty"`
+	Seed          int64   `json:"seed,omitempty"`
+	// Model is the name of a registered model. Jobs from before the registry
+	// leave it empty and use the default model.
+	Model  string     `json:"model,omitempty"`
+	Assets []AssetRef `json:"assets,omitempty"`
+	// Upscaler and UpscaleFactor are used by upscale jobs, whose Width and
+	// Height are the size of the upscaled image.
+	Upscaler      string `json:"upscaler,omitempty"`
+	UpscaleFactor int    `json:"upscaleFactor,omitempty"`
+}
+
+// DEFAULT_ASSET_WEIGHT is how strongly a LoRA is applied unless a job says
+// otherwise.
+const DEFAULT_ASSET_WEIGHT = 1.0
+
+// MAX_ASSETS limits how many assets a job can use.
+const MAX_ASSETS = 8
+
+// AssetRef is an uploaded asset used by a job. Weight only applies to LoRAs.
+type AssetRef struct {
+	ID     uuid.UUID `json:"id"`
+	Weight float64   `json:"weight,omitempty"`
 }
 
 func (s Settings) String() string {
@@ -39,6 +90,19 @@ func (s Settings) Value() (driver.Value, error) {
 	return json.Marshal(s)
 }
 
+// Cost is a rough measure of the compute a job needs: steps × pixels × samples.
+// Upscaling is counted as a single step.
+func (s Settings) Cost() int64 {
+	if s.Mode == UpscaleMode {
+		return int64(s.Width) * int64(s.Height)
+	}
+	steps := s.Steps
+	if steps <= 0 {
+		steps = DEFAULT_NUM_STEPS
+	}
+	return int64(steps) * int64(s.Width) * int64(s.Height) * int64(s.NumIterations)
+}
+
 func (s *Settings) Scan(value interface{}) error {
 	b, ok := value.([]byte)
 	if !ok {
@@ -49,8 +113,16 @@ func (s *Settings) Scan(value interface{}) error {
 }
 
 type Job struct {
-	Settings      Settings
-	UUID          uuid.UUID
+	Settings  Settings
+	UUID      uuid.UUID
+	OwnerID   int64
+	ClientIP  string
+	Priority  int
+	Hardware  string
+	BatchUUID uuid.UUID
+	// ParentUUID is the job whose image this job starts from, if any.
+	ParentUUID    uuid.UUID
+	CallbackURL   string
 	Running       bool
 	Created       time.Time
 	StartTime     *time.Time
@@ -82,20 +154,40 @@ func (j Job) Status() string {
 
 func New(settings Settings) (Job, error) {
 	if settings.Prompt == "" {
-		return Job{}, errors.Trace(errors.New("missing prompt"))
+		return Job{}, errors.NewNotValid(nil, "missing prompt")
 	}
 
 	if settings.NumIterations <= 0 {
 		settings.NumIterations = DEFAULT_NUM_ITERATIONS
-		log.Println("using default num iterations", DEFAULT_NUM_ITERATIONS)
+		slog.Debug("Using default num iterations", "numIterations", DEFAULT_NUM_ITERATIONS)
 	}
 	if settings.Width <= 0 {
 		settings.Width = DEFAULT_WIDTH
-		log.Println("using default width setting", DEFAULT_WIDTH)
+		slog.Debug("Using default width", "width", DEFAULT_WIDTH)
 	}
 	if settings.Height <= 0 {
 		settings.Height = DEFAULT_HEIGHT
-		log.Println("using default height setting", DEFAULT_HEIGHT)
+		slog.Debug("Using default height", "height", DEFAULT_HEIGHT)
+	}
+	if settings.Steps <= 0 {
+		settings.Steps = DEFAULT_NUM_STEPS
+	}
+	if settings.Scale <= 0 {
+		settings.Scale = DEFAULT_SCALE
+	}
+	// A seed of 0 lets stable diffusion pick one at random
+	if settings.Seed < 0 {
+		return Job{}, errors.NotValidf("seed %v", settings.Seed)
+	}
+	if len(settings.Assets) > MAX_ASSETS {
+		return Job{}, errors.NotValidf("%d assets (max %d)", len(settings.Assets), MAX_ASSETS)
+	}
+	// Batches share one list between their jobs
+	settings.Assets = append([]AssetRef(nil), settings.Assets...)
+	for i := range settings.Assets {
+		if settings.Assets[i].Weight == 0 {
+			settings.Assets[i].Weight = DEFAULT_ASSET_WEIGHT
+		}
 	}
 
 	if err := dimensionValid(settings.Width); err != nil {
@@ -112,9 +204,43 @@ func New(settings Settings) (Job, error) {
 	}, nil
 }
 
+// NewUpscale returns a job that enlarges an image of inputWidth by
+// inputHeight. The prompt is optional, and only used by upscalers that are
+// diffusion models.
+func NewUpscale(settings Settings, inputWidth, inputHeight int) (Job, error) {
+	if settings.Upscaler == "" {
+		settings.Upscaler = DEFAULT_UPSCALER
+	}
+	if settings.UpscaleFactor == 0 {
+		settings.UpscaleFactor = DEFAULT_UPSCALE_FACTOR
+	}
+	if settings.UpscaleFactor < 2 || settings.UpscaleFactor > MAX_UPSCALE_FACTOR {
+		return Job{}, errors.NotValidf("upscale factor %d (must be 2 to %d)", settings.UpscaleFactor, MAX_UPSCALE_FACTOR)
+	}
+	if inputWidth <= 0 || inputHeight <= 0 {
+		return Job{}, errors.NotValidf("input size %dx%d", inputWidth, inputHeight)
+	}
+
+	settings.Mode = UpscaleMode
+	settings.Width = inputWidth * settings.UpscaleFactor
+	settings.Height = inputHeight * settings.UpscaleFactor
+	if settings.Width > MAX_UPSCALE_SIZE || settings.Height > MAX_UPSCALE_SIZE {
+		return Job{}, errors.NotValidf("upscaled size %dx%d (max %d)", settings.Width, settings.Height, MAX_UPSCALE_SIZE)
+	}
+	settings.NumIterations = 1
+	settings.Model = ""
+	settings.Assets = nil
+
+	return Job{
+		Settings: settings,
+		UUID:     uuid.New(),
+		Created:  time.Now().Truncate(time.Microsecond).UTC(),
+	}, nil
+}
+
 func dimensionValid(dim int) error {
 	if dim%8 != 0 {
-		return errors.Errorf("invalid dimension %v", dim)
+		return errors.NotValidf("dimension %v (must be a multiple of 8)", dim)
 	}
 	return nil
 }
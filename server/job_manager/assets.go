@@ -0,0 +1,173 @@
+package job_manager
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/asset"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/logging"
+	"github.com/wellsjo/ai-art/server/runner"
+)
+
+// AddAsset stores an uploaded file, checksumming it on the way, and adds it
+// to the catalog. With S3, it is uploaded too so that other workers can
+// fetch it.
+func (jm *JobManager) AddAsset(ctx context.Context, a asset.Asset, r io.Reader) (asset.Asset, error) {
+	path := jm.assetPath(a)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return asset.Asset{}, errors.Trace(err)
+	}
+
+	sum, size, err := writeFile(path, io.LimitReader(r, asset.MAX_ASSET_SIZE+1))
+	if err != nil {
+		return asset.Asset{}, errors.Annotate(err, "AddAsset")
+	}
+	if size > asset.MAX_ASSET_SIZE {
+		os.Remove(path)
+		return asset.Asset{}, errors.NotValidf("asset over %d bytes", asset.MAX_ASSET_SIZE)
+	} else if size == 0 {
+		os.Remove(path)
+		return asset.Asset{}, errors.NotValidf("empty asset")
+	}
+	a.SHA256, a.Size = sum, size
+
+	if jm.opts.UseS3 {
+		if err := jm.s3.UploadFile(ctx, path, a.Key()); err != nil {
+			os.Remove(path)
+			return asset.Asset{}, errors.Annotate(err, "AddAsset upload")
+		}
+	}
+
+	if err := jm.db.AddAsset(ctx, a); err != nil {
+		os.Remove(path)
+		return asset.Asset{}, errors.Trace(err)
+	}
+	return a, nil
+}
+
+// DeleteAsset removes an asset from the catalog and storage. Jobs that were
+// queued with it fail.
+func (jm *JobManager) DeleteAsset(ctx context.Context, a asset.Asset) error {
+	if _, err := jm.db.DeleteAsset(ctx, a.ID); err != nil {
+		return errors.Trace(err)
+	}
+
+	// The catalog is what counts, so leftover files are only logged
+	if err := os.Remove(jm.assetPath(a)); err != nil && !os.IsNotExist(err) {
+		jm.logger.Warn("Failed to remove asset file", "asset", a.ID, logging.Err(err))
+	}
+	if jm.opts.UseS3 {
+		if err := jm.s3.DeleteFile(ctx, a.Key()); err != nil {
+			jm.logger.Warn("Failed to remove asset from s3", "asset", a.ID, logging.Err(err))
+		}
+	}
+	return nil
+}
+
+// checkAssets returns a NotValid error if a job uses an asset that doesn't
+// exist, or more than one VAE.
+func (jm *JobManager) checkAssets(ctx context.Context, jobs []job.Job) error {
+	assets := map[uuid.UUID]asset.Asset{}
+	for _, j := range jobs {
+		vaes := 0
+		for _, ref := range j.Settings.Assets {
+			a, ok := assets[ref.ID]
+			if !ok {
+				var (
+					found bool
+					err   error
+				)
+				if a, found, err = jm.db.GetAsset(ctx, ref.ID); err != nil {
+					return errors.Trace(err)
+				} else if !found {
+					return errors.NotValidf("asset %v", ref.ID)
+				}
+				assets[ref.ID] = a
+			}
+
+			if a.Kind == asset.KindVAE {
+				vaes++
+			}
+		}
+		if vaes > 1 {
+			return errors.NotValidf("%d VAEs (max 1)", vaes)
+		}
+	}
+	return nil
+}
+
+// taskAssets finds the files of a job's assets.
+func (jm *JobManager) taskAssets(ctx context.Context, j job.Job) ([]runner.Asset, error) {
+	var assets []runner.Asset
+	for _, ref := range j.Settings.Assets {
+		a, found, err := jm.db.GetAsset(ctx, ref.ID)
+		if err != nil {
+			return nil, errors.Trace(err)
+		} else if !found {
+			return nil, errors.NotFoundf("asset %v", ref.ID)
+		}
+
+		path, err := jm.localAsset(ctx, a)
+		if err != nil {
+			return nil, errors.Annotatef(err, "asset %v", a.ID)
+		}
+		assets = append(assets, runner.Asset{Asset: a, Path: path, Weight: ref.Weight})
+	}
+	return assets, nil
+}
+
+// localAsset returns the path of an asset's file, downloading it from S3 if
+// it was uploaded to another worker.
+func (jm *JobManager) localAsset(ctx context.Context, a asset.Asset) (string, error) {
+	path := jm.assetPath(a)
+	if _, err := os.Stat(path); err == nil || !os.IsNotExist(err) || !jm.opts.UseS3 {
+		return path, errors.Trace(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", errors.Trace(err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(jm.s3.DownloadFileTo(ctx, a.Key(), pw))
+	}()
+
+	sum, _, err := writeFile(path, pr)
+	pr.CloseWithError(err)
+	if err == nil && sum != a.SHA256 {
+		err = errors.Errorf("checksum %s doesn't match %s", sum, a.SHA256)
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", errors.Annotate(err, "download")
+	}
+	return path, nil
+}
+
+func (jm *JobManager) assetPath(a asset.Asset) string {
+	return filepath.Join(jm.opts.AssetPath, string(a.Kind), a.FileName)
+}
+
+// writeFile writes r to path through a temporary file, so a partial file is
+// never left at path, and returns its checksum and size.
+func writeFile(path string, r io.Reader) (string, int64, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), ".asset-*")
+	if err != nil {
+		return "", 0, errors.Trace(err)
+	}
+	defer os.Remove(f.Name())
+
+	sum, size, err := asset.Checksum(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, errors.Trace(err)
+	}
+	return sum, size, errors.Trace(os.Rename(f.Name(), path))
+}
@@ -0,0 +1,65 @@
+package job_manager
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wellsjo/ai-art/server/asset"
+	"github.com/wellsjo/ai-art/server/db/memory"
+	"github.com/wellsjo/ai-art/server/events"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/ws"
+)
+
+func TestAssets(t *testing.T) {
+	store := memory.New()
+	jm := New(Opts{MockJobs: true, AssetPath: t.TempDir()}, store, nil, ws.NewWSManager(), nil, events.New(events.Opts{}))
+	ctx := context.Background()
+
+	addAsset := func(kind asset.Kind) asset.Asset {
+		a, err := asset.New(kind, "", "style.safetensors", 1)
+		require.NoError(t, err)
+		a, err = jm.AddAsset(ctx, a, strings.NewReader("weights"))
+		require.NoError(t, err)
+		return a
+	}
+	lora, vae, otherVAE := addAsset(asset.KindLoRA), addAsset(asset.KindVAE), addAsset(asset.KindVAE)
+
+	assert.Equal(t, int64(7), lora.Size)
+	assert.NotEmpty(t, lora.SHA256)
+	b, err := os.ReadFile(jm.assetPath(lora))
+	assert.NoError(t, err)
+	assert.Equal(t, "weights", string(b))
+
+	empty, _ := asset.New(asset.KindLoRA, "", "empty.pt", 1)
+	_, err = jm.AddAsset(ctx, empty, strings.NewReader(""))
+	assert.True(t, errors.IsNotValid(err))
+
+	j, _ := job.New(job.Settings{Prompt: "hello", Assets: []job.AssetRef{{ID: lora.ID, Weight: 0.5}, {ID: vae.ID}}})
+	assert.NoError(t, jm.AddJob(ctx, j))
+
+	assets, err := jm.taskAssets(ctx, j)
+	assert.NoError(t, err)
+	assert.Len(t, assets, 2)
+	assert.Equal(t, jm.assetPath(lora), assets[0].Path)
+	assert.Equal(t, 0.5, assets[0].Weight)
+	assert.Equal(t, 1.0, assets[1].Weight)
+
+	twoVAEs, _ := job.New(job.Settings{Prompt: "hello", Assets: []job.AssetRef{{ID: vae.ID}, {ID: otherVAE.ID}}})
+	err = jm.AddJob(ctx, twoVAEs)
+	assert.True(t, errors.IsNotValid(err), "%v", err)
+
+	assert.NoError(t, jm.DeleteAsset(ctx, lora))
+	assert.NoFileExists(t, jm.assetPath(lora))
+	err = jm.AddJob(ctx, j)
+	assert.True(t, errors.IsNotValid(err), "%v", err)
+
+	// Queued jobs fail when they run
+	_, err = jm.taskAssets(ctx, j)
+	assert.True(t, errors.IsNotFound(err), "%v", err)
+}
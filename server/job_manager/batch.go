@@ -0,0 +1,130 @@
+package job_manager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/batch"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/logging"
+	"github.com/wellsjo/ai-art/server/ws"
+)
+
+// MAX_CONTACT_SHEET_COLUMNS wraps wide matrices onto more rows.
+const MAX_CONTACT_SHEET_COLUMNS = 8
+
+// MOCK_IMAGE_PATH stands in for every job image when jobs are mocked.
+const MOCK_IMAGE_PATH = "./images/mock.png"
+
+// CheckBatch broadcasts a batch's progress to its subscribers, and renders
+// the contact sheet once every job in it has finished.
+func (jm *JobManager) CheckBatch(ctx context.Context, batchUUID uuid.UUID) error {
+	b, found, err := jm.db.GetBatch(ctx, batchUUID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !found {
+		return errors.Errorf("batch %v not found", batchUUID)
+	}
+
+	jobs, err := jm.db.GetBatchJobs(ctx, batchUUID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	progress := batch.GetProgress(jobs)
+	if progress.Complete {
+		if err := jm.renderContactSheet(ctx, b, jobs); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Nobody may be watching the batch page
+	jm.ws.Broadcast(ws.BatchTopic(batchUUID), ws.BatchMessage(batchUUID, progress))
+	return nil
+}
+
+func (jm *JobManager) renderContactSheet(ctx context.Context, b batch.Batch, jobs []job.Job) error {
+	cells := make([]batch.Cell, 0, len(jobs))
+	for _, j := range jobs {
+		cell := batch.Cell{
+			Label: b.Matrix.Label(j.Settings),
+		}
+		if j.Done() {
+			img, err := jm.loadJobImage(ctx, j.UUID)
+			if err != nil {
+				// Leave a placeholder rather than losing the whole sheet
+				jm.logger.Warn("Failed to load contact sheet image", logging.KeyJob, j.UUID, logging.Err(err))
+			} else {
+				cell.Image = img
+			}
+		} else {
+			cell.Label = fmt.Sprintf("%s (%s)", cell.Label, j.Status())
+		}
+		cells = append(cells, cell)
+	}
+
+	columns := len(jobs)
+	if len(b.Matrix.Prompts) > 0 {
+		columns = len(jobs) / len(b.Matrix.Prompts)
+	}
+	if columns > MAX_CONTACT_SHEET_COLUMNS {
+		columns = MAX_CONTACT_SHEET_COLUMNS
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, batch.RenderContactSheet(cells, columns)); err != nil {
+		return errors.Trace(err)
+	}
+
+	fileName := GetBatchFileName(b.UUID)
+	imagePath := filepath.Join(jm.opts.StableDiffusionPath, "output", fileName)
+	if err := os.WriteFile(imagePath, buf.Bytes(), 0644); err != nil {
+		return errors.Trace(err)
+	}
+
+	if jm.opts.UseS3 {
+		if err := jm.s3.UploadFile(ctx, imagePath, fileName); err != nil {
+			return errors.Trace(err)
+		}
+		if err := os.Remove(imagePath); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	jm.logger.Info("Rendered contact sheet", logging.KeyBatch, b.UUID)
+	return nil
+}
+
+func (jm *JobManager) loadJobImage(ctx context.Context, uuid_ uuid.UUID) (image.Image, error) {
+	var (
+		b   []byte
+		err error
+	)
+
+	fileName := jm.getJobFileName(uuid_)
+	if jm.opts.MockJobs {
+		b, err = os.ReadFile(MOCK_IMAGE_PATH)
+	} else if jm.opts.UseS3 {
+		b, err = jm.s3.DownloadFile(ctx, fileName)
+	} else {
+		b, err = os.ReadFile(filepath.Join(jm.opts.StableDiffusionPath, "output", fileName))
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(b))
+	return img, errors.Trace(err)
+}
+
+func GetBatchFileName(uuid_ uuid.UUID) string {
+	return fmt.Sprintf("batch-%s.png", uuid_.String())
+}
@@ -0,0 +1,51 @@
+package job_manager
+
+import (
+	"github.com/google/uuid"
+	"github.com/wellsjo/ai-art/server/events"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/ws"
+)
+
+// PublishStatus sends a job's new status to websocket and event stream
+// subscribers. Archived jobs publish their final event.
+func (jm *JobManager) PublishStatus(j job.Job) {
+	typ := events.TypeStatus
+	if j.Archived {
+		typ = events.TypeComplete
+	}
+	jm.publish(j.UUID, typ, jm.StatusMessage(j))
+}
+
+// publish records a job event so late subscribers can catch up, and sends it
+// to everyone already watching.
+func (jm *JobManager) publish(jobUUID uuid.UUID, typ string, data interface{}) {
+	e := jm.events.Publish(jobUUID, typ, data)
+	jm.ws.Broadcast(ws.JobTopic(jobUUID), WSMessage(e))
+}
+
+// StatusMessage is the client representation of a job's status.
+func (jm *JobManager) StatusMessage(j job.Job) map[string]interface{} {
+	msg := map[string]interface{}{
+		"status": j.Status(),
+	}
+	if j.Done() {
+		msg["imageURLs"] = []string{jm.imageURL(j)}
+	}
+	return msg
+}
+
+// WSMessage converts a job event to its websocket message.
+func WSMessage(e events.Event) ws.Message {
+	typ := ws.TypeJob
+	switch e.Type {
+	case events.TypeQueue:
+		typ = ws.TypeQueue
+	case events.TypeProgress:
+		typ = ws.TypeProgress
+	}
+
+	msg := ws.JobMessage(typ, e.JobUUID, e.Data)
+	msg.EventID = e.ID
+	return msg
+}
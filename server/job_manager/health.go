@@ -0,0 +1,68 @@
+package job_manager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// JOB_LOOP_STALL is how long the idle job loop can go without polling for
+// jobs before it is reported as dead.
+const JOB_LOOP_STALL = 30 * time.Second
+
+type loopState struct {
+	mtx       sync.Mutex
+	heartbeat time.Time
+	busy      bool
+}
+
+func (l *loopState) beat(busy bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.heartbeat = time.Now()
+	l.busy = busy
+}
+
+// CheckJobLoop fails if the job loop hasn't started or has stopped polling.
+func (jm *JobManager) CheckJobLoop(ctx context.Context) (interface{}, error) {
+	jm.loop.mtx.Lock()
+	defer jm.loop.mtx.Unlock()
+
+	if jm.loop.heartbeat.IsZero() {
+		return nil, errors.New("job loop has not started")
+	}
+
+	details := map[string]interface{}{
+		"busy":          jm.loop.busy,
+		"lastHeartbeat": jm.loop.heartbeat.UTC(),
+	}
+	if !jm.loop.busy && time.Since(jm.loop.heartbeat) > JOB_LOOP_STALL {
+		return details, errors.Errorf("job loop stalled for %v", time.Since(jm.loop.heartbeat).Round(time.Second))
+	}
+	return details, nil
+}
+
+// CheckStorage fails if generated images can't be saved.
+func (jm *JobManager) CheckStorage(ctx context.Context) (interface{}, error) {
+	if jm.opts.UseS3 {
+		return "s3", errors.Trace(jm.s3.CheckBucket(ctx))
+	}
+
+	dir := filepath.Join(jm.opts.StableDiffusionPath, "output")
+	f, err := os.CreateTemp(dir, ".healthcheck-")
+	if err != nil {
+		return "local", errors.Trace(err)
+	}
+	f.Close()
+	return "local", errors.Trace(os.Remove(f.Name()))
+}
+
+// CheckRunner fails if jobs can't be rendered.
+func (jm *JobManager) CheckRunner(ctx context.Context) (interface{}, error) {
+	return jm.runner.Check(ctx)
+}
@@ -0,0 +1,71 @@
+package job_manager
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/logging"
+)
+
+// jobLogs holds the log of every running job until it is saved with the
+// archived job.
+type jobLogs struct {
+	mtx     sync.Mutex
+	running map[uuid.UUID]*logging.Capture
+}
+
+func newJobLogs() *jobLogs {
+	return &jobLogs{running: map[uuid.UUID]*logging.Capture{}}
+}
+
+func (jm *JobManager) startJobLog(j job.Job) *slog.Logger {
+	c := logging.NewCapture(0)
+
+	jm.logs.mtx.Lock()
+	jm.logs.running[j.UUID] = c
+	jm.logs.mtx.Unlock()
+
+	return jm.jobLogger(j.UUID)
+}
+
+// jobLogger logs about a job, recording the lines in its log while it runs.
+func (jm *JobManager) jobLogger(jobUUID uuid.UUID) *slog.Logger {
+	jm.logs.mtx.Lock()
+	defer jm.logs.mtx.Unlock()
+
+	if c, ok := jm.logs.running[jobUUID]; ok {
+		return c.Tee(jm.logger).With(logging.KeyJob, jobUUID)
+	}
+	return jm.logger.With(logging.KeyJob, jobUUID)
+}
+
+// saveJobLog stores the log of a job that has been archived.
+func (jm *JobManager) saveJobLog(ctx context.Context, jobUUID uuid.UUID) {
+	jm.logs.mtx.Lock()
+	c, ok := jm.logs.running[jobUUID]
+	delete(jm.logs.running, jobUUID)
+	jm.logs.mtx.Unlock()
+
+	if !ok {
+		return
+	}
+	if err := jm.db.SetJobOutput(ctx, jobUUID, c.String()); err != nil {
+		jm.logger.Error("Failed to save job log", logging.KeyJob, jobUUID, logging.Err(err))
+	}
+}
+
+// JobLog returns everything logged about a job while it ran. found is false
+// if the job never ran.
+func (jm *JobManager) JobLog(ctx context.Context, jobUUID uuid.UUID) (string, bool, error) {
+	jm.logs.mtx.Lock()
+	c, ok := jm.logs.running[jobUUID]
+	jm.logs.mtx.Unlock()
+
+	if ok {
+		return c.String(), true, nil
+	}
+	return jm.db.GetJobOutput(ctx, jobUUID)
+}
@@ -1,49 +1,59 @@
 package job_manager
 
 import (
-	"bufio"
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/juju/errors"
 	"github.com/wellsjo/ai-art/server/db"
+	"github.com/wellsjo/ai-art/server/eta"
+	"github.com/wellsjo/ai-art/server/events"
 	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/logging"
+	"github.com/wellsjo/ai-art/server/metrics"
+	"github.com/wellsjo/ai-art/server/model"
+	"github.com/wellsjo/ai-art/server/runner"
 	"github.com/wellsjo/ai-art/server/s3_manager"
+	"github.com/wellsjo/ai-art/server/webhook"
 	"github.com/wellsjo/ai-art/server/ws"
 )
 
 const NEXT_JOB_THROTTLE = 1 * time.Second
 const MAX_NUM_ITERATIONS = 50
 
-type statusRequest struct {
-	uuid uuid.UUID
-}
+// ETA_SAMPLE_SIZE is how many recent jobs are used to estimate durations.
+const ETA_SAMPLE_SIZE = 200
 
-type statusResponse struct {
-	found    bool
-	position int
-	job      job.Job
-}
+const (
+	ARCHIVE_ATTEMPTS    = 3
+	ARCHIVE_RETRY_DELAY = time.Second
+)
 
 type JobManager struct {
 	opts Opts
 
-	statusRequests  chan statusRequest
-	statusResponses chan statusResponse
-
-	addJobs chan job.Job
-	jobDone chan job.Job
-	queue   chan job.Job
-	done    chan struct{}
-
-	ws *ws.WSManager
-	s3 *s3_manager.S3Manager
-	db *db.DB
+	queueChanged chan struct{}
+	// wake cuts short the job loop's wait when a job is added.
+	wake chan struct{}
+	loop *loopState
+	logs *jobLogs
+
+	logger   *slog.Logger
+	runner   runner.Runner
+	ws       *ws.WSManager
+	s3       *s3_manager.S3Manager
+	db       db.Store
+	webhooks *webhook.Dispatcher
+	events   *events.Broker
+
+	// ctx is cancelled by Close, stopping the loops and any job in progress.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 type Opts struct {
@@ -51,273 +61,367 @@ type Opts struct {
 	UseS3               bool
 	UseCPU              bool
 	StableDiffusionPath string
-	ImageUploadPath     string
-	MaxNumIterations    int
+	// ImageUploadPath holds input images. Defaults to input in
+	// StableDiffusionPath, like the API's upload path.
+	ImageUploadPath string
+	// AssetPath holds uploaded assets. Defaults to input/assets in
+	// StableDiffusionPath, which build.sh mounts.
+	AssetPath        string
+	MaxNumIterations int
+	MaxQueuedJobs    int
+	// Runner renders jobs. Defaults to the mock runner when MockJobs is set,
+	// and otherwise to build.sh in StableDiffusionPath.
+	Runner runner.Runner
+	// PublicURL is prepended to local image links sent in webhooks.
+	PublicURL string
+	// WorkerID is attached to every log line and to the jobs this worker
+	// claims. Defaults to the hostname.
+	WorkerID string
 }
 
 func New(
 	opts Opts,
-	db *db.DB,
+	db db.Store,
 	s3m *s3_manager.S3Manager,
 	wsm *ws.WSManager,
+	webhooks *webhook.Dispatcher,
+	broker *events.Broker,
 ) *JobManager {
 	if opts.MaxNumIterations == 0 {
 		opts.MaxNumIterations = MAX_NUM_ITERATIONS
 	}
+	if opts.MaxQueuedJobs == 0 {
+		opts.MaxQueuedJobs = MAX_QUEUED_JOBS
+	}
+	if opts.Runner == nil && opts.MockJobs {
+		opts.Runner = runner.NewMock()
+	} else if opts.Runner == nil {
+		opts.Runner = runner.NewScript(runner.ScriptOpts{
+			Path:   opts.StableDiffusionPath,
+			UseCPU: opts.UseCPU,
+		})
+	}
+	if opts.ImageUploadPath == "" {
+		opts.ImageUploadPath = filepath.Join(opts.StableDiffusionPath, "input")
+	}
+	if opts.AssetPath == "" {
+		opts.AssetPath = filepath.Join(opts.StableDiffusionPath, "input", "assets")
+	}
+	if opts.WorkerID == "" {
+		opts.WorkerID, _ = os.Hostname()
+	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	return &JobManager{
 		opts: opts,
 
-		statusRequests:  make(chan statusRequest),
-		statusResponses: make(chan statusResponse),
-
-		addJobs: make(chan job.Job),
-		jobDone: make(chan job.Job),
-		queue:   make(chan job.Job, 100),
-		done:    make(chan struct{}),
-
-		ws: wsm,
-		s3: s3m,
-		db: db,
+		queueChanged: make(chan struct{}, 1),
+		wake:         make(chan struct{}, 1),
+		loop:         &loopState{},
+		logs:         newJobLogs(),
+
+		logger:   slog.Default().With(logging.KeyWorker, opts.WorkerID),
+		runner:   opts.Runner,
+		ws:       wsm,
+		s3:       s3m,
+		db:       db,
+		webhooks: webhooks,
+		events:   broker,
+
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
 func (jm JobManager) Run() {
-	go jm.RunJobsLoop()
-
-	go func() {
-		for {
-			select {
-			// case j := <-jm.addJobs:
-			// 	// TODO return error to caller
-			// 	err := jm.db.AddJob(j)
-			// 	if err != nil {
-			// 		log.Println(errors.ErrorStack(err))
-			// 	}
-
-			case j := <-jm.jobDone:
-				log.Println("Job Done", j)
-				err := jm.db.ArchiveJob(job.ArchiveReasonDone, j.UUID, *j.EndTime)
-				if err != nil {
-					log.Println(errors.ErrorStack(err))
-					return
-				}
-
-				fileName := jm.getJobFileName(j.UUID)
-				imagePath := filepath.Join(jm.opts.StableDiffusionPath, "output", fileName)
-
-				if jm.opts.UseS3 {
-					if err = jm.s3.UploadFile(imagePath, fileName); err != nil {
-						log.Println(errors.ErrorStack(err))
-						// return
-					}
+	if jobs, err := jm.db.GetAllJobs(jm.ctx); err != nil {
+		jm.logger.Error("Failed to get queued jobs", logging.Err(err))
+	} else {
+		jm.cancelOrphans(jm.ctx, jobs)
+	}
 
-					if err = os.Remove(imagePath); err != nil {
-						fmt.Println(err)
-						// return
-					}
-				}
+	go jm.RunJobsLoop()
+	go jm.runQueueUpdates()
+}
 
-				if err = jm.ws.Broadcast(j.UUID, ws.Message{"job": "done"}); err != nil {
-					log.Println(errors.ErrorStack(err))
-					// return
-				}
+// completeJob archives a finished job and tells everyone who is waiting on
+// it. Failures are logged and the remaining steps still run, except when the
+// job can't be archived: it is then left running, and is run again the next
+// time this worker starts.
+func (jm JobManager) completeJob(j job.Job) {
+	l := jm.jobLogger(j.UUID)
+	ar := job.ArchiveReasonDone
+	if j.ArchiveReason != nil {
+		ar = *j.ArchiveReason
+	}
+	l.Info("Job done", "status", ar, "duration", j.EndTime.Sub(*j.StartTime))
+
+	// The image is uploaded before the job is archived, since archiving lets
+	// its children run, and they download it. A job without its image failed.
+	if jm.opts.UseS3 && ar == job.ArchiveReasonDone {
+		fileName := jm.getJobFileName(j.UUID)
+		imagePath := filepath.Join(jm.opts.StableDiffusionPath, "output", fileName)
+		if err := jm.s3.UploadFile(jm.ctx, imagePath, fileName); err != nil {
+			l.Error("Failed to upload image", logging.Err(err))
+			ar = job.ArchiveReasonError
+		} else if err := os.Remove(imagePath); err != nil {
+			l.Error("Failed to remove image", logging.Err(err))
+		}
+	}
 
-			case req := <-jm.statusRequests:
-				log.Println("Status Request", req.uuid.String())
-				job, found, pos, err := jm.db.GetJobByUUID(req.uuid)
-				if err != nil {
-					log.Println(errors.ErrorStack(err))
-					return
-				}
+	if err := jm.archiveJob(ar, j); err != nil {
+		l.Error("Failed to archive job", logging.Err(err))
+		return
+	}
+	j.Running = false
+	j.Archived = true
+	j.ArchiveReason = &ar
+	metrics.JobsFinished.WithLabelValues(ar.String()).Inc()
+
+	jm.saveJobLog(jm.ctx, j.UUID)
+
+	jm.QueueChanged()
+	jm.PublishStatus(j)
+	jm.Notify(jm.ctx, j)
+	if ar != job.ArchiveReasonDone {
+		jm.cancelChildren(jm.ctx, j)
+	}
 
-				sr := statusResponse{
-					found:    found,
-					position: pos,
-					job:      job,
-				}
+	if j.BatchUUID != uuid.Nil {
+		if err := jm.CheckBatch(jm.ctx, j.BatchUUID); err != nil {
+			l.Error("Failed to check batch", logging.KeyBatch, j.BatchUUID, logging.Err(err))
+		}
+	}
+}
 
-				log.Println("Status Response", sr.job)
-				jm.statusResponses <- sr
+// archiveJob retries, since giving up means running the job again after a
+// restart.
+func (jm JobManager) archiveJob(ar job.ArchiveReason, j job.Job) error {
+	var err error
+	for attempt := 1; attempt <= ARCHIVE_ATTEMPTS; attempt++ {
+		if err = jm.db.ArchiveJob(jm.ctx, ar, j.UUID, *j.EndTime); err == nil {
+			return nil
+		}
+		jm.logger.Warn("Failed to archive job", logging.KeyJob, j.UUID, "attempt", attempt, logging.Err(err))
 
-			case <-jm.done:
-				log.Println("Done signal received. Closing JobManager")
-				close(jm.queue)
-				return
-			}
+		select {
+		case <-time.After(ARCHIVE_RETRY_DELAY):
+		case <-jm.ctx.Done():
+			return errors.Trace(err)
 		}
-	}()
+	}
+	return errors.Trace(err)
 }
 
+// RunJobsLoop runs one job at a time, finishing each before claiming the
+// next. Jobs this worker left running when it last stopped are run first.
 func (jm JobManager) RunJobsLoop() {
+	recovered, err := jm.db.GetRunningJobs(jm.ctx, jm.opts.WorkerID)
+	if jm.ctx.Err() != nil {
+		return
+	} else if err != nil {
+		jm.logger.Error("Failed to get running jobs", logging.Err(err))
+		os.Exit(1)
+	}
+
 	for {
-		j, found, err := jm.db.GetNextJob()
-		if err != nil {
-			log.Fatal(err)
+		jm.loop.beat(false)
+
+		var (
+			j     job.Job
+			found bool
+		)
+		if len(recovered) > 0 {
+			j, found, recovered = recovered[0], true, recovered[1:]
+		} else {
+			j, found, err = jm.db.GetNextJob(jm.ctx, jm.Hardware(), jm.opts.WorkerID)
+		}
+		if jm.ctx.Err() != nil {
+			return
+		} else if err != nil {
+			jm.logger.Error("Failed to get next job", logging.Err(err))
+			os.Exit(1)
 		}
 
+		// Jobs added by other servers are only seen by polling
 		if !found {
-			time.Sleep(NEXT_JOB_THROTTLE)
+			select {
+			case <-jm.wake:
+			case <-time.After(NEXT_JOB_THROTTLE):
+			case <-jm.ctx.Done():
+				return
+			}
 			continue
 		}
 
-		jm.ws.Broadcast(j.UUID, ws.Message{"job": "running"})
+		jm.loop.beat(true)
+		l := jm.startJobLog(j)
 
 		startTime := time.Now()
 		j.StartTime = &startTime
+		j.Running = true
 
-		if !jm.opts.MockJobs {
-			log.Println("Running job", j)
-			err := jm.RunStableDiffusionJob(j)
-			if err != nil {
-				log.Println("Job Error", errors.ErrorStack(err))
-				// TODO
+		jm.QueueChanged()
+		jm.PublishStatus(j)
+		jm.Notify(jm.ctx, j)
+
+		if j.BatchUUID != uuid.Nil {
+			if err := jm.CheckBatch(jm.ctx, j.BatchUUID); err != nil {
+				l.Error("Failed to check batch", logging.KeyBatch, j.BatchUUID, logging.Err(err))
 			}
-		} else {
-			log.Println("Running mock job", j)
-			jm.RunStableDiffusionJobMock()
+		}
+
+		l.Info("Running job", "hardware", jm.Hardware(), "settings", j.Settings)
+		task, err := jm.newTask(jm.ctx, j, l)
+		if err == nil {
+			err = jm.runner.Run(jm.ctx, task)
+		}
+		if jm.ctx.Err() != nil {
+			// Left running, so it is picked up again after a restart
+			l.Info("Job interrupted by shutdown")
+			return
+		} else if err != nil {
+			l.Error("Job failed", logging.Err(err))
+			metrics.RunnerFailure(err)
+			ar := job.ArchiveReasonError
+			j.ArchiveReason = &ar
 		}
 
 		endTime := time.Now()
 		j.EndTime = &endTime
 
-		jm.jobDone <- j
-	}
-
-	log.Println("Done running jobs")
-}
-
-func (jm JobManager) Close() {
-	log.Println("Closing done chan")
-	close(jm.done)
-}
-
-func (jm *JobManager) AddJob(j job.Job, timeout time.Duration) error {
-	if j.Settings.NumIterations > jm.opts.MaxNumIterations {
-		return errors.Errorf("NumIterations setting is too high (max %v)", jm.opts.MaxNumIterations)
-	}
+		if j.ArchiveReason == nil {
+			metrics.ObserveJob(jm.Hardware(), j.Settings.Width, j.Settings.Height, j.Settings.Steps, endTime.Sub(startTime))
+		}
 
-	select {
-	case jm.addJobs <- j:
-	case <-time.After(timeout):
-		return errors.New("Failed to add job (timeout)")
+		jm.completeJob(j)
 	}
-
-	return nil
 }
 
-func (jm *JobManager) GetJobStatus(uuid uuid.UUID, timeout time.Duration) (job.Job, bool, int, error) {
-	sr := statusRequest{
-		uuid: uuid,
+// Hardware describes what jobs are rendered on, so durations are only
+// compared between jobs that ran on the same kind of machine.
+func (jm *JobManager) Hardware() string {
+	if jm.opts.MockJobs {
+		return "mocked"
+	} else if jm.opts.UseCPU {
+		return "cpu"
 	}
+	return "gpu"
+}
 
+// QueueChanged tells subscribers of queued jobs to expect new positions and
+// ETAs. It never blocks; changes that arrive while an update is already
+// pending are folded into it.
+func (jm *JobManager) QueueChanged() {
 	select {
-	case jm.statusRequests <- sr:
-		sr := <-jm.statusResponses
-		return sr.job, sr.found, sr.position, nil
-
-	case <-time.After(timeout):
-		return job.Job{}, false, 0, errors.New("Failed to get status (timeout)")
+	case jm.queueChanged <- struct{}{}:
+	default:
 	}
 }
 
-func (jm *JobManager) RunStableDiffusionJob(j job.Job) error {
-	start := time.Now()
-	fileName := jm.getJobFileName(j.UUID)
-
-	var (
-		cmd       *exec.Cmd
-		cmdName   = "./build.sh"
-		cmdFnName = "runWithGPUs"
-		args      []string
-	)
-
-	if jm.opts.UseCPU {
-		cmdFnName = "runWithoutGPUs"
-	}
-
-	args = []string{
-		cmdFnName,
-	}
+func (jm JobManager) runQueueUpdates() {
+	for {
+		select {
+		case <-jm.queueChanged:
+			estimates, err := jm.GetQueueEstimates(jm.ctx)
+			if err != nil {
+				jm.logger.Error("Failed to estimate queue", logging.Err(err))
+				continue
+			}
 
-	// Image-To-Image Mode
-	if j.Settings.Mode == job.ImageToImageMode {
-		args = append(args,
-			"--image",
-			filepath.Join(jm.opts.ImageUploadPath, fmt.Sprintf("%v", j.UUID)),
-			"--strength",
-			"0.5",
-		)
+			running := 0
+			for uuid_, est := range estimates {
+				if est.Position == 0 {
+					running++
+				}
+				jm.publish(uuid_, events.TypeQueue, QueueMessage(est))
+			}
+			metrics.QueueDepth.WithLabelValues("running").Set(float64(running))
+			metrics.QueueDepth.WithLabelValues("pending").Set(float64(len(estimates) - running))
+
+			jm.ws.Broadcast(ws.ChannelTopic(ws.ChannelQueue), ws.Message{
+				Type: ws.TypeQueue,
+				Data: map[string]interface{}{
+					"running": running,
+					"pending": len(estimates) - running,
+				},
+			})
+
+		case <-jm.ctx.Done():
+			return
+		}
 	}
+}
 
-	args = append(args, []string{
-		j.Settings.Prompt,
-		"--n_iter", fmt.Sprintf("%d", j.Settings.NumIterations),
-		"--output", fileName,
-		"--W", fmt.Sprintf("%d", j.Settings.Width),
-		"--H", fmt.Sprintf("%d", j.Settings.Height),
-	}...)
-	log.Println("Running Command", cmdName, args)
-
-	cmd = exec.Command(
-		cmdName,
-		args...,
-	)
-
-	cmd.Dir = jm.opts.StableDiffusionPath
-
-	stdout, err := cmd.StdoutPipe()
+// GetQueueEstimates returns the position and ETA of every running and
+// pending job.
+func (jm *JobManager) GetQueueEstimates(ctx context.Context) (map[uuid.UUID]eta.Estimate, error) {
+	running, pending, err := jm.db.GetQueuedJobs(ctx)
 	if err != nil {
-		return errors.Annotate(err, "RunStableDiffusionJob StdoutPipe")
+		return nil, errors.Trace(err)
 	}
 
-	stderr, err := cmd.StderrPipe()
+	samples, err := jm.db.GetDurationSamples(ctx, jm.Hardware(), ETA_SAMPLE_SIZE)
 	if err != nil {
-		return errors.Annotate(err, "RunStableDiffusionJob StderrPipe")
+		return nil, errors.Trace(err)
 	}
 
-	log.Println("Starting to build image", j.UUID)
-	err = cmd.Start()
-	if err != nil {
-		return errors.Annotate(err, "RunStableDiffusionJob Start")
-	}
+	return eta.NewEstimator(samples).Queue(running, pending, time.Now()), nil
+}
 
-	scanner := bufio.NewScanner(stderr)
-	for scanner.Scan() {
-		fmt.Println(scanner.Text())
+// QueueMessage is the client representation of an estimate, in seconds.
+func QueueMessage(est eta.Estimate) map[string]interface{} {
+	return map[string]interface{}{
+		"position": est.Position,
+		"startIn":  int(est.StartIn.Seconds()),
+		"finishIn": int(est.FinishIn.Seconds()),
 	}
+}
 
-	log.Println("Waiting...")
-	err = cmd.Wait()
-	if err != nil {
-		return errors.Annotate(err, "RunStableDiffusionJob Wait")
-	}
+func (jm JobManager) Close() {
+	jm.logger.Info("Closing JobManager")
+	jm.cancel()
+}
 
-	for {
-		tmp := make([]byte, 1024)
-		_, err := stdout.Read(tmp)
-		fmt.Print(string(tmp))
-		if err != nil {
-			break
+// GetJobStatus reads a job straight from the store, so it never waits on
+// the job loop.
+func (jm *JobManager) GetJobStatus(ctx context.Context, uuid_ uuid.UUID) (job.Job, bool, int, error) {
+	j, found, pos, err := jm.db.GetJobByUUID(ctx, uuid_)
+	return j, found, pos, errors.Trace(err)
+}
+
+// newTask finds the model, assets and input image a job renders with. The
+// job fails if they were removed while it was queued.
+func (jm *JobManager) newTask(ctx context.Context, j job.Job, l *slog.Logger) (runner.Task, error) {
+	var m model.Model
+	if j.Settings.Mode != job.UpscaleMode {
+		var err error
+		if m, err = jm.Model(ctx, j.Settings.Model); err != nil {
+			return runner.Task{}, errors.Trace(err)
 		}
 	}
-	for {
-		tmp := make([]byte, 1024)
-		_, err := stderr.Read(tmp)
-		fmt.Print(string(tmp))
-		if err != nil {
-			break
-		}
+	assets, err := jm.taskAssets(ctx, j)
+	if err != nil {
+		return runner.Task{}, errors.Trace(err)
+	}
+	inputPath, err := jm.inputPath(ctx, j)
+	if err != nil {
+		return runner.Task{}, errors.Trace(err)
 	}
 
-	log.Println("Job Done", time.Now().Sub(start))
-	return nil
+	return runner.Task{
+		Job:       j,
+		Model:     m,
+		Assets:    assets,
+		ImagePath: filepath.Join(jm.opts.StableDiffusionPath, "output", jm.getJobFileName(j.UUID)),
+		InputPath: inputPath,
+		Logger:    l,
+		Progress: func(p events.Progress) {
+			jm.publish(j.UUID, events.TypeProgress, p)
+		},
+	}, nil
 }
 
 func (jm *JobManager) getJobFileName(uuid_ uuid.UUID) string {
 	return fmt.Sprintf("%s.png", uuid_.String())
 }
-
-func (jm *JobManager) RunStableDiffusionJobMock() {
-	time.Sleep(3 * time.Second)
-}
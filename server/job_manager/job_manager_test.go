@@ -0,0 +1,323 @@
+package job_manager
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wellsjo/ai-art/server/db"
+	"github.com/wellsjo/ai-art/server/db/memory"
+	"github.com/wellsjo/ai-art/server/events"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/model"
+	"github.com/wellsjo/ai-art/server/runner"
+	"github.com/wellsjo/ai-art/server/s3_manager"
+	"github.com/wellsjo/ai-art/server/ws"
+)
+
+func newTestJobManager(store db.Store) *JobManager {
+	return New(Opts{MockJobs: true}, store, nil, ws.NewWSManager(), nil, events.New(events.Opts{}))
+}
+
+func newTestJob(t *testing.T, store db.Store) job.Job {
+	j, err := job.New(job.Settings{Prompt: "hello"})
+	require.NoError(t, err)
+	require.NoError(t, store.AddJob(context.Background(), j))
+	return j
+}
+
+// Status reads go straight to the store, so they work without the job loop.
+func TestGetJobStatus(t *testing.T) {
+	store := memory.New()
+	jm := newTestJobManager(store)
+	j := newTestJob(t, store)
+
+	got, found, pos, err := jm.GetJobStatus(context.Background(), j.UUID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 1, pos)
+	assert.Equal(t, j.UUID, got.UUID)
+
+	_, found, _, err = jm.GetJobStatus(context.Background(), uuid.New())
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+// flakyStore fails to archive the first few times it is asked.
+type flakyStore struct {
+	*memory.Store
+	failures int
+}
+
+func (s *flakyStore) ArchiveJob(ctx context.Context, ar job.ArchiveReason, uuid_ uuid.UUID, endTime time.Time) error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("connection reset")
+	}
+	return s.Store.ArchiveJob(ctx, ar, uuid_, endTime)
+}
+
+func TestCompleteJobRetriesArchive(t *testing.T) {
+	store := &flakyStore{Store: memory.New(), failures: 1}
+	jm := newTestJobManager(store)
+	newTestJob(t, store)
+
+	j, _, err := store.GetNextJob(context.Background(), jm.Hardware(), "")
+	require.NoError(t, err)
+	now := time.Now()
+	j.StartTime, j.EndTime = &now, &now
+
+	jm.completeJob(j)
+
+	got, found, pos, err := jm.GetJobStatus(context.Background(), j.UUID)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, -1, pos)
+	assert.True(t, got.Done())
+}
+
+// countingRunner renders jobs instantly and counts how often each is run.
+type countingRunner struct {
+	mtx  sync.Mutex
+	runs map[uuid.UUID]int
+}
+
+func (r *countingRunner) Run(ctx context.Context, t runner.Task) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.runs[t.Job.UUID]++
+	return nil
+}
+
+func (r *countingRunner) Check(ctx context.Context) (interface{}, error) {
+	return "counting", nil
+}
+
+func (r *countingRunner) count(uuid_ uuid.UUID) int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.runs[uuid_]
+}
+
+// Every job is run once, and jobs left running are only run again by the
+// worker that claimed them.
+func TestRunJobsOnce(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	r := &countingRunner{runs: map[uuid.UUID]int{}}
+	jm := New(Opts{MockJobs: true, Runner: r, WorkerID: "worker-1"}, store, nil, ws.NewWSManager(), nil, events.New(events.Opts{}))
+
+	mine, other := newTestJob(t, store), newTestJob(t, store)
+	for _, worker := range []string{"worker-1", "worker-2"} {
+		_, _, err := store.GetNextJob(ctx, jm.Hardware(), worker)
+		require.NoError(t, err)
+	}
+	pending := []job.Job{newTestJob(t, store), newTestJob(t, store)}
+
+	jm.Run()
+	defer jm.Close()
+
+	done := append([]job.Job{mine}, pending...)
+	require.Eventually(t, func() bool {
+		for _, j := range done {
+			got, _, _, err := jm.GetJobStatus(ctx, j.UUID)
+			if err != nil || !got.Archived {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, j := range done {
+		assert.Equal(t, 1, r.count(j.UUID))
+	}
+	assert.Equal(t, 0, r.count(other.UUID))
+}
+
+func TestAddJob(t *testing.T) {
+	store := memory.New()
+	jm := New(Opts{MockJobs: true, MaxNumIterations: 4, MaxQueuedJobs: 2}, store, nil, ws.NewWSManager(), nil, events.New(events.Opts{}))
+	ctx := context.Background()
+
+	tooMany, _ := job.New(job.Settings{Prompt: "hello", NumIterations: 5})
+	err := jm.AddJob(ctx, tooMany)
+	assert.True(t, errors.IsNotValid(err))
+
+	for i := 0; i < 2; i++ {
+		j, _ := job.New(job.Settings{Prompt: "hello"})
+		assert.NoError(t, jm.AddJob(ctx, j))
+	}
+
+	// Adding a job wakes the job loop
+	select {
+	case <-jm.wake:
+	default:
+		t.Fatal("job loop not woken")
+	}
+
+	j, _ := job.New(job.Settings{Prompt: "hello"})
+	err = jm.AddJob(ctx, j)
+	assert.True(t, errors.Is(err, ErrQueueFull))
+
+	n, err := store.CountPendingJobs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+func TestAddJobChecksModel(t *testing.T) {
+	store := memory.New()
+	// Mocked jobs aren't on a cpu, so this only mocks the runner
+	jm := New(Opts{UseCPU: true, Runner: runner.NewMock()}, store, nil, ws.NewWSManager(), nil, events.New(events.Opts{}))
+	ctx := context.Background()
+
+	gpuOnly, err := model.New(model.Model{
+		Name:     "gpu-only",
+		Source:   "/models/gpu-only",
+		Modes:    []job.Mode{job.TextToImageMode},
+		MaxWidth: 768,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, store.AddModel(ctx, gpuOnly))
+
+	// Jobs without a model use the default
+	j, _ := job.New(job.Settings{Prompt: "hello"})
+	assert.NoError(t, jm.AddJob(ctx, j))
+
+	for _, s := range []job.Settings{
+		{Prompt: "hello", Model: "missing"},
+		{Prompt: "hello", Model: "gpu-only", Width: 1024},
+		{Prompt: "hello", Model: "gpu-only", Mode: job.ImageToImageMode},
+		{Prompt: "hello", Model: model.DEFAULT_MODEL, Width: 2048},
+	} {
+		j, _ := job.New(s)
+		err := jm.AddJob(ctx, j)
+		assert.True(t, errors.IsNotValid(err), "%v: %v", s, err)
+	}
+
+	// Allowed everywhere but on this worker's cpu
+	j, _ = job.New(job.Settings{Prompt: "hello", Model: "gpu-only"})
+	err = jm.AddJob(ctx, j)
+	assert.ErrorContains(t, err, "cpu")
+
+	jm.opts.UseCPU = false
+	assert.NoError(t, jm.AddJob(ctx, j))
+}
+
+func TestAddUpscaleJob(t *testing.T) {
+	store := memory.New()
+	sdPath := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(sdPath, "input"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(sdPath, "output"), 0755))
+	jm := New(Opts{StableDiffusionPath: sdPath, Runner: runner.NewMock()}, store, nil, ws.NewWSManager(), nil, events.New(events.Opts{}))
+	ctx := context.Background()
+
+	parent := newTestJob(t, store)
+	upscale, err := job.NewUpscale(job.Settings{UpscaleFactor: 4}, parent.Settings.Width, parent.Settings.Height)
+	require.NoError(t, err)
+	assert.Equal(t, 2048, upscale.Settings.Width)
+	upscale.ParentUUID = parent.UUID
+
+	// The job waits for its parent to finish
+	assert.NoError(t, jm.AddJob(ctx, upscale))
+	require.NoError(t, store.ArchiveJob(ctx, job.ArchiveReasonDone, parent.UUID, time.Now()))
+	require.NoError(t, os.WriteFile(filepath.Join(sdPath, "output", jm.getJobFileName(parent.UUID)), []byte("image"), 0644))
+
+	// Runners get a copy of the parent's image
+	task, err := jm.newTask(ctx, upscale, jm.logger)
+	assert.NoError(t, err)
+	b, err := os.ReadFile(task.InputPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "image", string(b))
+	assert.Equal(t, filepath.Join(sdPath, "input"), filepath.Dir(task.InputPath))
+
+	children, err := store.GetChildJobs(ctx, parent.UUID)
+	assert.NoError(t, err)
+	assert.Len(t, children, 1)
+
+	_, err = job.NewUpscale(job.Settings{UpscaleFactor: 4}, 2048, 512)
+	assert.True(t, errors.IsNotValid(err))
+}
+
+func TestCancelChildJobs(t *testing.T) {
+	store := memory.New()
+	jm := newTestJobManager(store)
+	ctx := context.Background()
+
+	newChild := func(parent job.Job) job.Job {
+		j, err := job.New(job.Settings{Prompt: "hello", Mode: job.ImageToImageMode})
+		require.NoError(t, err)
+		j.ParentUUID = parent.UUID
+		require.NoError(t, jm.AddJob(ctx, j))
+		return j
+	}
+	status := func(j job.Job) string {
+		got, found, _, err := jm.GetJobStatus(ctx, j.UUID)
+		require.NoError(t, err)
+		require.True(t, found)
+		return got.Status()
+	}
+
+	// Cancelling a job cancels the jobs waiting on it, and theirs
+	parent := newTestJob(t, store)
+	child := newChild(parent)
+	grandchild := newChild(child)
+	_, found, err := jm.CancelJob(ctx, parent)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "cancelled", status(child))
+	assert.Equal(t, "cancelled", status(grandchild))
+
+	// Jobs can't wait on a job that won't finish
+	j, _ := job.New(job.Settings{Prompt: "hello", Mode: job.ImageToImageMode})
+	j.ParentUUID = parent.UUID
+	assert.True(t, errors.IsNotValid(jm.AddJob(ctx, j)))
+
+	// A failed job's children are cancelled too
+	parent = newTestJob(t, store)
+	child = newChild(parent)
+	claimed, _, err := store.GetNextJob(ctx, jm.Hardware(), "")
+	require.NoError(t, err)
+	require.Equal(t, parent.UUID, claimed.UUID)
+	now := time.Now()
+	ar := job.ArchiveReasonError
+	claimed.StartTime, claimed.EndTime, claimed.ArchiveReason = &now, &now, &ar
+	jm.completeJob(claimed)
+	assert.Equal(t, "cancelled", status(child))
+}
+
+// A job whose image can't be uploaded fails, so children never wait on an
+// image that isn't there.
+func TestCompleteJobUploadFails(t *testing.T) {
+	store := memory.New()
+	s3m, err := s3_manager.New(s3_manager.Opts{Region: "us-east-1"})
+	require.NoError(t, err)
+	jm := New(Opts{MockJobs: true, UseS3: true, StableDiffusionPath: t.TempDir()}, store, s3m, ws.NewWSManager(), nil, events.New(events.Opts{}))
+	ctx := context.Background()
+
+	parent := newTestJob(t, store)
+	child, err := job.New(job.Settings{Prompt: "hello", Mode: job.ImageToImageMode})
+	require.NoError(t, err)
+	child.ParentUUID = parent.UUID
+	require.NoError(t, jm.AddJob(ctx, child))
+
+	// The runner never wrote the image
+	claimed, _, err := store.GetNextJob(ctx, jm.Hardware(), "")
+	require.NoError(t, err)
+	now := time.Now()
+	claimed.StartTime, claimed.EndTime = &now, &now
+	jm.completeJob(claimed)
+
+	for want, j := range map[string]job.Job{"error": parent, "cancelled": child} {
+		got, found, _, err := jm.GetJobStatus(ctx, j.UUID)
+		require.NoError(t, err)
+		require.True(t, found)
+		assert.Equal(t, want, got.Status())
+	}
+}
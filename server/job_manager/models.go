@@ -0,0 +1,56 @@
+package job_manager
+
+import (
+	"context"
+
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/model"
+)
+
+// Model returns the registered model called name, or the default model if
+// name is empty. Unknown models are a NotValid error, since the name comes
+// from the job's settings.
+func (jm *JobManager) Model(ctx context.Context, name string) (model.Model, error) {
+	var (
+		m     model.Model
+		found bool
+		err   error
+	)
+	if name == "" {
+		m, found, err = jm.db.GetDefaultModel(ctx)
+	} else {
+		m, found, err = jm.db.GetModel(ctx, name)
+	}
+	if err != nil {
+		return model.Model{}, errors.Trace(err)
+	}
+	if !found {
+		return model.Model{}, errors.NotValidf("model %q", name)
+	}
+	return m, nil
+}
+
+// checkModels checks jobs against the constraints of their models. Upscale
+// jobs don't use a model.
+func (jm *JobManager) checkModels(ctx context.Context, jobs []job.Job) error {
+	models := map[string]model.Model{}
+	for _, j := range jobs {
+		if j.Settings.Mode == job.UpscaleMode {
+			continue
+		}
+		m, ok := models[j.Settings.Model]
+		if !ok {
+			var err error
+			if m, err = jm.Model(ctx, j.Settings.Model); err != nil {
+				return errors.Trace(err)
+			}
+			models[j.Settings.Model] = m
+		}
+
+		if err := m.Check(j.Settings, jm.Hardware()); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
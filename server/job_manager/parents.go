@@ -0,0 +1,145 @@
+package job_manager
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/logging"
+	"github.com/wellsjo/ai-art/server/metrics"
+)
+
+// checkParents returns a NotValid error if a job starts from the image of a
+// job that doesn't exist or didn't finish. Parents that are still queued or
+// running are fine: the job waits for them.
+func (jm *JobManager) checkParents(ctx context.Context, jobs []job.Job) error {
+	for _, j := range jobs {
+		if j.ParentUUID == uuid.Nil {
+			continue
+		}
+		parent, found, _, err := jm.db.GetJobByUUID(ctx, j.ParentUUID)
+		if err != nil {
+			return errors.Trace(err)
+		} else if !found {
+			return errors.NotValidf("parent job %v", j.ParentUUID)
+		} else if parent.Archived && !parent.Done() {
+			return errors.NotValidf("parent job %v that is %s", j.ParentUUID, parent.Status())
+		}
+	}
+	return nil
+}
+
+// CancelJob cancels a job that hasn't started, along with the jobs waiting
+// on it. found is false if the job isn't waiting in the queue.
+func (jm *JobManager) CancelJob(ctx context.Context, j job.Job) (job.Job, bool, error) {
+	endTime := time.Now()
+	found, err := jm.db.CancelJob(ctx, j.UUID, endTime)
+	if err != nil || !found {
+		return job.Job{}, false, errors.Trace(err)
+	}
+
+	ar := job.ArchiveReasonCancelled
+	j.Running = false
+	j.Archived = true
+	j.ArchiveReason = &ar
+	j.EndTime = &endTime
+	metrics.JobsFinished.WithLabelValues(ar.String()).Inc()
+
+	jm.QueueChanged()
+	jm.PublishStatus(j)
+	jm.Notify(ctx, j)
+	jm.cancelChildren(ctx, j)
+	return j, true, nil
+}
+
+// cancelChildren cancels the jobs waiting on a job that failed or was
+// cancelled, since they have no image to start from.
+func (jm *JobManager) cancelChildren(ctx context.Context, parent job.Job) {
+	children, err := jm.db.GetChildJobs(ctx, parent.UUID)
+	if err != nil {
+		jm.logger.Error("Failed to get child jobs", logging.KeyJob, parent.UUID, logging.Err(err))
+		return
+	}
+
+	for _, child := range children {
+		if !child.Pending() {
+			continue
+		}
+		l := jm.logger.With(logging.KeyJob, child.UUID)
+		if _, _, err := jm.CancelJob(ctx, child); err != nil {
+			l.Error("Failed to cancel child job", "parent", parent.UUID, logging.Err(err))
+			continue
+		}
+		l.Info("Cancelled child job", "parent", parent.UUID, "parentStatus", parent.Status())
+
+		if child.BatchUUID != uuid.Nil {
+			if err := jm.CheckBatch(ctx, child.BatchUUID); err != nil {
+				l.Error("Failed to check batch", logging.KeyBatch, child.BatchUUID, logging.Err(err))
+			}
+		}
+	}
+}
+
+// cancelOrphans cancels queued jobs whose parent failed, which can happen if
+// a parent fails while its child is being added, or if the server stopped
+// before it cancelled a failed job's children.
+func (jm *JobManager) cancelOrphans(ctx context.Context, jobs []job.Job) {
+	for _, j := range jobs {
+		if j.ParentUUID == uuid.Nil || !j.Pending() {
+			continue
+		}
+		parent, found, _, err := jm.db.GetJobByUUID(ctx, j.ParentUUID)
+		if err != nil {
+			jm.logger.Error("Failed to get parent job", logging.KeyJob, j.UUID, logging.Err(err))
+			continue
+		}
+		if found && parent.Archived && !parent.Done() {
+			jm.cancelChildren(ctx, parent)
+		}
+	}
+}
+
+// inputPath is where a job's input image is. Jobs that start from another
+// job's image get a copy of it there, fetched from S3 if it was uploaded, so
+// runners find every input in the same place.
+func (jm *JobManager) inputPath(ctx context.Context, j job.Job) (string, error) {
+	path := filepath.Join(jm.opts.ImageUploadPath, j.UUID.String())
+	// Mocked jobs have no images
+	if j.ParentUUID == uuid.Nil || jm.opts.MockJobs {
+		return path, nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	defer f.Close()
+
+	fileName := jm.getJobFileName(j.ParentUUID)
+	if jm.opts.UseS3 {
+		err = jm.s3.DownloadFileTo(ctx, fileName, f)
+	} else {
+		err = copyFile(f, filepath.Join(jm.opts.StableDiffusionPath, "output", fileName))
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", errors.Annotatef(err, "image of parent job %v", j.ParentUUID)
+	}
+	return path, errors.Trace(f.Close())
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return errors.Trace(err)
+}
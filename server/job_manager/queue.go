@@ -0,0 +1,85 @@
+package job_manager
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/batch"
+	"github.com/wellsjo/ai-art/server/job"
+)
+
+// MAX_QUEUED_JOBS is how many jobs may wait to run. Submissions beyond it are
+// turned away until the queue drains.
+const MAX_QUEUED_JOBS = 100
+
+// QUEUE_FULL_RETRY_AFTER is how long clients turned away by a full queue are
+// told to wait.
+const QUEUE_FULL_RETRY_AFTER = 30 * time.Second
+
+var ErrQueueFull = errors.New("queue is full")
+
+// AddJob queues a job and wakes the job loop if it is waiting for work. A job
+// with a parent waits for the parent to finish.
+func (jm *JobManager) AddJob(ctx context.Context, j job.Job) error {
+	if err := jm.admit(ctx, []job.Job{j}); err != nil {
+		return errors.Trace(err)
+	}
+	if err := jm.db.AddJob(ctx, j); err != nil {
+		return errors.Trace(err)
+	}
+	jm.jobsAdded()
+
+	// The parent may have failed since it was checked
+	jm.cancelOrphans(ctx, []job.Job{j})
+	return nil
+}
+
+// AddBatch queues all of a batch's jobs, or none of them.
+func (jm *JobManager) AddBatch(ctx context.Context, b batch.Batch, jobs []job.Job) error {
+	if err := jm.admit(ctx, jobs); err != nil {
+		return errors.Trace(err)
+	}
+	if err := jm.db.AddBatch(ctx, b, jobs); err != nil {
+		return errors.Trace(err)
+	}
+	jm.jobsAdded()
+	return nil
+}
+
+// admit checks jobs against the settings limits, their models, assets and
+// parents, and the room left in the queue. Concurrent submissions can
+// overshoot MaxQueuedJobs slightly.
+func (jm *JobManager) admit(ctx context.Context, jobs []job.Job) error {
+	for _, j := range jobs {
+		if j.Settings.NumIterations > jm.opts.MaxNumIterations {
+			return errors.NotValidf("NumIterations %d (max %d)", j.Settings.NumIterations, jm.opts.MaxNumIterations)
+		}
+	}
+	if err := jm.checkModels(ctx, jobs); err != nil {
+		return errors.Trace(err)
+	}
+	if err := jm.checkAssets(ctx, jobs); err != nil {
+		return errors.Trace(err)
+	}
+	if err := jm.checkParents(ctx, jobs); err != nil {
+		return errors.Trace(err)
+	}
+
+	pending, err := jm.db.CountPendingJobs(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if pending+len(jobs) > jm.opts.MaxQueuedJobs {
+		return errors.Annotatef(ErrQueueFull, "%d jobs waiting", pending)
+	}
+	return nil
+}
+
+func (jm *JobManager) jobsAdded() {
+	select {
+	case jm.wake <- struct{}{}:
+	default:
+	}
+	jm.QueueChanged()
+}
@@ -0,0 +1,42 @@
+package job_manager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/logging"
+	"github.com/wellsjo/ai-art/server/webhook"
+)
+
+// Notify sends the job's current state to its callback URL, if it has one.
+// Deliveries happen in the background; only failures to record them are
+// logged here.
+func (jm *JobManager) Notify(ctx context.Context, j job.Job) {
+	if jm.webhooks == nil || j.CallbackURL == "" {
+		return
+	}
+
+	var imageURLs []string
+	if j.Done() {
+		imageURLs = []string{jm.imageURL(j)}
+	}
+
+	payload := webhook.NewJobPayload(j, imageURLs)
+	if _, err := jm.webhooks.Enqueue(ctx, j.UUID, j.CallbackURL, payload.Event, payload); err != nil {
+		jm.logger.Error("Failed to enqueue webhook", logging.KeyJob, j.UUID, logging.Err(err))
+	}
+}
+
+// imageURL is where a finished job's image can be fetched from outside the
+// server. Local images are only absolute when PublicURL is set.
+func (jm *JobManager) imageURL(j job.Job) string {
+	if jm.opts.MockJobs {
+		return fmt.Sprintf("%s/image/w/mock.png", strings.TrimSuffix(jm.opts.PublicURL, "/"))
+	} else if jm.opts.UseS3 {
+		// TODO put in config
+		return fmt.Sprintf("https://ai-art-1.s3.amazonaws.com/%v", jm.getJobFileName(j.UUID))
+	}
+	return fmt.Sprintf("%s/image/sd/%v", strings.TrimSuffix(jm.opts.PublicURL, "/"), jm.getJobFileName(j.UUID))
+}
@@ -0,0 +1,102 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// DEFAULT_CAPTURE_SIZE is the most a capture holds before it stops recording.
+const DEFAULT_CAPTURE_SIZE = 1 << 20
+
+const truncated = "... log truncated\n"
+
+// Capture records everything logged about one job, at every level, so it can
+// be read back while the job runs and stored once it finishes.
+type Capture struct {
+	mtx   sync.Mutex
+	buf   bytes.Buffer
+	limit int
+	full  bool
+}
+
+func NewCapture(limit int) *Capture {
+	if limit == 0 {
+		limit = DEFAULT_CAPTURE_SIZE
+	}
+	return &Capture{limit: limit}
+}
+
+// Write never fails, so that a chatty job can't break logging. Once the
+// limit is reached the rest is dropped.
+func (c *Capture) Write(p []byte) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.full {
+		return len(p), nil
+	}
+	if c.buf.Len()+len(p) > c.limit {
+		c.buf.WriteString(truncated)
+		c.full = true
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+func (c *Capture) String() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.buf.String()
+}
+
+// Tee returns a logger that logs to l, and also to c as text at every level.
+func (c *Capture) Tee(l *slog.Logger) *slog.Logger {
+	return slog.New(teeHandler{
+		l.Handler(),
+		slog.NewTextHandler(c, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	})
+}
+
+// teeHandler passes records to every handler that accepts their level.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	for _, h := range t {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if e := h.Handle(ctx, r.Clone()); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	handlers := make(teeHandler, len(t))
+	for i, h := range t {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
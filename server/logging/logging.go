@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/juju/errors"
+)
+
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Attribute keys shared by every package, so lines about the same job or
+// request can be found with one query.
+const (
+	KeyJob     = "job"
+	KeyBatch   = "batch"
+	KeyWorker  = "worker"
+	KeyRequest = "request"
+	KeyError   = "error"
+)
+
+type Opts struct {
+	Format string
+	Level  string
+	Output io.Writer
+}
+
+// New builds a logger from opts. Format defaults to text and Level to info.
+func New(opts Opts) (*slog.Logger, error) {
+	if opts.Output == nil {
+		opts.Output = os.Stdout
+	}
+
+	var level slog.Level
+	if opts.Level != "" {
+		if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+			return nil, errors.Annotatef(err, "log level %q", opts.Level)
+		}
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(opts.Format) {
+	case "", FormatText:
+		return slog.New(slog.NewTextHandler(opts.Output, handlerOpts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(opts.Output, handlerOpts)), nil
+	default:
+		return nil, errors.Errorf("unknown log format %q", opts.Format)
+	}
+}
+
+// Setup makes the logger described by opts the default, including for
+// anything still using the log package.
+func Setup(opts Opts) error {
+	l, err := New(opts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	slog.SetDefault(l)
+	log.SetFlags(0)
+	return nil
+}
+
+// Err is an attribute holding err's stack, as printed by errors.ErrorStack.
+func Err(err error) slog.Attr {
+	return slog.String(KeyError, errors.ErrorStack(err))
+}
+
+type ctxKey struct{}
+
+// WithLogger returns a copy of ctx carrying l.
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the logger stored in ctx, or the default logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
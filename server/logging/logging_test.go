@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(Opts{Format: FormatJSON, Level: "warn", Output: &buf})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	l.Info("hidden")
+	l.With(KeyJob, "abc").Warn("shown", "n", 1)
+
+	var line map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "shown", line["msg"])
+	assert.Equal(t, "abc", line[KeyJob])
+	assert.Equal(t, float64(1), line["n"])
+
+	_, err = New(Opts{Format: "xml"})
+	assert.Error(t, err)
+	_, err = New(Opts{Level: "loud"})
+	assert.Error(t, err)
+}
+
+func TestContext(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := New(Opts{Output: &buf})
+
+	ctx := WithLogger(context.Background(), l.With(KeyRequest, "r1"))
+	FromContext(ctx).Info("hello")
+	assert.Contains(t, buf.String(), "request=r1")
+
+	assert.NotNil(t, FromContext(context.Background()))
+}
+
+func TestCapture(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := New(Opts{Output: &buf})
+
+	c := NewCapture(0)
+	jl := c.Tee(l).With(KeyJob, "abc")
+	jl.Debug("step 1")
+	jl.Info("done")
+
+	// The capture records debug lines that the main logger drops
+	assert.NotContains(t, buf.String(), "step 1")
+	assert.Contains(t, buf.String(), "done")
+	assert.Contains(t, c.String(), "step 1")
+	assert.Contains(t, c.String(), "job=abc")
+
+	small := NewCapture(10)
+	small.Write([]byte("12345"))
+	small.Write([]byte("678901"))
+	small.Write([]byte("2"))
+	assert.Equal(t, "12345"+truncated, small.String())
+	assert.Equal(t, 1, strings.Count(small.String(), truncated))
+}
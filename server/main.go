@@ -1,17 +1,29 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/netip"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 
 	"github.com/juju/errors"
 	flag "github.com/spf13/pflag"
 	"github.com/wellsjo/ai-art/server/api"
 	"github.com/wellsjo/ai-art/server/db"
+	"github.com/wellsjo/ai-art/server/events"
+	"github.com/wellsjo/ai-art/server/job"
 	"github.com/wellsjo/ai-art/server/job_manager"
+	"github.com/wellsjo/ai-art/server/logging"
+	"github.com/wellsjo/ai-art/server/metrics"
+	"github.com/wellsjo/ai-art/server/quota"
+	"github.com/wellsjo/ai-art/server/runner"
 	"github.com/wellsjo/ai-art/server/s3_manager"
+	"github.com/wellsjo/ai-art/server/user"
+	"github.com/wellsjo/ai-art/server/webhook"
 	"github.com/wellsjo/ai-art/server/ws"
 )
 
@@ -27,7 +39,26 @@ func main() {
 		awsSecretAccessKeyOption  string
 		useCPUOption              bool
 		maxNumIterationsOption    int
+		maxQueuedJobsOption       int
 		stableDiffusionPathOption string
+		adminUsernameOption       string
+		adminPasswordOption       string
+		userLimitsOption          quota.Limits
+		ipLimitsOption            quota.Limits
+		webhookSecretOption       string
+		webhookAllowNetworkOption []string
+		publicURLOption           string
+		logFormatOption           string
+		logLevelOption            string
+		workerIDOption            string
+		skipMigrationsOption      bool
+		runnerOption              string
+		runnerURLOption           string
+		dockerMemoryLimitOption   int64
+		assetPathOption           string
+		upscalerOption            string
+		secureCookiesOption       bool
+		trustedProxiesOption      []string
 	)
 
 	defaultSDPath := ""
@@ -47,7 +78,34 @@ func main() {
 	flag.BoolVar(&useCPUOption, "use-cpu", false, "use cpu if gpu is not supported")
 	flag.BoolVar(&mockJobsOption, "mock-jobs", false, "mock image creation jobs for testing")
 	flag.IntVar(&maxNumIterationsOption, "max-num-iterations", 50, "maximum number of iterations for stable diffusion to use per job")
+	flag.IntVar(&maxQueuedJobsOption, "max-queued-jobs", job_manager.MAX_QUEUED_JOBS, "maximum number of jobs waiting to run before submissions are refused")
 	flag.StringVar(&stableDiffusionPathOption, "stable-diffusion-path", defaultSDPath, "path to stable diffusion docker entrypoint")
+	flag.StringVar(&runnerOption, "runner", "script", "how jobs are rendered: script runs build.sh per job, docker starts a container per job through the docker api, http sends them to a model server")
+	flag.StringVar(&runnerURLOption, "runner-url", runner.DEFAULT_RUNNER_URL, "model server url for --runner http")
+	flag.Int64Var(&dockerMemoryLimitOption, "docker-memory-limit", 0, "memory limit of job containers in MiB for --runner docker (0 is unlimited)")
+	flag.StringVar(&upscalerOption, "upscaler", job.DEFAULT_UPSCALER, "upscaler for upscale jobs that don't choose one: lanczos, bicubic, nearest or a diffusers upscaling model (with --runner http, the name of one of the model server's upscalers)")
+	flag.StringVar(&assetPathOption, "asset-path", "", "directory for uploaded LoRAs, embeddings and VAEs (defaults to input/assets in --stable-diffusion-path)")
+	flag.StringVar(&adminUsernameOption, "admin-username", "", "create an admin user with this name on startup if it does not exist")
+	flag.StringVar(&adminPasswordOption, "admin-password", "", "password for --admin-username")
+	flag.IntVar(&userLimitsOption.MaxPendingJobs, "user-max-pending-jobs", 0, "maximum number of queued jobs per user (0 is unlimited)")
+	flag.IntVar(&userLimitsOption.MaxJobsPerHour, "user-max-jobs-per-hour", 0, "maximum number of jobs a user can submit per hour (0 is unlimited)")
+	flag.Int64Var(&userLimitsOption.MaxCostPerHour, "user-max-cost-per-hour", 0, "maximum compute cost (steps x pixels x samples) a user can submit per hour (0 is unlimited)")
+	flag.IntVar(&ipLimitsOption.MaxPendingJobs, "ip-max-pending-jobs", 0, "maximum number of queued jobs per client ip (0 is unlimited)")
+	flag.IntVar(&ipLimitsOption.MaxJobsPerHour, "ip-max-jobs-per-hour", 0, "maximum number of jobs a client ip can submit per hour (0 is unlimited)")
+	flag.Int64Var(&ipLimitsOption.MaxCostPerHour, "ip-max-cost-per-hour", 0, "maximum compute cost (steps x pixels x samples) a client ip can submit per hour (0 is unlimited)")
+	flag.StringVar(&webhookSecretOption, "webhook-secret", "", "secret used to sign webhook payloads (webhooks are disabled without one)")
+	flag.StringSliceVar(&webhookAllowNetworkOption, "webhook-allow-network", nil, "internal network (cidr) that webhooks may be sent to, which are refused by default (repeatable)")
+	flag.StringSliceVar(&trustedProxiesOption, "trusted-proxies", nil, "addresses or networks of proxies whose X-Forwarded-For headers give the client ip (repeatable, none by default)")
+	flag.BoolVar(&secureCookiesOption, "secure-cookies", false, "only send session cookies over https, for servers behind a proxy that terminates tls")
+	flag.StringVar(&publicURLOption, "public-url", "", "external base url of this server, used for image links in webhooks")
+	flag.StringVar(&logFormatOption, "log-format", logging.FormatText, "log output format (text or json)")
+	flag.StringVar(&logLevelOption, "log-level", "info", "minimum level to log (debug, info, warn or error)")
+	flag.StringVar(&workerIDOption, "worker-id", "", "name attached to logs from the job loop, and to the jobs it claims (defaults to the hostname)")
+	flag.BoolVar(&skipMigrationsOption, "skip-migrations", false, "don't apply pending database migrations on startup")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: stable-diffusion-server [options] [migrate <command>]")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	if helpOption {
@@ -55,10 +113,38 @@ func main() {
 		os.Exit(0)
 	}
 
+	if err := logging.Setup(logging.Opts{
+		Format: logFormatOption,
+		Level:  logLevelOption,
+	}); err != nil {
+		panic(err)
+	}
+
 	if mockJobsOption && useS3Option {
 		panic("cannot upload to s3 if using --mock-jobs option")
 	}
 
+	if runnerOption != "script" && runnerOption != "docker" && runnerOption != "http" {
+		panic("--runner must be script, docker or http")
+	}
+
+	if adminUsernameOption != "" && adminPasswordOption == "" {
+		panic("missing --admin-password")
+	}
+
+	if err := api.ParseTrustedProxies(trustedProxiesOption); err != nil {
+		panic(fmt.Sprintf("invalid --trusted-proxies: %v", err))
+	}
+
+	var webhookAllowedNetworks []netip.Prefix
+	for _, n := range webhookAllowNetworkOption {
+		prefix, err := netip.ParsePrefix(n)
+		if err != nil {
+			panic(fmt.Sprintf("invalid --webhook-allow-network %q", n))
+		}
+		webhookAllowedNetworks = append(webhookAllowedNetworks, prefix)
+	}
+
 	if useS3Option {
 		if s3BucketOption == "" {
 			panic("missing --s3-bucket")
@@ -88,14 +174,17 @@ func main() {
 		saveFilesTo = fmt.Sprintf("s3://%s (%s)", s3BucketOption, s3RegionOption)
 	}
 
-	log.Println("Save Files:", saveFilesTo)
-	log.Println("Rendering Hardware:", renderingHardware)
-	log.Println("Stable Diffusion Path:", stableDiffusionPathOption)
-	log.Println("Stable Diffusion Num Iterations:", maxNumIterationsOption)
+	slog.Info("Starting",
+		"saveFiles", saveFilesTo,
+		"hardware", renderingHardware,
+		"runner", runnerOption,
+		"stableDiffusionPath", stableDiffusionPathOption,
+		"maxNumIterations", maxNumIterationsOption,
+	)
 
-	// Debug logging
-	log.SetOutput(os.Stdout)
-	log.SetFlags(log.Lshortfile)
+	// Everything started below stops when this is cancelled
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// TODO make these configurable
 	db, err := db.Connect("ai-art-db", 5432, "puma", "admin", "puma")
@@ -103,6 +192,29 @@ func main() {
 		logFatalError(err)
 	}
 
+	if flag.NArg() > 0 {
+		if flag.Arg(0) != "migrate" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		if err := runMigrate(ctx, db, flag.Args()[1:]); err != nil {
+			logFatalError(err)
+		}
+		return
+	}
+
+	if !skipMigrationsOption {
+		if err := db.MigrateUp(ctx); err != nil {
+			logFatalError(err)
+		}
+	}
+
+	if adminUsernameOption != "" {
+		if err := ensureAdmin(ctx, db, adminUsernameOption, adminPasswordOption); err != nil {
+			logFatalError(err)
+		}
+	}
+
 	s3Manager, err := s3_manager.New(s3_manager.Opts{
 		Bucket:          s3BucketOption,
 		Region:          s3RegionOption,
@@ -114,6 +226,40 @@ func main() {
 	}
 
 	wsManager := ws.NewWSManager()
+	metrics.RegisterWSConnections(wsManager.NumConns)
+
+	// Unsigned webhooks could be forged, so they are only sent with a secret
+	var webhooks *webhook.Dispatcher
+	if webhookSecretOption != "" {
+		webhooks = webhook.New(webhook.Opts{
+			Secret:          webhookSecretOption,
+			AllowedNetworks: webhookAllowedNetworks,
+		}, db)
+		webhooks.Run()
+		defer webhooks.Close()
+	} else {
+		slog.Warn("Webhooks are disabled, start with --webhook-secret to send them")
+	}
+
+	broker := events.New(events.Opts{})
+
+	// The script runner is the default, picked by job_manager
+	var jobRunner runner.Runner
+	if runnerOption == "http" && !mockJobsOption {
+		jobRunner = runner.NewHTTP(runner.HTTPOpts{URL: runnerURLOption})
+	} else if runnerOption == "docker" && !mockJobsOption {
+		dockerRunner := runner.NewDocker(runner.DockerOpts{
+			Path:        stableDiffusionPathOption,
+			UseCPU:      useCPUOption,
+			MemoryLimit: dockerMemoryLimitOption << 20,
+			WorkerID:    workerIDOption,
+		})
+		// Not fatal, the readiness check reports an unreachable daemon
+		if err := dockerRunner.Cleanup(ctx); err != nil {
+			slog.Error("Failed to remove leftover containers", logging.Err(err))
+		}
+		jobRunner = dockerRunner
+	}
 
 	jobManager := job_manager.New(
 		job_manager.Opts{
@@ -121,28 +267,76 @@ func main() {
 			UseCPU:              useCPUOption,
 			UseS3:               useS3Option,
 			StableDiffusionPath: stableDiffusionPathOption,
+			AssetPath:           assetPathOption,
 			MaxNumIterations:    maxNumIterationsOption,
+			MaxQueuedJobs:       maxQueuedJobsOption,
+			Runner:              jobRunner,
+			PublicURL:           publicURLOption,
+			WorkerID:            workerIDOption,
 		},
 		db,
 		s3Manager,
 		wsManager,
+		webhooks,
+		broker,
 	)
 	jobManager.Run()
 
 	server := api.New(
 		api.Opts{
-			MockJobs: mockJobsOption,
-			Port:     apiPortOption,
-			UseS3:    useS3Option,
+			MockJobs:       mockJobsOption,
+			Port:           apiPortOption,
+			UseS3:          useS3Option,
+			UploadPath:     filepath.Join(stableDiffusionPathOption, "input"),
+			UserLimits:     userLimitsOption,
+			IPLimits:       ipLimitsOption,
+			Upscaler:       upscalerOption,
+			SecureCookies:  secureCookiesOption,
+			TrustedProxies: trustedProxiesOption,
 		},
 		jobManager,
 		wsManager,
+		webhooks,
+		broker,
 		db,
 	)
 
-	server.Run()
+	if err := server.Run(ctx); err != nil {
+		logFatalError(err)
+	}
+
+	slog.Info("Shutting down")
+	jobManager.Close()
+}
+
+func ensureAdmin(ctx context.Context, db *db.DB, username, password string) error {
+	_, _, found, err := db.GetUserByUsername(ctx, username)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if found {
+		return nil
+	}
+
+	u, err := user.New(username, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	passwordHash, err := user.HashPassword(password)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u, err = db.AddUser(ctx, u, passwordHash)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	slog.Info("Created admin user", "user", u.Username)
+	return nil
 }
 
 func logFatalError(err error) {
-	log.Fatal(errors.ErrorStack(err))
+	slog.Error("Fatal error", logging.Err(err))
+	os.Exit(1)
 }
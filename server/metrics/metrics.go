@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ai_art"
+
+var (
+	QueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_jobs",
+		Help:      "Jobs waiting in or being worked on from the queue, by state.",
+	}, []string{"state"})
+
+	JobsFinished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_finished_total",
+		Help:      "Jobs that left the queue, by final status.",
+	}, []string{"status"})
+
+	JobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_duration_seconds",
+		Help:      "Time spent rendering jobs.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, []string{"hardware", "size", "steps"})
+
+	RunnerFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "runner_failures_total",
+		Help:      "Jobs whose runner failed, by cause.",
+	}, []string{"cause"})
+
+	S3UploadDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "s3_upload_duration_seconds",
+		Help:      "Time taken by S3 uploads, successful or not.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	S3UploadFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_upload_failures_total",
+		Help:      "S3 uploads that failed.",
+	})
+
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests, by route and response code.",
+	}, []string{"method", "route", "code"})
+
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to answer HTTP requests, by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+)
+
+// Runner failure causes
+const (
+	CauseStart = "start"
+	CauseExit  = "exit"
+	CauseOther = "other"
+)
+
+// RegisterWSConnections exports the number of open websockets, read from fn
+// whenever metrics are scraped.
+func RegisterWSConnections(fn func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_connections",
+		Help:      "Open websocket connections.",
+	}, func() float64 {
+		return float64(fn())
+	})
+}
+
+// ObserveJob records how long a job took to render.
+func ObserveJob(hardware string, width, height, steps int, d time.Duration) {
+	JobDuration.WithLabelValues(
+		hardware,
+		fmt.Sprintf("%dx%d", width, height),
+		strconv.Itoa(steps),
+	).Observe(d.Seconds())
+}
+
+// RunnerFailure records a failed job, classifying the error by whether the
+// runner couldn't be started or exited with an error. Runners report exits
+// with an error that has an ExitCode method, like *exec.ExitError.
+func RunnerFailure(err error) {
+	cause := CauseOther
+
+	var exitErr interface{ ExitCode() int }
+	var execErr *exec.Error
+	var pathErr *os.PathError
+	if errors.As(err, &exitErr) {
+		cause = CauseExit
+	} else if errors.As(err, &execErr) || errors.As(err, &pathErr) {
+		cause = CauseStart
+	}
+
+	RunnerFailures.WithLabelValues(cause).Inc()
+}
+
+// ObserveS3Upload records the outcome of an upload that started at start.
+func ObserveS3Upload(start time.Time, err error) {
+	S3UploadDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		S3UploadFailures.Inc()
+	}
+}
+
+// Middleware records every request under its route pattern, so that
+// requests for different jobs share a series.
+func Middleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+
+	HTTPRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+	HTTPDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+}
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
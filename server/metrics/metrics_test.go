@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Middleware)
+	r.GET("/job/:uuid", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	for _, path := range []string{"/job/a", "/job/b", "/nope"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(HTTPRequests.WithLabelValues("GET", "/job/:uuid", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(HTTPRequests.WithLabelValues("GET", "unmatched", "404")))
+}
+
+func TestRunnerFailure(t *testing.T) {
+	_, err := exec.Command("./does-not-exist").Output()
+	RunnerFailure(errors.Annotate(err, "RunStableDiffusionJob Start"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(RunnerFailures.WithLabelValues(CauseStart)))
+
+	err = exec.Command("false").Run()
+	RunnerFailure(errors.Annotate(err, "RunStableDiffusionJob Wait"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(RunnerFailures.WithLabelValues(CauseExit)))
+
+	RunnerFailure(errors.New("boom"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(RunnerFailures.WithLabelValues(CauseOther)))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/db"
+)
+
+const migrateUsage = `usage: stable-diffusion-server [options] migrate <command>
+
+Commands:
+  status      print the current and latest schema versions (default)
+  up          apply every pending migration
+  down [n]    revert the last n migrations (default 1)
+  to <n>      apply or revert migrations until the schema is at version n`
+
+// runMigrate handles the migrate subcommand.
+func runMigrate(ctx context.Context, database *db.DB, args []string) error {
+	cmd := "status"
+	if len(args) > 0 {
+		cmd = args[0]
+		args = args[1:]
+	}
+
+	switch cmd {
+	case "status":
+	case "up":
+		if err := database.MigrateUp(ctx); err != nil {
+			return errors.Trace(err)
+		}
+	case "down":
+		n := 1
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+				return errors.Errorf("invalid number of migrations %q", args[0])
+			}
+		}
+		if err := database.MigrateDown(ctx, n); err != nil {
+			return errors.Trace(err)
+		}
+	case "to":
+		if len(args) == 0 {
+			return errors.New(migrateUsage)
+		}
+		version, err := strconv.Atoi(args[0])
+		if err != nil {
+			return errors.Errorf("invalid version %q", args[0])
+		}
+		if err := database.MigrateTo(ctx, version); err != nil {
+			return errors.Trace(err)
+		}
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	version, err := database.SchemaVersion(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	latest, err := db.LatestVersion()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fmt.Printf("schema version %d (latest %d)\n", version, latest)
+	return nil
+}
@@ -0,0 +1,139 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/job"
+)
+
+// DEFAULT_MODEL is the model the docker entrypoint uses when it isn't given
+// one. The initial registry holds only this model; see
+// db/migrations/0002_models.up.sql.
+const (
+	DEFAULT_MODEL        = "stable-diffusion-v1-4"
+	DEFAULT_MODEL_SOURCE = "CompVis/stable-diffusion-v1-4"
+	DEFAULT_MAX_SIZE     = 1024
+)
+
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// Model is a registry entry that jobs can choose to render with.
+type Model struct {
+	Name string `json:"name"`
+	// Source is a Huggingface repo or a path the runner can load the model
+	// from.
+	Source        string     `json:"source"`
+	Modes         []job.Mode `json:"modes"`
+	DefaultWidth  int        `json:"defaultWidth"`
+	DefaultHeight int        `json:"defaultHeight"`
+	// MaxWidth and MaxHeight are unlimited when zero.
+	MaxWidth  int  `json:"maxWidth,omitempty"`
+	MaxHeight int  `json:"maxHeight,omitempty"`
+	AllowCPU  bool `json:"allowCPU"`
+	// Default is used by jobs that don't choose a model. Exactly one model
+	// is the default.
+	Default bool      `json:"default"`
+	Created time.Time `json:"created"`
+}
+
+func (m Model) String() string {
+	return fmt.Sprintf("%v (%v)", m.Name, m.Source)
+}
+
+// Default is the model in the initial registry.
+func Default() Model {
+	return Model{
+		Name:          DEFAULT_MODEL,
+		Source:        DEFAULT_MODEL_SOURCE,
+		Modes:         []job.Mode{job.TextToImageMode, job.ImageToImageMode},
+		DefaultWidth:  job.DEFAULT_WIDTH,
+		DefaultHeight: job.DEFAULT_HEIGHT,
+		MaxWidth:      DEFAULT_MAX_SIZE,
+		MaxHeight:     DEFAULT_MAX_SIZE,
+		AllowCPU:      true,
+		Default:       true,
+	}
+}
+
+// New validates a registry entry, filling in the job defaults for anything
+// left out.
+func New(m Model) (Model, error) {
+	if !validName.MatchString(m.Name) {
+		return Model{}, errors.NotValidf("model name %q", m.Name)
+	}
+	if m.Source == "" {
+		return Model{}, errors.NotValidf("empty source")
+	}
+
+	if len(m.Modes) == 0 {
+		m.Modes = []job.Mode{job.TextToImageMode, job.ImageToImageMode}
+	}
+	for _, mode := range m.Modes {
+		if mode != job.TextToImageMode && mode != job.ImageToImageMode {
+			return Model{}, errors.NotValidf("mode %d", mode)
+		}
+	}
+
+	if m.DefaultWidth <= 0 {
+		m.DefaultWidth = job.DEFAULT_WIDTH
+	}
+	if m.DefaultHeight <= 0 {
+		m.DefaultHeight = job.DEFAULT_HEIGHT
+	}
+	for _, dim := range []int{m.DefaultWidth, m.DefaultHeight, m.MaxWidth, m.MaxHeight} {
+		if dim < 0 || dim%8 != 0 {
+			return Model{}, errors.NotValidf("dimension %d", dim)
+		}
+	}
+	if (m.MaxWidth > 0 && m.DefaultWidth > m.MaxWidth) || (m.MaxHeight > 0 && m.DefaultHeight > m.MaxHeight) {
+		return Model{}, errors.NotValidf("default size %dx%d (max %dx%d)", m.DefaultWidth, m.DefaultHeight, m.MaxWidth, m.MaxHeight)
+	}
+
+	if m.Created.IsZero() {
+		m.Created = time.Now().Truncate(time.Microsecond).UTC()
+	}
+	return m, nil
+}
+
+// ApplyDefaults fills in the model's size for settings that leave it out.
+// It must be called before job.New, which would fill in its own.
+func (m Model) ApplyDefaults(s job.Settings) job.Settings {
+	s.Model = m.Name
+	if s.Width <= 0 {
+		s.Width = m.DefaultWidth
+	}
+	if s.Height <= 0 {
+		s.Height = m.DefaultHeight
+	}
+	return s
+}
+
+func (m Model) Supports(mode job.Mode) bool {
+	for _, supported := range m.Modes {
+		if supported == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns a NotValid error if a job with these settings can't be
+// rendered with the model on hardware.
+func (m Model) Check(s job.Settings, hardware string) error {
+	if !m.Supports(s.Mode) {
+		return errors.NotValidf("%v with model %s", s.Mode, m.Name)
+	}
+	if m.MaxWidth > 0 && s.Width > m.MaxWidth {
+		return errors.NotValidf("width %d (max %d for model %s)", s.Width, m.MaxWidth, m.Name)
+	}
+	if m.MaxHeight > 0 && s.Height > m.MaxHeight {
+		return errors.NotValidf("height %d (max %d for model %s)", s.Height, m.MaxHeight, m.Name)
+	}
+	if hardware == "cpu" && !m.AllowCPU {
+		return errors.NotValidf("model %s on cpu", m.Name)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/wellsjo/ai-art/server/job"
+)
+
+func TestNew(t *testing.T) {
+	m, err := New(Model{Name: "sd-1.5", Source: "runwayml/stable-diffusion-v1-5"})
+	assert.NoError(t, err)
+	assert.Equal(t, []job.Mode{job.TextToImageMode, job.ImageToImageMode}, m.Modes)
+	assert.Equal(t, job.DEFAULT_WIDTH, m.DefaultWidth)
+	assert.Equal(t, job.DEFAULT_HEIGHT, m.DefaultHeight)
+	assert.False(t, m.Created.IsZero())
+
+	for _, invalid := range []Model{
+		{Name: "", Source: "a/b"},
+		{Name: "has/slash", Source: "a/b"},
+		{Name: "sd", Source: ""},
+		{Name: "sd", Source: "a/b", Modes: []job.Mode{5}},
+		{Name: "sd", Source: "a/b", DefaultWidth: 500},
+		{Name: "sd", Source: "a/b", MaxHeight: 256},
+	} {
+		_, err := New(invalid)
+		assert.True(t, errors.IsNotValid(err), "%+v", invalid)
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	m, _ := New(Model{Name: "sd-2", Source: "a/b", DefaultWidth: 768, DefaultHeight: 768})
+
+	s := m.ApplyDefaults(job.Settings{Prompt: "hello", Height: 512})
+	assert.Equal(t, "sd-2", s.Model)
+	assert.Equal(t, 768, s.Width)
+	assert.Equal(t, 512, s.Height)
+}
+
+func TestCheck(t *testing.T) {
+	m, _ := New(Model{
+		Name:      "sd",
+		Source:    "a/b",
+		Modes:     []job.Mode{job.TextToImageMode},
+		MaxWidth:  768,
+		MaxHeight: 512,
+	})
+
+	assert.NoError(t, m.Check(job.Settings{Width: 768, Height: 512}, "gpu"))
+
+	for _, s := range []job.Settings{
+		{Width: 1024, Height: 512},
+		{Width: 512, Height: 768},
+		{Width: 512, Height: 512, Mode: job.ImageToImageMode},
+	} {
+		assert.True(t, errors.IsNotValid(m.Check(s, "gpu")), "%+v", s)
+	}
+
+	s := job.Settings{Width: 512, Height: 512}
+	assert.True(t, errors.IsNotValid(m.Check(s, "cpu")))
+	m.AllowCPU = true
+	assert.NoError(t, m.Check(s, "cpu"))
+	assert.NoError(t, m.Check(s, "mocked"))
+}
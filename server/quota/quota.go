@@ -0,0 +1,82 @@
+package quota
+
+import (
+	"fmt"
+	"time"
+)
+
+// Window is the sliding period that hourly limits are counted over.
+const Window = time.Hour
+
+// PendingRetryAfter is suggested to clients that hit the pending job limit.
+// There's no way to know when a queued job will finish, so this is a guess.
+const PendingRetryAfter = 30 * time.Second
+
+// Limits of zero are unlimited.
+type Limits struct {
+	MaxPendingJobs int
+	MaxJobsPerHour int
+	MaxCostPerHour int64
+}
+
+func (l Limits) Unlimited() bool {
+	return l.MaxPendingJobs == 0 && l.MaxJobsPerHour == 0 && l.MaxCostPerHour == 0
+}
+
+// Usage is what a user or IP address has submitted. Window counts cover jobs
+// created since now-Window, including ones that already finished.
+type Usage struct {
+	PendingJobs    int
+	JobsInWindow   int
+	CostInWindow   int64
+	OldestInWindow *time.Time
+}
+
+type ExceededError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s", e.Reason)
+}
+
+// Check returns an *ExceededError if submitting numJobs more jobs with the
+// given total cost would go over any of the limits.
+func (l Limits) Check(u Usage, numJobs int, cost int64, now time.Time) error {
+	if l.MaxPendingJobs > 0 && u.PendingJobs+numJobs > l.MaxPendingJobs {
+		return &ExceededError{
+			Reason:     fmt.Sprintf("too many pending jobs (max %d)", l.MaxPendingJobs),
+			RetryAfter: PendingRetryAfter,
+		}
+	}
+
+	if l.MaxJobsPerHour > 0 && u.JobsInWindow+numJobs > l.MaxJobsPerHour {
+		return &ExceededError{
+			Reason:     fmt.Sprintf("too many jobs this hour (max %d)", l.MaxJobsPerHour),
+			RetryAfter: u.retryAfter(now),
+		}
+	}
+
+	if l.MaxCostPerHour > 0 && u.CostInWindow+cost > l.MaxCostPerHour {
+		return &ExceededError{
+			Reason:     fmt.Sprintf("compute cost this hour would be %d (max %d)", u.CostInWindow+cost, l.MaxCostPerHour),
+			RetryAfter: u.retryAfter(now),
+		}
+	}
+
+	return nil
+}
+
+// retryAfter is when the oldest job in the window falls out of it.
+func (u Usage) retryAfter(now time.Time) time.Duration {
+	if u.OldestInWindow == nil {
+		return Window
+	}
+
+	d := u.OldestInWindow.Add(Window).Sub(now)
+	if d < time.Second {
+		return time.Second
+	}
+	return d.Round(time.Second)
+}
@@ -0,0 +1,47 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	now := time.Now()
+	oldest := now.Add(-45 * time.Minute)
+
+	limits := Limits{
+		MaxPendingJobs: 2,
+		MaxJobsPerHour: 10,
+		MaxCostPerHour: 1000,
+	}
+
+	err := limits.Check(Usage{PendingJobs: 1, JobsInWindow: 9, CostInWindow: 500}, 1, 500, now)
+	assert.Nil(t, err)
+
+	err = limits.Check(Usage{PendingJobs: 2}, 1, 0, now)
+	if assert.IsType(t, &ExceededError{}, err) {
+		assert.Equal(t, PendingRetryAfter, err.(*ExceededError).RetryAfter)
+	}
+
+	err = limits.Check(Usage{JobsInWindow: 10, OldestInWindow: &oldest}, 1, 0, now)
+	if assert.IsType(t, &ExceededError{}, err) {
+		assert.Equal(t, 15*time.Minute, err.(*ExceededError).RetryAfter)
+	}
+
+	err = limits.Check(Usage{CostInWindow: 900, OldestInWindow: &oldest}, 1, 200, now)
+	assert.IsType(t, &ExceededError{}, err)
+
+	// A batch is rejected as a whole if it doesn't fit
+	err = limits.Check(Usage{PendingJobs: 1}, 2, 0, now)
+	assert.IsType(t, &ExceededError{}, err)
+}
+
+func TestUnlimited(t *testing.T) {
+	limits := Limits{}
+	assert.True(t, limits.Unlimited())
+
+	err := limits.Check(Usage{PendingJobs: 1000, JobsInWindow: 1000, CostInWindow: 1 << 40}, 1000, 1<<40, time.Now())
+	assert.Nil(t, err)
+}
@@ -0,0 +1,442 @@
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/logging"
+)
+
+const (
+	DOCKER_API_VERSION = "v1.41"
+	// CONTAINER_LABEL marks the containers started by a worker, so that ones
+	// left behind by a crash can be found. Its value is the worker ID.
+	CONTAINER_LABEL = "ai-art.worker"
+	// MODEL_CACHE_VOLUME holds the downloaded model, like in build.sh.
+	MODEL_CACHE_VOLUME = "huggingface"
+	// CONTAINER_HOME is the stable diffusion image's working directory.
+	CONTAINER_HOME = "/home/huggingface"
+	// CLEANUP_TIMEOUT bounds the requests that remove a container, which are
+	// made even after the job's context is cancelled.
+	CLEANUP_TIMEOUT = 10 * time.Second
+	// EXIT_OUTPUT_LINES is how much of a failed container's stderr is kept
+	// in its error.
+	EXIT_OUTPUT_LINES = 20
+)
+
+type DockerOpts struct {
+	// Path is the stable diffusion docker checkout.
+	Path string
+	// Image defaults to the name build.sh tags it with, the directory name
+	// of Path.
+	Image string
+	// Socket is the docker daemon's unix socket. Defaults to DOCKER_HOST if
+	// it is a unix socket, otherwise DOCKER_SOCKET.
+	Socket string
+	UseCPU bool
+	// MemoryLimit is in bytes. Zero is unlimited.
+	MemoryLimit int64
+	// WorkerID labels the containers. Defaults to the hostname.
+	WorkerID string
+}
+
+// Docker runs every job in a new stable diffusion container, like Script,
+// but talks to the docker daemon directly. Containers are killed when a job
+// is cancelled and always removed afterwards.
+type Docker struct {
+	opts   DockerOpts
+	client *http.Client
+}
+
+// APIError is an error response from the docker daemon.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("docker: %d %s", e.StatusCode, e.Message)
+}
+
+// ExitError is returned when a container exits with a non-zero code.
+type ExitError struct {
+	Code int
+	// Output is the end of the container's stderr.
+	Output string
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("container exited with code %d", e.Code)
+}
+
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+func NewDocker(opts DockerOpts) *Docker {
+	if opts.Image == "" {
+		opts.Image = filepath.Base(opts.Path)
+	}
+	if opts.Socket == "" {
+		opts.Socket = DOCKER_SOCKET
+		if host := os.Getenv("DOCKER_HOST"); strings.HasPrefix(host, "unix://") {
+			opts.Socket = strings.TrimPrefix(host, "unix://")
+		}
+	}
+	if opts.WorkerID == "" {
+		opts.WorkerID, _ = os.Hostname()
+	}
+
+	socket := opts.Socket
+	return &Docker{
+		opts: opts,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+type containerConfig struct {
+	Image      string
+	Cmd        []string
+	Labels     map[string]string
+	HostConfig hostConfig
+}
+
+type hostConfig struct {
+	Binds          []string
+	Memory         int64           `json:",omitempty"`
+	DeviceRequests []deviceRequest `json:",omitempty"`
+}
+
+type deviceRequest struct {
+	Count        int
+	Capabilities [][]string
+}
+
+// Run creates the job's container, streams its logs for progress and waits
+// for it to exit.
+func (d *Docker) Run(ctx context.Context, t Task) error {
+	name := containerName(t.Job.UUID)
+
+	// A job restarted after a crash may have left its container behind
+	if err := d.remove(ctx, name); err != nil && !isNotFound(err) {
+		return errors.Annotate(err, "Docker.Run remove")
+	}
+
+	id, err := d.create(ctx, name, t)
+	if err != nil {
+		return errors.Annotate(err, "Docker.Run create")
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), CLEANUP_TIMEOUT)
+		defer cancel()
+		if err := d.remove(ctx, id); err != nil {
+			t.Logger.Error("Failed to remove container", "container", id, logging.Err(err))
+		}
+	}()
+
+	if err := d.do(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil); err != nil {
+		return errors.Annotate(err, "Docker.Run start")
+	}
+
+	// Buffered, since the logs are abandoned if the job is cancelled
+	stderrTail := make(chan []string, 1)
+	go func() {
+		stderrTail <- d.streamLogs(ctx, t, id)
+	}()
+
+	var wait struct {
+		StatusCode int
+		Error      *struct {
+			Message string
+		}
+	}
+	err = d.do(ctx, http.MethodPost, "/containers/"+id+"/wait", nil, &wait)
+	if ctx.Err() != nil {
+		d.kill(t, id)
+		return errors.Trace(ctx.Err())
+	} else if err != nil {
+		return errors.Annotate(err, "Docker.Run wait")
+	} else if wait.Error != nil && wait.Error.Message != "" {
+		return errors.Errorf("Docker.Run wait: %s", wait.Error.Message)
+	}
+
+	tail := <-stderrTail
+	if wait.StatusCode != 0 {
+		return &ExitError{Code: wait.StatusCode, Output: strings.Join(tail, "\n")}
+	}
+	return nil
+}
+
+func (d *Docker) create(ctx context.Context, name string, t Task) (string, error) {
+	home := CONTAINER_HOME
+	binds := []string{
+		MODEL_CACHE_VOLUME + ":" + home + "/.cache/huggingface",
+		filepath.Dir(t.ImagePath) + ":" + home + "/output",
+	}
+
+	inputPath := ""
+	if t.InputPath != "" {
+		inputPath = home + "/input/" + filepath.Base(t.InputPath)
+		binds = append(binds, t.InputPath+":"+inputPath+":ro")
+	}
+
+	var assetPaths []string
+	for _, a := range t.Assets {
+		p := home + "/assets/" + filepath.Base(a.Path)
+		binds = append(binds, a.Path+":"+p+":ro")
+		assetPaths = append(assetPaths, p)
+	}
+
+	cfg := containerConfig{
+		Image:  d.opts.Image,
+		Cmd:    entrypointArgs(t, inputPath, assetPaths),
+		Labels: map[string]string{CONTAINER_LABEL: d.opts.WorkerID},
+		HostConfig: hostConfig{
+			Binds:  binds,
+			Memory: d.opts.MemoryLimit,
+		},
+	}
+	// The same as --gpus=all
+	if !d.opts.UseCPU {
+		cfg.HostConfig.DeviceRequests = []deviceRequest{{
+			Count:        -1,
+			Capabilities: [][]string{{"gpu"}},
+		}}
+	}
+	t.Logger.Debug("Creating container", "name", name, "image", cfg.Image, "cmd", cfg.Cmd)
+
+	var created struct {
+		Id       string
+		Warnings []string
+	}
+	path := "/containers/create?name=" + url.QueryEscape(name)
+	if err := d.do(ctx, http.MethodPost, path, cfg, &created); err != nil {
+		return "", errors.Trace(err)
+	}
+	for _, w := range created.Warnings {
+		t.Logger.Warn("Docker warning", "warning", w)
+	}
+	return created.Id, nil
+}
+
+// streamLogs logs the container's output and reports progress until it
+// exits, and returns the last lines of stderr.
+func (d *Docker) streamLogs(ctx context.Context, t Task, id string) []string {
+	l := t.Logger
+	resp, err := d.request(ctx, http.MethodGet, "/containers/"+id+"/logs?follow=1&stdout=1&stderr=1", nil)
+	if err != nil {
+		l.Warn("Failed to stream container logs", logging.Err(err))
+		return nil
+	}
+	defer resp.Body.Close()
+
+	stdout, stdoutW := io.Pipe()
+	stderr, stderrW := io.Pipe()
+	go func() {
+		err := demux(resp.Body, stdoutW, stderrW)
+		stdoutW.CloseWithError(err)
+		stderrW.CloseWithError(err)
+	}()
+
+	stdoutDone := make(chan struct{})
+	go func() {
+		defer close(stdoutDone)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			l.Debug("Runner output", "stream", "stdout", "line", scanner.Text())
+		}
+		io.Copy(io.Discard, stdout)
+	}()
+
+	var tail []string
+	progress := newProgressTracker(t.Job.Settings.NumIterations)
+	scanner := bufio.NewScanner(stderr)
+	scanner.Split(scanProgressLines)
+	for scanner.Scan() {
+		line := scanner.Text()
+		l.Debug("Runner output", "stream", "stderr", "line", line)
+
+		if p, ok := progress.parse(line); ok {
+			t.progress(p)
+		} else if line != "" {
+			tail = append(tail, line)
+			if len(tail) > EXIT_OUTPUT_LINES {
+				tail = tail[1:]
+			}
+		}
+	}
+	io.Copy(io.Discard, stderr)
+
+	<-stdoutDone
+	return tail
+}
+
+// demux splits a container's log stream. Without a TTY, output comes in
+// frames of an 8 byte header, holding the stream and the payload's size,
+// followed by the payload.
+func demux(r io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+// kill stops a cancelled job's container straight away. ctx is already
+// cancelled, so the request gets its own.
+func (d *Docker) kill(t Task, id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), CLEANUP_TIMEOUT)
+	defer cancel()
+
+	if err := d.do(ctx, http.MethodPost, "/containers/"+id+"/kill", nil, nil); err != nil && !isNotFound(err) {
+		t.Logger.Warn("Failed to kill container", "container", id, logging.Err(err))
+	}
+}
+
+// remove deletes a container, killing it if it's still running.
+func (d *Docker) remove(ctx context.Context, id string) error {
+	err := d.do(ctx, http.MethodDelete, "/containers/"+id+"?force=1", nil, nil)
+	return errors.Trace(err)
+}
+
+// Cleanup removes every container this worker started, which only exist
+// after a crash. It should be called before jobs are run.
+func (d *Docker) Cleanup(ctx context.Context) error {
+	filters, err := json.Marshal(map[string][]string{
+		"label": {CONTAINER_LABEL + "=" + d.opts.WorkerID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var containers []struct {
+		Id string
+	}
+	path := "/containers/json?all=1&filters=" + url.QueryEscape(string(filters))
+	if err := d.do(ctx, http.MethodGet, path, nil, &containers); err != nil {
+		return errors.Annotate(err, "Docker.Cleanup list")
+	}
+
+	for _, c := range containers {
+		if err := d.remove(ctx, c.Id); err != nil && !isNotFound(err) {
+			return errors.Annotate(err, "Docker.Cleanup remove")
+		}
+	}
+	return nil
+}
+
+// Check fails if the docker daemon can't be reached or the image hasn't
+// been built.
+func (d *Docker) Check(ctx context.Context) (interface{}, error) {
+	if err := d.do(ctx, http.MethodGet, "/_ping", nil, nil); err != nil {
+		return nil, errors.Annotate(err, "docker daemon")
+	}
+	if err := d.do(ctx, http.MethodGet, "/images/"+d.opts.Image+"/json", nil, nil); err != nil {
+		return nil, errors.Annotatef(err, "image %s", d.opts.Image)
+	}
+
+	hardware := "gpu"
+	if d.opts.UseCPU {
+		hardware = "cpu"
+	}
+	return map[string]interface{}{
+		"image":    d.opts.Image,
+		"hardware": hardware,
+	}, nil
+}
+
+// do sends body as JSON and decodes the JSON response into out. Either can
+// be nil.
+func (d *Docker) do(ctx context.Context, method, path string, body, out interface{}) error {
+	resp, err := d.request(ctx, method, path, body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return errors.Trace(json.NewDecoder(resp.Body).Decode(out))
+}
+
+// request returns the response to a versioned API request, or an *APIError
+// if the daemon refused it.
+func (d *Docker) request(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	// The host is ignored, since requests go to the socket
+	req, err := http.NewRequestWithContext(ctx, method, "http://docker/"+DOCKER_API_VERSION+path, r)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		var msg struct {
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&msg); err == nil {
+			apiErr.Message = msg.Message
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+func isNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+func containerName(uuid_ uuid.UUID) string {
+	return "ai-art-" + uuid_.String()
+}
@@ -0,0 +1,174 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wellsjo/ai-art/server/asset"
+	"github.com/wellsjo/ai-art/server/events"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/model"
+	"github.com/wellsjo/ai-art/server/runner/runnertest"
+)
+
+const testImage = "stable-diffusion-docker"
+
+func newTestDocker(t *testing.T, opts runnertest.DockerOpts) (*Docker, *runnertest.Docker) {
+	opts.Image = testImage
+	fake := runnertest.NewDocker(t.TempDir(), opts)
+	t.Cleanup(fake.Close)
+
+	d := NewDocker(DockerOpts{
+		Path:        "/src/" + testImage,
+		Socket:      fake.Socket,
+		MemoryLimit: 8 << 30,
+		WorkerID:    "worker-1",
+	})
+	return d, fake
+}
+
+func TestDockerRun(t *testing.T) {
+	d, fake := newTestDocker(t, runnertest.DockerOpts{
+		Stderr: []string{
+			"loading model",
+			" 50%|█████     | 1/2 [00:01<00:01,  1.00it/s]",
+			"100%|██████████| 2/2 [00:02<00:00,  1.00it/s]",
+		},
+	})
+	task, progress := newTestTask(t, job.Settings{
+		Prompt:        "a lighthouse",
+		Mode:          job.ImageToImageMode,
+		NumIterations: 1,
+	})
+	task.InputPath = "/uploads/input"
+	task.Model = model.Default()
+
+	assert.NoError(t, d.Run(context.Background(), task))
+	assert.FileExists(t, task.ImagePath)
+	assert.Equal(t, []events.Progress{events.NewProgress(1, 2), events.NewProgress(2, 2)}, progress())
+
+	containers := fake.Containers()
+	assert.Len(t, containers, 1)
+	c := containers[0]
+	assert.Equal(t, containerName(task.Job.UUID), c.Name)
+	assert.Equal(t, testImage, c.Image)
+	assert.Equal(t, "worker-1", c.Labels[CONTAINER_LABEL])
+	assert.Contains(t, c.Cmd, "/home/huggingface/input/input")
+	assert.Equal(t, []string{"--model", model.DEFAULT_MODEL_SOURCE}, c.Cmd[len(c.Cmd)-2:])
+	assert.Equal(t, []string{
+		"huggingface:/home/huggingface/.cache/huggingface",
+		filepath.Dir(task.ImagePath) + ":/home/huggingface/output",
+		"/uploads/input:/home/huggingface/input/input:ro",
+	}, c.HostConfig.Binds)
+	assert.Equal(t, int64(8<<30), c.HostConfig.Memory)
+	assert.Len(t, c.HostConfig.DeviceRequests, 1)
+	assert.Equal(t, -1, c.HostConfig.DeviceRequests[0].Count)
+	assert.True(t, c.Removed)
+}
+
+func TestDockerAssets(t *testing.T) {
+	d, fake := newTestDocker(t, runnertest.DockerOpts{})
+	task, _ := newTestTask(t, job.Settings{Prompt: "a lighthouse", NumIterations: 1})
+	task.Assets = []Asset{
+		{Asset: asset.Asset{Kind: asset.KindLoRA, FileName: "a.safetensors"}, Path: "/assets/lora/a.safetensors", Weight: 0.6},
+		{Asset: asset.Asset{Kind: asset.KindEmbedding, FileName: "b.pt"}, Path: "/assets/embedding/b.pt", Weight: 1},
+		{Asset: asset.Asset{Kind: asset.KindVAE, FileName: "c.bin"}, Path: "/assets/vae/c.bin", Weight: 1},
+	}
+
+	assert.NoError(t, d.Run(context.Background(), task))
+
+	c := fake.Containers()[0]
+	assert.Equal(t, []string{
+		"--lora", "/home/huggingface/assets/a.safetensors:0.6",
+		"--embedding", "/home/huggingface/assets/b.pt",
+		"--vae", "/home/huggingface/assets/c.bin",
+	}, c.Cmd[len(c.Cmd)-6:])
+	assert.Equal(t, []string{
+		"/assets/lora/a.safetensors:/home/huggingface/assets/a.safetensors:ro",
+		"/assets/embedding/b.pt:/home/huggingface/assets/b.pt:ro",
+		"/assets/vae/c.bin:/home/huggingface/assets/c.bin:ro",
+	}, c.HostConfig.Binds[2:])
+}
+
+func TestDockerExitError(t *testing.T) {
+	d, fake := newTestDocker(t, runnertest.DockerOpts{
+		Stderr:   []string{"CUDA out of memory"},
+		ExitCode: 1,
+	})
+	task, _ := newTestTask(t, job.Settings{Prompt: "a lighthouse"})
+
+	err := d.Run(context.Background(), task)
+	var exitErr *ExitError
+	assert.ErrorAs(t, err, &exitErr)
+	assert.Equal(t, 1, exitErr.Code)
+	assert.Equal(t, "CUDA out of memory", exitErr.Output)
+	assert.True(t, fake.Containers()[0].Removed)
+}
+
+func TestDockerCancel(t *testing.T) {
+	d, fake := newTestDocker(t, runnertest.DockerOpts{Duration: time.Minute})
+	task, _ := newTestTask(t, job.Settings{Prompt: "a lighthouse"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := d.Run(ctx, task)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	c := fake.Containers()[0]
+	assert.True(t, c.Killed)
+	assert.True(t, c.Removed)
+}
+
+func TestDockerCleanup(t *testing.T) {
+	d, fake := newTestDocker(t, runnertest.DockerOpts{})
+	fake.AddContainer("ours", map[string]string{CONTAINER_LABEL: "worker-1"})
+	fake.AddContainer("other-worker", map[string]string{CONTAINER_LABEL: "worker-2"})
+	fake.AddContainer("unrelated", nil)
+
+	// Left by a crash while running this job
+	task, _ := newTestTask(t, job.Settings{Prompt: "a lighthouse"})
+	fake.AddContainer(containerName(task.Job.UUID), nil)
+
+	assert.NoError(t, d.Cleanup(context.Background()))
+	assert.NoError(t, d.Run(context.Background(), task))
+
+	removed := map[string]bool{}
+	for _, c := range fake.Containers() {
+		removed[c.Name] = c.Removed
+	}
+	assert.Equal(t, map[string]bool{
+		"ours":                       true,
+		"other-worker":               false,
+		"unrelated":                  false,
+		containerName(task.Job.UUID): true,
+	}, removed)
+}
+
+func TestDockerCheck(t *testing.T) {
+	d, fake := newTestDocker(t, runnertest.DockerOpts{})
+
+	details, err := d.Check(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"image": testImage, "hardware": "gpu"}, details)
+
+	missing := NewDocker(DockerOpts{Image: "missing", Socket: fake.Socket})
+	_, err = missing.Check(context.Background())
+	assert.True(t, isNotFound(err))
+}
+
+func TestDemux(t *testing.T) {
+	stream := []byte{
+		1, 0, 0, 0, 0, 0, 0, 3, 'o', 'u', 't',
+		2, 0, 0, 0, 0, 0, 0, 3, 'e', 'r', 'r',
+	}
+
+	var stdout, stderr bytes.Buffer
+	assert.NoError(t, demux(bytes.NewReader(stream), &stdout, &stderr))
+	assert.Equal(t, "out", stdout.String())
+	assert.Equal(t, "err", stderr.String())
+}
@@ -0,0 +1,325 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/asset"
+	"github.com/wellsjo/ai-art/server/events"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/logging"
+)
+
+const (
+	DEFAULT_RUNNER_URL        = "http://127.0.0.1:7860"
+	DEFAULT_PROGRESS_INTERVAL = time.Second
+	// INTERRUPT_TIMEOUT bounds the request that stops a cancelled job.
+	INTERRUPT_TIMEOUT = 5 * time.Second
+)
+
+// IMAGE_TO_IMAGE_STRENGTH matches the strength build.sh is run with.
+const IMAGE_TO_IMAGE_STRENGTH = 0.5
+
+type HTTPOpts struct {
+	// URL is the model server's base URL.
+	URL              string
+	ProgressInterval time.Duration
+}
+
+// HTTP sends jobs to a model server that keeps the model loaded between jobs.
+// It speaks the AUTOMATIC1111 web UI API (/sdapi/v1), which other servers
+// implement as well.
+type HTTP struct {
+	opts   HTTPOpts
+	client *http.Client
+}
+
+func NewHTTP(opts HTTPOpts) *HTTP {
+	if opts.URL == "" {
+		opts.URL = DEFAULT_RUNNER_URL
+	}
+	if opts.ProgressInterval == 0 {
+		opts.ProgressInterval = DEFAULT_PROGRESS_INTERVAL
+	}
+	opts.URL = strings.TrimSuffix(opts.URL, "/")
+
+	return &HTTP{
+		opts: opts,
+		// Jobs can take minutes, so requests are bounded by their context
+		client: &http.Client{},
+	}
+}
+
+type generateRequest struct {
+	Prompt            string   `json:"prompt"`
+	Width             int      `json:"width"`
+	Height            int      `json:"height"`
+	Steps             int      `json:"steps,omitempty"`
+	CFGScale          float64  `json:"cfg_scale,omitempty"`
+	Seed              int64    `json:"seed"`
+	NIter             int      `json:"n_iter"`
+	BatchSize         int      `json:"batch_size"`
+	InitImages        []string `json:"init_images,omitempty"`
+	DenoisingStrength float64  `json:"denoising_strength,omitempty"`
+	// OverrideSettings switches the server's checkpoint to the task's model.
+	// It is kept loaded afterwards, so the next job with the same model
+	// doesn't wait for it.
+	OverrideSettings        map[string]string `json:"override_settings,omitempty"`
+	OverrideSettingsRestore bool              `json:"override_settings_restore_afterwards"`
+}
+
+type generateResponse struct {
+	Images []string `json:"images"`
+}
+
+// upscaleRequest is for the extras endpoint, which runs upscalers on their
+// own.
+type upscaleRequest struct {
+	Image           string `json:"image"`
+	Upscaler        string `json:"upscaler_1"`
+	UpscalingResize int    `json:"upscaling_resize"`
+}
+
+type upscaleResponse struct {
+	Image string `json:"image"`
+}
+
+type progressResponse struct {
+	Progress float64 `json:"progress"`
+	State    struct {
+		JobCount      int `json:"job_count"`
+		JobNo         int `json:"job_no"`
+		SamplingStep  int `json:"sampling_step"`
+		SamplingSteps int `json:"sampling_steps"`
+	} `json:"state"`
+}
+
+// Run posts the job and waits for its images, polling for progress
+// meanwhile. If ctx is cancelled the server is told to stop. Only the first
+// image returned is saved.
+func (h *HTTP) Run(ctx context.Context, t Task) error {
+	j := t.Job
+	if j.Settings.Mode == job.UpscaleMode {
+		return h.upscale(ctx, t)
+	}
+
+	req := generateRequest{
+		Prompt:    j.Settings.Prompt,
+		Width:     j.Settings.Width,
+		Height:    j.Settings.Height,
+		Steps:     j.Settings.Steps,
+		CFGScale:  j.Settings.Scale,
+		Seed:      -1,
+		NIter:     j.Settings.NumIterations,
+		BatchSize: 1,
+	}
+	if j.Settings.Seed > 0 {
+		req.Seed = j.Settings.Seed
+	}
+	if t.Model.Source != "" {
+		req.OverrideSettings = map[string]string{"sd_model_checkpoint": t.Model.Source}
+	}
+	addAssets(&req, t.Assets)
+
+	path := "/sdapi/v1/txt2img"
+	if j.Settings.Mode == job.ImageToImageMode {
+		b, err := os.ReadFile(t.InputPath)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		path = "/sdapi/v1/img2img"
+		req.InitImages = []string{base64.StdEncoding.EncodeToString(b)}
+		req.DenoisingStrength = IMAGE_TO_IMAGE_STRENGTH
+	}
+
+	pollDone := make(chan struct{})
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		h.pollProgress(ctx, t, pollDone)
+	}()
+
+	var resp generateResponse
+	err := h.do(ctx, http.MethodPost, path, req, &resp)
+	close(pollDone)
+	<-polled
+
+	if ctx.Err() != nil {
+		h.interrupt(t)
+		return errors.Trace(ctx.Err())
+	} else if err != nil {
+		return errors.Annotate(err, "HTTP.Run")
+	}
+
+	if len(resp.Images) == 0 {
+		return errors.New("model server returned no images")
+	}
+	img, err := decodeImage(resp.Images[0])
+	if err != nil {
+		return errors.Annotate(err, "HTTP.Run decode")
+	}
+	return errors.Trace(os.WriteFile(t.ImagePath, img, 0644))
+}
+
+// upscale has no progress to poll, and can't be interrupted.
+func (h *HTTP) upscale(ctx context.Context, t Task) error {
+	b, err := os.ReadFile(t.InputPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	req := upscaleRequest{
+		Image:           base64.StdEncoding.EncodeToString(b),
+		Upscaler:        t.Job.Settings.Upscaler,
+		UpscalingResize: t.Job.Settings.UpscaleFactor,
+	}
+
+	var resp upscaleResponse
+	if err := h.do(ctx, http.MethodPost, "/sdapi/v1/extra-single-image", req, &resp); ctx.Err() != nil {
+		return errors.Trace(ctx.Err())
+	} else if err != nil {
+		return errors.Annotate(err, "HTTP.Run upscale")
+	}
+
+	img, err := decodeImage(resp.Image)
+	if err != nil {
+		return errors.Annotate(err, "HTTP.Run decode")
+	}
+	t.progress(events.NewProgress(1, 1))
+	return errors.Trace(os.WriteFile(t.ImagePath, img, 0644))
+}
+
+// addAssets refers to assets by file name the way AUTOMATIC1111 does, with
+// prompt tags for LoRAs and embeddings and a setting for the VAE. The server
+// must have the same files in its own model directories.
+func addAssets(req *generateRequest, assets []Asset) {
+	for _, a := range assets {
+		name := strings.TrimSuffix(a.FileName, filepath.Ext(a.FileName))
+		switch a.Kind {
+		case asset.KindLoRA:
+			req.Prompt += fmt.Sprintf(" <lora:%s:%g>", name, a.Weight)
+		case asset.KindEmbedding:
+			req.Prompt += " " + name
+		case asset.KindVAE:
+			if req.OverrideSettings == nil {
+				req.OverrideSettings = map[string]string{}
+			}
+			req.OverrideSettings["sd_vae"] = a.FileName
+		}
+	}
+}
+
+func (h *HTTP) pollProgress(ctx context.Context, t Task, done chan struct{}) {
+	ticker := time.NewTicker(h.opts.ProgressInterval)
+	defer ticker.Stop()
+
+	lastPercent := -1
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		var resp progressResponse
+		if err := h.do(ctx, http.MethodGet, "/sdapi/v1/progress?skip_current_image=true", nil, &resp); err != nil {
+			t.Logger.Debug("Failed to get progress", logging.Err(err))
+			continue
+		}
+
+		// The state counts iterations and steps, but isn't filled in by
+		// every server
+		var p events.Progress
+		if s := resp.State; s.JobCount > 0 && s.SamplingSteps > 0 {
+			p = events.NewProgress(s.JobNo*s.SamplingSteps+s.SamplingStep, s.JobCount*s.SamplingSteps)
+		} else {
+			p = events.NewProgress(int(resp.Progress*100), 100)
+		}
+		if p.Percent > lastPercent {
+			lastPercent = p.Percent
+			t.progress(p)
+		}
+	}
+}
+
+// interrupt stops the job the server is working on. ctx is already
+// cancelled, so the request gets its own.
+func (h *HTTP) interrupt(t Task) {
+	ctx, cancel := context.WithTimeout(context.Background(), INTERRUPT_TIMEOUT)
+	defer cancel()
+
+	if err := h.do(ctx, http.MethodPost, "/sdapi/v1/interrupt", nil, nil); err != nil {
+		t.Logger.Warn("Failed to interrupt model server", logging.Err(err))
+	}
+}
+
+// Check fails if the model server can't be reached, and otherwise reports
+// the model it has loaded.
+func (h *HTTP) Check(ctx context.Context) (interface{}, error) {
+	var options struct {
+		Model string `json:"sd_model_checkpoint"`
+	}
+	if err := h.do(ctx, http.MethodGet, "/sdapi/v1/options", nil, &options); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return map[string]interface{}{
+		"url":   h.opts.URL,
+		"model": options.Model,
+	}, nil
+}
+
+// do sends body as JSON and decodes the JSON response into out. Either can
+// be nil.
+func (h *HTTP) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, h.opts.URL+path, r)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("%s %s: %d %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return errors.Trace(json.NewDecoder(resp.Body).Decode(out))
+}
+
+// decodeImage accepts plain base64 or a data URL.
+func decodeImage(s string) ([]byte, error) {
+	if i := strings.Index(s, ","); i >= 0 && strings.HasPrefix(s, "data:") {
+		s = s[i+1:]
+	}
+	b, err := base64.StdEncoding.DecodeString(s)
+	return b, errors.Trace(err)
+}
@@ -0,0 +1,212 @@
+package runner
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/wellsjo/ai-art/server/asset"
+	"github.com/wellsjo/ai-art/server/events"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/model"
+	"github.com/wellsjo/ai-art/server/runner/runnertest"
+)
+
+func newTestTask(t *testing.T, settings job.Settings) (Task, func() []events.Progress) {
+	var (
+		mtx      sync.Mutex
+		progress []events.Progress
+	)
+
+	task := Task{
+		Job:       job.Job{UUID: uuid.New(), Settings: settings},
+		ImagePath: filepath.Join(t.TempDir(), "out.png"),
+		Logger:    slog.Default(),
+		Progress: func(p events.Progress) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			progress = append(progress, p)
+		},
+	}
+	return task, func() []events.Progress {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return append([]events.Progress(nil), progress...)
+	}
+}
+
+func writeTestPNG(t *testing.T, path string, width, height int) {
+	f, err := os.Create(path)
+	assert.NoError(t, err)
+	defer f.Close()
+	assert.NoError(t, png.Encode(f, image.NewRGBA(image.Rect(0, 0, width, height))))
+}
+
+func TestHTTPRun(t *testing.T) {
+	srv := runnertest.NewServer(5 * time.Millisecond)
+	defer srv.Close()
+
+	h := NewHTTP(HTTPOpts{URL: srv.URL, ProgressInterval: time.Millisecond})
+	task, progress := newTestTask(t, job.Settings{
+		Prompt:        "a lighthouse",
+		Width:         64,
+		Height:        32,
+		Steps:         5,
+		NumIterations: 2,
+	})
+	task.Model = model.Default()
+
+	assert.NoError(t, h.Run(context.Background(), task))
+
+	f, err := os.Open(task.ImagePath)
+	assert.NoError(t, err)
+	defer f.Close()
+	cfg, err := png.DecodeConfig(f)
+	assert.NoError(t, err)
+	assert.Equal(t, 64, cfg.Width)
+	assert.Equal(t, 32, cfg.Height)
+
+	reqs := srv.Requests()
+	assert.Len(t, reqs, 1)
+	assert.Equal(t, "/sdapi/v1/txt2img", reqs[0].Path)
+	assert.Equal(t, "a lighthouse", reqs[0].Prompt)
+	assert.Equal(t, int64(-1), reqs[0].Seed)
+	assert.Equal(t, 2, reqs[0].NIter)
+	assert.Empty(t, reqs[0].InitImages)
+	assert.Equal(t, map[string]string{"sd_model_checkpoint": model.DEFAULT_MODEL_SOURCE}, reqs[0].OverrideSettings)
+
+	ps := progress()
+	assert.NotEmpty(t, ps)
+	for i := 1; i < len(ps); i++ {
+		assert.Greater(t, ps[i].Percent, ps[i-1].Percent)
+	}
+	for _, p := range ps {
+		assert.Equal(t, 10, p.Total)
+	}
+}
+
+func TestHTTPAssets(t *testing.T) {
+	srv := runnertest.NewServer(0)
+	defer srv.Close()
+
+	h := NewHTTP(HTTPOpts{URL: srv.URL, ProgressInterval: time.Millisecond})
+	task, _ := newTestTask(t, job.Settings{Prompt: "a lighthouse", NumIterations: 1})
+	task.Assets = []Asset{
+		{Asset: asset.Asset{Kind: asset.KindLoRA, FileName: "a.safetensors"}, Weight: 0.6},
+		{Asset: asset.Asset{Kind: asset.KindEmbedding, FileName: "b.pt"}, Weight: 1},
+		{Asset: asset.Asset{Kind: asset.KindVAE, FileName: "c.bin"}, Weight: 1},
+	}
+
+	assert.NoError(t, h.Run(context.Background(), task))
+
+	reqs := srv.Requests()
+	assert.Len(t, reqs, 1)
+	assert.Equal(t, "a lighthouse <lora:a:0.6> b", reqs[0].Prompt)
+	assert.Equal(t, map[string]string{"sd_vae": "c.bin"}, reqs[0].OverrideSettings)
+}
+
+func TestHTTPUpscale(t *testing.T) {
+	srv := runnertest.NewServer(0)
+	defer srv.Close()
+
+	h := NewHTTP(HTTPOpts{URL: srv.URL})
+	upscale, err := job.NewUpscale(job.Settings{UpscaleFactor: 3}, 16, 8)
+	assert.NoError(t, err)
+	task, progress := newTestTask(t, upscale.Settings)
+	task.InputPath = filepath.Join(t.TempDir(), "input.png")
+	writeTestPNG(t, task.InputPath, 16, 8)
+
+	assert.NoError(t, h.Run(context.Background(), task))
+
+	f, err := os.Open(task.ImagePath)
+	assert.NoError(t, err)
+	defer f.Close()
+	cfg, err := png.DecodeConfig(f)
+	assert.NoError(t, err)
+	assert.Equal(t, 48, cfg.Width)
+	assert.Equal(t, 24, cfg.Height)
+
+	reqs := srv.Requests()
+	assert.Len(t, reqs, 1)
+	assert.Equal(t, "/sdapi/v1/extra-single-image", reqs[0].Path)
+	assert.Equal(t, job.DEFAULT_UPSCALER, reqs[0].Upscaler)
+	assert.Equal(t, 3, reqs[0].UpscalingResize)
+	assert.Equal(t, []events.Progress{events.NewProgress(1, 1)}, progress())
+}
+
+func TestHTTPImageToImage(t *testing.T) {
+	srv := runnertest.NewServer(0)
+	defer srv.Close()
+
+	h := NewHTTP(HTTPOpts{URL: srv.URL})
+	task, _ := newTestTask(t, job.Settings{
+		Prompt: "a lighthouse",
+		Mode:   job.ImageToImageMode,
+		Seed:   42,
+	})
+	task.InputPath = filepath.Join(t.TempDir(), "in")
+	assert.NoError(t, os.WriteFile(task.InputPath, []byte("input"), 0644))
+
+	assert.NoError(t, h.Run(context.Background(), task))
+
+	reqs := srv.Requests()
+	assert.Len(t, reqs, 1)
+	assert.Equal(t, "/sdapi/v1/img2img", reqs[0].Path)
+	assert.Equal(t, []string{"aW5wdXQ="}, reqs[0].InitImages)
+	assert.Equal(t, IMAGE_TO_IMAGE_STRENGTH, reqs[0].DenoisingStrength)
+	assert.Equal(t, int64(42), reqs[0].Seed)
+}
+
+func TestHTTPCancel(t *testing.T) {
+	srv := runnertest.NewServer(time.Second)
+	defer srv.Close()
+
+	h := NewHTTP(HTTPOpts{URL: srv.URL})
+	task, _ := newTestTask(t, job.Settings{Prompt: "a lighthouse", Steps: 50})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := h.Run(ctx, task)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.True(t, srv.Interrupted())
+	assert.NoFileExists(t, task.ImagePath)
+}
+
+func TestHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of memory", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	h := NewHTTP(HTTPOpts{URL: srv.URL})
+	task, _ := newTestTask(t, job.Settings{Prompt: "a lighthouse"})
+
+	err := h.Run(context.Background(), task)
+	assert.ErrorContains(t, err, "out of memory")
+
+	_, err = h.Check(context.Background())
+	assert.Error(t, err)
+}
+
+func TestHTTPCheck(t *testing.T) {
+	srv := runnertest.NewServer(0)
+	defer srv.Close()
+
+	details, err := NewHTTP(HTTPOpts{URL: srv.URL + "/"}).Check(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"url":   srv.URL,
+		"model": runnertest.FAKE_MODEL,
+	}, details)
+}
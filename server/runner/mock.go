@@ -0,0 +1,39 @@
+package runner
+
+import (
+	"context"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/events"
+)
+
+const (
+	MOCK_STEPS         = 10
+	MOCK_STEP_DURATION = 300 * time.Millisecond
+)
+
+// Mock pretends to render jobs, for testing without stable diffusion. It
+// doesn't write an image.
+type Mock struct{}
+
+func NewMock() *Mock {
+	return &Mock{}
+}
+
+func (m *Mock) Run(ctx context.Context, t Task) error {
+	for i := 1; i <= MOCK_STEPS; i++ {
+		select {
+		case <-time.After(MOCK_STEP_DURATION):
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		}
+		t.Logger.Debug("Mock step", "step", i, "total", MOCK_STEPS)
+		t.progress(events.NewProgress(i, MOCK_STEPS))
+	}
+	return nil
+}
+
+func (m *Mock) Check(ctx context.Context) (interface{}, error) {
+	return "mocked", nil
+}
@@ -0,0 +1,72 @@
+package runner
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+
+	"github.com/wellsjo/ai-art/server/events"
+)
+
+// Matches the counter of a tqdm progress bar, e.g.
+// " 40%|████      | 20/50 [00:05<00:07,  4.00it/s]"
+var tqdmCounter = regexp.MustCompile(`(\d+)/(\d+) \[`)
+
+// progressTracker turns the per-iteration progress bars printed by the
+// diffusers pipeline into progress for the whole job.
+type progressTracker struct {
+	numIterations int
+	iteration     int
+	lastStep      int
+	lastPercent   int
+}
+
+func newProgressTracker(numIterations int) *progressTracker {
+	if numIterations < 1 {
+		numIterations = 1
+	}
+	return &progressTracker{numIterations: numIterations, lastPercent: -1}
+}
+
+// parse returns the job's progress if line moves it forward by at least a
+// percent.
+func (p *progressTracker) parse(line string) (events.Progress, bool) {
+	m := tqdmCounter.FindStringSubmatch(line)
+	if m == nil {
+		return events.Progress{}, false
+	}
+	step, _ := strconv.Atoi(m[1])
+	total, _ := strconv.Atoi(m[2])
+	if total == 0 {
+		return events.Progress{}, false
+	}
+
+	// Each iteration starts a new bar
+	if step < p.lastStep && p.iteration < p.numIterations-1 {
+		p.iteration++
+	}
+	p.lastStep = step
+
+	progress := events.NewProgress(p.iteration*total+step, p.numIterations*total)
+	if progress.Percent <= p.lastPercent {
+		return events.Progress{}, false
+	}
+	p.lastPercent = progress.Percent
+
+	return progress, true
+}
+
+// scanProgressLines is a bufio.SplitFunc that also splits on the carriage
+// returns tqdm uses to redraw its bars.
+func scanProgressLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
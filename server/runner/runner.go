@@ -0,0 +1,50 @@
+// Package runner renders the images for jobs, either with the stable
+// diffusion container started per job or by a model server that stays up.
+package runner
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/wellsjo/ai-art/server/asset"
+	"github.com/wellsjo/ai-art/server/events"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/model"
+)
+
+// Task is a job to render.
+type Task struct {
+	Job job.Job
+	// Model is the registered model the job renders with.
+	Model  model.Model
+	Assets []Asset
+	// ImagePath is where the finished image is written.
+	ImagePath string
+	// InputPath is the source image of an image-to-image job.
+	InputPath string
+	Logger    *slog.Logger
+	// Progress is called as the job moves forward.
+	Progress func(events.Progress)
+}
+
+// Asset is an uploaded file a task renders with.
+type Asset struct {
+	asset.Asset
+	// Path is where the file is on this machine.
+	Path   string
+	Weight float64
+}
+
+type Runner interface {
+	// Run renders a task's image. It stops early if ctx is cancelled.
+	Run(ctx context.Context, t Task) error
+	// Check fails if the runner can't take jobs. It is used by the readiness
+	// check, so it should be quick.
+	Check(ctx context.Context) (interface{}, error)
+}
+
+func (t Task) progress(p events.Progress) {
+	if t.Progress != nil {
+		t.Progress(p)
+	}
+}
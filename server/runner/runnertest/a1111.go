@@ -0,0 +1,237 @@
+// Package runnertest provides fakes of the services runners talk to: a
+// model server for the HTTP runner and a docker daemon for the docker
+// runner.
+package runnertest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_STEPS = 20
+	FAKE_MODEL    = "fake.safetensors"
+)
+
+// Request is what the server was asked to render.
+type Request struct {
+	Path              string
+	Prompt            string            `json:"prompt"`
+	Width             int               `json:"width"`
+	Height            int               `json:"height"`
+	Steps             int               `json:"steps"`
+	CFGScale          float64           `json:"cfg_scale"`
+	Seed              int64             `json:"seed"`
+	NIter             int               `json:"n_iter"`
+	BatchSize         int               `json:"batch_size"`
+	InitImages        []string          `json:"init_images"`
+	DenoisingStrength float64           `json:"denoising_strength"`
+	OverrideSettings  map[string]string `json:"override_settings"`
+	// Image, Upscaler and UpscalingResize are sent to upscale.
+	Image           string `json:"image"`
+	Upscaler        string `json:"upscaler_1"`
+	UpscalingResize int    `json:"upscaling_resize"`
+}
+
+type state struct {
+	JobCount      int `json:"job_count"`
+	JobNo         int `json:"job_no"`
+	SamplingStep  int `json:"sampling_step"`
+	SamplingSteps int `json:"sampling_steps"`
+}
+
+// Server is a fake AUTOMATIC1111 web UI API. It takes stepDuration per step
+// and renders blank images of the requested size. Upscaling is immediate.
+type Server struct {
+	*httptest.Server
+	stepDuration time.Duration
+
+	mtx         sync.Mutex
+	requests    []Request
+	state       state
+	interrupted bool
+	interrupt   chan struct{}
+}
+
+func NewServer(stepDuration time.Duration) *Server {
+	s := &Server{
+		stepDuration: stepDuration,
+		interrupt:    make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sdapi/v1/txt2img", s.generate)
+	mux.HandleFunc("/sdapi/v1/img2img", s.generate)
+	mux.HandleFunc("/sdapi/v1/extra-single-image", s.upscale)
+	mux.HandleFunc("/sdapi/v1/progress", s.progress)
+	mux.HandleFunc("/sdapi/v1/interrupt", s.stop)
+	mux.HandleFunc("/sdapi/v1/options", s.options)
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Requests returns every render request received, in order.
+func (s *Server) Requests() []Request {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return append([]Request(nil), s.requests...)
+}
+
+// Interrupted reports whether a client asked the server to stop.
+func (s *Server) Interrupted() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.interrupted
+}
+
+func (s *Server) generate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := Request{Path: r.URL.Path}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Steps == 0 {
+		req.Steps = DEFAULT_STEPS
+	}
+	if req.NIter == 0 {
+		req.NIter = 1
+	}
+	if req.Width == 0 || req.Height == 0 {
+		req.Width, req.Height = 512, 512
+	}
+
+	s.mtx.Lock()
+	s.requests = append(s.requests, req)
+	s.state = state{JobCount: req.NIter, SamplingSteps: req.Steps}
+	s.mtx.Unlock()
+
+	// Like the real server, an interrupted job still returns what it has
+render:
+	for i := 0; i < req.NIter; i++ {
+		for step := 1; step <= req.Steps; step++ {
+			select {
+			case <-time.After(s.stepDuration):
+			case <-s.interrupt:
+				break render
+			case <-r.Context().Done():
+				return
+			}
+
+			s.mtx.Lock()
+			s.state.JobNo, s.state.SamplingStep = i, step
+			s.mtx.Unlock()
+		}
+	}
+
+	img, err := blankPNG(req.Width, req.Height)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	images := make([]string, req.NIter)
+	for i := range images {
+		images[i] = img
+	}
+	writeJSON(w, map[string]interface{}{"images": images})
+}
+
+// upscale returns a blank image of the upscaled size.
+func (s *Server) upscale(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := Request{Path: r.URL.Path}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	b, err := base64.StdEncoding.DecodeString(req.Image)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	s.mtx.Lock()
+	s.requests = append(s.requests, req)
+	s.mtx.Unlock()
+
+	img, err := blankPNG(cfg.Width*req.UpscalingResize, cfg.Height*req.UpscalingResize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"image": img})
+}
+
+func (s *Server) progress(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	st := s.state
+	s.mtx.Unlock()
+
+	var progress float64
+	if total := st.JobCount * st.SamplingSteps; total > 0 {
+		progress = float64(st.JobNo*st.SamplingSteps+st.SamplingStep) / float64(total)
+	}
+	writeJSON(w, map[string]interface{}{
+		"progress": progress,
+		"state":    st,
+	})
+}
+
+func (s *Server) stop(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !s.interrupted {
+		s.interrupted = true
+		close(s.interrupt)
+	}
+	writeJSON(w, map[string]interface{}{})
+}
+
+func (s *Server) options(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{"sd_model_checkpoint": FAKE_MODEL})
+}
+
+func blankPNG(width, height int) (string, error) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.White)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,368 @@
+package runnertest
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DockerOpts decide how the fake daemon's containers behave.
+type DockerOpts struct {
+	// Image is the only image that exists.
+	Image string
+	// Stderr is written by every container as soon as it starts.
+	Stderr []string
+	// Duration is how long containers run for.
+	Duration time.Duration
+	ExitCode int
+}
+
+// Container is a container the fake daemon was asked to create.
+type Container struct {
+	ID         string
+	Name       string
+	Image      string
+	Cmd        []string
+	Labels     map[string]string
+	HostConfig struct {
+		Binds          []string
+		Memory         int64
+		DeviceRequests []struct {
+			Count        int
+			Capabilities [][]string
+		}
+	}
+	Started bool
+	Killed  bool
+	Removed bool
+
+	exitCode int
+	exited   chan struct{}
+	kill     chan struct{}
+}
+
+// Docker is a fake docker daemon listening on a unix socket. Containers
+// write an empty file named by the --output argument to the directory bound
+// to the image's output directory, and then exit.
+type Docker struct {
+	Socket string
+	opts   DockerOpts
+	srv    *httptest.Server
+
+	mtx        sync.Mutex
+	containers []*Container
+}
+
+// NewDocker listens on a socket in dir.
+func NewDocker(dir string, opts DockerOpts) *Docker {
+	d := &Docker{
+		Socket: filepath.Join(dir, "docker.sock"),
+		opts:   opts,
+	}
+
+	l, err := net.Listen("unix", d.Socket)
+	if err != nil {
+		panic(fmt.Sprintf("runnertest: failed to listen on %s: %v", d.Socket, err))
+	}
+	d.srv = httptest.NewUnstartedServer(http.HandlerFunc(d.handle))
+	d.srv.Listener = l
+	d.srv.Start()
+
+	return d
+}
+
+func (d *Docker) Close() {
+	d.srv.Close()
+}
+
+// Containers returns a copy of every container created, in order.
+func (d *Docker) Containers() []Container {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	containers := make([]Container, len(d.containers))
+	for i, c := range d.containers {
+		containers[i] = *c
+	}
+	return containers
+}
+
+// AddContainer adds a stopped container, as if it was left by a crash.
+func (d *Docker) AddContainer(name string, labels map[string]string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	c := d.newContainer(name)
+	c.Labels = labels
+	close(c.exited)
+}
+
+func (d *Docker) newContainer(name string) *Container {
+	c := &Container{
+		ID:     fmt.Sprintf("container%d", len(d.containers)+1),
+		Name:   name,
+		exited: make(chan struct{}),
+		kill:   make(chan struct{}),
+	}
+	d.containers = append(d.containers, c)
+	return c
+}
+
+// find returns the container with an ID or name that hasn't been removed.
+func (d *Docker) find(idOrName string) *Container {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	for _, c := range d.containers {
+		if !c.Removed && (c.ID == idOrName || c.Name == idOrName) {
+			return c
+		}
+	}
+	return nil
+}
+
+func (d *Docker) handle(w http.ResponseWriter, r *http.Request) {
+	// Requests are prefixed by the API version
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 {
+		apiError(w, http.StatusNotFound, "page not found")
+		return
+	}
+	parts = parts[1:]
+
+	switch {
+	case parts[0] == "_ping":
+		w.Write([]byte("OK"))
+
+	case parts[0] == "images" && len(parts) == 3:
+		if parts[1] != d.opts.Image {
+			apiError(w, http.StatusNotFound, "No such image: "+parts[1])
+			return
+		}
+		writeJSON(w, map[string]interface{}{"Id": "sha256:fake"})
+
+	case parts[0] == "containers" && len(parts) == 2 && parts[1] == "create":
+		d.create(w, r)
+
+	case parts[0] == "containers" && len(parts) == 2 && parts[1] == "json":
+		d.list(w, r)
+
+	case parts[0] == "containers" && len(parts) >= 2:
+		c := d.find(parts[1])
+		if c == nil {
+			apiError(w, http.StatusNotFound, "No such container: "+parts[1])
+			return
+		}
+
+		action := ""
+		if len(parts) == 3 {
+			action = parts[2]
+		}
+		switch {
+		case action == "" && r.Method == http.MethodDelete:
+			d.remove(w, c)
+		case action == "start":
+			d.start(w, c)
+		case action == "wait":
+			d.wait(w, r, c)
+		case action == "logs":
+			d.logs(w, r, c)
+		case action == "kill":
+			d.kill(w, c)
+		default:
+			apiError(w, http.StatusNotFound, "page not found")
+		}
+
+	default:
+		apiError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+func (d *Docker) create(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if d.find(name) != nil {
+		apiError(w, http.StatusConflict, "Conflict. The container name is already in use")
+		return
+	}
+
+	var cfg Container
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if cfg.Image != d.opts.Image {
+		apiError(w, http.StatusNotFound, "No such image: "+cfg.Image)
+		return
+	}
+
+	d.mtx.Lock()
+	c := d.newContainer(name)
+	c.Image, c.Cmd, c.Labels, c.HostConfig = cfg.Image, cfg.Cmd, cfg.Labels, cfg.HostConfig
+	d.mtx.Unlock()
+
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, map[string]interface{}{"Id": c.ID, "Warnings": []string{}})
+}
+
+func (d *Docker) list(w http.ResponseWriter, r *http.Request) {
+	var filters struct {
+		Label []string `json:"label"`
+	}
+	json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	list := []map[string]interface{}{}
+	for _, c := range d.containers {
+		if !c.Removed && hasLabels(c, filters.Label) {
+			list = append(list, map[string]interface{}{"Id": c.ID, "Names": []string{"/" + c.Name}})
+		}
+	}
+	writeJSON(w, list)
+}
+
+func (d *Docker) start(w http.ResponseWriter, c *Container) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if c.Started {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	c.Started = true
+
+	go func() {
+		select {
+		case <-time.After(d.opts.Duration):
+			if d.opts.ExitCode == 0 {
+				writeOutput(c)
+			}
+			d.exit(c, d.opts.ExitCode)
+		case <-c.kill:
+			d.exit(c, 137)
+		}
+	}()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Docker) exit(c *Container, code int) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	c.exitCode = code
+	close(c.exited)
+}
+
+func (d *Docker) wait(w http.ResponseWriter, r *http.Request, c *Container) {
+	select {
+	case <-c.exited:
+	case <-r.Context().Done():
+		return
+	}
+
+	d.mtx.Lock()
+	code := c.exitCode
+	d.mtx.Unlock()
+	writeJSON(w, map[string]interface{}{"StatusCode": code})
+}
+
+// logs sends the container's stderr in frames, and ends once it exits if
+// following.
+func (d *Docker) logs(w http.ResponseWriter, r *http.Request, c *Container) {
+	w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+	for _, line := range d.opts.Stderr {
+		payload := []byte(line + "\n")
+		header := make([]byte, 8)
+		header[0] = 2
+		binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+		w.Write(header)
+		w.Write(payload)
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	if r.URL.Query().Get("follow") != "" {
+		select {
+		case <-c.exited:
+		case <-r.Context().Done():
+		}
+	}
+}
+
+func (d *Docker) kill(w http.ResponseWriter, c *Container) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	select {
+	case <-c.exited:
+		apiError(w, http.StatusConflict, "Container "+c.ID+" is not running")
+		return
+	default:
+	}
+	if !c.Killed {
+		c.Killed = true
+		close(c.kill)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Docker) remove(w http.ResponseWriter, c *Container) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	// Force kills a running container
+	if c.Started && !c.Killed {
+		select {
+		case <-c.exited:
+		default:
+			c.Killed = true
+			close(c.kill)
+		}
+	}
+	c.Removed = true
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func hasLabels(c *Container, labels []string) bool {
+	for _, l := range labels {
+		k, v, _ := strings.Cut(l, "=")
+		if got, ok := c.Labels[k]; !ok || (v != "" && got != v) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeOutput creates the image named by the --output argument in the
+// directory bound to the container's output directory.
+func writeOutput(c *Container) {
+	output := ""
+	for i, arg := range c.Cmd {
+		if arg == "--output" && i+1 < len(c.Cmd) {
+			output = c.Cmd[i+1]
+		}
+	}
+	for _, b := range c.HostConfig.Binds {
+		parts := strings.Split(b, ":")
+		if len(parts) >= 2 && strings.HasSuffix(parts[1], "/output") && output != "" {
+			os.WriteFile(filepath.Join(parts[0], output), nil, 0644)
+		}
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
@@ -0,0 +1,222 @@
+package runner
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/asset"
+	"github.com/wellsjo/ai-art/server/job"
+)
+
+const DOCKER_SOCKET = "/var/run/docker.sock"
+
+type ScriptOpts struct {
+	// Path is the stable diffusion docker checkout containing build.sh.
+	Path   string
+	UseCPU bool
+}
+
+// Script runs every job in a new stable diffusion container, started by
+// build.sh. The script writes images to the output directory under Path, so
+// task image paths must be in that directory.
+type Script struct {
+	opts ScriptOpts
+}
+
+func NewScript(opts ScriptOpts) *Script {
+	return &Script{opts: opts}
+}
+
+// Run starts the container and waits for it to exit. The script is killed if
+// ctx is cancelled.
+func (s *Script) Run(ctx context.Context, t Task) error {
+	l := t.Logger
+
+	cmdName := "./build.sh"
+	cmdFnName := "runWithGPUs"
+	if s.opts.UseCPU {
+		cmdFnName = "runWithoutGPUs"
+	}
+	// The entrypoint looks for input images in the input directory
+	inputPath := ""
+	if t.Job.Settings.Mode != job.TextToImageMode {
+		var err error
+		if inputPath, err = s.inputRel(t.InputPath); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	assetPaths, err := s.assetPaths(t)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	args := append([]string{cmdFnName}, entrypointArgs(t, inputPath, assetPaths)...)
+	l.Debug("Running command", "cmd", cmdName, "args", args)
+
+	cmd := exec.CommandContext(
+		ctx,
+		cmdName,
+		args...,
+	)
+
+	cmd.Dir = s.opts.Path
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Annotate(err, "Script.Run StdoutPipe")
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return errors.Annotate(err, "Script.Run StderrPipe")
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return errors.Annotate(err, "Script.Run Start")
+	}
+
+	// Both pipes must be drained before Wait, or the process can block on a
+	// full pipe.
+	stdoutDone := make(chan struct{})
+	go func() {
+		defer close(stdoutDone)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			l.Debug("Runner output", "stream", "stdout", "line", scanner.Text())
+		}
+	}()
+
+	progress := newProgressTracker(t.Job.Settings.NumIterations)
+	scanner := bufio.NewScanner(stderr)
+	scanner.Split(scanProgressLines)
+	for scanner.Scan() {
+		line := scanner.Text()
+		l.Debug("Runner output", "stream", "stderr", "line", line)
+
+		if p, ok := progress.parse(line); ok {
+			t.progress(p)
+		}
+	}
+
+	<-stdoutDone
+
+	err = cmd.Wait()
+	if err != nil {
+		return errors.Annotate(err, "Script.Run Wait")
+	}
+	return nil
+}
+
+// Check fails if build.sh or the docker daemon are missing.
+func (s *Script) Check(ctx context.Context) (interface{}, error) {
+	entrypoint := filepath.Join(s.opts.Path, "build.sh")
+	if _, err := os.Stat(entrypoint); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if _, err := exec.LookPath("docker"); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if os.Getenv("DOCKER_HOST") == "" {
+		if _, err := os.Stat(DOCKER_SOCKET); err != nil {
+			return nil, errors.Annotate(err, "docker daemon")
+		}
+	}
+
+	if s.opts.UseCPU {
+		return "cpu", nil
+	}
+	return "gpu", nil
+}
+
+// assetPaths finds the task's assets in the container.
+func (s *Script) assetPaths(t Task) ([]string, error) {
+	var paths []string
+	for _, a := range t.Assets {
+		rel, err := s.inputRel(a.Path)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		paths = append(paths, path.Join("input", rel))
+	}
+	return paths, nil
+}
+
+// inputRel returns where a file is in the input directory under Path, which
+// is the only one build.sh mounts besides the output.
+func (s *Script) inputRel(p string) (string, error) {
+	rel, err := filepath.Rel(filepath.Join(s.opts.Path, "input"), p)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", errors.Errorf("%s is not in %s/input", p, s.opts.Path)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// entrypointArgs are the arguments of the stable diffusion image's
+// entrypoint. inputPath is where the entrypoint finds the task's input image,
+// and assetPaths are where it finds each of the task's assets.
+func entrypointArgs(t Task, inputPath string, assetPaths []string) []string {
+	j := t.Job
+	var args []string
+
+	if j.Settings.Mode == job.UpscaleMode {
+		args = append(args,
+			"--upscale", fmt.Sprintf("%d", j.Settings.UpscaleFactor),
+			"--upscaler", j.Settings.Upscaler,
+			"--image", inputPath,
+			"--output", filepath.Base(t.ImagePath),
+		)
+		if j.Settings.Prompt != "" {
+			args = append(args, "--prompt", j.Settings.Prompt)
+		}
+		return args
+	}
+
+	// Image-To-Image Mode
+	if j.Settings.Mode == job.ImageToImageMode {
+		args = append(args,
+			"--image",
+			inputPath,
+			"--strength",
+			"0.5",
+		)
+	}
+
+	args = append(args, []string{
+		j.Settings.Prompt,
+		"--n_iter", fmt.Sprintf("%d", j.Settings.NumIterations),
+		"--output", filepath.Base(t.ImagePath),
+		"--W", fmt.Sprintf("%d", j.Settings.Width),
+		"--H", fmt.Sprintf("%d", j.Settings.Height),
+	}...)
+
+	if j.Settings.Steps > 0 {
+		args = append(args, "--ddim_steps", fmt.Sprintf("%d", j.Settings.Steps))
+	}
+	if j.Settings.Scale > 0 {
+		args = append(args, "--scale", fmt.Sprintf("%g", j.Settings.Scale))
+	}
+	if j.Settings.Seed > 0 {
+		args = append(args, "--seed", fmt.Sprintf("%d", j.Settings.Seed))
+	}
+	if t.Model.Source != "" {
+		args = append(args, "--model", t.Model.Source)
+	}
+	for i, a := range t.Assets {
+		switch a.Kind {
+		case asset.KindLoRA:
+			args = append(args, "--lora", fmt.Sprintf("%s:%g", assetPaths[i], a.Weight))
+		case asset.KindEmbedding:
+			args = append(args, "--embedding", assetPaths[i])
+		case asset.KindVAE:
+			args = append(args, "--vae", assetPaths[i])
+		}
+	}
+	return args
+}
@@ -2,14 +2,18 @@ package s3_manager
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/metrics"
 )
 
 type S3Manager struct {
@@ -47,7 +51,10 @@ func New(opts Opts) (*S3Manager, error) {
 	}, nil
 }
 
-func (s3m *S3Manager) UploadFile(from, to string) error {
+func (s3m *S3Manager) UploadFile(ctx context.Context, from, to string) (err error) {
+	start := time.Now()
+	defer func() { metrics.ObserveS3Upload(start, err) }()
+
 	upFile, err := os.Open(from)
 	if err != nil {
 		return err
@@ -61,7 +68,8 @@ func (s3m *S3Manager) UploadFile(from, to string) error {
 
 	_, err = s3.New(
 		s3m.session,
-	).PutObject(
+	).PutObjectWithContext(
+		ctx,
 		&s3.PutObjectInput{
 			Bucket:               aws.String(s3m.bucket),
 			Key:                  aws.String(to),
@@ -75,3 +83,63 @@ func (s3m *S3Manager) UploadFile(from, to string) error {
 	)
 	return err
 }
+
+func (s3m *S3Manager) DownloadFile(ctx context.Context, key string) ([]byte, error) {
+	out, err := s3.New(
+		s3m.session,
+	).GetObjectWithContext(
+		ctx,
+		&s3.GetObjectInput{
+			Bucket: aws.String(s3m.bucket),
+			Key:    aws.String(key),
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer out.Body.Close()
+
+	b, err := io.ReadAll(out.Body)
+	return b, errors.Trace(err)
+}
+
+// CheckBucket fails if the bucket can't be reached with our credentials.
+func (s3m *S3Manager) CheckBucket(ctx context.Context) error {
+	_, err := s3.New(
+		s3m.session,
+	).HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(s3m.bucket),
+	})
+	return errors.Trace(err)
+}
+
+// DownloadFileTo streams an object to w, for objects too big to hold in
+// memory.
+func (s3m *S3Manager) DownloadFileTo(ctx context.Context, key string, w io.Writer) error {
+	out, err := s3.New(
+		s3m.session,
+	).GetObjectWithContext(
+		ctx,
+		&s3.GetObjectInput{
+			Bucket: aws.String(s3m.bucket),
+			Key:    aws.String(key),
+		},
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer out.Body.Close()
+
+	_, err = io.Copy(w, out.Body)
+	return errors.Trace(err)
+}
+
+func (s3m *S3Manager) DeleteFile(ctx context.Context, key string) error {
+	_, err := s3.New(
+		s3m.session,
+	).DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s3m.bucket),
+		Key:    aws.String(key),
+	})
+	return errors.Trace(err)
+}
@@ -0,0 +1,114 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// APIKeyPrefix is prepended to every issued key so they are easy to spot in
+// logs and config files.
+const APIKeyPrefix = "sds_"
+
+const SessionDuration = 7 * 24 * time.Hour
+
+type User struct {
+	ID       int64     `json:"id"`
+	Username string    `json:"username"`
+	Admin    bool      `json:"admin"`
+	Created  time.Time `json:"created"`
+}
+
+func (u User) String() string {
+	return fmt.Sprintf("%v (%d)", u.Username, u.ID)
+}
+
+// CanAccess reports whether the user may view or modify something owned by
+// ownerID.
+func (u User) CanAccess(ownerID int64) bool {
+	return u.Admin || u.ID == ownerID
+}
+
+type APIKey struct {
+	ID      int64      `json:"id"`
+	UserID  int64      `json:"userID"`
+	Name    string     `json:"name"`
+	Prefix  string     `json:"prefix"`
+	Created time.Time  `json:"created"`
+	Revoked *time.Time `json:"revoked,omitempty"`
+	// CallbackURL receives webhooks for jobs submitted with this key, unless
+	// the job sets its own.
+	CallbackURL string `json:"callbackURL,omitempty"`
+}
+
+func (k APIKey) Active() bool {
+	return k.Revoked == nil
+}
+
+func New(username string, admin bool) (User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return User{}, errors.New("missing username")
+	}
+
+	return User{
+		Username: username,
+		Admin:    admin,
+		Created:  time.Now().Truncate(time.Microsecond).UTC(),
+	}, nil
+}
+
+// NewToken returns a random token and the hash that should be stored in place
+// of it. Tokens are used for both API keys and login sessions.
+func NewToken(prefix string) (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", errors.Trace(err)
+	}
+
+	token := prefix + hex.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func HashPassword(password string) (string, error) {
+	if password == "" {
+		return "", errors.New("missing password")
+	}
+
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return string(b), nil
+}
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// CheckNoPassword takes as long as CheckPassword, and always fails. Logins
+// for users that don't exist use it so they can't be told apart by timing.
+func CheckNoPassword(password string) bool {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+	return false
+}
+
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -0,0 +1,78 @@
+package webhook
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+
+	"github.com/juju/errors"
+)
+
+// CheckURL returns a NotValid error if webhooks can't be sent to url: it
+// isn't http or https, or its host resolves to an address that isn't
+// allowed.
+func (d *Dispatcher) CheckURL(ctx context.Context, s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return errors.NewNotValid(err, "callback url")
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.NotValidf("callback url %q", s)
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil {
+		return errors.NewNotValid(err, "callback url host")
+	}
+	for _, addr := range addrs {
+		if err := d.checkAddr(addr); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// checkAddr refuses loopback, private, link-local and unspecified addresses,
+// so users can't send requests into the network the server runs in, unless
+// they are in one of the AllowedNetworks.
+func (d *Dispatcher) checkAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	for _, n := range d.opts.AllowedNetworks {
+		if n.Contains(addr) {
+			return nil
+		}
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() {
+		return errors.NotValidf("callback address %v", addr)
+	}
+	return nil
+}
+
+// newClient returns a client that checks every address it connects to, so
+// hosts that resolve differently when the delivery is sent, or redirects,
+// can't reach addresses CheckURL refuses.
+func (d *Dispatcher) newClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: d.opts.Timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			return d.checkAddr(addrPort.Addr())
+		},
+	}
+	return &http.Client{
+		Timeout: d.opts.Timeout,
+		Transport: &http.Transport{
+			// A proxy would be dialed instead of the callback host
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: d.opts.Timeout,
+		},
+	}
+}
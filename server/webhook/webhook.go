@@ -0,0 +1,357 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/job"
+	"github.com/wellsjo/ai-art/server/logging"
+)
+
+const (
+	DEFAULT_MAX_ATTEMPTS  = 8
+	DEFAULT_MIN_BACKOFF   = 5 * time.Second
+	DEFAULT_MAX_BACKOFF   = time.Hour
+	DEFAULT_TIMEOUT       = 10 * time.Second
+	DEFAULT_POLL_INTERVAL = time.Second
+	// CLAIM_BATCH is how many deliveries are claimed at once.
+	CLAIM_BATCH = 10
+)
+
+// Headers sent with every delivery. The signature is the hex HMAC-SHA256 of
+// the request body using the shared secret, prefixed with "sha256=".
+const (
+	SignatureHeader = "X-Webhook-Signature-256"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+type Status string
+
+var (
+	StatusPending   Status = "pending"
+	StatusDelivered Status = "delivered"
+	StatusFailed    Status = "failed"
+)
+
+// Delivery is one payload sent to one URL, along with the outcome of the
+// latest attempt.
+type Delivery struct {
+	ID           int64      `json:"id"`
+	JobUUID      uuid.UUID  `json:"jobUUID"`
+	URL          string     `json:"url"`
+	Event        string     `json:"event"`
+	Payload      []byte     `json:"-"`
+	Status       Status     `json:"status"`
+	Attempts     int        `json:"attempts"`
+	ResponseCode int        `json:"responseCode,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+	Created      time.Time  `json:"created"`
+	NextAttempt  *time.Time `json:"nextAttempt,omitempty"`
+	DeliveredAt  *time.Time `json:"deliveredAt,omitempty"`
+}
+
+// Store persists deliveries so they survive restarts and can be inspected.
+type Store interface {
+	AddDelivery(ctx context.Context, d Delivery) (Delivery, error)
+	UpdateDelivery(ctx context.Context, d Delivery) error
+	GetDelivery(ctx context.Context, id int64) (Delivery, bool, error)
+	// ClaimDueDeliveries returns up to limit pending deliveries due at now,
+	// and moves their next attempt to leaseUntil so no one else sends them
+	// meanwhile.
+	ClaimDueDeliveries(ctx context.Context, now, leaseUntil time.Time, limit int) ([]Delivery, error)
+}
+
+// ErrNoSecret is returned instead of sending deliveries without a secret,
+// since anyone could sign them.
+var ErrNoSecret = errors.New("missing webhook secret")
+
+type Opts struct {
+	// Secret signs deliveries. Nothing is sent without one.
+	Secret string
+	// AllowedNetworks are internal networks that deliveries may be sent to.
+	// Loopback, private and link-local addresses are refused otherwise.
+	AllowedNetworks []netip.Prefix
+	MaxAttempts     int
+	MinBackoff      time.Duration
+	MaxBackoff      time.Duration
+	Timeout         time.Duration
+	PollInterval    time.Duration
+}
+
+// Dispatcher sends deliveries in the background, retrying failures with
+// exponential backoff until MaxAttempts is reached.
+type Dispatcher struct {
+	opts   Opts
+	store  Store
+	client *http.Client
+	wake   chan struct{}
+
+	// ctx is cancelled by Close, aborting any delivery in flight.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func New(opts Opts, store Store) *Dispatcher {
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = DEFAULT_MAX_ATTEMPTS
+	}
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = DEFAULT_MIN_BACKOFF
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = DEFAULT_MAX_BACKOFF
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DEFAULT_TIMEOUT
+	}
+	if opts.PollInterval == 0 {
+		opts.PollInterval = DEFAULT_POLL_INTERVAL
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		opts:   opts,
+		store:  store,
+		wake:   make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	d.client = d.newClient()
+	return d
+}
+
+func (d *Dispatcher) Run() {
+	go func() {
+		ticker := time.NewTicker(d.opts.PollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-d.wake:
+			case <-ticker.C:
+			case <-d.ctx.Done():
+				return
+			}
+
+			if err := d.deliverDue(d.ctx); err != nil {
+				slog.Error("Failed to deliver webhooks", logging.Err(err))
+			}
+		}
+	}()
+}
+
+func (d *Dispatcher) Close() {
+	d.cancel()
+}
+
+// Enqueue records a delivery of payload to url and schedules it immediately.
+func (d *Dispatcher) Enqueue(ctx context.Context, jobUUID uuid.UUID, url, event string, payload interface{}) (Delivery, error) {
+	if d.opts.Secret == "" {
+		return Delivery{}, errors.Trace(ErrNoSecret)
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return Delivery{}, errors.Trace(err)
+	}
+
+	now := time.Now().Truncate(time.Microsecond).UTC()
+	dl, err := d.store.AddDelivery(ctx, Delivery{
+		JobUUID:     jobUUID,
+		URL:         url,
+		Event:       event,
+		Payload:     b,
+		Status:      StatusPending,
+		Created:     now,
+		NextAttempt: &now,
+	})
+	if err != nil {
+		return Delivery{}, errors.Trace(err)
+	}
+
+	d.notify()
+	return dl, nil
+}
+
+// Redeliver schedules another round of attempts for a delivery, whatever its
+// current status.
+func (d *Dispatcher) Redeliver(ctx context.Context, id int64) (Delivery, error) {
+	dl, found, err := d.store.GetDelivery(ctx, id)
+	if err != nil {
+		return Delivery{}, errors.Trace(err)
+	}
+	if !found {
+		return Delivery{}, errors.NotFoundf("delivery %d", id)
+	}
+
+	now := time.Now().UTC()
+	dl.Status = StatusPending
+	dl.Attempts = 0
+	dl.NextAttempt = &now
+	if err := d.store.UpdateDelivery(ctx, dl); err != nil {
+		return Delivery{}, errors.Trace(err)
+	}
+
+	d.notify()
+	return dl, nil
+}
+
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverDue sends the deliveries that are due, a batch at a time. Servers
+// sharing the store each claim their own, and deliveries claimed by a server
+// that stops are sent by another once the lease runs out.
+func (d *Dispatcher) deliverDue(ctx context.Context) error {
+	now := time.Now()
+	lease := now.Add(2 * CLAIM_BATCH * d.opts.Timeout)
+	due, err := d.store.ClaimDueDeliveries(ctx, now, lease, CLAIM_BATCH)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, dl := range due {
+		dl = d.attempt(ctx, dl)
+		if err := d.store.UpdateDelivery(ctx, dl); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func (d *Dispatcher) attempt(ctx context.Context, dl Delivery) Delivery {
+	dl.Attempts++
+	now := time.Now().UTC()
+
+	code, err := d.post(ctx, dl)
+	dl.ResponseCode = code
+	if err == nil {
+		dl.Status = StatusDelivered
+		dl.LastError = ""
+		dl.DeliveredAt = &now
+		dl.NextAttempt = nil
+		return dl
+	}
+
+	dl.LastError = err.Error()
+	if dl.Attempts >= d.opts.MaxAttempts {
+		dl.Status = StatusFailed
+		dl.NextAttempt = nil
+		slog.Warn("Webhook delivery failed", "delivery", dl.ID, logging.KeyJob, dl.JobUUID, "url", dl.URL, logging.Err(err))
+		return dl
+	}
+
+	next := now.Add(d.backoff(dl.Attempts))
+	dl.NextAttempt = &next
+	return dl
+}
+
+func (d *Dispatcher) post(ctx context.Context, dl Delivery) (int, error) {
+	if d.opts.Secret == "" {
+		return 0, errors.Trace(ErrNoSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dl.URL, bytes.NewReader(dl.Payload))
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, dl.Event)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(dl.ID, 10))
+	req.Header.Set(SignatureHeader, Sign(d.opts.Secret, dl.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff doubles with every failed attempt, up to MaxBackoff.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	b := d.opts.MinBackoff
+	for i := 1; i < attempts; i++ {
+		b *= 2
+		if b >= d.opts.MaxBackoff {
+			return d.opts.MaxBackoff
+		}
+	}
+	return b
+}
+
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature header value against a body. Receivers can use it
+// to authenticate deliveries.
+func Verify(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// JobPayload is the body sent when a job changes state.
+type JobPayload struct {
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+	Job       JobInfo   `json:"job"`
+	ImageURLs []string  `json:"imageURLs,omitempty"`
+}
+
+type JobInfo struct {
+	UUID      uuid.UUID    `json:"uuid"`
+	Status    string       `json:"status"`
+	Settings  job.Settings `json:"settings"`
+	BatchUUID *uuid.UUID   `json:"batchUUID,omitempty"`
+	Created   time.Time    `json:"created"`
+	StartTime *time.Time   `json:"startTime,omitempty"`
+	EndTime   *time.Time   `json:"endTime,omitempty"`
+}
+
+func NewJobPayload(j job.Job, imageURLs []string) JobPayload {
+	info := JobInfo{
+		UUID:      j.UUID,
+		Status:    j.Status(),
+		Settings:  j.Settings,
+		Created:   j.Created,
+		StartTime: j.StartTime,
+		EndTime:   j.EndTime,
+	}
+	if j.BatchUUID != uuid.Nil {
+		info.BatchUUID = &j.BatchUUID
+	}
+
+	return JobPayload{
+		Event:     JobEvent(info.Status),
+		Timestamp: time.Now().UTC(),
+		Job:       info,
+		ImageURLs: imageURLs,
+	}
+}
+
+func JobEvent(status string) string {
+	return fmt.Sprintf("job.%s", status)
+}
@@ -0,0 +1,242 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/wellsjo/ai-art/server/job"
+)
+
+const testSecret = "shh"
+
+func TestDelivery(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		requests int
+		received JobPayload
+	)
+
+	// Fails the first attempt so the delivery has to be retried
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if !Verify(testSecret, body, r.Header.Get(SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		assert.Equal(t, "job.done", r.Header.Get(EventHeader))
+		json.Unmarshal(body, &received)
+	}))
+	defer receiver.Close()
+
+	store := newMemStore()
+	d := newTestDispatcher(store, 3)
+	d.Run()
+	defer d.Close()
+
+	j := newTestJob(job.ArchiveReasonDone)
+	dl, err := d.Enqueue(context.Background(), j.UUID, receiver.URL, "job.done", NewJobPayload(j, []string{"http://example.com/a.png"}))
+	assert.Nil(t, err)
+
+	dl = waitForStatus(t, store, dl.ID, StatusDelivered)
+	assert.Equal(t, 2, dl.Attempts)
+	assert.Equal(t, 200, dl.ResponseCode)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, j.UUID, received.Job.UUID)
+	assert.Equal(t, "done", received.Job.Status)
+	assert.Equal(t, []string{"http://example.com/a.png"}, received.ImageURLs)
+}
+
+func TestFailureAndRedelivery(t *testing.T) {
+	var (
+		mtx  sync.Mutex
+		fail = true
+	)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer receiver.Close()
+
+	store := newMemStore()
+	d := newTestDispatcher(store, 2)
+	d.Run()
+	defer d.Close()
+
+	j := newTestJob(job.ArchiveReasonError)
+	dl, err := d.Enqueue(context.Background(), j.UUID, receiver.URL, "job.error", NewJobPayload(j, nil))
+	assert.Nil(t, err)
+
+	dl = waitForStatus(t, store, dl.ID, StatusFailed)
+	assert.Equal(t, 2, dl.Attempts)
+	assert.Equal(t, 502, dl.ResponseCode)
+	assert.NotEmpty(t, dl.LastError)
+
+	mtx.Lock()
+	fail = false
+	mtx.Unlock()
+
+	_, err = d.Redeliver(context.Background(), dl.ID)
+	assert.Nil(t, err)
+
+	dl = waitForStatus(t, store, dl.ID, StatusDelivered)
+	assert.Equal(t, 1, dl.Attempts)
+}
+
+func TestInternalTargets(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		requests int
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests++
+	}))
+	defer receiver.Close()
+
+	store := newMemStore()
+	d := New(Opts{Secret: testSecret, MaxAttempts: 1, PollInterval: 5 * time.Millisecond}, store)
+	ctx := context.Background()
+
+	for _, u := range []string{
+		receiver.URL,
+		"http://localhost/hook",
+		"http://10.0.0.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+		"http://0.0.0.0/hook",
+		"ftp://example.com/hook",
+	} {
+		assert.True(t, errors.IsNotValid(d.CheckURL(ctx, u)), u)
+	}
+	assert.NoError(t, d.CheckURL(ctx, "http://93.184.216.34/hook"))
+
+	// Deliveries are checked when they are sent too, in case the host
+	// resolves differently by then
+	d.Run()
+	defer d.Close()
+	j := newTestJob(job.ArchiveReasonDone)
+	dl, err := d.Enqueue(ctx, j.UUID, receiver.URL, "job.done", NewJobPayload(j, nil))
+	assert.NoError(t, err)
+	dl = waitForStatus(t, store, dl.ID, StatusFailed)
+	assert.Contains(t, dl.LastError, "not valid")
+	mtx.Lock()
+	assert.Zero(t, requests)
+	mtx.Unlock()
+
+	// Nothing is sent unsigned
+	unsigned := New(Opts{}, store)
+	_, err = unsigned.Enqueue(ctx, j.UUID, "http://93.184.216.34/hook", "job.done", NewJobPayload(j, nil))
+	assert.True(t, errors.Is(err, ErrNoSecret))
+}
+
+func TestBackoff(t *testing.T) {
+	d := New(Opts{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}, nil)
+	assert.Equal(t, time.Second, d.backoff(1))
+	assert.Equal(t, 2*time.Second, d.backoff(2))
+	assert.Equal(t, 8*time.Second, d.backoff(4))
+	assert.Equal(t, 10*time.Second, d.backoff(5))
+}
+
+func newTestDispatcher(store Store, maxAttempts int) *Dispatcher {
+	return New(Opts{
+		Secret: testSecret,
+		// The receivers are on loopback
+		AllowedNetworks: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+		MaxAttempts:     maxAttempts,
+		MinBackoff:      10 * time.Millisecond,
+		PollInterval:    5 * time.Millisecond,
+	}, store)
+}
+
+func newTestJob(ar job.ArchiveReason) job.Job {
+	j, _ := job.New(job.Settings{Prompt: "hello"})
+	j.Archived = true
+	j.ArchiveReason = &ar
+	return j
+}
+
+func waitForStatus(t *testing.T, store *memStore, id int64, status Status) Delivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		dl, _, _ := store.GetDelivery(context.Background(), id)
+		if dl.Status == status {
+			return dl
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("delivery %d never reached status %v", id, status)
+	return Delivery{}
+}
+
+type memStore struct {
+	mtx        sync.Mutex
+	deliveries map[int64]Delivery
+	nextID     int64
+}
+
+func newMemStore() *memStore {
+	return &memStore{deliveries: map[int64]Delivery{}}
+}
+
+func (s *memStore) AddDelivery(ctx context.Context, d Delivery) (Delivery, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.nextID++
+	d.ID = s.nextID
+	s.deliveries[d.ID] = d
+	return d, nil
+}
+
+func (s *memStore) UpdateDelivery(ctx context.Context, d Delivery) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.deliveries[d.ID] = d
+	return nil
+}
+
+func (s *memStore) GetDelivery(ctx context.Context, id int64) (Delivery, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	d, ok := s.deliveries[id]
+	return d, ok, nil
+}
+
+func (s *memStore) ClaimDueDeliveries(ctx context.Context, now, leaseUntil time.Time, limit int) ([]Delivery, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	due := []Delivery{}
+	for id, d := range s.deliveries {
+		if len(due) < limit && d.Status == StatusPending && d.NextAttempt != nil && !d.NextAttempt.After(now) {
+			lease := leaseUntil
+			d.NextAttempt = &lease
+			s.deliveries[id] = d
+			due = append(due, d)
+		}
+	}
+	return due, nil
+}
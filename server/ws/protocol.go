@@ -0,0 +1,160 @@
+package ws
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// ProtocolVersion is sent in every message. Clients must send it too, so the
+// format can change without old pages misreading new messages.
+const ProtocolVersion = 1
+
+// Client requests
+const (
+	TypeSubscribe   = "subscribe"
+	TypeUnsubscribe = "unsubscribe"
+)
+
+// Server messages
+const (
+	TypeAck   = "ack"
+	TypeError = "error"
+	// TypeJob is sent when a job's status changes
+	TypeJob      = "job"
+	TypeQueue    = "queue"
+	TypeProgress = "progress"
+	TypeBatch    = "batch"
+)
+
+// Channels that aren't tied to a job or batch
+const (
+	// ChannelQueue receives the number of running and pending jobs whenever
+	// the queue changes.
+	ChannelQueue = "queue"
+)
+
+// Error codes
+const (
+	ErrCodeInvalidMessage     = "invalid_message"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalidUUID        = "invalid_uuid"
+	ErrCodeUnknownChannel     = "unknown_channel"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeInternal           = "internal"
+)
+
+// Request is a message from a client. ID is optional and is echoed back in
+// the ack or error reply. Since maps job UUIDs to the last event ID the
+// client saw, so that a reconnecting client is only sent what it missed.
+//
+//	{"v": 1, "id": "1", "type": "subscribe", "jobs": ["..."], "channels": ["queue"]}
+type Request struct {
+	V        int              `json:"v"`
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type"`
+	Jobs     []string         `json:"jobs,omitempty"`
+	Batches  []string         `json:"batches,omitempty"`
+	Channels []string         `json:"channels,omitempty"`
+	Since    map[string]int64 `json:"since,omitempty"`
+}
+
+// Message is sent from the server. Job or Batch names the subscription it was
+// sent for. Job messages carry the ID of the job event they describe, which
+// clients can ignore if they have already seen a later one.
+type Message struct {
+	V       int         `json:"v"`
+	Type    string      `json:"type"`
+	ID      string      `json:"id,omitempty"`
+	Job     *uuid.UUID  `json:"job,omitempty"`
+	Batch   *uuid.UUID  `json:"batch,omitempty"`
+	EventID int64       `json:"eventID,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   *Error      `json:"error,omitempty"`
+}
+
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func newError(code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Topic is something a connection can subscribe to: a job, a batch or a
+// channel.
+type Topic struct {
+	Kind    string
+	UUID    uuid.UUID
+	Channel string
+}
+
+const (
+	TopicJob     = "job"
+	TopicBatch   = "batch"
+	TopicChannel = "channel"
+)
+
+func JobTopic(uuid_ uuid.UUID) Topic {
+	return Topic{Kind: TopicJob, UUID: uuid_}
+}
+
+func BatchTopic(uuid_ uuid.UUID) Topic {
+	return Topic{Kind: TopicBatch, UUID: uuid_}
+}
+
+func ChannelTopic(name string) Topic {
+	return Topic{Kind: TopicChannel, Channel: name}
+}
+
+func (t Topic) String() string {
+	if t.Kind == TopicChannel {
+		return t.Channel
+	}
+	return fmt.Sprintf("%s:%v", t.Kind, t.UUID)
+}
+
+// JobMessage is sent to subscribers of a job.
+func JobMessage(typ string, jobUUID uuid.UUID, data interface{}) Message {
+	return Message{Type: typ, Job: &jobUUID, Data: data}
+}
+
+// BatchMessage is sent to subscribers of a batch.
+func BatchMessage(batchUUID uuid.UUID, data interface{}) Message {
+	return Message{Type: TypeBatch, Batch: &batchUUID, Data: data}
+}
+
+// topics parses the subscriptions named in a request.
+func (r Request) topics() ([]Topic, *Error) {
+	var topics []Topic
+	for _, s := range r.Jobs {
+		u, err := uuid.Parse(s)
+		if err != nil {
+			return nil, newError(ErrCodeInvalidUUID, "invalid job %q", s)
+		}
+		topics = append(topics, JobTopic(u))
+	}
+	for _, s := range r.Batches {
+		u, err := uuid.Parse(s)
+		if err != nil {
+			return nil, newError(ErrCodeInvalidUUID, "invalid batch %q", s)
+		}
+		topics = append(topics, BatchTopic(u))
+	}
+	for _, s := range r.Channels {
+		if s != ChannelQueue {
+			return nil, newError(ErrCodeUnknownChannel, "unknown channel %q", s)
+		}
+		topics = append(topics, ChannelTopic(s))
+	}
+	if len(topics) == 0 {
+		return nil, newError(ErrCodeInvalidMessage, "nothing to %s", r.Type)
+	}
+	return topics, nil
+}
@@ -2,157 +2,350 @@ package ws
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"log/slog"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"github.com/juju/errors"
+	"github.com/wellsjo/ai-art/server/logging"
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
 )
 
+const (
+	// SEND_BUFFER is how many messages may be waiting for a connection before
+	// it is considered too slow and dropped.
+	SEND_BUFFER   = 64
+	WRITE_TIMEOUT = 10 * time.Second
+	PING_INTERVAL = 30 * time.Second
+	PONG_TIMEOUT  = 10 * time.Second
+)
+
+// Authorizer reports whether a connection may subscribe to a topic. Topics
+// that don't exist should be reported the same as forbidden ones.
+type Authorizer func(ctx context.Context, t Topic) (bool, error)
+
+// Snapshotter returns the messages that bring a new subscriber of a topic up
+// to date: the events after lastEventID if they are still known, otherwise
+// the topic's current state.
+type Snapshotter func(ctx context.Context, t Topic, lastEventID int64) ([]Message, error)
+
+// Hooks let the owner of a connection decide what it may see.
+type Hooks struct {
+	Authorize Authorizer
+	Snapshot  Snapshotter
+}
+
+// connection owns a websocket. Messages are queued on send and written by
+// the connection's own goroutine, so a stalled client never blocks anyone
+// else.
+type connection struct {
+	conn   *websocket.Conn
+	hooks  Hooks
+	topics map[Topic]struct{}
+	logger *slog.Logger
+
+	send      chan Message
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
 type WSManager struct {
-	connections       map[*websocket.Conn]struct{}
-	connSubscriptions map[*websocket.Conn]uuid.UUID
-	subscriptionConns map[uuid.UUID]map[*websocket.Conn]struct{}
-	connectionsMtx    *sync.RWMutex
+	connections    map[*connection]struct{}
+	subscriptions  map[Topic]map[*connection]struct{}
+	connectionsMtx *sync.RWMutex
+
+	sendBuffer   int
+	writeTimeout time.Duration
+	pingInterval time.Duration
+	pongTimeout  time.Duration
 }
 
 func NewWSManager() *WSManager {
 	return &WSManager{
-		connections:       map[*websocket.Conn]struct{}{},
-		connSubscriptions: map[*websocket.Conn]uuid.UUID{},
-		subscriptionConns: map[uuid.UUID]map[*websocket.Conn]struct{}{},
-		connectionsMtx:    new(sync.RWMutex),
+		connections:    map[*connection]struct{}{},
+		subscriptions:  map[Topic]map[*connection]struct{}{},
+		connectionsMtx: new(sync.RWMutex),
+
+		sendBuffer:   SEND_BUFFER,
+		writeTimeout: WRITE_TIMEOUT,
+		pingInterval: PING_INTERVAL,
+		pongTimeout:  PONG_TIMEOUT,
 	}
 }
 
-func (wsm *WSManager) AddConnection(c *gin.Context) error {
+func (wsm *WSManager) AddConnection(c *gin.Context, hooks Hooks) error {
 	conn, err := websocket.Accept(c.Writer, c.Request, nil)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	cn := &connection{
+		conn:   conn,
+		hooks:  hooks,
+		topics: map[Topic]struct{}{},
+		logger: logging.FromContext(c.Request.Context()),
+		send:   make(chan Message, wsm.sendBuffer),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
 	wsm.connectionsMtx.Lock()
-	wsm.connections[conn] = struct{}{}
+	wsm.connections[cn] = struct{}{}
 	wsm.connectionsMtx.Unlock()
 
-	go wsm.listen(conn)
+	go wsm.listen(cn)
+	go wsm.write(cn)
 
-	log.Println("Add connection", wsm.NumConns())
+	cn.logger.Debug("Add websocket connection", "conns", wsm.NumConns())
 
 	return nil
 }
 
-func (wsm *WSManager) subscribe(conn *websocket.Conn, uuid_ uuid.UUID) {
+func (wsm *WSManager) subscribe(cn *connection, topics []Topic) {
 	wsm.connectionsMtx.Lock()
 	defer wsm.connectionsMtx.Unlock()
 
-	wsm.connSubscriptions[conn] = uuid_
-
-	connMap, ok := wsm.subscriptionConns[uuid_]
-	if !ok {
-		connMap = map[*websocket.Conn]struct{}{}
-	}
+	for _, t := range topics {
+		cn.topics[t] = struct{}{}
 
-	connMap[conn] = struct{}{}
-	wsm.subscriptionConns[uuid_] = connMap
+		conns, ok := wsm.subscriptions[t]
+		if !ok {
+			conns = map[*connection]struct{}{}
+			wsm.subscriptions[t] = conns
+		}
+		conns[cn] = struct{}{}
 
-	log.Println("Subscribe", uuid_, len(connMap))
+		cn.logger.Debug("Subscribe", "topic", t, "subscribers", len(conns))
+	}
 }
 
-func (wsm *WSManager) unsubscribe(conn *websocket.Conn) error {
+func (wsm *WSManager) unsubscribe(cn *connection, topics []Topic) {
 	wsm.connectionsMtx.Lock()
 	defer wsm.connectionsMtx.Unlock()
 
-	delete(wsm.connections, conn)
-
-	uuid_, ok := wsm.connSubscriptions[conn]
-	if !ok {
-		// This isn't an error because the client could not subscribe over the connection
-		return nil
-	}
+	wsm.unsubscribeLocked(cn, topics)
+}
 
-	delete(wsm.connSubscriptions, conn)
+func (wsm *WSManager) unsubscribeLocked(cn *connection, topics []Topic) {
+	for _, t := range topics {
+		delete(cn.topics, t)
 
-	connMap, ok := wsm.subscriptionConns[uuid_]
-	// If there is no connection map, that just means they weren't watching a job
-	// e.g. on home page.
-	if !ok {
-		return nil
+		conns, ok := wsm.subscriptions[t]
+		if !ok {
+			continue
+		}
+		delete(conns, cn)
+		if len(conns) == 0 {
+			delete(wsm.subscriptions, t)
+		}
 	}
+}
 
-	delete(connMap, conn)
-	if len(connMap) == 0 {
-		delete(wsm.subscriptionConns, uuid_)
+func (wsm *WSManager) removeConnection(cn *connection) {
+	wsm.connectionsMtx.Lock()
+	defer wsm.connectionsMtx.Unlock()
+
+	topics := make([]Topic, 0, len(cn.topics))
+	for t := range cn.topics {
+		topics = append(topics, t)
 	}
+	wsm.unsubscribeLocked(cn, topics)
 
-	return nil
+	delete(wsm.connections, cn)
 }
 
-type Message map[string]interface{}
-
-func (wsm *WSManager) Broadcast(uuid_ uuid.UUID, msg Message) error {
+// Broadcast queues msg for every connection subscribed to t. Topics nobody is
+// watching are skipped. It never blocks on the network.
+func (wsm *WSManager) Broadcast(t Topic, msg Message) {
 	wsm.connectionsMtx.RLock()
 	defer wsm.connectionsMtx.RUnlock()
 
-	connsMap, ok := wsm.subscriptionConns[uuid_]
-	if !ok {
-		return errors.Errorf("connection map not found for %v", uuid_)
+	for cn := range wsm.subscriptions[t] {
+		wsm.enqueue(cn, msg)
 	}
-
-	for conn, _ := range connsMap {
-		wsm.send(conn, msg)
-	}
-
-	return nil
 }
 
-func (wsm *WSManager) listen(conn *websocket.Conn) {
+func (wsm *WSManager) listen(cn *connection) {
 	defer func() {
-		err := wsm.unsubscribe(conn)
-		if err != nil {
-			log.Println("unsubscribe error", errors.ErrorStack(err))
-		}
-
-		log.Println("Remove connection", wsm.NumConns())
+		wsm.removeConnection(cn)
+		cn.logger.Debug("Remove websocket connection", "conns", wsm.NumConns())
 	}()
 
+	defer cn.close(websocket.StatusNormalClosure, "")
+
 	for {
-		var v map[string]string
-		err := wsjson.Read(context.Background(), conn, &v)
+		_, b, err := cn.conn.Read(cn.ctx)
 		if err != nil {
 			// TODO capture whether this error was a page close or actual ws error
 			// Client closed
 			break
 		}
 
-		for cmd, arg := range v {
-			switch cmd {
-			case "subscribe":
-				uuidParsed, err := uuid.Parse(arg)
-				if err != nil {
-					log.Println("WEBSOCKET PARSE ERROR", err)
-					break
-				}
-
-				wsm.subscribe(conn, uuidParsed)
-				wsm.send(conn, Message{"subscribed": arg})
+		var req Request
+		if err := json.Unmarshal(b, &req); err != nil {
+			wsm.reply(cn, req, newError(ErrCodeInvalidMessage, "%v", err))
+			continue
+		}
+
+		e := wsm.handle(cn, req)
+		wsm.reply(cn, req, e)
+		if e == nil && req.Type == TypeSubscribe {
+			wsm.sendSnapshots(cn, req)
+		}
+	}
+}
+
+func (wsm *WSManager) handle(cn *connection, req Request) *Error {
+	if req.V != ProtocolVersion {
+		return newError(ErrCodeUnsupportedVersion, "unsupported protocol version %d", req.V)
+	}
+
+	switch req.Type {
+	case TypeSubscribe:
+		topics, e := req.topics()
+		if e != nil {
+			return e
+		}
+
+		for _, t := range topics {
+			if t.Kind == TopicChannel {
+				continue
+			}
+			ok, err := cn.hooks.Authorize(cn.ctx, t)
+			if err != nil {
+				cn.logger.Error("Failed to authorize subscription", "topic", t, logging.Err(err))
+				return newError(ErrCodeInternal, "failed to subscribe to %v", t)
+			}
+			if !ok {
+				return newError(ErrCodeNotFound, "%v not found", t)
 			}
 		}
+
+		wsm.subscribe(cn, topics)
+		return nil
+
+	case TypeUnsubscribe:
+		topics, e := req.topics()
+		if e != nil {
+			return e
+		}
+
+		wsm.unsubscribe(cn, topics)
+		return nil
+
+	default:
+		return newError(ErrCodeUnknownType, "unknown message type %q", req.Type)
+	}
+}
+
+// sendSnapshots follows a subscribe ack with the current state of what was
+// subscribed to. Broadcasts that raced with the subscription may arrive
+// before it; clients tell them apart by event ID.
+func (wsm *WSManager) sendSnapshots(cn *connection, req Request) {
+	if cn.hooks.Snapshot == nil {
+		return
+	}
+
+	topics, _ := req.topics()
+	for _, t := range topics {
+		if t.Kind == TopicChannel {
+			continue
+		}
+
+		msgs, err := cn.hooks.Snapshot(cn.ctx, t, req.Since[t.UUID.String()])
+		if err != nil {
+			cn.logger.Error("Failed to get snapshot", "topic", t, logging.Err(err))
+			continue
+		}
+		for _, msg := range msgs {
+			wsm.enqueue(cn, msg)
+		}
 	}
 }
 
-func (wsm *WSManager) send(conn *websocket.Conn, msg Message) error {
-	log.Println("Send", msg)
+// reply acks a request, or reports why it failed.
+func (wsm *WSManager) reply(cn *connection, req Request, e *Error) {
+	msg := Message{Type: TypeAck, ID: req.ID}
+	if e != nil {
+		msg.Type = TypeError
+		msg.Error = e
+	}
 
-	if err := wsjson.Write(context.Background(), conn, msg); err != nil {
+	wsm.enqueue(cn, msg)
+}
+
+// enqueue drops the connection if its queue is full; the client can reconnect
+// and subscribe again once it catches up.
+func (wsm *WSManager) enqueue(cn *connection, msg Message) {
+	select {
+	case cn.send <- msg:
+	case <-cn.ctx.Done():
+	default:
+		cn.logger.Warn("Dropping slow websocket connection")
+		// Closing waits for the client's reply, so don't hold up the caller
+		go cn.close(websocket.StatusPolicyViolation, "too slow")
+	}
+}
+
+// write sends queued messages and pings the client, closing the connection
+// if either takes too long.
+func (wsm *WSManager) write(cn *connection) {
+	ticker := time.NewTicker(wsm.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg := <-cn.send:
+			if err := wsm.send(cn, msg); err != nil {
+				cn.logger.Warn("Websocket write failed", logging.Err(err))
+				cn.close(websocket.StatusGoingAway, "write failed")
+				return
+			}
+
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(cn.ctx, wsm.pongTimeout)
+			err := cn.conn.Ping(ctx)
+			cancel()
+			if err != nil {
+				cn.logger.Warn("Websocket ping failed", logging.Err(err))
+				cn.close(websocket.StatusGoingAway, "ping timeout")
+				return
+			}
+
+		case <-cn.ctx.Done():
+			return
+		}
+	}
+}
+
+func (wsm *WSManager) send(cn *connection, msg Message) error {
+	msg.V = ProtocolVersion
+	cn.logger.Debug("Send", "type", msg.Type, "id", msg.ID)
+
+	ctx, cancel := context.WithTimeout(cn.ctx, wsm.writeTimeout)
+	defer cancel()
+
+	if err := wsjson.Write(ctx, cn.conn, msg); err != nil {
 		return errors.Annotate(err, "WSManager.send")
 	}
 	return nil
 }
 
+func (cn *connection) close(code websocket.StatusCode, reason string) {
+	cn.closeOnce.Do(func() {
+		cn.conn.Close(code, reason)
+		cn.cancel()
+	})
+}
+
 func (wsm *WSManager) NumConns() int {
+	wsm.connectionsMtx.RLock()
+	defer wsm.connectionsMtx.RUnlock()
+
 	return len(wsm.connections)
 }
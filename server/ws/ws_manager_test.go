@@ -0,0 +1,199 @@
+package ws
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func newTestServer(t *testing.T, hooks Hooks) (*WSManager, *websocket.Conn) {
+	gin.SetMode(gin.TestMode)
+	wsm := NewWSManager()
+
+	r := gin.New()
+	r.GET("/ws", func(c *gin.Context) {
+		if err := wsm.AddConnection(c, hooks); err != nil {
+			t.Error(err)
+		}
+	})
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+
+	return wsm, conn
+}
+
+func request(t *testing.T, conn *websocket.Conn, req Request) Message {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := wsjson.Write(ctx, conn, req); err != nil {
+		t.Fatal(err)
+	}
+	return read(t, conn)
+}
+
+func read(t *testing.T, conn *websocket.Conn) Message {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var msg Message
+	if err := wsjson.Read(ctx, conn, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func allowAll(context.Context, Topic) (bool, error) {
+	return true, nil
+}
+
+func TestSubscriptions(t *testing.T) {
+	forbidden := uuid.New()
+	wsm, conn := newTestServer(t, Hooks{
+		Authorize: func(ctx context.Context, topic Topic) (bool, error) {
+			return topic.UUID != forbidden, nil
+		},
+	})
+
+	job1, job2 := uuid.New(), uuid.New()
+
+	ack := request(t, conn, Request{
+		V:        ProtocolVersion,
+		ID:       "1",
+		Type:     TypeSubscribe,
+		Jobs:     []string{job1.String(), job2.String()},
+		Channels: []string{ChannelQueue},
+	})
+	assert.Equal(t, TypeAck, ack.Type)
+	assert.Equal(t, "1", ack.ID)
+	assert.Equal(t, ProtocolVersion, ack.V)
+
+	wsm.Broadcast(JobTopic(job1), JobMessage(TypeJob, job1, "running"))
+	msg := read(t, conn)
+	assert.Equal(t, TypeJob, msg.Type)
+	assert.Equal(t, job1, *msg.Job)
+
+	wsm.Broadcast(JobTopic(job2), JobMessage(TypeJob, job2, "running"))
+	assert.Equal(t, job2, *read(t, conn).Job)
+
+	wsm.Broadcast(ChannelTopic(ChannelQueue), Message{Type: TypeQueue})
+	assert.Equal(t, TypeQueue, read(t, conn).Type)
+
+	ack = request(t, conn, Request{V: ProtocolVersion, ID: "2", Type: TypeUnsubscribe, Jobs: []string{job1.String()}})
+	assert.Equal(t, TypeAck, ack.Type)
+
+	// Only job2 is still subscribed, so its message is the next one read
+	wsm.Broadcast(JobTopic(job1), JobMessage(TypeJob, job1, "done"))
+	wsm.Broadcast(JobTopic(job2), JobMessage(TypeJob, job2, "done"))
+	assert.Equal(t, job2, *read(t, conn).Job)
+
+	wsm.connectionsMtx.RLock()
+	assert.Len(t, wsm.subscriptions, 2)
+	wsm.connectionsMtx.RUnlock()
+
+	e := request(t, conn, Request{V: ProtocolVersion, ID: "3", Type: TypeSubscribe, Jobs: []string{forbidden.String()}})
+	assert.Equal(t, TypeError, e.Type)
+	assert.Equal(t, "3", e.ID)
+	assert.Equal(t, ErrCodeNotFound, e.Error.Code)
+}
+
+func TestErrors(t *testing.T) {
+	_, conn := newTestServer(t, Hooks{Authorize: allowAll})
+
+	tests := []struct {
+		req  Request
+		code string
+	}{
+		{Request{V: 0, Type: TypeSubscribe, Jobs: []string{uuid.NewString()}}, ErrCodeUnsupportedVersion},
+		{Request{V: ProtocolVersion, Type: "publish"}, ErrCodeUnknownType},
+		{Request{V: ProtocolVersion, Type: TypeSubscribe, Jobs: []string{"nope"}}, ErrCodeInvalidUUID},
+		{Request{V: ProtocolVersion, Type: TypeSubscribe, Channels: []string{"nope"}}, ErrCodeUnknownChannel},
+		{Request{V: ProtocolVersion, Type: TypeSubscribe}, ErrCodeInvalidMessage},
+	}
+	for _, test := range tests {
+		msg := request(t, conn, test.req)
+		if assert.Equal(t, TypeError, msg.Type) {
+			assert.Equal(t, test.code, msg.Error.Code)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := conn.Write(ctx, websocket.MessageText, []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	msg := read(t, conn)
+	assert.Equal(t, ErrCodeInvalidMessage, msg.Error.Code)
+}
+
+func TestDisconnect(t *testing.T) {
+	wsm, conn := newTestServer(t, Hooks{Authorize: allowAll})
+
+	request(t, conn, Request{V: ProtocolVersion, Type: TypeSubscribe, Jobs: []string{uuid.NewString()}})
+	conn.Close(websocket.StatusNormalClosure, "")
+
+	assert.Eventually(t, func() bool {
+		wsm.connectionsMtx.RLock()
+		defer wsm.connectionsMtx.RUnlock()
+		return len(wsm.connections) == 0 && len(wsm.subscriptions) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSlowConsumer(t *testing.T) {
+	wsm, conn := newTestServer(t, Hooks{Authorize: allowAll})
+
+	jobUUID := uuid.New()
+	request(t, conn, Request{V: ProtocolVersion, Type: TypeSubscribe, Jobs: []string{jobUUID.String()}})
+
+	// The client stops reading, so the queue fills up behind the blocked
+	// writer.
+	big := strings.Repeat("x", 1<<20)
+	for i := 0; i < 2*SEND_BUFFER; i++ {
+		wsm.Broadcast(JobTopic(jobUUID), JobMessage(TypeJob, jobUUID, big))
+	}
+
+	assert.Eventually(t, func() bool {
+		return wsm.NumConns() == 0
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestSnapshot(t *testing.T) {
+	jobUUID := uuid.New()
+	_, conn := newTestServer(t, Hooks{
+		Authorize: allowAll,
+		Snapshot: func(ctx context.Context, topic Topic, lastEventID int64) ([]Message, error) {
+			if lastEventID > 0 {
+				return []Message{JobMessage(TypeProgress, topic.UUID, "replayed")}, nil
+			}
+			return []Message{JobMessage(TypeJob, topic.UUID, "running")}, nil
+		},
+	})
+
+	ack := request(t, conn, Request{V: ProtocolVersion, Type: TypeSubscribe, Jobs: []string{jobUUID.String()}})
+	assert.Equal(t, TypeAck, ack.Type)
+	msg := read(t, conn)
+	assert.Equal(t, TypeJob, msg.Type)
+	assert.Equal(t, "running", msg.Data)
+
+	request(t, conn, Request{
+		V:     ProtocolVersion,
+		Type:  TypeSubscribe,
+		Jobs:  []string{jobUUID.String()},
+		Since: map[string]int64{jobUUID.String(): 3},
+	})
+	assert.Equal(t, "replayed", read(t, conn).Data)
+}
@@ -1,10 +1,12 @@
 #!/usr/bin/env python
 import argparse, datetime, os, random, time
+import diffusers
 import numpy as np
 import torch
 from PIL import Image
 from torch import autocast
 from diffusers import (
+    AutoencoderKL,
     OnnxStableDiffusionPipeline,
     OnnxStableDiffusionInpaintPipeline,
     OnnxStableDiffusionImg2ImgPipeline,
@@ -28,6 +30,40 @@ def skip_safety_checker(images, *args, **kwargs):
     return images, False
 
 
+def load_vae(path, dtype):
+    if os.path.isdir(path):
+        return AutoencoderKL.from_pretrained(path, torch_dtype=dtype)
+    if not hasattr(AutoencoderKL, "from_single_file"):
+        raise SystemExit("this diffusers version can't load single file VAEs")
+    return AutoencoderKL.from_single_file(path, torch_dtype=dtype)
+
+
+def load_assets(pipeline, p):
+    # Older diffusers releases have no loaders, so fail clearly rather than
+    # render without the assets
+    if p.lora and not hasattr(pipeline, "load_lora_weights"):
+        raise SystemExit("this diffusers version can't load LoRAs")
+    if p.embedding and not hasattr(pipeline, "load_textual_inversion"):
+        raise SystemExit("this diffusers version can't load embeddings")
+
+    names, weights = [], []
+    for lora in p.lora:
+        path, _, weight = lora.rpartition(":")
+        names.append(os.path.splitext(os.path.basename(path))[0])
+        weights.append(float(weight))
+        pipeline.load_lora_weights(path, adapter_name=names[-1])
+        print(f"loaded lora from {path}:", iso_date_time(), flush=True)
+    if names:
+        pipeline.set_adapters(names, adapter_weights=weights)
+
+    # Embeddings take effect where their token is in the prompt
+    for path in p.embedding:
+        token = os.path.splitext(os.path.basename(path))[0]
+        pipeline.load_textual_inversion(path, token=token)
+        p.prompt += " " + token
+        print(f"loaded embedding {token} from {path}:", iso_date_time(), flush=True)
+
+
 def stable_diffusion_pipeline(p):
     p.dtype = torch.float16 if p.half else torch.float32
 
@@ -65,15 +101,25 @@ def stable_diffusion_pipeline(p):
     else:
         p.generator = torch.Generator(device=p.device).manual_seed(p.seed)
 
+    if p.revision == "onnx" and (p.lora or p.embedding or p.vae):
+        raise SystemExit("--lora, --embedding and --vae need a cuda device")
+
     print("load pipeline start:", iso_date_time(), flush=True)
 
+    kwargs = {}
+    if p.vae is not None:
+        kwargs["vae"] = load_vae(p.vae, p.dtype)
+
     pipeline = p.diffuser.from_pretrained(
         p.model,
         torch_dtype=p.dtype,
         revision=p.revision,
         use_auth_token=p.token,
+        **kwargs,
     ).to(p.device)
 
+    load_assets(pipeline, p)
+
     if p.skip:
         pipeline.safety_checker = skip_safety_checker
 
@@ -87,6 +133,52 @@ def stable_diffusion_pipeline(p):
     return p
 
 
+# Upscalers that only resample. Anything else is the name or path of a
+# diffusers upscaling model.
+RESAMPLERS = {
+    "lanczos": Image.LANCZOS,
+    "bicubic": Image.BICUBIC,
+    "nearest": Image.NEAREST,
+}
+
+
+def upscale(p):
+    image = load_image(p.image)
+    size = (image.width * p.upscale, image.height * p.upscale)
+
+    resampler = RESAMPLERS.get(p.upscaler.lower())
+    if resampler is not None:
+        result = image.resize(size, resampler)
+    else:
+        diffuser = getattr(diffusers, "StableDiffusionUpscalePipeline", None)
+        if diffuser is None:
+            raise SystemExit("this diffusers version has no upscaling pipeline")
+        if p.token is None:
+            with open("token.txt") as f:
+                p.token = f.read().replace("\n", "")
+
+        print("load pipeline start:", iso_date_time(), flush=True)
+        pipeline = diffuser.from_pretrained(
+            p.upscaler,
+            torch_dtype=torch.float16 if p.half else torch.float32,
+            use_auth_token=p.token,
+        ).to(p.device)
+        print("loaded models after:", iso_date_time(), flush=True)
+
+        result = pipeline(
+            prompt=p.prompt or "",
+            image=image,
+            num_inference_steps=p.ddim_steps,
+        ).images[0]
+        # The models have a fixed factor, usually 4
+        if result.size != size:
+            result = result.resize(size, Image.LANCZOS)
+
+    print("saving image", p.output)
+    result.save(os.path.join("output", p.output))
+    print("completed upscale:", iso_date_time(), flush=True)
+
+
 def stable_diffusion_inference(p):
     prefix = p.prompt.replace(" ", "_")[:170]
     for j in range(p.n_iter):
@@ -206,6 +298,36 @@ def main():
         default="CompVis/stable-diffusion-v1-4",
         help="The model used to render images",
     )
+    parser.add_argument(
+        "--lora",
+        type=str,
+        action="append",
+        default=[],
+        help="A LoRA file to apply, as PATH:WEIGHT. Can be repeated",
+    )
+    parser.add_argument(
+        "--embedding",
+        type=str,
+        action="append",
+        default=[],
+        help="A textual inversion embedding file, added to the prompt. Can be repeated",
+    )
+    parser.add_argument(
+        "--vae",
+        type=str,
+        help="A VAE file or directory to use instead of the model's",
+    )
+    parser.add_argument(
+        "--upscale",
+        type=int,
+        help="Upscale --image by this factor instead of rendering an image",
+    )
+    parser.add_argument(
+        "--upscaler",
+        type=str,
+        default="lanczos",
+        help="lanczos, bicubic, nearest, or a diffusers upscaling model",
+    )
     parser.add_argument(
         "--negative-prompt",
         type=str,
@@ -240,6 +362,12 @@ def main():
     if args.prompt0 is not None:
         args.prompt = args.prompt0
 
+    if args.upscale is not None:
+        if args.image is None:
+            raise SystemExit("--upscale needs an --image")
+        upscale(args)
+        return
+
     pipeline = stable_diffusion_pipeline(args)
     stable_diffusion_inference(pipeline)
 